@@ -0,0 +1,61 @@
+// Package cardinality bounds the number of series of the metrics labelled with values received from the network
+package cardinality
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Other replaces the label values beyond the limit of a metric
+const Other = "other"
+
+// Limit tracks the label values a metric was updated with. Once limit series exist, new series are counted
+// with every label set to Other as any of them may come from an unbounded set
+type Limit struct {
+	name     string
+	limit    int
+	overflow *prometheus.CounterVec
+
+	mu     sync.Mutex
+	series map[string]bool
+}
+
+// NewLimit bounds the metric name to limit series, 0 meaning unbounded. Every update counted as Other
+// increments overflow, a counter labelled by metric
+func NewLimit(name string, limit int, overflow *prometheus.CounterVec) *Limit {
+	return &Limit{name: name, limit: limit, overflow: overflow, series: make(map[string]bool)}
+}
+
+// Labels returns the label values to update the metric with. Values are made valid UTF-8 as Prometheus
+// panics on anything else
+func (l *Limit) Labels(values ...string) []string {
+
+	for i, value := range values {
+		values[i] = strings.ToValidUTF8(value, "�")
+	}
+
+	key := strings.Join(values, "\xff")
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.series[key] {
+		return values
+	}
+
+	if l.limit > 0 && len(l.series) >= l.limit {
+		for i := range values {
+			values[i] = Other
+		}
+
+		l.overflow.WithLabelValues(l.name).Inc()
+
+		key = strings.Join(values, "\xff")
+	}
+
+	l.series[key] = true
+
+	return values
+}
@@ -9,17 +9,27 @@ import (
 
 	"github.com/lucabrasi83/peppamon_versa/initializer"
 	"github.com/lucabrasi83/peppamon_versa/logging"
+	"github.com/lucabrasi83/peppamon_versa/versa_client"
 	"github.com/lucabrasi83/peppamon_versa/versa_collector"
+	"github.com/lucabrasi83/peppamon_versa/versa_flow"
+	"github.com/lucabrasi83/peppamon_versa/versa_lef"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 var (
-	collector = versa_collector.NewVersaAnalyticsExporter()
+	collector = newScrapeHandler()
 )
 
-func init() {
-	prometheus.MustRegister(collector)
+// newScrapeHandler builds an exporter for every Versa instance listed in PEPPAMON_VERSA_INSTANCES
+func newScrapeHandler() *versa_collector.ScrapeHandler {
+
+	var exporters []*versa_collector.VersaAnalyticsExporter
+
+	for _, instance := range versa_client.Instances() {
+		exporters = append(exporters, versa_collector.NewVersaAnalyticsExporter(instance))
+	}
+
+	return versa_collector.NewScrapeHandler(exporters)
 }
 
 func main() {
@@ -34,9 +44,32 @@ func main() {
 
 	promHTTPSrv := http.Server{Addr: ":2112"}
 
+	// Start the LEF syslog receiver when a listen address is configured
+	lefListener := versa_lef.ListenerFromEnv()
+
+	if lefListener != nil {
+		prometheus.MustRegister(lefListener.Metrics)
+
+		if err := lefListener.Start(); err != nil {
+			logging.PeppaMonLog("fatal", "Failed to start Versa LEF listener %v", err)
+		}
+	}
+
+	// Start the IPFIX and NetFlow v9 receiver when a listen address is configured
+	flowListener := versa_flow.ListenerFromEnv()
+
+	if flowListener != nil {
+		prometheus.MustRegister(flowListener.Metrics)
+
+		if err := flowListener.Start(); err != nil {
+			logging.PeppaMonLog("fatal", "Failed to start Versa flow listener %v", err)
+		}
+	}
+
 	// Start Prometheus HTTP handler
 	go func() {
-		http.Handle("/metrics", promhttp.Handler())
+		// The handler binds every scrape to the Prometheus request deadline and labels each Versa instance
+		http.Handle("/metrics", collector)
 
 		http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 			_, errWelcomePage := w.Write([]byte(`<html>
@@ -79,4 +112,12 @@ func main() {
 			"warning",
 			"Error while shutting down Prometheus HTTP Server %v", errPromHTTPShut)
 	}
+
+	if lefListener != nil {
+		lefListener.Close()
+	}
+
+	if flowListener != nil {
+		flowListener.Close()
+	}
 }
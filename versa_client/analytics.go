@@ -1,31 +1,142 @@
 package versa_client
 
 import (
-	"crypto/tls"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/cookiejar"
-	"os"
 	"sync"
 	"time"
 
 	"github.com/lucabrasi83/peppamon_versa/logging"
 )
 
+// Identifiers of the Versa Analytics reports, used as the report label of the self-metrics and errors
 const (
-	longReportPrecision   = "15minutesAgo"
-	mediumReportPrecision = "5minutesAgo"
-	shortReportPrecision  = "1minutesAgo"
+	ReportTenants                = "tenants"
+	ReportSitesAvailability      = "sites_availability"
+	ReportApplicationUsageRate   = "application_usage_rate"
+	ReportApplicationUsageVolume = "application_usage_volume"
+	ReportSiteCircuitUsage       = "site_circuit_usage"
+	ReportSiteSLAMetrics         = "site_sla_metrics"
+	ReportApplianceCompute       = "appliance_compute_performance"
+)
+
+var (
+	sitesAvailabilityQuery = Query{
+		Report:     ReportSitesAvailability,
+		Title:      "Get Sites Availability",
+		Feature:    "SDWAN",
+		Expression: QueryExpression{Name: "site"},
+		Type:       QueryTypeStats,
+		Metrics:    []string{"availability"},
+		Count:      CountAll,
+		Window:     5 * time.Minute,
+	}
+
+	applicationUsageRateQuery = Query{
+		Report:     ReportApplicationUsageRate,
+		Title:      "Get Application Usage Rate",
+		Feature:    "SDWAN",
+		Expression: QueryExpression{Name: "appUser", GroupBy: []string{"site", "appId", "user", "accCkt"}},
+		Type:       QueryTypeTimeseries,
+		Metrics:    []string{"bw-rx", "bw-tx"},
+		Gap:        "1MINUTE",
+		DataSource: "aggregate",
+		Count:      15000,
+	}
+
+	applicationUsageVolumeQuery = Query{
+		Report:     ReportApplicationUsageVolume,
+		Title:      "Get Application Usage Volume",
+		Feature:    "SDWAN",
+		Expression: QueryExpression{Name: "appUser", GroupBy: []string{"site", "appId", "user", "accCkt"}},
+		Type:       QueryTypeTimeseries,
+		Metrics:    []string{"volume-rx", "volume-tx"},
+		Gap:        "1MINUTE",
+		DataSource: "aggregate",
+		Count:      15000,
+	}
+
+	siteCircuitUsageQuery = Query{
+		Report:     ReportSiteCircuitUsage,
+		Title:      "Get Site Circuits Usage",
+		Feature:    "SDWAN",
+		Expression: QueryExpression{Name: "linkUsage", GroupBy: []string{"site", "accCkt"}},
+		Type:       QueryTypeTimeseries,
+		Metrics:    []string{"bw-rx", "bw-tx"},
+		Gap:        "1MINUTE",
+		DataSource: "aggregate",
+		Count:      CountAll,
+	}
+
+	siteSLAMetricsQuery = Query{
+		Report:  ReportSiteSLAMetrics,
+		Title:   "Get Site SLA Metrics",
+		Feature: "SDWAN",
+		Expression: QueryExpression{
+			Name:    "slam",
+			GroupBy: []string{"localSite", "remoteSite", "localAccCkt", "remoteAccCkt"},
+		},
+		Type:       QueryTypeTimeseries,
+		Metrics:    []string{"fwdDelayVar", "revDelayVar", "delay", "fwdLossRatio", "revLossRatio"},
+		Gap:        "1MINUTE",
+		DataSource: "aggregate",
+		Count:      CountAll,
+	}
+
+	applianceComputePerfQuery = Query{
+		Report:     ReportApplianceCompute,
+		Title:      "Get Appliance Compute Performance",
+		Feature:    "SYSTEM",
+		Expression: QueryExpression{Name: "applMonitor"},
+		Type:       QueryTypeTimeseries,
+		Metrics:    []string{"CPULOAD", "MEMLOAD", "DISKLOAD", "SESSLOAD"},
+		Gap:        "1MINUTE",
+		DataSource: "aggregate",
+		Count:      CountAll,
+	}
 )
 
 type VersaAnalyticsClient struct {
-	Hostname   string
 	Protocol   string
-	Username   string
-	Password   string
 	HttpClient *http.Client
+	Nodes      *NodePool
+	Retry      RetryPolicy
 	Tenants    VersaTenantList
+
+	// Pool bounds the number of concurrent requests across every tenant and report
+	Pool             *WorkerPool
+	ReportPriorities map[string]int
+
+	// MaxRows is the ceiling of rows fetched when paging through a truncated result
+	MaxRows int
+
+	// Windows aligns the queries on the most recent complete buckets in the Analytics server timezone
+	Windows TimeWindows
+
+	// Clock returns the time the queries are aligned on and the tenant cache ages by, time.Now when nil
+	Clock func() time.Time
+
+	// Breakers skip the reports failing repeatedly until their cool-down is over
+	Breakers *Breakers
+
+	// TenantFilter selects the discovered tenants to query
+	TenantFilter TenantFilter
+
+	// TenantCacheTTL is how long discovered tenants are reused across scrapes. Discovery runs on every
+	// scrape when it is zero
+	TenantCacheTTL time.Duration
+	tenantCache    tenantCache
+
+	metrics *clientMetrics
+
+	transport  *reloadingTransport
+	cancel     context.CancelFunc
+	background sync.WaitGroup
+	closeOnce  sync.Once
 }
 
 type VersaTenantList []struct {
@@ -40,689 +151,485 @@ type VersaSitesAvailability struct {
 	}
 }
 
-type VersaApplicationUsageRate struct {
-	TenantName string
-	QTime      int `json:"qTime"`
-	Data       []struct {
-		Name       string          `json:"name"`
-		Type       string          `json:"type"`
-		Metric     string          `json:"metric"`
-		MetricName string          `json:"metricName"`
-		Label      string          `json:"label"`
-		Data       [][]interface{} `json:"data"`
-	} `json:"data"`
-}
-
-type VersaApplicationUsageVolume struct {
-	TenantName string
-	QTime      int `json:"qTime"`
-	Data       []struct {
-		Name       string          `json:"name"`
-		Type       string          `json:"type"`
-		Metric     string          `json:"metric"`
-		MetricName string          `json:"metricName"`
-		Label      string          `json:"label"`
-		Data       [][]interface{} `json:"data"`
-	} `json:"data"`
-}
-
-type VersaSiteSLAMetrics struct {
-	TenantName string
-	QTime      int `json:"qTime"`
-	Data       []struct {
-		Name       string          `json:"name"`
-		Type       string          `json:"type"`
-		Metric     string          `json:"metric"`
-		MetricName string          `json:"metricName"`
-		Label      string          `json:"label"`
-		Data       [][]interface{} `json:"data"`
-	} `json:"data"`
+// versaSitesAvailabilityStats is the response of the sites availability stats query
+type versaSitesAvailabilityStats struct {
+	Stats map[string]struct {
+		Mean *float64 `json:"mean"`
+	} `json:"stats"`
 }
 
-type VersaSiteBandwidthUsage struct {
-	TenantName string
-	QTime      int `json:"qTime"`
-	Data       []struct {
-		Name       string          `json:"name"`
-		Type       string          `json:"type"`
-		Metric     string          `json:"metric"`
-		MetricName string          `json:"metricName"`
-		Label      string          `json:"label"`
-		Data       [][]interface{} `json:"data"`
-	} `json:"data"`
-}
+// NewVersaAnalyticsClient builds the client of a Versa instance. An empty instance name reads the global
+// PEPPAMON_VERSA_* environment variables only
+func NewVersaAnalyticsClient(instance string) *VersaAnalyticsClient {
 
-type VersaAppliancePerformance struct {
-	TenantName string
-	QTime      int `json:"qTime"`
-	Data       []struct {
-		Name       string          `json:"name"`
-		Type       string          `json:"type"`
-		Metric     string          `json:"metric"`
-		MetricName string          `json:"metricName"`
-		Label      string          `json:"label"`
-		Data       [][]interface{} `json:"data"`
-	} `json:"data"`
-}
+	client, err := NewClient(SettingsFromEnv(instance))
 
-func NewVersaAnalyticsClient() *VersaAnalyticsClient {
-	cookieJar, _ := cookiejar.New(nil)
-
-	httpTransport := &http.Transport{
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: true,
-		}}
-
-	versaHTTPClient := &http.Client{
-		Timeout:   10 * time.Minute,
-		Jar:       cookieJar,
-		Transport: httpTransport,
+	if err != nil {
+		logging.PeppaMonLog("fatal", "Unable to set up the Versa Analytics client with error %v", err)
 	}
 
-	return &VersaAnalyticsClient{
-		Hostname:   os.Getenv("PEPPAMON_VERSA_ANALYTICS_HOSTNAME"),
-		Username:   os.Getenv("PEPPAMON_VERSA_ANALYTICS_USERNAME"),
-		Password:   os.Getenv("PEPPAMON_VERSA_ANALYTICS_PASSWORD"),
-		Protocol:   "https",
-		HttpClient: versaHTTPClient,
-	}
+	return client
 }
 
-func (v *VersaAnalyticsClient) Login() error {
+// NewClient builds a Versa Analytics client from settings and starts its background health checks and
+// tenant refreshes, which run until Close is called
+func NewClient(settings Settings) (*VersaAnalyticsClient, error) {
 
-	url := fmt.Sprintf("%s://%s/versa/login?username=%s&password=%s", v.Protocol, v.Hostname, v.Username, v.Password)
+	if err := settings.validate(); err != nil {
+		return nil, err
+	}
 
-	queryTitle := "Versa Analytics Login"
+	cookieJar, _ := cookiejar.New(nil)
 
-	httpNewReq, err := http.NewRequest("POST", url, nil)
+	tlsTransport, err := newReloadingTransport(settings.TLS, settings.Proxy)
 
 	if err != nil {
-		logging.PeppaMonLog("error", "unable to build HTTP request for %v with error %v", queryTitle, err)
-		return err
+		return nil, fmt.Errorf("unable to set up TLS for Versa Analytics: %v", err)
 	}
 
-	cookieRes, err := v.HttpClient.Do(httpNewReq)
+	clock := settings.Clock
 
-	if err != nil {
-		logging.PeppaMonLog("error", "HTTP request for %v failed with error %v", queryTitle, err)
-		return err
-	}
-
-	if cookieRes.StatusCode != http.StatusOK || cookieRes.StatusCode > http.StatusAccepted {
-		logging.PeppaMonLog("error", "Versa Analytics responded with HTTP error code %v for %v",
-			cookieRes.StatusCode, queryTitle)
-		return fmt.Errorf("versa analytics responded with HTTP error code %v for %v", cookieRes.StatusCode, queryTitle)
+	if clock == nil {
+		clock = time.Now
 	}
-	return nil
-}
-
-func (v *VersaAnalyticsClient) GetTenantList() error {
-
-	logging.PeppaMonLog("info", "Started Batch Job to fetch Versa Tenants")
 
-	url := fmt.Sprintf("%s://%s/versa/analytics/v1.0.0/data/provider/features/SDWAN/tenants?count=-1", v.Protocol, v.Hostname)
-
-	queryTitle := "Get Tenants List"
-
-	httpNewReq, err := http.NewRequest("GET", url, nil)
+	clock, err = settings.Fixtures.Clock(clock)
 
 	if err != nil {
-		logging.PeppaMonLog("error", "unable to build HTTP request for %v with error %v", queryTitle, err)
-		return err
+		tlsTransport.Close()
+		return nil, err
 	}
 
-	httpNewReq.Header.Add("Content-Type", "application/json")
-
-	tenantsRes, err := v.HttpClient.Do(httpNewReq)
+	httpTransport, err := settings.Fixtures.Transport(tlsTransport, clock)
 
 	if err != nil {
-		logging.PeppaMonLog("error", "HTTP request for %v failed with error %v", queryTitle, err)
-		return err
+		tlsTransport.Close()
+		return nil, err
 	}
 
-	if tenantsRes.StatusCode != http.StatusOK || tenantsRes.StatusCode > http.StatusAccepted {
-		logging.PeppaMonLog("error", "Versa Analytics responded with HTTP error code %v for %v",
-			tenantsRes.StatusCode, queryTitle)
-		return fmt.Errorf("versa analytics responded with HTTP error code %v for %v", tenantsRes.StatusCode, queryTitle)
+	versaHTTPClient := &http.Client{
+		Timeout:   10 * time.Minute,
+		Jar:       cookieJar,
+		Transport: httpTransport,
 	}
 
-	defer func() {
+	protocol := "https"
 
-		errBodyClose := tenantsRes.Body.Close()
+	// Every node of the Analytics cluster gets its own session and rate limits
+	var nodes []*AnalyticsNode
 
-		if errBodyClose != nil {
-			logging.PeppaMonLog("error", "HTTP request for %v failed with error %v", queryTitle, err)
-		}
-	}()
+	for _, hostname := range settings.Hostnames {
+		baseURL := protocol + "://" + hostname
 
-	var tenantList VersaTenantList
+		authenticator, err := newAuthenticator(settings.Auth, versaHTTPClient, baseURL)
 
-	err = json.NewDecoder(tenantsRes.Body).Decode(&tenantList)
+		if err != nil {
+			tlsTransport.Close()
+			return nil, err
+		}
 
-	if err != nil {
-		logging.PeppaMonLog("error", "Unable to decode JSON response from %v with error %v", queryTitle, err)
-		return err
+		nodes = append(nodes, &AnalyticsNode{
+			Hostname:      hostname,
+			BaseURL:       baseURL,
+			Authenticator: authenticator,
+			limiters:      newNodeLimiters(settings.RateLimit, settings.ReportRateLimits),
+		})
 	}
 
-	v.Tenants = tenantList
-
-	logging.PeppaMonLog("info", "Completed Batch Job to fetch Versa Tenants")
-
-	return nil
-
-}
-
-func (v *VersaAnalyticsClient) GetSitesAvailability() ([]VersaSitesAvailability, error) {
-	logging.PeppaMonLog("info", "Started Batch Job to fetch Sites Availability Metrics")
-	var wg sync.WaitGroup
-	wg.Add(len(v.Tenants))
-
-	var mu sync.Mutex
-
-	availabilitySitesSlice := make([]VersaSitesAvailability, 0, len(v.Tenants))
-
-	for _, tenant := range v.Tenants {
-
-		go func(t struct{ TenantName string }) {
-
-			defer wg.Done()
+	metrics := newClientMetrics()
 
-			url := fmt.Sprintf("%s://%s/versa/analytics/v1.0."+
-				"0/data/provider/tenants/%s/features/SDWAN/?qt=stats&start-date=5minutesAgo&end-date=today&q=site"+
-				"&metrics"+
-				"=availability"+
-				"&count=-1", v.Protocol, v.Hostname, t.TenantName)
+	ctx, cancel := context.WithCancel(context.Background())
 
-			queryTitle := "Get Sites Availability"
+	nodePool := newNodePool(nodes, settings.NodeStrategy, settings.HealthCheckInterval, settings.NodeRetryInterval,
+		metrics.nodeUp)
 
-			httpNewReq, err := http.NewRequest("GET", url, nil)
-
-			if err != nil {
-				logging.PeppaMonLog("error", "unable to build HTTP request for %v with error %v", queryTitle, err)
-				return
-
-			}
-
-			httpNewReq.Header.Add("Content-Type", "application/json")
+	client := &VersaAnalyticsClient{
+		Protocol:   protocol,
+		HttpClient: versaHTTPClient,
+		Nodes:      nodePool,
+		Retry:      settings.Retry,
+		Pool:       NewWorkerPool(settings.Workers),
+
+		ReportPriorities: settings.ReportPriorities,
+		MaxRows:          settings.MaxRows,
+		Windows:          settings.Windows,
+		Clock:            clock,
+		Breakers:         newBreakers(settings.Breaker, metrics.breakerState),
+		TenantFilter:     settings.TenantFilter,
+		TenantCacheTTL:   settings.TenantCacheTTL,
+
+		metrics:   metrics,
+		transport: tlsTransport,
+		cancel:    cancel,
+	}
 
-			tenantsRes, err := v.HttpClient.Do(httpNewReq)
+	if settings.HealthCheckInterval > 0 {
+		client.background.Add(1)
 
-			if err != nil {
-				logging.PeppaMonLog("error", "HTTP request for %v failed with error %v", queryTitle, err)
-				return
+		go func() {
+			defer client.background.Done()
+			client.Nodes.healthCheck(ctx, versaHTTPClient)
+		}()
+	}
 
-			}
+	if client.TenantCacheTTL > 0 {
+		client.background.Add(1)
 
-			if tenantsRes.StatusCode != http.StatusOK || tenantsRes.StatusCode > http.StatusAccepted {
-				logging.PeppaMonLog("error", "Versa Analytics responded with HTTP error code %v for %v",
-					tenantsRes.StatusCode, queryTitle)
-				return
-			}
+		go func() {
+			defer client.background.Done()
+			client.refreshTenants(ctx)
+		}()
+	}
 
-			defer func() {
+	return client, nil
+}
 
-				errBodyClose := tenantsRes.Body.Close()
+// Close stops the background health checks, tenant refreshes, certificate reloads and workers, then
+// closes the idle connections. Queries must not be sent once the client is closed
+func (v *VersaAnalyticsClient) Close() {
 
-				if errBodyClose != nil {
-					logging.PeppaMonLog("error", "HTTP request for %v failed with error %v", queryTitle, err)
-					return
-				}
-			}()
+	v.closeOnce.Do(func() {
+		v.cancel()
+		v.background.Wait()
+		v.Pool.Close()
+		v.transport.Close()
+	})
+}
 
-			var sitesAvailabilityStats interface{}
+// Login obtains new credentials from the Versa Analytics node currently in use
+func (v *VersaAnalyticsClient) Login(ctx context.Context) error {
+	return v.Nodes.Pick().Authenticator.Login(ctx)
+}
 
-			err = json.NewDecoder(tenantsRes.Body).Decode(&sitesAvailabilityStats)
+// GetTenantList loads the monitored tenants for the scrape, from the cache when it is still fresh.
+// A failure is returned as an *Error for the tenants report
+func (v *VersaAnalyticsClient) GetTenantList(ctx context.Context) error {
 
-			if err != nil {
-				logging.PeppaMonLog("error", "Unable to decode JSON response from %v with error %v", queryTitle, err)
-				return
-			}
+	if tenants, ok := v.cachedTenants(); ok {
+		v.Tenants = tenants
+		return nil
+	}
 
-			availabilitySiteObj := VersaSitesAvailability{TenantName: t.TenantName}
+	tenants, err := v.discoverTenants(ctx)
 
-			// JSON object parses into a map with string keys
-			itemsMap := sitesAvailabilityStats.(map[string]interface{})
+	if err != nil {
+		err = wrapError(err, ReportTenants, "")
+		v.metrics.reportErrors.WithLabelValues(ReportTenants, string(ErrorKindOf(err))).Inc()
+		return err
+	}
 
-			for key, val := range itemsMap {
-				if key == "stats" {
-					for site, stats := range val.(map[string]interface{}) {
-						availabilityPct := stats.(map[string]interface{})["mean"].(float64)
+	v.Tenants = tenants
 
-						siteObj := struct {
-							SiteName        string
-							AvailabilityPct float64
-						}{SiteName: site, AvailabilityPct: availabilityPct}
-						availabilitySiteObj.SitesList = append(availabilitySiteObj.SitesList, siteObj)
+	return nil
+}
 
-					}
-				}
-			}
-			mu.Lock()
-			availabilitySitesSlice = append(availabilitySitesSlice, availabilitySiteObj)
-			mu.Unlock()
+// Run executes a Versa Analytics query for the given tenant and decodes the JSON response into result
+func (v *VersaAnalyticsClient) Run(ctx context.Context, tenant string, q Query, result interface{}) error {
+	return v.RunStream(ctx, tenant, q, func(r io.Reader) error {
+		return json.NewDecoder(r).Decode(result)
+	})
+}
 
-		}(struct{ TenantName string }(tenant))
+// BuildQuery returns the query aligned on the most recent complete buckets of the client clock. Queries are
+// sent as given by Run, RunStream and StreamTimeseries, so that every tenant and page of a query built once
+// covers the same window
+func (v *VersaAnalyticsClient) BuildQuery(q Query) Query {
+	return v.Windows.Align(q, v.now())
+}
 
+func (v *VersaAnalyticsClient) now() time.Time {
+	if v.Clock == nil {
+		return time.Now()
 	}
-	wg.Wait()
-
-	logging.PeppaMonLog("info", "Completed Batch Job to fetch Sites Availability Metrics")
-	return availabilitySitesSlice, nil
+	return v.Clock()
 }
 
-func (v *VersaAnalyticsClient) GetSitesApplicationUsageRate() ([]VersaApplicationUsageRate, error) {
-
-	logging.PeppaMonLog("info", "Started Batch Job to fetch Application Usage Rate Metrics")
-
-	var wg sync.WaitGroup
-	wg.Add(len(v.Tenants))
-
-	var mu sync.Mutex
-
-	applicationUsageSlice := make([]VersaApplicationUsageRate, 0, len(v.Tenants))
-
-	for _, tenant := range v.Tenants {
+// RunStream executes a Versa Analytics query for the given tenant and hands the response body over to decode.
+// A failure is returned as an *Error carrying the tenant and report
+func (v *VersaAnalyticsClient) RunStream(ctx context.Context, tenant string, q Query,
+	decode func(r io.Reader) error) error {
 
-		go func(t struct{ TenantName string }) {
-
-			defer wg.Done()
+	params, err := q.Values()
 
-			url := fmt.Sprintf("%s://%s/versa/analytics/v1.0."+
-				"0/data/provider/tenants/%s/features/SDWAN/?start-date=%s&end-date=today&q=appUser(site,appId,user,"+
-				"accCkt)&qt=timeseries&ds=aggregate&gap=1MINUTE&metrics=bw-rx&metrics=bw-tx&count=15000",
-				v.Protocol, v.Hostname, t.TenantName, longReportPrecision)
-
-			queryTitle := "Get Application Usage Rate"
+	if err != nil {
+		logging.PeppaMonLog("error", "unable to build query %v for tenant %v with error %v", q.Title, tenant, err)
+		return &Error{Kind: ErrorKindQuery, Tenant: tenant, Report: q.Report, Err: err}
+	}
 
-			httpNewReq, err := http.NewRequest("GET", url, nil)
+	if !v.Breakers.Allow(q.Report, tenant) {
+		return &Error{Kind: ErrorKindCircuitOpen, Tenant: tenant, Report: q.Report, Err: ErrCircuitOpen}
+	}
 
-			if err != nil {
-				logging.PeppaMonLog("error", "unable to build HTTP request for %v with error %v", queryTitle, err)
-				return
+	err = v.get(ctx, q.Report, q.Title, q.path(tenant)+"?"+params.Encode(), decode)
 
-			}
+	v.Breakers.Record(ctx, q.Report, tenant, err)
 
-			httpNewReq.Header.Add("Content-Type", "application/json")
+	return wrapError(err, q.Report, tenant)
+}
 
-			tenantsRes, err := v.HttpClient.Do(httpNewReq)
+// getJSON sends a GET request for the path to Versa Analytics and decodes the JSON response into result
+func (v *VersaAnalyticsClient) getJSON(ctx context.Context, report, queryTitle, reqPath string,
+	result interface{}) error {
 
-			if err != nil {
-				logging.PeppaMonLog("error", "HTTP request for %v failed with error %v", queryTitle, err)
-				return
+	return v.get(ctx, report, queryTitle, reqPath, func(r io.Reader) error {
+		return json.NewDecoder(r).Decode(result)
+	})
+}
 
-			}
+// get sends a GET request for the path to Versa Analytics and hands the response body over to decode
+func (v *VersaAnalyticsClient) get(ctx context.Context, report, queryTitle, reqPath string,
+	decode func(r io.Reader) error) error {
 
-			if tenantsRes.StatusCode != http.StatusOK || tenantsRes.StatusCode > http.StatusAccepted {
-				logging.PeppaMonLog("error", "Versa Analytics responded with HTTP error code %v for %v",
-					tenantsRes.StatusCode, queryTitle)
+	res, err := v.getWithRetry(ctx, report, queryTitle, reqPath)
 
-				return
-			}
+	if err != nil {
+		logging.PeppaMonLog("error", "HTTP request for %v failed with error %v", queryTitle, err)
+		return wrapError(err, report, "")
+	}
 
-			defer func() {
+	defer func() {
 
-				errBodyClose := tenantsRes.Body.Close()
+		errBodyClose := res.Body.Close()
 
-				if errBodyClose != nil {
-					logging.PeppaMonLog("error", "HTTP request for %v failed with error %v", queryTitle, err)
-					return
-				}
-			}()
+		if errBodyClose != nil {
+			logging.PeppaMonLog("error", "HTTP request for %v failed with error %v", queryTitle, errBodyClose)
+		}
+	}()
 
-			var tenantApplicationUsage VersaApplicationUsageRate
+	if res.StatusCode != http.StatusOK || res.StatusCode > http.StatusAccepted {
+		logging.PeppaMonLog("error", "Versa Analytics responded with HTTP error code %v for %v",
+			res.StatusCode, queryTitle)
 
-			err = json.NewDecoder(tenantsRes.Body).Decode(&tenantApplicationUsage)
+		kind := ErrorKindHTTPStatus
 
-			if err != nil {
-				logging.PeppaMonLog("error", "Unable to decode JSON response from %v with error %v", queryTitle, err)
-				return
+		if res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden {
+			kind = ErrorKindAuth
+		}
 
-			}
+		return &Error{
+			Kind:       kind,
+			Report:     report,
+			StatusCode: res.StatusCode,
+			Err:        fmt.Errorf("versa analytics responded with HTTP error code %v for %v", res.StatusCode, queryTitle),
+		}
+	}
 
-			tenantApplicationUsage.TenantName = t.TenantName
+	err = decode(res.Body)
 
-			mu.Lock()
-			applicationUsageSlice = append(applicationUsageSlice, tenantApplicationUsage)
-			mu.Unlock()
+	if err != nil {
+		logging.PeppaMonLog("error", "Unable to decode JSON response from %v with error %v", queryTitle, err)
 
-		}(struct{ TenantName string }(tenant))
+		// The request was cut short while the body was read
+		if ctx.Err() != nil {
+			return &Error{Kind: ErrorKindTimeout, Report: report, Err: err}
+		}
 
+		return &Error{Kind: ErrorKindDecode, Report: report, Err: err}
 	}
-	wg.Wait()
 
-	logging.PeppaMonLog("info", "Completed Batch Job to fetch Application Usage Rate Metrics")
-	return applicationUsageSlice, nil
+	return nil
 }
 
-func (v *VersaAnalyticsClient) GetSitesApplicationUsageVolume() ([]VersaApplicationUsageVolume, error) {
-
-	logging.PeppaMonLog("info", "Started Batch Job to fetch Application Usage Volume Metrics")
-
+// forEachTenant schedules fn on the worker pool for every tenant and waits for all of them to complete.
+// Jobs still queued when ctx is done, or rejected as the client is closed, are skipped and reported as timed
+// out. The failures are returned per tenant, or nil when every tenant succeeded
+func (v *VersaAnalyticsClient) forEachTenant(ctx context.Context, report string, fn func(tenant string) error) error {
 	var wg sync.WaitGroup
 	wg.Add(len(v.Tenants))
 
 	var mu sync.Mutex
 
-	applicationUsageSlice := make([]VersaApplicationUsageVolume, 0, len(v.Tenants))
-
-	for _, tenant := range v.Tenants {
+	failures := make(TenantErrors)
 
-		go func(t struct{ TenantName string }) {
-
-			defer wg.Done()
+	fail := func(tenant string, err error) {
 
-			url := fmt.Sprintf("%s://%s/versa/analytics/v1.0."+
-				"0/data/provider/tenants/%s/features/SDWAN/?start-date=%s&end-date=today&q=appUser(site,appId,user,"+
-				"accCkt)&qt=timeseries&ds=aggregate&gap=1MINUTE&metrics=volume-rx&metrics=volume-tx&count=15000",
-				v.Protocol, v.Hostname, t.TenantName, longReportPrecision)
-
-			queryTitle := "Get Application Usage Volume"
-
-			httpNewReq, err := http.NewRequest("GET", url, nil)
-
-			if err != nil {
-				logging.PeppaMonLog("error", "unable to build HTTP request for %v with error %v", queryTitle, err)
-				return
+		v.metrics.reportErrors.WithLabelValues(report, string(ErrorKindOf(err))).Inc()
 
-			}
+		mu.Lock()
+		failures[tenant] = err
+		mu.Unlock()
+	}
 
-			httpNewReq.Header.Add("Content-Type", "application/json")
+	priority := v.ReportPriorities[report]
 
-			tenantsRes, err := v.HttpClient.Do(httpNewReq)
+	for _, tenant := range v.Tenants {
 
-			if err != nil {
-				logging.PeppaMonLog("error", "HTTP request for %v failed with error %v", queryTitle, err)
-				return
+		t := tenant.TenantName
 
-			}
+		err := v.Pool.Submit(t, priority, func() {
+			defer wg.Done()
 
-			if tenantsRes.StatusCode != http.StatusOK || tenantsRes.StatusCode > http.StatusAccepted {
-				logging.PeppaMonLog("error", "Versa Analytics responded with HTTP error code %v for %v",
-					tenantsRes.StatusCode, queryTitle)
+			var err error
 
-				return
+			if ctx.Err() != nil {
+				err = &Error{Kind: ErrorKindTimeout, Tenant: t, Report: report, Err: ctx.Err()}
+			} else {
+				err = wrapError(fn(t), report, t)
 			}
 
-			defer func() {
-
-				errBodyClose := tenantsRes.Body.Close()
-
-				if errBodyClose != nil {
-					logging.PeppaMonLog("error", "HTTP request for %v failed with error %v", queryTitle, err)
-					return
-				}
-			}()
-
-			var tenantApplicationUsage VersaApplicationUsageVolume
-
-			err = json.NewDecoder(tenantsRes.Body).Decode(&tenantApplicationUsage)
-
 			if err != nil {
-				logging.PeppaMonLog("error", "Unable to decode JSON response from %v with error %v", queryTitle, err)
-				return
-
+				fail(t, err)
 			}
+		})
 
-			tenantApplicationUsage.TenantName = t.TenantName
-
-			mu.Lock()
-			applicationUsageSlice = append(applicationUsageSlice, tenantApplicationUsage)
-			mu.Unlock()
-
-		}(struct{ TenantName string }(tenant))
-
+		if err != nil {
+			fail(t, &Error{Kind: ErrorKindTimeout, Tenant: t, Report: report, Err: err})
+			wg.Done()
+		}
 	}
 	wg.Wait()
 
-	logging.PeppaMonLog("info", "Completed Batch Job to fetch Application Usage Volume Metrics")
-	return applicationUsageSlice, nil
+	return failures.err()
 }
 
-func (v *VersaAnalyticsClient) GetSitesCircuitBandwidthUsage() ([]VersaSiteBandwidthUsage, error) {
-
-	logging.PeppaMonLog("info", "Started Batch Job to fetch Site Circuits Usage Metrics")
-
-	var wg sync.WaitGroup
-	wg.Add(len(v.Tenants))
+func (v *VersaAnalyticsClient) GetSitesAvailability(ctx context.Context) ([]VersaSitesAvailability, error) {
+	logging.PeppaMonLog("info", "Started Batch Job to fetch Sites Availability Metrics")
 
 	var mu sync.Mutex
 
-	applicationUsageSlice := make([]VersaSiteBandwidthUsage, 0, len(v.Tenants))
-
-	for _, tenant := range v.Tenants {
-
-		go func(t struct{ TenantName string }) {
-
-			defer wg.Done()
+	availabilitySitesSlice := make([]VersaSitesAvailability, 0, len(v.Tenants))
 
-			url := fmt.Sprintf("%s://%s/versa/analytics/v1.0."+
-				"0/data/provider/tenants/%s/features/SDWAN/?start-date=%s&end-date=today&q=linkUsage(site,accCkt)&qt=timeseries&ds=aggregate&gap=1MINUTE&metrics=bw-rx&metrics=bw-tx&count=-1",
-				v.Protocol, v.Hostname, t.TenantName, mediumReportPrecision)
+	// Every tenant is queried over the same window
+	q := v.BuildQuery(sitesAvailabilityQuery)
 
-			queryTitle := "Get Site Circuits Usage"
+	err := v.forEachTenant(ctx, q.Report, func(tenant string) error {
 
-			httpNewReq, err := http.NewRequest("GET", url, nil)
+		var sitesAvailabilityStats versaSitesAvailabilityStats
 
-			if err != nil {
-				logging.PeppaMonLog("error", "unable to build HTTP request for %v with error %v", queryTitle, err)
-				return
-
-			}
+		err := v.Run(ctx, tenant, q, &sitesAvailabilityStats)
 
-			httpNewReq.Header.Add("Content-Type", "application/json")
-
-			tenantsRes, err := v.HttpClient.Do(httpNewReq)
+		if err != nil {
+			return err
+		}
 
-			if err != nil {
-				logging.PeppaMonLog("error", "HTTP request for %v failed with error %v", queryTitle, err)
-				return
+		availabilitySiteObj := VersaSitesAvailability{TenantName: tenant}
 
-			}
+		for site, stats := range sitesAvailabilityStats.Stats {
 
-			if tenantsRes.StatusCode != http.StatusOK || tenantsRes.StatusCode > http.StatusAccepted {
-				logging.PeppaMonLog("error", "Versa Analytics responded with HTTP error code %v for %v",
-					tenantsRes.StatusCode, queryTitle)
-				return
+			// Skip sites for which Versa Analytics did not compute a mean
+			if stats.Mean == nil {
+				continue
 			}
 
-			defer func() {
-
-				errBodyClose := tenantsRes.Body.Close()
-
-				if errBodyClose != nil {
-					logging.PeppaMonLog("error", "HTTP request for %v failed with error %v", queryTitle, err)
-					return
-				}
-			}()
-
-			var tenantSiteCircuitUsage VersaSiteBandwidthUsage
+			siteObj := struct {
+				SiteName        string
+				AvailabilityPct float64
+			}{SiteName: site, AvailabilityPct: *stats.Mean}
+			availabilitySiteObj.SitesList = append(availabilitySiteObj.SitesList, siteObj)
+		}
 
-			err = json.NewDecoder(tenantsRes.Body).Decode(&tenantSiteCircuitUsage)
+		mu.Lock()
+		availabilitySitesSlice = append(availabilitySitesSlice, availabilitySiteObj)
+		mu.Unlock()
 
-			if err != nil {
-				logging.PeppaMonLog("error", "Unable to decode JSON response from %v with error %v", queryTitle, err)
-				return
+		return nil
+	})
 
-			}
+	logging.PeppaMonLog("info", "Completed Batch Job to fetch Sites Availability Metrics")
+	return availabilitySitesSlice, err
+}
 
-			tenantSiteCircuitUsage.TenantName = t.TenantName
+// RunTimeseries executes a Versa Analytics timeseries query for the given tenant.
+// Results truncated at the query Count are paged through up to the client MaxRows ceiling
+func (v *VersaAnalyticsClient) RunTimeseries(ctx context.Context, tenant string, q Query) (TimeseriesResult, error) {
 
-			mu.Lock()
-			applicationUsageSlice = append(applicationUsageSlice, tenantSiteCircuitUsage)
-			mu.Unlock()
+	result := TimeseriesResult{TenantName: tenant}
 
-		}(struct{ TenantName string }(tenant))
+	qTime, err := v.StreamTimeseries(ctx, tenant, q, func(series TimeseriesSeries) {
+		result.Series = append(result.Series, series)
+	})
 
-	}
-	wg.Wait()
+	result.QTime = qTime
 
-	logging.PeppaMonLog("info", "Completed Batch Job to fetch Site Circuits Usage Metrics")
-	return applicationUsageSlice, nil
+	return result, err
 }
 
-func (v *VersaAnalyticsClient) GetSitesSLAMetrics() ([]VersaSiteSLAMetrics, error) {
-
-	logging.PeppaMonLog("info", "Started Batch Job to fetch Site SLA Metrics")
-
-	var wg sync.WaitGroup
-	wg.Add(len(v.Tenants))
+// getTimeseries runs a timeseries query against every tenant and returns the results of the tenants
+// that succeeded along with the failures of the others
+func (v *VersaAnalyticsClient) getTimeseries(ctx context.Context, q Query) ([]TimeseriesResult, error) {
 
 	var mu sync.Mutex
 
-	metricsIPSLASlice := make([]VersaSiteSLAMetrics, 0, len(v.Tenants))
+	results := make([]TimeseriesResult, 0, len(v.Tenants))
 
-	for _, tenant := range v.Tenants {
+	err := v.forEachTenant(ctx, q.Report, func(tenant string) error {
 
-		go func(t struct{ TenantName string }) {
-
-			defer wg.Done()
+		result, err := v.RunTimeseries(ctx, tenant, q)
 
-			url := fmt.Sprintf("%s://%s/versa/analytics/v1.0."+
-				"0/data/provider/tenants/%s/features/SDWAN/?start-date=%s&end-date=today&q=slam(localSite,remoteSite,"+
-				"localAccCkt,remoteAccCkt)&qt=timeseries&gap=1MINUTE&ds=aggregate&metrics=fwdDelayVar&metrics"+
-				"=revDelayVar&metrics=delay&count=-1&metrics=fwdLossRatio&metrics=revLossRatio",
-				v.Protocol, v.Hostname, t.TenantName, longReportPrecision)
-
-			queryTitle := "Get Site SLA Metrics"
+		if err != nil {
+			return err
+		}
 
-			httpNewReq, err := http.NewRequest("GET", url, nil)
+		mu.Lock()
+		results = append(results, result)
+		mu.Unlock()
 
-			if err != nil {
-				logging.PeppaMonLog("error", "unable to build HTTP request for %v with error %v", queryTitle, err)
-				return
+		return nil
+	})
 
-			}
+	return results, err
+}
 
-			httpNewReq.Header.Add("Content-Type", "application/json")
+// buildWindowQuery returns the query covering window aligned on the client clock, the window configured for
+// the report or a single gap bucket being used when it is zero
+func (v *VersaAnalyticsClient) buildWindowQuery(q Query, window time.Duration) Query {
+	q.Window = window
+	return v.BuildQuery(q)
+}
 
-			tenantsRes, err := v.HttpClient.Do(httpNewReq)
+// GetSitesApplicationUsageRate streams the application usage rate series of every tenant over window to fn as
+// they are decoded, as the responses can hold thousands of rows per tenant
+func (v *VersaAnalyticsClient) GetSitesApplicationUsageRate(ctx context.Context, window time.Duration, fn SeriesFunc) error {
 
-			if err != nil {
-				logging.PeppaMonLog("error", "HTTP request for %v failed with error %v", queryTitle, err)
-				return
+	logging.PeppaMonLog("info", "Started Batch Job to fetch Application Usage Rate Metrics")
 
-			}
+	err := v.streamTimeseries(ctx, v.buildWindowQuery(applicationUsageRateQuery, window), fn)
 
-			if tenantsRes.StatusCode != http.StatusOK || tenantsRes.StatusCode > http.StatusAccepted {
-				logging.PeppaMonLog("error", "Versa Analytics responded with HTTP error code %v for %v",
-					tenantsRes.StatusCode, queryTitle)
-				return
-			}
+	logging.PeppaMonLog("info", "Completed Batch Job to fetch Application Usage Rate Metrics")
+	return err
+}
 
-			defer func() {
+// GetSitesApplicationUsageVolume streams the application usage volume series of every tenant over window to fn
+// as they are decoded, as the responses can hold thousands of rows per tenant
+func (v *VersaAnalyticsClient) GetSitesApplicationUsageVolume(ctx context.Context, window time.Duration, fn SeriesFunc) error {
 
-				errBodyClose := tenantsRes.Body.Close()
+	logging.PeppaMonLog("info", "Started Batch Job to fetch Application Usage Volume Metrics")
 
-				if errBodyClose != nil {
-					logging.PeppaMonLog("error", "HTTP request for %v failed with error %v", queryTitle, err)
-					return
-				}
-			}()
+	err := v.streamTimeseries(ctx, v.buildWindowQuery(applicationUsageVolumeQuery, window), fn)
 
-			var tenantIPSLAMetrics VersaSiteSLAMetrics
+	logging.PeppaMonLog("info", "Completed Batch Job to fetch Application Usage Volume Metrics")
+	return err
+}
 
-			err = json.NewDecoder(tenantsRes.Body).Decode(&tenantIPSLAMetrics)
+// GetSitesCircuitBandwidthUsage returns the circuit usage series of every tenant over window
+func (v *VersaAnalyticsClient) GetSitesCircuitBandwidthUsage(ctx context.Context, window time.Duration) ([]TimeseriesResult, error) {
 
-			if err != nil {
-				logging.PeppaMonLog("error", "Unable to decode JSON response from %v with error %v", queryTitle, err)
-				return
+	logging.PeppaMonLog("info", "Started Batch Job to fetch Site Circuits Usage Metrics")
 
-			}
+	siteCircuitUsageSlice, err := v.getTimeseries(ctx, v.buildWindowQuery(siteCircuitUsageQuery, window))
 
-			tenantIPSLAMetrics.TenantName = t.TenantName
+	logging.PeppaMonLog("info", "Completed Batch Job to fetch Site Circuits Usage Metrics")
+	return siteCircuitUsageSlice, err
+}
 
-			mu.Lock()
-			metricsIPSLASlice = append(metricsIPSLASlice, tenantIPSLAMetrics)
-			mu.Unlock()
+// GetSitesSLAMetrics returns the SLA series of every tenant over window
+func (v *VersaAnalyticsClient) GetSitesSLAMetrics(ctx context.Context, window time.Duration) ([]TimeseriesResult, error) {
 
-		}(struct{ TenantName string }(tenant))
+	logging.PeppaMonLog("info", "Started Batch Job to fetch Site SLA Metrics")
 
-	}
-	wg.Wait()
+	metricsIPSLASlice, err := v.getTimeseries(ctx, v.buildWindowQuery(siteSLAMetricsQuery, window))
 
 	logging.PeppaMonLog("info", "Completed Batch Job to fetch Site SLA Metrics")
-	return metricsIPSLASlice, nil
+	return metricsIPSLASlice, err
 }
 
-func (v *VersaAnalyticsClient) GetApplianceComputePerf() ([]VersaAppliancePerformance, error) {
+// GetApplianceComputePerf returns the appliance load series of every tenant over window
+func (v *VersaAnalyticsClient) GetApplianceComputePerf(ctx context.Context, window time.Duration) ([]TimeseriesResult, error) {
 
 	logging.PeppaMonLog("info", "Started Batch Job to fetch Appliance Compute Metrics")
 
-	var wg sync.WaitGroup
-	wg.Add(len(v.Tenants))
-
-	var mu sync.Mutex
-
-	applicationUsageSlice := make([]VersaAppliancePerformance, 0, len(v.Tenants))
-
-	for _, tenant := range v.Tenants {
-
-		go func(t struct{ TenantName string }) {
-
-			defer wg.Done()
-
-			url := fmt.Sprintf("%s://%s/versa/analytics/v1.0."+
-				"0/data/provider/tenants/%s/features/SYSTEM?start-date=%s&q=applMonitor&qt=timeseries&gap=1MINUTE&ds"+
-				"=aggregate&count=-1&metrics=CPULOAD&metrics=MEMLOAD&metrics=DISKLOAD&metrics=SESSLOAD",
-				v.Protocol, v.Hostname, t.TenantName, longReportPrecision)
-
-			queryTitle := "Get Appliance Compute Performance"
-
-			httpNewReq, err := http.NewRequest("GET", url, nil)
-
-			if err != nil {
-				logging.PeppaMonLog("error", "unable to build HTTP request for %v with error %v", queryTitle, err)
-				return
-
-			}
-
-			httpNewReq.Header.Add("Content-Type", "application/json")
-
-			tenantsRes, err := v.HttpClient.Do(httpNewReq)
-
-			if err != nil {
-				logging.PeppaMonLog("error", "HTTP request for %v failed with error %v", queryTitle, err)
-				return
-
-			}
-
-			if tenantsRes.StatusCode != http.StatusOK || tenantsRes.StatusCode > http.StatusAccepted {
-				logging.PeppaMonLog("error", "Versa Analytics responded with HTTP error code %v for %v",
-					tenantsRes.StatusCode, queryTitle)
-				return
-			}
-
-			defer func() {
-
-				errBodyClose := tenantsRes.Body.Close()
-
-				if errBodyClose != nil {
-					logging.PeppaMonLog("error", "HTTP request for %v failed with error %v", queryTitle, err)
-					return
-				}
-			}()
-
-			var tenantSiteCircuitUsage VersaAppliancePerformance
-
-			err = json.NewDecoder(tenantsRes.Body).Decode(&tenantSiteCircuitUsage)
-
-			if err != nil {
-				logging.PeppaMonLog("error", "Unable to decode JSON response from %v with error %v", queryTitle, err)
-				return
-
-			}
-
-			tenantSiteCircuitUsage.TenantName = t.TenantName
-
-			mu.Lock()
-			applicationUsageSlice = append(applicationUsageSlice, tenantSiteCircuitUsage)
-			mu.Unlock()
-
-		}(struct{ TenantName string }(tenant))
-
-	}
-	wg.Wait()
+	appliancePerfSlice, err := v.getTimeseries(ctx, v.buildWindowQuery(applianceComputePerfQuery, window))
 
 	logging.PeppaMonLog("info", "Completed Batch Job to fetch Appliance Compute Metrics")
-	return applicationUsageSlice, nil
+	return appliancePerfSlice, err
 }
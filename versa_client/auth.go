@@ -0,0 +1,143 @@
+package versa_client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+const (
+	AuthModeCookie = "cookie"
+	AuthModeOAuth2 = "oauth2"
+)
+
+// Authenticator obtains and renews the credentials sent with every Versa Analytics request
+type Authenticator interface {
+	// Login obtains new credentials from Versa
+	Login(ctx context.Context) error
+
+	// Authorize adds valid credentials to the request, logging in first when none are held yet.
+	// It returns the generation of the credentials used so that they can be renewed only once when they expire
+	Authorize(req *http.Request) (uint64, error)
+
+	// Renew replaces the credentials of the given generation after Versa rejected them
+	Renew(ctx context.Context, expired uint64) error
+
+	// Expired reports whether the response means the credentials used for the request are no longer valid
+	Expired(res *http.Response) bool
+}
+
+// AuthSettings holds the credentials of Versa Analytics and how they are sent
+type AuthSettings struct {
+	// Mode is cookie or oauth2, cookie when empty
+	Mode string
+
+	Username string
+	Password string
+
+	// OAuthTokenURL defaults to the /auth/token endpoint of every node
+	OAuthTokenURL     string
+	OAuthClientID     string
+	OAuthClientSecret string
+}
+
+// authSettingsFromEnv loads PEPPAMON_VERSA_ANALYTICS_AUTH_MODE along with the credentials of the mode
+func authSettingsFromEnv(env Env) AuthSettings {
+	return AuthSettings{
+		Mode:              env.String("PEPPAMON_VERSA_ANALYTICS_AUTH_MODE", ""),
+		Username:          env.String("PEPPAMON_VERSA_ANALYTICS_USERNAME", ""),
+		Password:          env.String("PEPPAMON_VERSA_ANALYTICS_PASSWORD", ""),
+		OAuthTokenURL:     env.String("PEPPAMON_VERSA_ANALYTICS_OAUTH_TOKEN_URL", ""),
+		OAuthClientID:     env.String("PEPPAMON_VERSA_ANALYTICS_OAUTH_CLIENT_ID", ""),
+		OAuthClientSecret: env.String("PEPPAMON_VERSA_ANALYTICS_OAUTH_CLIENT_SECRET", ""),
+	}
+}
+
+// newAuthenticator builds the authenticator of the node at baseURL for the authentication mode
+func newAuthenticator(settings AuthSettings, httpClient *http.Client, baseURL string) (Authenticator, error) {
+
+	switch settings.Mode {
+	case "", AuthModeCookie:
+		return NewCookieAuthenticator(httpClient, baseURL, settings.Username, settings.Password), nil
+
+	case AuthModeOAuth2:
+		tokenURL := settings.OAuthTokenURL
+
+		if tokenURL == "" {
+			tokenURL = baseURL + "/auth/token"
+		}
+
+		return NewOAuth2Authenticator(
+			httpClient,
+			tokenURL,
+			settings.OAuthClientID,
+			settings.OAuthClientSecret,
+			settings.Username,
+			settings.Password,
+		), nil
+
+	default:
+		return nil, fmt.Errorf("unsupported Versa Analytics authentication mode %v", settings.Mode)
+	}
+}
+
+// do sends the request to the node with its credentials and transparently retries it once
+// after renewing them if Versa rejected them in the meantime
+func (v *VersaAnalyticsClient) do(node *AnalyticsNode, req *http.Request) (*http.Response, error) {
+
+	// Keep a pristine copy as the cookie jar adds the expired session cookie to the request being sent
+	retryReq := req.Clone(req.Context())
+
+	generation, err := node.Authenticator.Authorize(req)
+
+	if err != nil {
+		return nil, authError(err)
+	}
+
+	res, err := v.HttpClient.Do(req)
+
+	if err != nil || !node.Authenticator.Expired(res) {
+		return res, err
+	}
+
+	_ = res.Body.Close()
+
+	if err := node.Authenticator.Renew(req.Context(), generation); err != nil {
+		return nil, authError(err)
+	}
+
+	if req.GetBody != nil {
+		if retryReq.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := node.Authenticator.Authorize(retryReq); err != nil {
+		return nil, authError(err)
+	}
+
+	res, err = v.HttpClient.Do(retryReq)
+
+	if err != nil || !node.Authenticator.Expired(res) {
+		return res, err
+	}
+
+	_ = res.Body.Close()
+
+	return nil, &Error{
+		Kind:       ErrorKindAuth,
+		StatusCode: res.StatusCode,
+		Err:        fmt.Errorf("versa analytics rejected the credentials for %v right after renewing them", node.Hostname),
+	}
+}
+
+// authError classifies a failure to obtain credentials. Failing to reach Versa keeps its own kind
+// so that an unreachable node is not reported as an authentication failure
+func authError(err error) error {
+
+	if kind := ErrorKindOf(err); kind != ErrorKindTransport || retryableError(err) {
+		return err
+	}
+
+	return &Error{Kind: ErrorKindAuth, Err: err}
+}
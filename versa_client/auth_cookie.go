@@ -0,0 +1,135 @@
+package versa_client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/lucabrasi83/peppamon_versa/logging"
+)
+
+// CookieAuthenticator logs in to Versa Analytics with a username and password and relies on the
+// session cookie stored in the HTTP client cookie jar, which is reused across scrapes
+type CookieAuthenticator struct {
+	HttpClient *http.Client
+	BaseURL    string
+	Username   string
+	Password   string
+
+	mu    sync.Mutex
+	valid bool
+
+	// generation is incremented on every successful login so that concurrent requests
+	// hitting the same expired session only trigger a single re-login
+	generation uint64
+}
+
+func NewCookieAuthenticator(httpClient *http.Client, baseURL, username, password string) *CookieAuthenticator {
+	return &CookieAuthenticator{
+		HttpClient: httpClient,
+		BaseURL:    baseURL,
+		Username:   username,
+		Password:   password,
+	}
+}
+
+// Login opens a new session on Versa Analytics
+func (c *CookieAuthenticator) Login(ctx context.Context) error {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.loginLocked(ctx)
+}
+
+// loginLocked sends the credentials as a form body and must be called with the lock held
+func (c *CookieAuthenticator) loginLocked(ctx context.Context) error {
+
+	c.valid = false
+
+	queryTitle := "Versa Analytics Login"
+
+	credentials := url.Values{}
+	credentials.Set("username", c.Username)
+	credentials.Set("password", c.Password)
+
+	httpNewReq, err := http.NewRequestWithContext(ctx, "POST", c.BaseURL+"/versa/login", strings.NewReader(credentials.Encode()))
+
+	if err != nil {
+		logging.PeppaMonLog("error", "unable to build HTTP request for %v with error %v", queryTitle, err)
+		return err
+	}
+
+	httpNewReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	cookieRes, err := c.HttpClient.Do(httpNewReq)
+
+	if err != nil {
+		logging.PeppaMonLog("error", "HTTP request for %v failed with error %v", queryTitle, err)
+		return err
+	}
+
+	defer func() {
+
+		errBodyClose := cookieRes.Body.Close()
+
+		if errBodyClose != nil {
+			logging.PeppaMonLog("error", "HTTP request for %v failed with error %v", queryTitle, errBodyClose)
+		}
+	}()
+
+	if cookieRes.StatusCode != http.StatusOK || cookieRes.StatusCode > http.StatusAccepted {
+		logging.PeppaMonLog("error", "Versa Analytics responded with HTTP error code %v for %v",
+			cookieRes.StatusCode, queryTitle)
+		return fmt.Errorf("versa analytics responded with HTTP error code %v for %v", cookieRes.StatusCode, queryTitle)
+	}
+
+	c.valid = true
+	c.generation++
+
+	return nil
+}
+
+// Authorize logs in if no session is open yet. The session cookie is added to the request by the cookie jar
+func (c *CookieAuthenticator) Authorize(req *http.Request) (uint64, error) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.valid {
+		if err := c.loginLocked(req.Context()); err != nil {
+			return 0, err
+		}
+	}
+
+	return c.generation, nil
+}
+
+// Renew logs in again unless another request already renewed the expired session
+func (c *CookieAuthenticator) Renew(ctx context.Context, expired uint64) error {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.valid && c.generation != expired {
+		return nil
+	}
+
+	logging.PeppaMonLog("warning", "Versa Analytics session on %v expired. Logging in again", c.BaseURL)
+
+	return c.loginLocked(ctx)
+}
+
+// Expired reports whether Versa Analytics rejected the request because the session is no longer valid,
+// either with a 401 or by redirecting it to the login page
+func (c *CookieAuthenticator) Expired(res *http.Response) bool {
+
+	if res.StatusCode == http.StatusUnauthorized {
+		return true
+	}
+
+	return res.Request != nil && strings.HasSuffix(strings.TrimSuffix(res.Request.URL.Path, "/"), "/login")
+}
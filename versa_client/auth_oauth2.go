@@ -0,0 +1,254 @@
+package versa_client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/lucabrasi83/peppamon_versa/logging"
+)
+
+const (
+	// oauth2RefreshMargin is how long before its expiry a cached token gets refreshed, at most half its lifetime
+	oauth2RefreshMargin = 1 * time.Minute
+
+	// oauth2DefaultLifetime is assumed for the tokens returned without expires_in
+	oauth2DefaultLifetime = 5 * time.Minute
+)
+
+// OAuth2Authenticator sends a bearer token obtained from the Versa token endpoint with the password grant.
+// The token is cached and refreshed with the refresh token shortly before it expires
+type OAuth2Authenticator struct {
+	HttpClient   *http.Client
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	Username     string
+	Password     string
+
+	mu           sync.Mutex
+	accessToken  string
+	refreshToken string
+	refreshAt    time.Time
+	generation   uint64
+
+	// clock returns the current time, time.Now when nil
+	clock func() time.Time
+}
+
+// oauth2TokenRequest is the JSON body expected by the Versa token endpoint
+type oauth2TokenRequest struct {
+	GrantType    string `json:"grant_type"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	Username     string `json:"username,omitempty"`
+	Password     string `json:"password,omitempty"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+}
+
+type oauth2TokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	TokenType    string `json:"token_type"`
+
+	// Versa returns expires_in either as a number or as a quoted number
+	ExpiresIn json.Number `json:"expires_in"`
+}
+
+func NewOAuth2Authenticator(httpClient *http.Client, tokenURL, clientID, clientSecret, username,
+	password string) *OAuth2Authenticator {
+
+	return &OAuth2Authenticator{
+		HttpClient:   httpClient,
+		TokenURL:     tokenURL,
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		Username:     username,
+		Password:     password,
+	}
+}
+
+// Login requests a new token with the password grant
+func (o *OAuth2Authenticator) Login(ctx context.Context) error {
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return o.passwordGrantLocked(ctx)
+}
+
+// Authorize sets the bearer token on the request, requesting or refreshing it first when needed
+func (o *OAuth2Authenticator) Authorize(req *http.Request) (uint64, error) {
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	switch {
+	case o.accessToken == "":
+		if err := o.passwordGrantLocked(req.Context()); err != nil {
+			return 0, err
+		}
+
+	case !o.now().Before(o.refreshAt):
+		if err := o.renewLocked(req.Context()); err != nil {
+			return 0, err
+		}
+	}
+
+	req.Header.Set("Authorization", "Bearer "+o.accessToken)
+
+	return o.generation, nil
+}
+
+func (o *OAuth2Authenticator) now() time.Time {
+	if o.clock == nil {
+		return time.Now()
+	}
+	return o.clock()
+}
+
+// Renew refreshes the token unless another request already replaced the rejected one
+func (o *OAuth2Authenticator) Renew(ctx context.Context, expired uint64) error {
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.accessToken != "" && o.generation != expired {
+		return nil
+	}
+
+	logging.PeppaMonLog("warning", "Versa OAuth2 token from %v was rejected. Requesting a new one", o.TokenURL)
+
+	return o.renewLocked(ctx)
+}
+
+// Expired reports whether Versa rejected the bearer token
+func (o *OAuth2Authenticator) Expired(res *http.Response) bool {
+	return res.StatusCode == http.StatusUnauthorized
+}
+
+// renewLocked uses the refresh token when one is held and falls back to the password grant
+func (o *OAuth2Authenticator) renewLocked(ctx context.Context) error {
+
+	if o.refreshToken != "" {
+
+		err := o.requestTokenLocked(ctx, oauth2TokenRequest{
+			GrantType:    "refresh_token",
+			ClientID:     o.ClientID,
+			ClientSecret: o.ClientSecret,
+			RefreshToken: o.refreshToken,
+		})
+
+		if err == nil {
+			return nil
+		}
+
+		logging.PeppaMonLog("warning", "Unable to refresh Versa OAuth2 token with error %v. Using password grant", err)
+	}
+
+	return o.passwordGrantLocked(ctx)
+}
+
+func (o *OAuth2Authenticator) passwordGrantLocked(ctx context.Context) error {
+	return o.requestTokenLocked(ctx, oauth2TokenRequest{
+		GrantType:    "password",
+		ClientID:     o.ClientID,
+		ClientSecret: o.ClientSecret,
+		Username:     o.Username,
+		Password:     o.Password,
+	})
+}
+
+// requestTokenLocked calls the token endpoint and caches the returned token. It must be called with the lock held
+func (o *OAuth2Authenticator) requestTokenLocked(ctx context.Context, tokenReq oauth2TokenRequest) error {
+
+	queryTitle := "Versa OAuth2 Token " + tokenReq.GrantType
+
+	body, err := json.Marshal(tokenReq)
+
+	if err != nil {
+		return err
+	}
+
+	httpNewReq, err := http.NewRequestWithContext(ctx, "POST", o.TokenURL, bytes.NewReader(body))
+
+	if err != nil {
+		logging.PeppaMonLog("error", "unable to build HTTP request for %v with error %v", queryTitle, err)
+		return err
+	}
+
+	httpNewReq.Header.Set("Content-Type", "application/json")
+	httpNewReq.Header.Set("Accept", "application/json")
+
+	tokenRes, err := o.HttpClient.Do(httpNewReq)
+
+	if err != nil {
+		logging.PeppaMonLog("error", "HTTP request for %v failed with error %v", queryTitle, err)
+		return err
+	}
+
+	defer func() {
+
+		errBodyClose := tokenRes.Body.Close()
+
+		if errBodyClose != nil {
+			logging.PeppaMonLog("error", "HTTP request for %v failed with error %v", queryTitle, errBodyClose)
+		}
+	}()
+
+	if tokenRes.StatusCode != http.StatusOK || tokenRes.StatusCode > http.StatusAccepted {
+		logging.PeppaMonLog("error", "Versa responded with HTTP error code %v for %v",
+			tokenRes.StatusCode, queryTitle)
+		return fmt.Errorf("versa responded with HTTP error code %v for %v", tokenRes.StatusCode, queryTitle)
+	}
+
+	var token oauth2TokenResponse
+
+	err = json.NewDecoder(tokenRes.Body).Decode(&token)
+
+	if err != nil {
+		logging.PeppaMonLog("error", "Unable to decode JSON response from %v with error %v", queryTitle, err)
+		return err
+	}
+
+	if token.AccessToken == "" {
+		return fmt.Errorf("versa returned an empty access token for %v", queryTitle)
+	}
+
+	lifetime := oauth2DefaultLifetime
+
+	if token.ExpiresIn != "" {
+
+		expiresIn, err := token.ExpiresIn.Int64()
+
+		if err != nil || expiresIn < 0 {
+			return fmt.Errorf("invalid expires_in %q returned for %v", token.ExpiresIn, queryTitle)
+		}
+
+		if expiresIn > 0 {
+			lifetime = time.Duration(expiresIn) * time.Second
+		}
+	}
+
+	// Short lived tokens are refreshed halfway through their lifetime instead of on every request
+	margin := oauth2RefreshMargin
+
+	if margin > lifetime/2 {
+		margin = lifetime / 2
+	}
+
+	o.accessToken = token.AccessToken
+	o.refreshAt = o.now().Add(lifetime - margin)
+	o.generation++
+
+	// Some grants do not return a new refresh token, keep using the previous one in that case
+	if token.RefreshToken != "" {
+		o.refreshToken = token.RefreshToken
+	}
+
+	return nil
+}
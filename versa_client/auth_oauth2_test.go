@@ -0,0 +1,217 @@
+package versa_client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// tokenServer is a Versa token endpoint answering with the expires_in set, refresh grants being rejected
+// when rejectRefresh is set
+type tokenServer struct {
+	*httptest.Server
+
+	mu            sync.Mutex
+	expiresIn     interface{}
+	rejectRefresh bool
+	grants        []string
+	issued        int
+}
+
+func newTokenServer(expiresIn interface{}) *tokenServer {
+
+	s := &tokenServer{expiresIn: expiresIn}
+
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		var tokenReq oauth2TokenRequest
+
+		if err := json.NewDecoder(r.Body).Decode(&tokenReq); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		s.grants = append(s.grants, tokenReq.GrantType)
+
+		if tokenReq.GrantType == "refresh_token" && (s.rejectRefresh || tokenReq.RefreshToken == "") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		s.issued++
+
+		token := map[string]interface{}{
+			"access_token":  fmt.Sprintf("token%v", s.issued),
+			"refresh_token": fmt.Sprintf("refresh%v", s.issued),
+			"token_type":    "bearer",
+		}
+
+		if s.expiresIn != nil {
+			token["expires_in"] = s.expiresIn
+		}
+
+		_ = json.NewEncoder(w).Encode(token)
+	}))
+
+	return s
+}
+
+// requestedGrants returns the grants requested since the last call
+func (s *tokenServer) requestedGrants() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	grants := s.grants
+	s.grants = nil
+
+	return grants
+}
+
+// authorize returns the bearer token set on a request along with the grants it requested
+func authorize(t *testing.T, o *OAuth2Authenticator, server *tokenServer) (string, []string) {
+
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodGet, "/versa/analytics", nil)
+
+	if _, err := o.Authorize(req); err != nil {
+		t.Fatalf("Authorize() failed with error %v", err)
+	}
+
+	return req.Header.Get("Authorization"), server.requestedGrants()
+}
+
+func testOAuth2Authenticator(server *tokenServer) (*OAuth2Authenticator, *time.Time) {
+
+	now := time.Date(2020, 3, 2, 10, 0, 0, 0, time.UTC)
+
+	o := NewOAuth2Authenticator(server.Client(), server.URL, "peppamon", "secret", "admin", "password")
+	o.clock = func() time.Time { return now }
+
+	return o, &now
+}
+
+func TestOAuth2TokenRefresh(t *testing.T) {
+
+	tests := []struct {
+		name      string
+		expiresIn interface{}
+
+		// cachedFor is how long the token is used before being refreshed
+		cachedFor time.Duration
+	}{
+		{name: "number", expiresIn: 3600, cachedFor: 59 * time.Minute},
+		{name: "quoted number", expiresIn: "3600", cachedFor: 59 * time.Minute},
+		{name: "missing expires_in", cachedFor: oauth2DefaultLifetime - oauth2RefreshMargin},
+		{name: "zero expires_in", expiresIn: 0, cachedFor: oauth2DefaultLifetime - oauth2RefreshMargin},
+		{name: "lifetime shorter than the refresh margin", expiresIn: 30, cachedFor: 15 * time.Second},
+	}
+
+	for _, tt := range tests {
+
+		t.Run(tt.name, func(t *testing.T) {
+
+			server := newTokenServer(tt.expiresIn)
+			defer server.Close()
+
+			o, now := testOAuth2Authenticator(server)
+
+			token, grants := authorize(t, o, server)
+
+			if token != "Bearer token1" || len(grants) != 1 || grants[0] != "password" {
+				t.Fatalf("got token %q with grants %v, want token1 from the password grant", token, grants)
+			}
+
+			*now = now.Add(tt.cachedFor - time.Second)
+
+			if token, grants = authorize(t, o, server); token != "Bearer token1" || len(grants) != 0 {
+				t.Fatalf("got token %q with grants %v before the refresh time, want the cached token1", token, grants)
+			}
+
+			*now = now.Add(time.Second)
+
+			if token, grants = authorize(t, o, server); token != "Bearer token2" || len(grants) != 1 || grants[0] != "refresh_token" {
+				t.Fatalf("got token %q with grants %v at the refresh time, want token2 from the refresh grant", token, grants)
+			}
+		})
+	}
+}
+
+func TestOAuth2RefreshFallback(t *testing.T) {
+
+	server := newTokenServer(120)
+	defer server.Close()
+
+	o, now := testOAuth2Authenticator(server)
+
+	authorize(t, o, server)
+
+	server.mu.Lock()
+	server.rejectRefresh = true
+	server.mu.Unlock()
+
+	*now = now.Add(time.Minute)
+
+	token, grants := authorize(t, o, server)
+
+	if token != "Bearer token2" || len(grants) != 2 || grants[0] != "refresh_token" || grants[1] != "password" {
+		t.Fatalf("got token %q with grants %v, want token2 from the password grant once the refresh grant failed",
+			token, grants)
+	}
+}
+
+func TestOAuth2Renew(t *testing.T) {
+
+	server := newTokenServer(3600)
+	defer server.Close()
+
+	o, _ := testOAuth2Authenticator(server)
+
+	req := httptest.NewRequest(http.MethodGet, "/versa/analytics", nil)
+
+	expired, err := o.Authorize(req)
+
+	if err != nil {
+		t.Fatalf("Authorize() failed with error %v", err)
+	}
+
+	server.requestedGrants()
+
+	// The token rejected with a 401 is refreshed once, the other requests holding it reuse the new one
+	for i := 0; i < 2; i++ {
+		if err := o.Renew(req.Context(), expired); err != nil {
+			t.Fatalf("Renew() failed with error %v", err)
+		}
+	}
+
+	if grants := server.requestedGrants(); len(grants) != 1 || grants[0] != "refresh_token" {
+		t.Fatalf("got grants %v, want a single refresh grant", grants)
+	}
+
+	if token, _ := authorize(t, o, server); token != "Bearer token2" {
+		t.Fatalf("got token %q after the renewal, want token2", token)
+	}
+}
+
+func TestOAuth2InvalidExpiry(t *testing.T) {
+
+	for _, expiresIn := range []interface{}{"soon", -1} {
+
+		server := newTokenServer(expiresIn)
+
+		o, _ := testOAuth2Authenticator(server)
+
+		if _, err := o.Authorize(httptest.NewRequest(http.MethodGet, "/versa/analytics", nil)); err == nil {
+			t.Errorf("Authorize() accepted expires_in %v", expiresIn)
+		}
+
+		server.Close()
+	}
+}
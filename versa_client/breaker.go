@@ -0,0 +1,288 @@
+package versa_client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/lucabrasi83/peppamon_versa/logging"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// BreakerState is the state of a circuit breaker as exported in the breaker state metric
+type BreakerState int
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// ErrCircuitOpen is wrapped in the errors of the queries skipped while the circuit breaker of their report is open
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// circuitBreaker stops sending a report after consecutive failures until its cool-down is over.
+// A single probe request is then let through to decide whether to close it again
+type circuitBreaker struct {
+	mu       sync.Mutex
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// OpenCircuit is a report, or a report of a tenant, skipped until its cool-down is over
+type OpenCircuit struct {
+	Report string
+	Tenant string
+	Until  time.Time
+}
+
+type breakerKey struct {
+	report, tenant string
+}
+
+// Breakers holds the circuit breakers of every report, or of every report and tenant. The breakers of a
+// report shared by every tenant only count the failures that are not specific to a tenant
+type Breakers struct {
+	// Threshold is the number of consecutive failures opening a breaker, breakers are disabled when zero
+	Threshold int
+	Cooldown  time.Duration
+	PerTenant bool
+
+	mu       sync.Mutex
+	breakers map[breakerKey]*circuitBreaker
+	state    *prometheus.GaugeVec
+
+	// clock returns the current time, time.Now when nil
+	clock func() time.Time
+}
+
+// BreakerSettings configures the circuit breakers of the reports, which are disabled when Threshold is zero
+type BreakerSettings struct {
+	Threshold int
+	Cooldown  time.Duration
+	PerTenant bool
+}
+
+// breakerSettingsFromEnv loads PEPPAMON_VERSA_BREAKER_FAILURES, PEPPAMON_VERSA_BREAKER_COOLDOWN and PEPPAMON_VERSA_BREAKER_PER_TENANT
+func breakerSettingsFromEnv(env Env) BreakerSettings {
+
+	settings := BreakerSettings{
+		Threshold: env.Int("PEPPAMON_VERSA_BREAKER_FAILURES", 5),
+		Cooldown:  env.Duration("PEPPAMON_VERSA_BREAKER_COOLDOWN", 5*time.Minute),
+		PerTenant: env.Bool("PEPPAMON_VERSA_BREAKER_PER_TENANT", false),
+	}
+
+	if settings.Threshold < 0 || settings.Cooldown <= 0 {
+		logging.PeppaMonLog("fatal", "Invalid Versa Analytics circuit breaker settings %+v", settings)
+	}
+
+	return settings
+}
+
+func newBreakers(settings BreakerSettings, state *prometheus.GaugeVec) *Breakers {
+	return &Breakers{
+		Threshold: settings.Threshold,
+		Cooldown:  settings.Cooldown,
+		PerTenant: settings.PerTenant,
+		breakers:  make(map[breakerKey]*circuitBreaker),
+		state:     state,
+	}
+}
+
+func (b *Breakers) now() time.Time {
+	if b.clock == nil {
+		return time.Now()
+	}
+	return b.clock()
+}
+
+// reportWideFailure reports whether the failure is likely to affect every tenant of the report: Versa
+// Analytics being unreachable, timing out or answering with a server error. A missing tenant, a response
+// that could not be decoded or rejected credentials are specific to the tenant
+func reportWideFailure(err error) bool {
+
+	var clientErr *Error
+
+	if errors.As(err, &clientErr) && clientErr.Kind == ErrorKindHTTPStatus {
+		return clientErr.StatusCode >= http.StatusInternalServerError
+	}
+
+	switch ErrorKindOf(err) {
+	case ErrorKindTransport, ErrorKindProxy, ErrorKindTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+func (b *Breakers) key(report, tenant string) breakerKey {
+	if !b.PerTenant {
+		tenant = ""
+	}
+	return breakerKey{report: report, tenant: tenant}
+}
+
+func (b *Breakers) get(key breakerKey) *circuitBreaker {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	breaker, ok := b.breakers[key]
+
+	if !ok {
+		breaker = &circuitBreaker{}
+		b.breakers[key] = breaker
+		b.state.WithLabelValues(key.report, key.tenant).Set(float64(BreakerClosed))
+	}
+
+	return breaker
+}
+
+// setState must be called with the breaker lock held
+func (b *Breakers) setState(key breakerKey, breaker *circuitBreaker, state BreakerState) {
+
+	if breaker.state == state {
+		return
+	}
+
+	breaker.state = state
+	b.state.WithLabelValues(key.report, key.tenant).Set(float64(state))
+
+	logging.PeppaMonLog("warning", "Circuit breaker of report %v%v is now %v", key.report, tenantSuffix(key.tenant), state)
+}
+
+func tenantSuffix(tenant string) string {
+	if tenant == "" {
+		return ""
+	}
+	return " for tenant " + tenant
+}
+
+// Allow reports whether a query of the report may be sent for the tenant
+func (b *Breakers) Allow(report, tenant string) bool {
+
+	if b == nil || b.Threshold == 0 {
+		return true
+	}
+
+	key := b.key(report, tenant)
+	breaker := b.get(key)
+
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+
+	switch breaker.state {
+	case BreakerOpen:
+		if b.now().Sub(breaker.openedAt) < b.Cooldown {
+			return false
+		}
+
+		b.setState(key, breaker, BreakerHalfOpen)
+		breaker.probing = true
+
+		return true
+
+	case BreakerHalfOpen:
+		// Only the probe goes through until it completes
+		if breaker.probing {
+			return false
+		}
+
+		breaker.probing = true
+
+		return true
+
+	default:
+		return true
+	}
+}
+
+// Record updates the breaker with the outcome of a query. Queries interrupted because the scrape
+// ended are not held against the report, nor are the failures specific to a tenant when the breaker is
+// shared by every tenant
+func (b *Breakers) Record(ctx context.Context, report, tenant string, err error) {
+
+	if b == nil || b.Threshold == 0 {
+		return
+	}
+
+	key := b.key(report, tenant)
+	breaker := b.get(key)
+
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+
+	wasProbe := breaker.probing
+	breaker.probing = false
+
+	switch {
+	case err != nil && ctx.Err() != nil:
+		return
+
+	case err != nil && !b.PerTenant && !reportWideFailure(err):
+		return
+
+	case err == nil:
+		breaker.failures = 0
+		b.setState(key, breaker, BreakerClosed)
+
+	default:
+		breaker.failures++
+
+		if wasProbe || breaker.failures >= b.Threshold {
+			breaker.openedAt = b.now()
+			b.setState(key, breaker, BreakerOpen)
+		}
+	}
+}
+
+// OpenCircuits lists the breakers currently open
+func (b *Breakers) OpenCircuits() []OpenCircuit {
+
+	if b == nil {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var open []OpenCircuit
+
+	for key, breaker := range b.breakers {
+
+		breaker.mu.Lock()
+
+		until := breaker.openedAt.Add(b.Cooldown)
+
+		if breaker.state == BreakerOpen && b.now().Before(until) {
+			open = append(open, OpenCircuit{Report: key.report, Tenant: key.tenant, Until: until})
+		}
+
+		breaker.mu.Unlock()
+	}
+
+	sort.Slice(open, func(i, j int) bool {
+		if open[i].Report != open[j].Report {
+			return open[i].Report < open[j].Report
+		}
+		return open[i].Tenant < open[j].Tenant
+	})
+
+	return open
+}
@@ -0,0 +1,178 @@
+package versa_client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// testBreakers returns breakers opening after 3 failures for a minute along with their clock
+func testBreakers(perTenant bool) (*Breakers, *time.Time) {
+
+	now := time.Date(2020, 3, 2, 10, 0, 0, 0, time.UTC)
+
+	state := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "test_breaker_state"}, []string{"report", "tenant"})
+
+	breakers := newBreakers(BreakerSettings{Threshold: 3, Cooldown: time.Minute, PerTenant: perTenant}, state)
+	breakers.clock = func() time.Time { return now }
+
+	return breakers, &now
+}
+
+func expectState(t *testing.T, b *Breakers, report, tenant string, want BreakerState) {
+
+	t.Helper()
+
+	if got := BreakerState(testutil.ToFloat64(b.state.WithLabelValues(report, tenant))); got != want {
+		t.Fatalf("breaker of report %v%v is %v, want %v", report, tenantSuffix(tenant), got, want)
+	}
+}
+
+func statusError(code int) error {
+	return &Error{Kind: ErrorKindHTTPStatus, StatusCode: code, Err: fmt.Errorf("unexpected status code %v", code)}
+}
+
+func TestBreakerStateMachine(t *testing.T) {
+
+	ctx := context.Background()
+	b, now := testBreakers(false)
+
+	failure := statusError(http.StatusServiceUnavailable)
+
+	// Closed: queries go through until the threshold of consecutive failures, a success resetting the count
+	for i := 0; i < 2; i++ {
+		if !b.Allow(ReportSiteCircuitUsage, "acme") {
+			t.Fatal("Allow() got false for a closed breaker")
+		}
+		b.Record(ctx, ReportSiteCircuitUsage, "acme", failure)
+	}
+
+	b.Record(ctx, ReportSiteCircuitUsage, "acme", nil)
+
+	for i := 0; i < 2; i++ {
+		b.Record(ctx, ReportSiteCircuitUsage, "acme", failure)
+	}
+
+	expectState(t, b, ReportSiteCircuitUsage, "", BreakerClosed)
+
+	// Open: the third consecutive failure opens the breaker of the report for every tenant
+	b.Record(ctx, ReportSiteCircuitUsage, "acme", failure)
+
+	expectState(t, b, ReportSiteCircuitUsage, "", BreakerOpen)
+
+	if b.Allow(ReportSiteCircuitUsage, "globex") {
+		t.Fatal("Allow() got true for an open breaker")
+	}
+
+	if open := b.OpenCircuits(); len(open) != 1 || !open[0].Until.Equal(now.Add(time.Minute)) {
+		t.Fatalf("OpenCircuits() got %+v, want the circuit usage report until the end of the cool-down", open)
+	}
+
+	*now = now.Add(59 * time.Second)
+
+	if b.Allow(ReportSiteCircuitUsage, "acme") {
+		t.Fatal("Allow() got true before the end of the cool-down")
+	}
+
+	// Half-open: a single probe goes through once the cool-down is over, its failure opening the breaker again
+	*now = now.Add(time.Second)
+
+	if !b.Allow(ReportSiteCircuitUsage, "acme") {
+		t.Fatal("Allow() got false for the probe once the cool-down is over")
+	}
+
+	expectState(t, b, ReportSiteCircuitUsage, "", BreakerHalfOpen)
+
+	if b.Allow(ReportSiteCircuitUsage, "globex") {
+		t.Fatal("Allow() got true for a second query while the probe is in flight")
+	}
+
+	b.Record(ctx, ReportSiteCircuitUsage, "acme", failure)
+
+	expectState(t, b, ReportSiteCircuitUsage, "", BreakerOpen)
+
+	if b.Allow(ReportSiteCircuitUsage, "acme") {
+		t.Fatal("Allow() got true right after the probe failed")
+	}
+
+	// Closed again once a probe succeeds
+	*now = now.Add(time.Minute)
+
+	if !b.Allow(ReportSiteCircuitUsage, "globex") {
+		t.Fatal("Allow() got false for the probe once the cool-down is over")
+	}
+
+	b.Record(ctx, ReportSiteCircuitUsage, "globex", nil)
+
+	expectState(t, b, ReportSiteCircuitUsage, "", BreakerClosed)
+
+	if !b.Allow(ReportSiteCircuitUsage, "acme") || !b.Allow(ReportSiteCircuitUsage, "globex") {
+		t.Fatal("Allow() got false once the breaker closed")
+	}
+
+	if open := b.OpenCircuits(); len(open) != 0 {
+		t.Fatalf("OpenCircuits() got %+v once the breaker closed", open)
+	}
+}
+
+func TestBreakerFailureKinds(t *testing.T) {
+
+	tests := []struct {
+		name      string
+		err       error
+		perTenant bool
+		wantOpen  bool
+	}{
+		{name: "server error", err: statusError(http.StatusInternalServerError), wantOpen: true},
+		{name: "transport error", err: &Error{Kind: ErrorKindTransport, Err: fmt.Errorf("connection refused")}, wantOpen: true},
+		{name: "timeout", err: &Error{Kind: ErrorKindTimeout, Err: context.DeadlineExceeded}, wantOpen: true},
+		{name: "proxy error", err: &Error{Kind: ErrorKindProxy, Err: fmt.Errorf("bad gateway")}, wantOpen: true},
+		{name: "missing tenant", err: statusError(http.StatusNotFound)},
+		{name: "decode error", err: &Error{Kind: ErrorKindDecode, Err: fmt.Errorf("unexpected EOF")}},
+		{name: "rejected credentials", err: &Error{Kind: ErrorKindAuth, StatusCode: http.StatusForbidden, Err: fmt.Errorf("forbidden")}},
+		{name: "missing tenant per tenant", err: statusError(http.StatusNotFound), perTenant: true, wantOpen: true},
+		{name: "decode error per tenant", err: &Error{Kind: ErrorKindDecode, Err: fmt.Errorf("unexpected EOF")}, perTenant: true, wantOpen: true},
+	}
+
+	for _, tt := range tests {
+
+		t.Run(tt.name, func(t *testing.T) {
+
+			b, _ := testBreakers(tt.perTenant)
+
+			for i := 0; i < 3; i++ {
+				b.Record(context.Background(), ReportSiteSLAMetrics, "acme", tt.err)
+			}
+
+			if open := !b.Allow(ReportSiteSLAMetrics, "acme"); open != tt.wantOpen {
+				t.Fatalf("got breaker open %v for tenant acme, want %v", open, tt.wantOpen)
+			}
+
+			// The other tenants are only skipped when the failures affect the whole report
+			if open := !b.Allow(ReportSiteSLAMetrics, "globex"); open != (tt.wantOpen && !tt.perTenant) {
+				t.Fatalf("got breaker open %v for tenant globex, want %v", open, tt.wantOpen && !tt.perTenant)
+			}
+		})
+	}
+}
+
+func TestBreakerIgnoresInterruptedQueries(t *testing.T) {
+
+	b, _ := testBreakers(false)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	for i := 0; i < 3; i++ {
+		b.Record(ctx, ReportSiteSLAMetrics, "acme", &Error{Kind: ErrorKindTimeout, Err: ctx.Err()})
+	}
+
+	if !b.Allow(ReportSiteSLAMetrics, "acme") {
+		t.Fatal("Allow() got false after queries interrupted by the end of the scrape")
+	}
+}
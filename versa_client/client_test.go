@@ -0,0 +1,585 @@
+package versa_client_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lucabrasi83/peppamon_versa/versa_client"
+	"github.com/lucabrasi83/peppamon_versa/versatest"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func testTenant(name string, apps int) versatest.Tenant {
+
+	site := versatest.Site{
+		Name:         name + "-branch1",
+		Availability: 100,
+		Circuits:     []versatest.Circuit{{Name: "MPLS", RxBps: 1000, TxBps: 500}},
+	}
+
+	for i := 0; i < apps; i++ {
+		site.Apps = append(site.Apps, versatest.App{
+			Name:     fmt.Sprintf("app%v", i),
+			ClientIP: "10.0.0.1",
+			Circuit:  "MPLS",
+			RxBps:    float64(i),
+			TxBps:    float64(i),
+		})
+	}
+
+	return versatest.Tenant{Name: name, Sites: []versatest.Site{site}}
+}
+
+func newTestClient(t *testing.T, server *versatest.Server, settings versa_client.Settings) *versa_client.VersaAnalyticsClient {
+
+	client, err := versa_client.NewClient(settings)
+
+	if err != nil {
+		t.Fatalf("NewClient() failed with error %v", err)
+	}
+
+	if err := client.GetTenantList(context.Background()); err != nil {
+		client.Close()
+		t.Fatalf("GetTenantList() failed with error %v", err)
+	}
+
+	return client
+}
+
+func TestLoginAndSessionExpiry(t *testing.T) {
+	t.Parallel()
+
+	server := versatest.NewServer(testTenant("acme", 1))
+	server.Username, server.Password = "admin", "secret"
+	defer server.Close()
+
+	client := newTestClient(t, server, server.ClientSettings())
+	defer client.Close()
+
+	if logins := server.Requests("login"); logins != 1 {
+		t.Fatalf("got %v logins, want 1", logins)
+	}
+
+	server.ExpireSessions()
+
+	results, err := client.GetSitesCircuitBandwidthUsage(context.Background(), 0)
+
+	if err != nil {
+		t.Fatalf("GetSitesCircuitBandwidthUsage() after the session expired failed with error %v", err)
+	}
+
+	if len(results) != 1 || len(results[0].Series) != 2 {
+		t.Fatalf("got %+v, want the rx and tx series of a single circuit", results)
+	}
+
+	if logins := server.Requests("login"); logins != 2 {
+		t.Fatalf("got %v logins after the session expired, want 2", logins)
+	}
+}
+
+func TestWrongCredentials(t *testing.T) {
+	t.Parallel()
+
+	server := versatest.NewServer(testTenant("acme", 1))
+	server.Username, server.Password = "admin", "secret"
+	defer server.Close()
+
+	settings := server.ClientSettings()
+	settings.Auth.Password = "wrong"
+
+	client, err := versa_client.NewClient(settings)
+
+	if err != nil {
+		t.Fatalf("NewClient() failed with error %v", err)
+	}
+	defer client.Close()
+
+	err = client.GetTenantList(context.Background())
+
+	if kind := versa_client.ErrorKindOf(err); kind != versa_client.ErrorKindAuth {
+		t.Fatalf("got error %v of kind %v, want %v", err, kind, versa_client.ErrorKindAuth)
+	}
+}
+
+func TestTenantFault(t *testing.T) {
+	t.Parallel()
+
+	server := versatest.NewServer(testTenant("acme", 1), testTenant("globex", 1))
+	defer server.Close()
+
+	server.Inject(versatest.Fault{Tenant: "acme", Query: "linkUsage", StatusCode: http.StatusInternalServerError})
+
+	client := newTestClient(t, server, server.ClientSettings())
+	defer client.Close()
+
+	results, err := client.GetSitesCircuitBandwidthUsage(context.Background(), 0)
+
+	if len(results) != 1 || results[0].TenantName != "globex" {
+		t.Fatalf("got %+v, want the results of globex only", results)
+	}
+
+	failures := versa_client.AsTenantErrors(err)
+
+	if len(failures) != 1 {
+		t.Fatalf("got failures %v, want a single failure for acme", failures)
+	}
+
+	var clientErr *versa_client.Error
+
+	if !errors.As(failures["acme"], &clientErr) || clientErr.Kind != versa_client.ErrorKindHTTPStatus ||
+		clientErr.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("got acme failure %v, want an HTTP status 500 error", failures["acme"])
+	}
+}
+
+func TestRetry(t *testing.T) {
+	t.Parallel()
+
+	server := versatest.NewServer(testTenant("acme", 1))
+	defer server.Close()
+
+	server.Inject(versatest.Fault{Query: "linkUsage", StatusCode: http.StatusServiceUnavailable, RetryAfter: "0", Times: 2})
+
+	client := newTestClient(t, server, server.ClientSettings())
+	defer client.Close()
+
+	results, err := client.GetSitesCircuitBandwidthUsage(context.Background(), 0)
+
+	if err != nil || len(results) != 1 {
+		t.Fatalf("got %+v with error %v, want the results once the retries succeed", results, err)
+	}
+
+	if requests := server.Requests("linkUsage"); requests != 3 {
+		t.Fatalf("got %v linkUsage requests, want 3", requests)
+	}
+}
+
+func TestRetryExhausted(t *testing.T) {
+	t.Parallel()
+
+	server := versatest.NewServer(testTenant("acme", 1))
+	defer server.Close()
+
+	server.Inject(versatest.Fault{Query: "linkUsage", StatusCode: http.StatusServiceUnavailable})
+
+	client := newTestClient(t, server, server.ClientSettings())
+	defer client.Close()
+
+	_, err := client.GetSitesCircuitBandwidthUsage(context.Background(), 0)
+
+	if kind := versa_client.ErrorKindOf(versa_client.AsTenantErrors(err)["acme"]); kind != versa_client.ErrorKindHTTPStatus {
+		t.Fatalf("got error %v of kind %v, want %v", err, kind, versa_client.ErrorKindHTTPStatus)
+	}
+
+	if requests := server.Requests("linkUsage"); requests != 3 {
+		t.Fatalf("got %v linkUsage requests, want the 3 attempts of the retry policy", requests)
+	}
+}
+
+func TestPagination(t *testing.T) {
+	t.Parallel()
+
+	server := versatest.NewServer(testTenant("acme", 25))
+	defer server.Close()
+
+	client := newTestClient(t, server, server.ClientSettings())
+	defer client.Close()
+
+	q := versa_client.Query{
+		Report:     versa_client.ReportApplicationUsageRate,
+		Title:      "Get Application Usage Rate",
+		Feature:    "SDWAN",
+		Expression: versa_client.QueryExpression{Name: "appUser", GroupBy: []string{"site", "appId", "user", "accCkt"}},
+		Type:       versa_client.QueryTypeTimeseries,
+		Metrics:    []string{"bw-rx", "bw-tx"},
+		Gap:        "1MINUTE",
+		DataSource: "aggregate",
+		Count:      10,
+	}
+
+	apps := make(map[string]bool)
+
+	_, err := client.StreamTimeseries(context.Background(), "acme", client.BuildQuery(q), func(series versa_client.TimeseriesSeries) {
+		if _, ok := series.LatestValue(); !ok {
+			t.Errorf("series %v has no point within the query window", series.Name)
+		}
+		apps[series.Key("appId")] = true
+	})
+
+	if err != nil {
+		t.Fatalf("StreamTimeseries() failed with error %v", err)
+	}
+
+	if len(apps) != 25 {
+		t.Fatalf("got %v applications, want the 25 of every page", len(apps))
+	}
+
+	if requests := server.Requests("appUser"); requests != 3 {
+		t.Fatalf("got %v appUser requests, want 3 pages of 10 rows", requests)
+	}
+}
+
+func TestMalformedResponse(t *testing.T) {
+	t.Parallel()
+
+	server := versatest.NewServer(testTenant("acme", 1))
+	defer server.Close()
+
+	server.Inject(versatest.Fault{Query: "linkUsage", Malformed: true})
+
+	client := newTestClient(t, server, server.ClientSettings())
+	defer client.Close()
+
+	_, err := client.GetSitesCircuitBandwidthUsage(context.Background(), 0)
+
+	if kind := versa_client.ErrorKindOf(versa_client.AsTenantErrors(err)["acme"]); kind != versa_client.ErrorKindDecode {
+		t.Fatalf("got error %v of kind %v, want %v", err, kind, versa_client.ErrorKindDecode)
+	}
+}
+
+func TestNodeFailover(t *testing.T) {
+	t.Parallel()
+
+	primary := versatest.NewServer(testTenant("acme", 1))
+	defer primary.Close()
+
+	secondary := versatest.NewServer(testTenant("acme", 1))
+	defer secondary.Close()
+
+	// Both servers share the certificate of httptest, health checks are disabled
+	settings := primary.ClientSettings()
+	settings.Hostnames = []string{primary.Hostname(), secondary.Hostname()}
+	settings.NodeStrategy = versa_client.NodeStrategyRoundRobin
+	settings.NodeRetryInterval = 200 * time.Millisecond
+
+	client := newTestClient(t, primary, settings)
+	defer client.Close()
+
+	primary.Inject(versatest.Fault{Query: "linkUsage", Disconnect: true})
+
+	// Queries alternate between the nodes, the one sent to the primary failing over to the secondary
+	for i := 0; i < 2; i++ {
+		if _, err := client.GetSitesCircuitBandwidthUsage(context.Background(), 0); err != nil {
+			t.Fatalf("GetSitesCircuitBandwidthUsage() failed with error %v", err)
+		}
+	}
+
+	if client.Nodes.Nodes[0].Healthy() {
+		t.Fatal("the primary node is still healthy after dropping the connection")
+	}
+
+	primary.ClearFaults()
+
+	sent := primary.Requests("linkUsage")
+
+	for i := 0; i < 2; i++ {
+		if _, err := client.GetSitesCircuitBandwidthUsage(context.Background(), 0); err != nil {
+			t.Fatalf("GetSitesCircuitBandwidthUsage() failed with error %v", err)
+		}
+	}
+
+	if requests := primary.Requests("linkUsage"); requests != sent {
+		t.Fatalf("got %v queries sent to the primary node within its retry interval, want none", requests-sent)
+	}
+
+	// Once the retry interval is over, a query tries the primary node again and brings it back up
+	time.Sleep(settings.NodeRetryInterval)
+
+	for i := 0; i < 2; i++ {
+		if _, err := client.GetSitesCircuitBandwidthUsage(context.Background(), 0); err != nil {
+			t.Fatalf("GetSitesCircuitBandwidthUsage() failed with error %v", err)
+		}
+	}
+
+	if requests := primary.Requests("linkUsage"); requests == sent {
+		t.Fatal("got no query sent to the primary node once its retry interval was over")
+	}
+
+	if !client.Nodes.Nodes[0].Healthy() {
+		t.Fatal("the primary node is still down after answering a query")
+	}
+}
+
+func TestPaginationCeiling(t *testing.T) {
+	t.Parallel()
+
+	server := versatest.NewServer(testTenant("acme", 25))
+	defer server.Close()
+
+	settings := server.ClientSettings()
+	settings.MaxRows = 20
+
+	client := newTestClient(t, server, settings)
+	defer client.Close()
+
+	q := versa_client.Query{
+		Report:     versa_client.ReportApplicationUsageRate,
+		Title:      "Get Application Usage Rate",
+		Feature:    "SDWAN",
+		Expression: versa_client.QueryExpression{Name: "appUser", GroupBy: []string{"site", "appId", "user", "accCkt"}},
+		Type:       versa_client.QueryTypeTimeseries,
+		Metrics:    []string{"bw-rx", "bw-tx"},
+		Gap:        "1MINUTE",
+		Count:      10,
+	}
+
+	series := 0
+
+	_, err := client.StreamTimeseries(context.Background(), "acme", client.BuildQuery(q), func(versa_client.TimeseriesSeries) {
+		series++
+	})
+
+	if err != nil {
+		t.Fatalf("StreamTimeseries() failed with error %v", err)
+	}
+
+	// Pages hold 10 rows of a rx and a tx series each, paging stops once the 20 rows ceiling is reached
+	if requests := server.Requests("appUser"); requests != 2 || series != 40 {
+		t.Fatalf("got %v series over %v appUser requests, want 40 series over 2 pages", series, requests)
+	}
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(client)
+
+	expected := `
+# HELP versa_analytics_exporter_pagination_ceiling_reached_total The number of Versa Analytics results left incomplete as paging reached the rows ceiling
+# TYPE versa_analytics_exporter_pagination_ceiling_reached_total counter
+versa_analytics_exporter_pagination_ceiling_reached_total{report="application_usage_rate"} 1
+`
+
+	err = testutil.GatherAndCompare(registry, strings.NewReader(expected),
+		"versa_analytics_exporter_pagination_ceiling_reached_total")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewClientRejectsInvalidMaxRows(t *testing.T) {
+	t.Parallel()
+
+	server := versatest.NewServer()
+	defer server.Close()
+
+	for _, maxRows := range []int{0, -1} {
+
+		settings := server.ClientSettings()
+		settings.MaxRows = maxRows
+
+		if client, err := versa_client.NewClient(settings); err == nil {
+			client.Close()
+			t.Errorf("NewClient() accepted a pagination ceiling of %v rows", maxRows)
+		}
+	}
+}
+
+func TestReplayedFixtures(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "versa-fixtures")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	server := versatest.NewServer(testTenant("acme", 1))
+	defer server.Close()
+
+	// The fixtures are recorded for the window of an hour ago, which the current time no longer covers
+	recordedAt := time.Now().Add(-time.Hour)
+
+	settings := server.ClientSettings()
+	settings.Fixtures = versa_client.FixtureSettings{Mode: versa_client.FixtureModeRecord, Dir: dir}
+	settings.Clock = func() time.Time { return recordedAt }
+
+	recorder := newTestClient(t, server, settings)
+
+	_, err = recorder.GetSitesCircuitBandwidthUsage(context.Background(), 0)
+	recorder.Close()
+
+	if err != nil {
+		t.Fatalf("GetSitesCircuitBandwidthUsage() failed while recording with error %v", err)
+	}
+
+	settings.Fixtures.Mode = versa_client.FixtureModeReplay
+	settings.Clock = nil
+
+	replayer := newTestClient(t, server, settings)
+	defer replayer.Close()
+
+	if now := replayer.Clock(); !now.Equal(recordedAt) {
+		t.Fatalf("got a replay clock at %v, want the recording time %v", now, recordedAt)
+	}
+
+	results, err := replayer.GetSitesCircuitBandwidthUsage(context.Background(), 0)
+
+	if err != nil || len(results) != 1 || len(results[0].Series) != 2 {
+		t.Fatalf("got %+v with error %v, want the recorded rx and tx series", results, err)
+	}
+
+	for _, series := range results[0].Series {
+		if _, ok := series.LatestValue(); !ok {
+			t.Errorf("replayed series %v %v has no point", series.Name, series.Metric)
+		}
+	}
+}
+
+func TestReportAfterClose(t *testing.T) {
+	t.Parallel()
+
+	server := versatest.NewServer(testTenant("acme", 1), testTenant("globex", 1))
+	defer server.Close()
+
+	client := newTestClient(t, server, server.ClientSettings())
+	client.Close()
+
+	done := make(chan error, 1)
+
+	go func() {
+		_, err := client.GetSitesCircuitBandwidthUsage(context.Background(), 0)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		failures := versa_client.AsTenantErrors(err)
+
+		for _, tenant := range []string{"acme", "globex"} {
+			if !errors.Is(failures[tenant], versa_client.ErrPoolClosed) {
+				t.Errorf("got error %v for tenant %v, want %v", failures[tenant], tenant, versa_client.ErrPoolClosed)
+			}
+		}
+
+	case <-time.After(5 * time.Second):
+		t.Fatal("GetSitesCircuitBandwidthUsage() blocked on a closed client")
+	}
+
+	if requests := server.Requests("linkUsage"); requests != 0 {
+		t.Fatalf("got %v linkUsage requests from a closed client, want none", requests)
+	}
+}
+
+func TestClose(t *testing.T) {
+	t.Parallel()
+
+	server := versatest.NewServer(testTenant("acme", 1))
+	defer server.Close()
+
+	settings := server.ClientSettings()
+	settings.HealthCheckInterval = time.Millisecond
+	settings.TenantCacheTTL = 2 * time.Millisecond
+
+	client := newTestClient(t, server, settings)
+
+	done := make(chan struct{})
+
+	go func() {
+		client.Close()
+		client.Close()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close() did not stop the background goroutines")
+	}
+}
+
+func TestTenantCache(t *testing.T) {
+	t.Parallel()
+
+	server := versatest.NewServer(testTenant("acme", 1))
+	defer server.Close()
+
+	var mu sync.Mutex
+	now := time.Date(2020, 3, 2, 10, 0, 0, 0, time.UTC)
+
+	advance := func(d time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		now = now.Add(d)
+	}
+
+	settings := server.ClientSettings()
+	settings.TenantCacheTTL = time.Hour
+	settings.Clock = func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return now
+	}
+
+	client := newTestClient(t, server, settings)
+	defer client.Close()
+
+	tenantNames := func() string {
+		var names []string
+
+		for _, tenant := range client.Tenants {
+			names = append(names, tenant.TenantName)
+		}
+
+		return strings.Join(names, ",")
+	}
+
+	server.SetTenants(testTenant("acme", 1), testTenant("globex", 1))
+
+	// The tenants are reused until the cache expires
+	advance(59 * time.Minute)
+
+	if err := client.GetTenantList(context.Background()); err != nil {
+		t.Fatalf("GetTenantList() failed with error %v", err)
+	}
+
+	if requests := server.Requests("tenants"); requests != 1 || tenantNames() != "acme" {
+		t.Fatalf("got tenants %v after %v requests, want the cached acme after 1", tenantNames(), requests)
+	}
+
+	advance(2 * time.Minute)
+
+	if err := client.GetTenantList(context.Background()); err != nil {
+		t.Fatalf("GetTenantList() failed with error %v", err)
+	}
+
+	if requests := server.Requests("tenants"); requests != 2 || tenantNames() != "acme,globex" {
+		t.Fatalf("got tenants %v after %v requests, want acme and globex rediscovered", tenantNames(), requests)
+	}
+
+	// A failed rediscovery is reported and keeps the tenants previously discovered
+	server.Inject(versatest.Fault{Query: "tenants", StatusCode: http.StatusInternalServerError})
+	advance(2 * time.Hour)
+
+	err := client.GetTenantList(context.Background())
+
+	if kind := versa_client.ErrorKindOf(err); kind != versa_client.ErrorKindHTTPStatus {
+		t.Fatalf("GetTenantList() got error %v of kind %v, want a %v error", err, kind, versa_client.ErrorKindHTTPStatus)
+	}
+
+	if tenantNames() != "acme,globex" {
+		t.Fatalf("got tenants %v after the failed rediscovery, want acme and globex", tenantNames())
+	}
+
+	// The failure is not cached, the next call rediscovers the tenants
+	server.ClearFaults()
+	requests := server.Requests("tenants")
+
+	if err := client.GetTenantList(context.Background()); err != nil {
+		t.Fatalf("GetTenantList() failed with error %v once Versa recovered", err)
+	}
+
+	if server.Requests("tenants") != requests+1 {
+		t.Fatalf("got %v requests once Versa recovered, want %v", server.Requests("tenants"), requests+1)
+	}
+}
@@ -0,0 +1,175 @@
+package versa_client
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/lucabrasi83/peppamon_versa/logging"
+)
+
+const envPrefix = "PEPPAMON_VERSA_"
+
+// Env reads the settings of a Versa instance from the environment. Settings of a named
+// instance are read from variables prefixed with PEPPAMON_VERSA_<INSTANCE>_, for example
+// PEPPAMON_VERSA_EMEA_ANALYTICS_HOSTNAME, and fall back to the global PEPPAMON_VERSA_* variables
+type Env struct {
+	Instance string
+}
+
+// instanceName returns the instance name as it appears in variable names
+func instanceName(instance string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToUpper(r)
+		}
+		return '_'
+	}, instance)
+}
+
+// instanceKey returns the name of the variable overriding key for the instance
+func (e Env) instanceKey(key string) string {
+	return envPrefix + instanceName(e.Instance) + "_" + strings.TrimPrefix(key, envPrefix)
+}
+
+// lookup returns the instance specific value of the variable, or the global one when the instance
+// does not set it. An instance variable set to an empty value overrides the global one
+func (e Env) lookup(key string) (string, string) {
+	if e.Instance != "" {
+		instanceKey := e.instanceKey(key)
+
+		if value, ok := os.LookupEnv(instanceKey); ok {
+			return instanceKey, value
+		}
+	}
+
+	return key, os.Getenv(key)
+}
+
+// String returns the environment variable value or fallback when it is not set
+func (e Env) String(key string, fallback string) string {
+	if _, value := e.lookup(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// Bool parses a boolean environment variable and stops the collector if the value is invalid
+func (e Env) Bool(key string, fallback bool) bool {
+	key, value := e.lookup(key)
+
+	if value == "" {
+		return fallback
+	}
+
+	parsed, err := strconv.ParseBool(value)
+
+	if err != nil {
+		logging.PeppaMonLog("fatal", "Invalid boolean %q for environment variable %v", value, key)
+	}
+
+	return parsed
+}
+
+// Int parses an integer environment variable and stops the collector if the value is invalid
+func (e Env) Int(key string, fallback int) int {
+	key, value := e.lookup(key)
+
+	if value == "" {
+		return fallback
+	}
+
+	parsed, err := strconv.Atoi(value)
+
+	if err != nil {
+		logging.PeppaMonLog("fatal", "Invalid integer %q for environment variable %v", value, key)
+	}
+
+	return parsed
+}
+
+// Float parses a decimal environment variable and stops the collector if the value is invalid
+func (e Env) Float(key string, fallback float64) float64 {
+	key, value := e.lookup(key)
+
+	if value == "" {
+		return fallback
+	}
+
+	parsed, err := strconv.ParseFloat(value, 64)
+
+	if err != nil {
+		logging.PeppaMonLog("fatal", "Invalid number %q for environment variable %v", value, key)
+	}
+
+	return parsed
+}
+
+// Duration parses a duration environment variable such as 30s and stops the collector if the value is invalid
+func (e Env) Duration(key string, fallback time.Duration) time.Duration {
+	key, value := e.lookup(key)
+
+	if value == "" {
+		return fallback
+	}
+
+	parsed, err := time.ParseDuration(value)
+
+	if err != nil {
+		logging.PeppaMonLog("fatal", "Invalid duration %q for environment variable %v", value, key)
+	}
+
+	return parsed
+}
+
+// List splits a comma separated environment variable, ignoring empty entries
+func (e Env) List(key string) []string {
+	_, value := e.lookup(key)
+
+	var list []string
+
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+
+	return list
+}
+
+// Instances returns the names of the Versa instances listed in PEPPAMON_VERSA_INSTANCES.
+// A single unnamed instance configured with the global variables is returned when it is not set.
+// The collector is stopped when two instances would read the same variables
+func Instances() []string {
+	instances, err := parseInstances(Env{}.List("PEPPAMON_VERSA_INSTANCES"))
+
+	if err != nil {
+		logging.PeppaMonLog("fatal", "Invalid PEPPAMON_VERSA_INSTANCES with error %v", err)
+	}
+
+	return instances
+}
+
+// parseInstances rejects the instances whose names collide once normalised into variable names
+func parseInstances(instances []string) ([]string, error) {
+	if len(instances) == 0 {
+		return []string{""}, nil
+	}
+
+	seen := make(map[string]string, len(instances))
+
+	for _, instance := range instances {
+		name := instanceName(instance)
+
+		if other, ok := seen[name]; ok {
+			return nil, fmt.Errorf("instances %q and %q both read PEPPAMON_VERSA_%v_* variables", other, instance, name)
+		}
+
+		seen[name] = instance
+	}
+
+	return instances, nil
+}
@@ -0,0 +1,107 @@
+package versa_client
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// setEnv sets the variables, an empty value being set as is, and returns a function restoring them
+func setEnv(vars map[string]string) func() {
+
+	previous := make(map[string]*string, len(vars))
+
+	for key, value := range vars {
+
+		if old, ok := os.LookupEnv(key); ok {
+			previous[key] = &old
+		} else {
+			previous[key] = nil
+		}
+
+		_ = os.Setenv(key, value)
+	}
+
+	return func() {
+		for key, old := range previous {
+			if old == nil {
+				_ = os.Unsetenv(key)
+			} else {
+				_ = os.Setenv(key, *old)
+			}
+		}
+	}
+}
+
+func TestEnvInstanceLookup(t *testing.T) {
+
+	defer setEnv(map[string]string{
+		"PEPPAMON_VERSA_TEST_HOSTNAME":           "global.example.com",
+		"PEPPAMON_VERSA_TEST_TIMEOUT":            "30s",
+		"PEPPAMON_VERSA_TEST_SITES":              "a,b",
+		"PEPPAMON_VERSA_EU_WEST_TEST_HOSTNAME":   "eu.example.com",
+		"PEPPAMON_VERSA_EU_WEST_TEST_TIMEOUT":    "",
+		"PEPPAMON_VERSA_EU_WEST_TEST_SITES":      "",
+		"PEPPAMON_VERSA_EU_WEST_TEST_PAGE_COUNT": "50",
+	})()
+
+	eu := Env{Instance: "eu-west"}
+
+	if got := eu.String("PEPPAMON_VERSA_TEST_HOSTNAME", "default"); got != "eu.example.com" {
+		t.Errorf("String() got %q, want the instance value", got)
+	}
+
+	// An instance variable set to an empty value does not fall back to the global one
+	if got := eu.Duration("PEPPAMON_VERSA_TEST_TIMEOUT", time.Minute); got != time.Minute {
+		t.Errorf("Duration() got %v, want the fallback overriding the global value", got)
+	}
+
+	if got := eu.List("PEPPAMON_VERSA_TEST_SITES"); len(got) != 0 {
+		t.Errorf("List() got %v, want an empty list overriding the global one", got)
+	}
+
+	if got := eu.Int("PEPPAMON_VERSA_TEST_PAGE_COUNT", 10); got != 50 {
+		t.Errorf("Int() got %v, want the instance value", got)
+	}
+
+	// Variables the instance does not set are read from the global ones
+	apac := Env{Instance: "apac"}
+
+	if got := apac.String("PEPPAMON_VERSA_TEST_HOSTNAME", "default"); got != "global.example.com" {
+		t.Errorf("String() got %q, want the global value", got)
+	}
+
+	if got := apac.List("PEPPAMON_VERSA_TEST_SITES"); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Errorf("List() got %v, want the global value", got)
+	}
+
+	if got := apac.Int("PEPPAMON_VERSA_TEST_PAGE_COUNT", 10); got != 10 {
+		t.Errorf("Int() got %v, want the fallback", got)
+	}
+}
+
+func TestParseInstances(t *testing.T) {
+
+	tests := []struct {
+		name      string
+		instances []string
+		want      []string
+		wantErr   bool
+	}{
+		{name: "unset", want: []string{""}},
+		{name: "distinct", instances: []string{"eu", "us-east", "apac"}, want: []string{"eu", "us-east", "apac"}},
+		{name: "case collision", instances: []string{"eu", "EU"}, wantErr: true},
+		{name: "separator collision", instances: []string{"us-east", "us.east"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+
+		got, err := parseInstances(tt.instances)
+
+		if (err != nil) != tt.wantErr || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v: parseInstances(%v) got %v, error %v, want %v, error %v", tt.name, tt.instances, got, err,
+				tt.want, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package versa_client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// ErrorKind classifies the failures of Versa Analytics requests
+type ErrorKind string
+
+const (
+	// ErrorKindAuth is a login failure or credentials rejected by Versa Analytics
+	ErrorKindAuth ErrorKind = "auth"
+
+	// ErrorKindHTTPStatus is a response with an unexpected HTTP status code
+	ErrorKindHTTPStatus ErrorKind = "http_status"
+
+	// ErrorKindTransport is a failure to reach Versa Analytics such as a refused or reset connection
+	ErrorKindTransport ErrorKind = "transport"
+
+	// ErrorKindProxy is a failure of the proxy Versa Analytics is reached through
+	ErrorKindProxy ErrorKind = "proxy"
+
+	// ErrorKindDecode is a response body that could not be decoded
+	ErrorKindDecode ErrorKind = "decode"
+
+	// ErrorKindTimeout is a request cancelled or timed out, including the jobs skipped once the scrape is over
+	ErrorKindTimeout ErrorKind = "timeout"
+
+	// ErrorKindCircuitOpen is a request skipped as the circuit breaker of its report is open
+	ErrorKindCircuitOpen ErrorKind = "circuit_open"
+
+	// ErrorKindQuery is a query that could not be built
+	ErrorKindQuery ErrorKind = "query"
+)
+
+// Error is the failure of a Versa Analytics report for a tenant. Tenant is empty for requests that are
+// not bound to a tenant such as the tenant discovery
+type Error struct {
+	Kind   ErrorKind
+	Tenant string
+	Report string
+
+	// StatusCode is the HTTP status code of the response for ErrorKindHTTPStatus and ErrorKindAuth errors
+	StatusCode int
+
+	Err error
+}
+
+func (e *Error) Error() string {
+	if e.Tenant == "" {
+		return fmt.Sprintf("report %v failed with %v error: %v", e.Report, e.Kind, e.Err)
+	}
+	return fmt.Sprintf("report %v of tenant %v failed with %v error: %v", e.Report, e.Tenant, e.Kind, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// ErrorKindOf returns the kind of a Versa Analytics error, errors not raised by the client are reported as
+// transport errors
+func ErrorKindOf(err error) ErrorKind {
+
+	var clientErr *Error
+
+	if errors.As(err, &clientErr) {
+		return clientErr.Kind
+	}
+
+	return classifyError(err)
+}
+
+// classifyError infers the kind of an error returned while sending a request
+func classifyError(err error) ErrorKind {
+
+	if _, ok := AsProxyError(err); ok {
+		return ErrorKindProxy
+	}
+
+	if errors.Is(err, ErrCircuitOpen) {
+		return ErrorKindCircuitOpen
+	}
+
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return ErrorKindTimeout
+	}
+
+	var netErr net.Error
+
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return ErrorKindTimeout
+	}
+
+	return ErrorKindTransport
+}
+
+// wrapError tags err with the report and tenant it failed for, keeping the kind it was raised with
+func wrapError(err error, report, tenant string) error {
+
+	if err == nil {
+		return nil
+	}
+
+	var clientErr *Error
+
+	if errors.As(err, &clientErr) {
+		tagged := *clientErr
+
+		if tagged.Report == "" {
+			tagged.Report = report
+		}
+		if tagged.Tenant == "" {
+			tagged.Tenant = tenant
+		}
+
+		return &tagged
+	}
+
+	return &Error{Kind: classifyError(err), Tenant: tenant, Report: report, Err: err}
+}
+
+// TenantErrors maps the tenants a report failed for to their error. It is returned along with the results
+// of the tenants that succeeded
+type TenantErrors map[string]error
+
+func (t TenantErrors) Error() string {
+
+	tenants := make([]string, 0, len(t))
+
+	for tenant := range t {
+		tenants = append(tenants, tenant)
+	}
+
+	sort.Strings(tenants)
+
+	messages := make([]string, 0, len(tenants))
+
+	for _, tenant := range tenants {
+		messages = append(messages, t[tenant].Error())
+	}
+
+	return fmt.Sprintf("%v tenants failed: %v", len(t), strings.Join(messages, "; "))
+}
+
+// err returns the tenant errors as an error, or nil when every tenant succeeded
+func (t TenantErrors) err() error {
+	if len(t) == 0 {
+		return nil
+	}
+	return t
+}
+
+// AsTenantErrors returns the per tenant failures of an error returned by a Get method. A failure that is
+// not bound to a tenant is returned under the empty tenant name
+func AsTenantErrors(err error) TenantErrors {
+
+	if err == nil {
+		return nil
+	}
+
+	var tenantErrors TenantErrors
+
+	if errors.As(err, &tenantErrors) {
+		return tenantErrors
+	}
+
+	return TenantErrors{"": err}
+}
@@ -0,0 +1,476 @@
+package versa_client
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lucabrasi83/peppamon_versa/logging"
+)
+
+const (
+	FixtureModeRecord = "record"
+	FixtureModeReplay = "replay"
+
+	redacted = "REDACTED"
+
+	// clockFile holds the time the fixtures were recorded at
+	clockFile = "clock.json"
+)
+
+var (
+	// redactedHeaders carry credentials and are never written to fixtures
+	redactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+	// redactedFields are the JSON fields holding credentials in the Versa responses
+	redactedFields = map[string]bool{
+		"access_token":  true,
+		"refresh_token": true,
+		"password":      true,
+		"client_secret": true,
+	}
+
+	// unkeyedParams change on every run and are left out of the fixture key so that replays still match
+	unkeyedParams = []string{"start-date", "end-date"}
+
+	fixtureNameRegexp = regexp.MustCompile(`[^A-Za-z0-9.]+`)
+)
+
+// fixtureClock is the time the query windows were aligned on while recording
+type fixtureClock struct {
+	RecordedAt time.Time `json:"recorded_at"`
+}
+
+// fixture is a request and response pair saved to disk
+type fixture struct {
+	Request struct {
+		Method string      `json:"method"`
+		URL    string      `json:"url"`
+		Header http.Header `json:"header"`
+	} `json:"request"`
+
+	Response struct {
+		StatusCode int             `json:"status_code"`
+		Header     http.Header     `json:"header"`
+		Body       json.RawMessage `json:"body,omitempty"`
+		RawBody    string          `json:"raw_body,omitempty"`
+	} `json:"response"`
+}
+
+// FixtureTransport records the Versa API requests and their responses to a fixture directory, or serves
+// the recorded responses back so that the exporter can run offline. Credentials are redacted from fixtures
+// and tenant names are optionally replaced by stable aliases
+type FixtureTransport struct {
+	Mode      string
+	Dir       string
+	Anonymize bool
+
+	// Next sends the requests being recorded
+	Next http.RoundTripper
+
+	// Clock is the time saved along with the recorded fixtures, time.Now when nil
+	Clock func() time.Time
+
+	mu        sync.Mutex
+	tenants   map[string]string
+	clockOnce sync.Once
+}
+
+// FixtureSettings selects whether the Versa API responses are recorded to or replayed from Dir
+type FixtureSettings struct {
+	// Mode is record or replay, fixtures are disabled when empty
+	Mode string
+
+	Dir              string
+	AnonymizeTenants bool
+}
+
+// FixtureSettingsFromEnv loads PEPPAMON_VERSA_FIXTURES_MODE, PEPPAMON_VERSA_FIXTURES_DIR and
+// PEPPAMON_VERSA_FIXTURES_ANONYMIZE_TENANTS
+func FixtureSettingsFromEnv(env Env) FixtureSettings {
+	return FixtureSettings{
+		Mode:             env.String("PEPPAMON_VERSA_FIXTURES_MODE", ""),
+		Dir:              env.String("PEPPAMON_VERSA_FIXTURES_DIR", "fixtures"),
+		AnonymizeTenants: env.Bool("PEPPAMON_VERSA_FIXTURES_ANONYMIZE_TENANTS", false),
+	}
+}
+
+// Clock returns clock, or a clock stopped at the time the fixtures were recorded at when replaying them so
+// that the replayed queries cover the window the responses were recorded for
+func (s FixtureSettings) Clock(clock func() time.Time) (func() time.Time, error) {
+
+	if s.Mode != FixtureModeReplay {
+		return clock, nil
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(s.Dir, clockFile))
+
+	if os.IsNotExist(err) {
+		logging.PeppaMonLog("warning", "No recording time in Versa fixtures directory %v, replayed queries "+
+			"are aligned on the current time", s.Dir)
+		return clock, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the Versa fixtures recording time: %v", err)
+	}
+
+	var recorded fixtureClock
+
+	if err := json.Unmarshal(content, &recorded); err != nil {
+		return nil, fmt.Errorf("invalid Versa fixtures recording time %v: %v", filepath.Join(s.Dir, clockFile), err)
+	}
+
+	return func() time.Time { return recorded.RecordedAt }, nil
+}
+
+// Transport wraps next with the fixture mode, if any. clock is the recording time saved with the fixtures
+func (s FixtureSettings) Transport(next http.RoundTripper, clock func() time.Time) (http.RoundTripper, error) {
+
+	if s.Mode == "" {
+		return next, nil
+	}
+
+	if s.Mode != FixtureModeRecord && s.Mode != FixtureModeReplay {
+		return nil, fmt.Errorf("unsupported Versa fixtures mode %v, expected record or replay", s.Mode)
+	}
+
+	if err := os.MkdirAll(s.Dir, 0755); err != nil {
+		return nil, fmt.Errorf("unable to create Versa fixtures directory %v: %v", s.Dir, err)
+	}
+
+	logging.PeppaMonLog("warning", "Versa API requests are in %v mode with fixtures directory %v", s.Mode, s.Dir)
+
+	transport := NewFixtureTransport(s.Mode, s.Dir, s.AnonymizeTenants, next)
+	transport.Clock = clock
+
+	return transport, nil
+}
+
+// FixtureTransportFromEnv wraps next with the fixture mode set by PEPPAMON_VERSA_FIXTURES_MODE, if any
+func FixtureTransportFromEnv(env Env, next http.RoundTripper) http.RoundTripper {
+
+	transport, err := FixtureSettingsFromEnv(env).Transport(next, time.Now)
+
+	if err != nil {
+		logging.PeppaMonLog("fatal", "Invalid Versa fixtures settings: %v", err)
+	}
+
+	return transport
+}
+
+func NewFixtureTransport(mode, dir string, anonymize bool, next http.RoundTripper) *FixtureTransport {
+	return &FixtureTransport{
+		Mode:      mode,
+		Dir:       dir,
+		Anonymize: anonymize,
+		Next:      next,
+		tenants:   make(map[string]string),
+	}
+}
+
+func (f *FixtureTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if f.Mode == FixtureModeReplay {
+		return f.replay(req)
+	}
+	return f.record(req)
+}
+
+// fixturePath returns the file of the request. Requests are told apart by method, path and query parameters
+func (f *FixtureTransport) fixturePath(method string, reqURL *url.URL) string {
+
+	query := reqURL.Query()
+
+	for _, param := range unkeyedParams {
+		query.Del(param)
+	}
+
+	sum := sha256.Sum256([]byte(method + " " + reqURL.EscapedPath() + "?" + query.Encode()))
+
+	name := fixtureNameRegexp.ReplaceAllString(reqURL.Path, "-")
+
+	if len(name) > 60 {
+		name = name[len(name)-60:]
+	}
+
+	name = strings.Trim(name, "-")
+
+	return filepath.Join(f.Dir, fmt.Sprintf("%v_%v_%v.json", method, name, hex.EncodeToString(sum[:6])))
+}
+
+func (f *FixtureTransport) replay(req *http.Request) (*http.Response, error) {
+
+	fixturePath := f.fixturePath(req.Method, req.URL)
+
+	content, err := ioutil.ReadFile(fixturePath)
+
+	// A missing fixture is answered with a 404 so that the exporter carries on like with a partial Versa setup
+	if os.IsNotExist(err) {
+		logging.PeppaMonLog("warning", "No Versa fixture recorded for %v %v", req.Method, req.URL.Path)
+
+		return &http.Response{
+			Status:     "404 Not Found",
+			StatusCode: http.StatusNotFound,
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     http.Header{"X-Peppamon-Fixture": []string{"missing"}},
+			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+			Request:    req,
+		}, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var recorded fixture
+
+	if err := json.Unmarshal(content, &recorded); err != nil {
+		return nil, fmt.Errorf("invalid Versa fixture %v: %v", fixturePath, err)
+	}
+
+	body := []byte(recorded.Response.Body)
+
+	if recorded.Response.RawBody != "" {
+		body = []byte(recorded.Response.RawBody)
+	}
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", recorded.Response.StatusCode, http.StatusText(recorded.Response.StatusCode)),
+		StatusCode:    recorded.Response.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        recorded.Response.Header,
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
+
+func (f *FixtureTransport) record(req *http.Request) (*http.Response, error) {
+
+	f.clockOnce.Do(func() {
+		if err := f.saveClock(); err != nil {
+			logging.PeppaMonLog("error", "Unable to record the Versa fixtures recording time with error %v", err)
+		}
+	})
+
+	res, err := f.Next.RoundTrip(req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	_ = res.Body.Close()
+
+	if err != nil {
+		return nil, err
+	}
+
+	// The caller still gets the genuine response, only the fixture is redacted
+	res.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	if err := f.save(req, res, body); err != nil {
+		logging.PeppaMonLog("error", "Unable to record Versa fixture for %v %v with error %v",
+			req.Method, req.URL.Path, err)
+	}
+
+	return res, nil
+}
+
+// saveClock writes the time the fixtures are recorded at, which the replayed queries are aligned on
+func (f *FixtureTransport) saveClock() error {
+
+	clock := f.Clock
+
+	if clock == nil {
+		clock = time.Now
+	}
+
+	content, err := json.MarshalIndent(fixtureClock{RecordedAt: clock()}, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filepath.Join(f.Dir, clockFile), content, 0644)
+}
+
+// save writes the redacted and optionally anonymized request and response pair
+func (f *FixtureTransport) save(req *http.Request, res *http.Response, body []byte) error {
+
+	if f.Anonymize {
+		f.learnTenants(req.URL.Path, body)
+	}
+
+	fixtureURL := *req.URL
+	fixtureURL.User = nil
+	fixtureURL.RawPath = ""
+	fixtureURL.Path = f.anonymize(req.URL.Path)
+	fixtureURL.RawQuery = f.anonymize(req.URL.RawQuery)
+
+	var recorded fixture
+
+	recorded.Request.Method = req.Method
+	recorded.Request.URL = fixtureURL.String()
+	recorded.Request.Header = redactHeader(req.Header)
+
+	recorded.Response.StatusCode = res.StatusCode
+	recorded.Response.Header = redactHeader(res.Header)
+
+	// The body length changes once redacted and anonymized
+	recorded.Response.Header.Del("Content-Length")
+
+	var document interface{}
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+
+	if err := decoder.Decode(&document); err == nil {
+
+		redactedBody, err := json.Marshal(redactJSON(document))
+
+		if err != nil {
+			return err
+		}
+
+		recorded.Response.Body = json.RawMessage(f.anonymize(string(redactedBody)))
+	} else {
+		recorded.Response.RawBody = f.anonymize(string(body))
+	}
+
+	content, err := json.MarshalIndent(recorded, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(f.fixturePath(req.Method, &fixtureURL), content, 0644)
+}
+
+// learnTenants collects the tenant names from the Analytics tenant list and the Director organization list
+func (f *FixtureTransport) learnTenants(reqPath string, body []byte) {
+
+	var names []string
+
+	switch {
+	case strings.HasSuffix(reqPath, "/tenants"):
+		var tenants VersaTenantList
+
+		if json.Unmarshal(body, &tenants) == nil {
+			for _, tenant := range tenants {
+				names = append(names, tenant.TenantName)
+			}
+		}
+
+	case strings.HasSuffix(reqPath, "/organization/orgs"):
+		var orgs struct {
+			Organizations []struct {
+				Name string `json:"name"`
+			} `json:"organizations"`
+		}
+
+		if json.Unmarshal(body, &orgs) == nil {
+			for _, org := range orgs.Organizations {
+				names = append(names, org.Name)
+			}
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+
+		// Aliases are derived from the name so that they remain stable across recording sessions
+		sum := sha256.Sum256([]byte(name))
+		f.tenants[name] = "tenant-" + hex.EncodeToString(sum[:4])
+	}
+}
+
+// anonymize replaces the known tenant names, the longest first so that a name containing another one is
+// replaced as a whole
+func (f *FixtureTransport) anonymize(s string) string {
+
+	if !f.Anonymize {
+		return s
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	names := make([]string, 0, len(f.tenants))
+
+	for name := range f.tenants {
+		names = append(names, name)
+	}
+
+	sort.Slice(names, func(i, j int) bool {
+		return len(names[i]) > len(names[j])
+	})
+
+	for _, name := range names {
+		s = strings.Replace(s, name, f.tenants[name], -1)
+		s = strings.Replace(s, url.PathEscape(name), f.tenants[name], -1)
+		s = strings.Replace(s, url.QueryEscape(name), f.tenants[name], -1)
+	}
+
+	return s
+}
+
+func redactHeader(header http.Header) http.Header {
+
+	clone := make(http.Header, len(header))
+
+	for key, values := range header {
+		clone[key] = append([]string(nil), values...)
+	}
+
+	for _, key := range redactedHeaders {
+		if _, ok := clone[key]; ok {
+			clone.Set(key, redacted)
+		}
+	}
+
+	return clone
+}
+
+// redactJSON replaces the credential fields found anywhere in the decoded JSON document
+func redactJSON(document interface{}) interface{} {
+
+	switch value := document.(type) {
+	case map[string]interface{}:
+		for key, field := range value {
+			if redactedFields[key] {
+				value[key] = redacted
+			} else {
+				value[key] = redactJSON(field)
+			}
+		}
+
+	case []interface{}:
+		for i, item := range value {
+			value[i] = redactJSON(item)
+		}
+	}
+
+	return document
+}
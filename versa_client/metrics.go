@@ -0,0 +1,95 @@
+package versa_client
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// clientMetrics are the exporter self-metrics about the requests sent to Versa Analytics
+type clientMetrics struct {
+	requestRetries           *prometheus.CounterVec
+	paginationCeilingReached *prometheus.CounterVec
+	nodeUp                   *prometheus.GaugeVec
+	tenants                  *prometheus.GaugeVec
+	rateLimitWait            *prometheus.HistogramVec
+	breakerState             *prometheus.GaugeVec
+	reportErrors             *prometheus.CounterVec
+}
+
+func newClientMetrics() *clientMetrics {
+	return &clientMetrics{
+		requestRetries: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "versa_analytics_exporter_request_retries_total",
+				Help: "The number of Versa Analytics requests retried after a transient failure",
+			},
+			[]string{"report", "reason"},
+		),
+		paginationCeilingReached: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "versa_analytics_exporter_pagination_ceiling_reached_total",
+				Help: "The number of Versa Analytics results left incomplete as paging reached the rows ceiling",
+			},
+			[]string{"report"},
+		),
+		nodeUp: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "versa_analytics_exporter_node_up",
+				Help: "Whether the Versa Analytics node answered the last health check or request",
+			},
+			[]string{"node"},
+		),
+		tenants: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "versa_analytics_exporter_tenants",
+				Help: "The number of tenants discovered on Versa Analytics and monitored after filtering",
+			},
+			[]string{"state"},
+		),
+		rateLimitWait: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "versa_analytics_exporter_rate_limit_wait_seconds",
+				Help:    "The time Versa Analytics requests waited for the client side rate limiter",
+				Buckets: []float64{0, 0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+			},
+			[]string{"report"},
+		),
+		breakerState: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "versa_analytics_exporter_circuit_breaker_state",
+				Help: "The state of the report circuit breakers: 0 closed, 1 open and 2 half-open",
+			},
+			[]string{"report", "tenant"},
+		),
+		reportErrors: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "versa_analytics_exporter_report_errors_total",
+				Help: "The number of Versa Analytics reports that failed for a tenant, or for every tenant, by kind of error",
+			},
+			[]string{"report", "kind"},
+		),
+	}
+}
+
+func (m *clientMetrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.requestRetries,
+		m.paginationCeilingReached,
+		m.nodeUp,
+		m.tenants,
+		m.rateLimitWait,
+		m.breakerState,
+		m.reportErrors,
+	}
+}
+
+// Describe implements prometheus.Collector for the client self-metrics
+func (v *VersaAnalyticsClient) Describe(ch chan<- *prometheus.Desc) {
+	for _, c := range v.metrics.collectors() {
+		c.Describe(ch)
+	}
+}
+
+// Collect implements prometheus.Collector for the client self-metrics
+func (v *VersaAnalyticsClient) Collect(ch chan<- prometheus.Metric) {
+	for _, c := range v.metrics.collectors() {
+		c.Collect(ch)
+	}
+}
@@ -0,0 +1,234 @@
+package versa_client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/lucabrasi83/peppamon_versa/logging"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	NodeStrategySticky     = "sticky"
+	NodeStrategyRoundRobin = "round-robin"
+
+	defaultNodeRetryInterval = time.Minute
+)
+
+// AnalyticsNode is a single node of the Versa Analytics cluster with its own session
+type AnalyticsNode struct {
+	Hostname      string
+	BaseURL       string
+	Authenticator Authenticator
+
+	// limiters keep the request rate to the node under the configured limits
+	limiters *nodeLimiters
+
+	mu        sync.Mutex
+	healthy   bool
+	downSince time.Time
+}
+
+// Healthy reports whether the node answered the last health check or request
+func (n *AnalyticsNode) Healthy() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return n.healthy
+}
+
+// NodePool selects the Versa Analytics node to send queries to and fails over to another one
+// when a node stops responding
+type NodePool struct {
+	Nodes    []*AnalyticsNode
+	Strategy string
+
+	// HealthCheckInterval is how often every node is probed, including the ones marked down
+	HealthCheckInterval time.Duration
+
+	// RetryInterval is how long a node marked down is skipped before a request tries it again, so that it
+	// comes back without health checks. A minute when zero
+	RetryInterval time.Duration
+
+	mu      sync.Mutex
+	current int
+	nodeUp  *prometheus.GaugeVec
+}
+
+func newNodePool(nodes []*AnalyticsNode, strategy string, healthCheckInterval, retryInterval time.Duration,
+	nodeUp *prometheus.GaugeVec) *NodePool {
+
+	// Nodes are assumed healthy until a request or a health check says otherwise
+	for _, node := range nodes {
+		node.healthy = true
+		nodeUp.WithLabelValues(node.Hostname).Set(1)
+	}
+
+	return &NodePool{
+		Nodes:               nodes,
+		Strategy:            strategy,
+		HealthCheckInterval: healthCheckInterval,
+		RetryInterval:       retryInterval,
+		nodeUp:              nodeUp,
+	}
+}
+
+// Pick returns the node to send the next query to. A node down for the retry interval is tried again by
+// a single query. When every node is down, nodes are still tried in turn
+func (p *NodePool) Pick() *AnalyticsNode {
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+
+	for i := 0; i < len(p.Nodes); i++ {
+
+		idx := (p.current + i) % len(p.Nodes)
+		node := p.Nodes[idx]
+
+		if !p.available(node, now) {
+			continue
+		}
+
+		if p.Strategy == NodeStrategyRoundRobin {
+			p.current = (idx + 1) % len(p.Nodes)
+		} else if idx != p.current {
+			logging.PeppaMonLog("warning", "Failing over Versa Analytics queries from %v to %v",
+				p.Nodes[p.current].Hostname, node.Hostname)
+			p.current = idx
+		}
+
+		return node
+	}
+
+	node := p.Nodes[p.current]
+	p.current = (p.current + 1) % len(p.Nodes)
+
+	return node
+}
+
+// available reports whether the node is healthy or down for the retry interval, in which case the retry
+// interval starts over so that the other queries keep skipping it until the retry succeeds
+func (p *NodePool) available(node *AnalyticsNode, now time.Time) bool {
+
+	node.mu.Lock()
+	defer node.mu.Unlock()
+
+	if node.healthy {
+		return true
+	}
+
+	retryInterval := p.RetryInterval
+
+	if retryInterval <= 0 {
+		retryInterval = defaultNodeRetryInterval
+	}
+
+	if now.Sub(node.downSince) < retryInterval {
+		return false
+	}
+
+	node.downSince = now
+
+	return true
+}
+
+// setHealth records the health of a node and logs state changes
+func (p *NodePool) setHealth(node *AnalyticsNode, healthy bool, reason error) {
+
+	node.mu.Lock()
+	changed := node.healthy != healthy
+	node.healthy = healthy
+
+	if !healthy {
+		node.downSince = time.Now()
+	}
+	node.mu.Unlock()
+
+	if healthy {
+		p.nodeUp.WithLabelValues(node.Hostname).Set(1)
+	} else {
+		p.nodeUp.WithLabelValues(node.Hostname).Set(0)
+	}
+
+	switch {
+	case changed && healthy:
+		logging.PeppaMonLog("info", "Versa Analytics node %v is back up", node.Hostname)
+	case changed:
+		logging.PeppaMonLog("error", "Versa Analytics node %v is down with error %v", node.Hostname, reason)
+	}
+}
+
+// healthCheck probes the login page of every node until ctx is done. Any answer below HTTP 500 means
+// the node is up
+func (p *NodePool) healthCheck(ctx context.Context, httpClient *http.Client) {
+
+	ticker := time.NewTicker(p.HealthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		var wg sync.WaitGroup
+		wg.Add(len(p.Nodes))
+
+		for _, node := range p.Nodes {
+
+			go func(n *AnalyticsNode) {
+				defer wg.Done()
+
+				healthy, err := probeNode(ctx, httpClient, n, p.HealthCheckInterval)
+
+				if ctx.Err() != nil {
+					return
+				}
+
+				// The node cannot be probed while the proxy is failing, keep its last known health
+				if proxyErr, ok := AsProxyError(err); ok {
+					logging.PeppaMonLog("warning", "Unable to probe Versa Analytics node %v: %v", n.Hostname, proxyErr)
+					return
+				}
+
+				p.setHealth(n, healthy, err)
+			}(node)
+		}
+
+		wg.Wait()
+	}
+}
+
+// probeNode returns whether the node is healthy along with the reason it is not
+func probeNode(ctx context.Context, httpClient *http.Client, node *AnalyticsNode,
+	timeout time.Duration) (bool, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	httpNewReq, err := http.NewRequestWithContext(ctx, "GET", node.BaseURL+"/versa/login", nil)
+
+	if err != nil {
+		return false, err
+	}
+
+	res, err := httpClient.Do(httpNewReq)
+
+	if err != nil {
+		return false, err
+	}
+
+	_ = res.Body.Close()
+
+	if res.StatusCode >= http.StatusInternalServerError {
+		return false, fmt.Errorf("health check responded with HTTP error code %v", res.StatusCode)
+	}
+
+	return true, nil
+}
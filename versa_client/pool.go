@@ -0,0 +1,175 @@
+package versa_client
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/lucabrasi83/peppamon_versa/logging"
+)
+
+// defaultReportPriorities favours the light site level reports over the large application usage ones
+var defaultReportPriorities = map[string]int{
+	ReportSitesAvailability:      50,
+	ReportSiteCircuitUsage:       40,
+	ReportApplianceCompute:       30,
+	ReportSiteSLAMetrics:         20,
+	ReportApplicationUsageRate:   10,
+	ReportApplicationUsageVolume: 10,
+}
+
+// ErrPoolClosed is returned by Submit once the pool is closed
+var ErrPoolClosed = errors.New("worker pool is closed")
+
+// poolLevel holds the pending jobs of a priority. Tenants with pending jobs are served in turn
+type poolLevel struct {
+	queues map[string][]func()
+	ring   []string
+}
+
+// WorkerPool runs (tenant, report) jobs on a fixed number of workers shared by every report.
+// Jobs of higher priority reports run first and, within a priority, tenants are served in a round-robin
+// fashion so that a tenant with many pending jobs cannot starve the others
+type WorkerPool struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	levels map[int]*poolLevel
+
+	// priorities lists the levels with pending jobs from the highest to the lowest
+	priorities []int
+
+	closed bool
+}
+
+// NewWorkerPool starts a pool of the given number of workers
+func NewWorkerPool(workers int) *WorkerPool {
+	p := &WorkerPool{levels: make(map[int]*poolLevel)}
+	p.cond = sync.NewCond(&p.mu)
+
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+
+	return p
+}
+
+// Submit queues fn to run on the pool for the tenant at the priority of its report. fn is rejected with
+// ErrPoolClosed once the pool is closed
+func (p *WorkerPool) Submit(tenant string, priority int, fn func()) error {
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return ErrPoolClosed
+	}
+
+	level, ok := p.levels[priority]
+
+	if !ok {
+		level = &poolLevel{queues: make(map[string][]func())}
+		p.levels[priority] = level
+
+		p.priorities = append(p.priorities, priority)
+		sort.Sort(sort.Reverse(sort.IntSlice(p.priorities)))
+	}
+
+	if len(level.queues[tenant]) == 0 {
+		level.ring = append(level.ring, tenant)
+	}
+
+	level.queues[tenant] = append(level.queues[tenant], fn)
+
+	p.cond.Signal()
+
+	return nil
+}
+
+// next pops the job to run next and must be called with the lock held
+func (p *WorkerPool) next() func() {
+
+	priority := p.priorities[0]
+	level := p.levels[priority]
+
+	tenant := level.ring[0]
+	level.ring = level.ring[1:]
+
+	job := level.queues[tenant][0]
+	level.queues[tenant] = level.queues[tenant][1:]
+
+	if len(level.queues[tenant]) > 0 {
+		level.ring = append(level.ring, tenant)
+	} else {
+		delete(level.queues, tenant)
+	}
+
+	if len(level.ring) == 0 {
+		delete(p.levels, priority)
+		p.priorities = p.priorities[1:]
+	}
+
+	return job
+}
+
+// Close stops the workers once the pending jobs have run and rejects the jobs submitted afterwards
+func (p *WorkerPool) Close() {
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+	p.cond.Broadcast()
+}
+
+func (p *WorkerPool) work() {
+	for {
+		p.mu.Lock()
+
+		for len(p.priorities) == 0 && !p.closed {
+			p.cond.Wait()
+		}
+
+		if len(p.priorities) == 0 {
+			p.mu.Unlock()
+			return
+		}
+
+		job := p.next()
+
+		p.mu.Unlock()
+
+		job()
+	}
+}
+
+// reportPrioritiesFromEnv overrides the default priorities with PEPPAMON_VERSA_REPORT_PRIORITIES
+// given as a comma separated list of report=priority
+func reportPrioritiesFromEnv(env Env) map[string]int {
+
+	priorities := make(map[string]int, len(defaultReportPriorities))
+
+	for report, priority := range defaultReportPriorities {
+		priorities[report] = priority
+	}
+
+	for _, item := range env.List("PEPPAMON_VERSA_REPORT_PRIORITIES") {
+
+		tokens := strings.SplitN(item, "=", 2)
+
+		if len(tokens) != 2 {
+			logging.PeppaMonLog("fatal", "Invalid report priority %q, expected report=priority", item)
+		}
+
+		priority, err := strconv.Atoi(strings.TrimSpace(tokens[1]))
+
+		if err != nil {
+			logging.PeppaMonLog("fatal", "Invalid priority %q for report %v", tokens[1], tokens[0])
+		}
+
+		priorities[strings.TrimSpace(tokens[0])] = priority
+	}
+
+	return priorities
+}
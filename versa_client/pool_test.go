@@ -0,0 +1,108 @@
+package versa_client
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// queuedJob is a job of the tenant at a priority, named to record the order jobs run in
+type queuedJob struct {
+	tenant   string
+	priority int
+	name     string
+}
+
+// runQueued submits the jobs to a pool without workers, then runs them on a single worker and returns the
+// order they ran in
+func runQueued(t *testing.T, jobs []queuedJob) []string {
+
+	pool := NewWorkerPool(0)
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var order []string
+
+	for _, job := range jobs {
+
+		name := job.name
+		wg.Add(1)
+
+		err := pool.Submit(job.tenant, job.priority, func() {
+			defer wg.Done()
+
+			mu.Lock()
+			order = append(order, name)
+			mu.Unlock()
+		})
+
+		if err != nil {
+			t.Fatalf("Submit() failed with error %v", err)
+		}
+	}
+
+	go pool.work()
+
+	wg.Wait()
+	pool.Close()
+
+	return order
+}
+
+func TestWorkerPoolPriority(t *testing.T) {
+
+	order := runQueued(t, []queuedJob{
+		{"acme", 10, "acme-application-usage"},
+		{"globex", 50, "globex-availability"},
+		{"acme", 30, "acme-appliance-compute"},
+		{"acme", 50, "acme-availability"},
+	})
+
+	want := []string{"globex-availability", "acme-availability", "acme-appliance-compute", "acme-application-usage"}
+
+	if !reflect.DeepEqual(order, want) {
+		t.Fatalf("jobs ran in order %v, want %v", order, want)
+	}
+}
+
+func TestWorkerPoolRoundRobin(t *testing.T) {
+
+	order := runQueued(t, []queuedJob{
+		{"acme", 10, "acme-1"},
+		{"acme", 10, "acme-2"},
+		{"acme", 10, "acme-3"},
+		{"globex", 10, "globex-1"},
+		{"globex", 10, "globex-2"},
+		{"initech", 10, "initech-1"},
+	})
+
+	want := []string{"acme-1", "globex-1", "initech-1", "acme-2", "globex-2", "acme-3"}
+
+	if !reflect.DeepEqual(order, want) {
+		t.Fatalf("jobs ran in order %v, want %v", order, want)
+	}
+}
+
+func TestWorkerPoolClose(t *testing.T) {
+
+	pool := NewWorkerPool(0)
+
+	ran := make(chan bool, 1)
+
+	if err := pool.Submit("acme", 10, func() { ran <- true }); err != nil {
+		t.Fatalf("Submit() failed with error %v", err)
+	}
+
+	pool.Close()
+
+	if err := pool.Submit("acme", 10, func() { ran <- true }); err != ErrPoolClosed {
+		t.Fatalf("Submit() after Close() got error %v, want %v", err, ErrPoolClosed)
+	}
+
+	// The job queued before Close still runs, the worker returning once the queue is empty
+	pool.work()
+
+	if len(ran) != 1 {
+		t.Fatalf("got %v jobs run, want the one submitted before Close()", len(ran))
+	}
+}
@@ -0,0 +1,353 @@
+package versa_client
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/lucabrasi83/peppamon_versa/logging"
+)
+
+// ProxyFunc returns the proxy to send a request through, or nil to connect directly
+type ProxyFunc func(req *http.Request) (*url.URL, error)
+
+// ProxyError is returned when the connection to Versa could not be established through the egress proxy,
+// as opposed to an error returned by Versa itself
+type ProxyError struct {
+	Proxy string
+
+	// StatusCode is the status the proxy refused the tunnel with, 0 when the proxy could not be reached
+	StatusCode int
+
+	Err error
+}
+
+func (e *ProxyError) Error() string {
+	return fmt.Sprintf("unable to reach Versa through proxy %v: %v", e.Proxy, e.Err)
+}
+
+func (e *ProxyError) Unwrap() error {
+	return e.Err
+}
+
+// retryable reports whether the proxy failure may be transient. A proxy refusing the tunnel with a client
+// error such as 407 Proxy Authentication Required fails the same way on every attempt
+func (e *ProxyError) retryable() bool {
+	return e.StatusCode < 400 || e.StatusCode >= 500 ||
+		e.StatusCode == http.StatusRequestTimeout || e.StatusCode == http.StatusTooManyRequests
+}
+
+// ProxyFromEnv returns the proxy set by PEPPAMON_VERSA_PROXY_URL as http://, https:// or socks5:// along with its
+// optional PEPPAMON_VERSA_PROXY_USERNAME and PEPPAMON_VERSA_PROXY_PASSWORD. Hosts matching PEPPAMON_VERSA_NO_PROXY
+// are reached directly. The standard HTTPS_PROXY and NO_PROXY variables are used when no proxy is set
+func ProxyFromEnv(env Env) ProxyFunc {
+
+	rawURL := env.String("PEPPAMON_VERSA_PROXY_URL", "")
+
+	if rawURL == "" {
+		return http.ProxyFromEnvironment
+	}
+
+	proxyURL, err := url.Parse(rawURL)
+
+	if err != nil || proxyURL.Host == "" {
+		logging.PeppaMonLog("fatal", "Invalid proxy URL %q for Versa", rawURL)
+	}
+
+	switch proxyURL.Scheme {
+	case "http", "https", "socks5":
+	default:
+		logging.PeppaMonLog("fatal", "Unsupported proxy scheme %v for Versa, expected http, https or socks5",
+			proxyURL.Scheme)
+	}
+
+	if username := env.String("PEPPAMON_VERSA_PROXY_USERNAME", ""); username != "" {
+		proxyURL.User = url.UserPassword(username, env.String("PEPPAMON_VERSA_PROXY_PASSWORD", ""))
+	}
+
+	noProxy := env.List("PEPPAMON_VERSA_NO_PROXY")
+
+	logging.PeppaMonLog("info", "Sending Versa requests through proxy %v://%v", proxyURL.Scheme, proxyURL.Host)
+
+	return func(req *http.Request) (*url.URL, error) {
+		if bypassProxy(req.URL.Hostname(), noProxy) {
+			return nil, nil
+		}
+		return proxyURL, nil
+	}
+}
+
+// bypassProxy reports whether the host matches one of the no proxy rules given as *, a host name,
+// a domain suffix such as .example.com, an IP address or a CIDR
+func bypassProxy(host string, noProxy []string) bool {
+
+	ip := net.ParseIP(host)
+
+	for _, rule := range noProxy {
+
+		if rule == "*" {
+			return true
+		}
+
+		if _, cidr, err := net.ParseCIDR(rule); err == nil {
+			if ip != nil && cidr.Contains(ip) {
+				return true
+			}
+			continue
+		}
+
+		if ruleIP := net.ParseIP(rule); ruleIP != nil {
+			if ruleIP.Equal(ip) {
+				return true
+			}
+			continue
+		}
+
+		rule = strings.ToLower(rule)
+		host := strings.ToLower(host)
+
+		if host == strings.TrimPrefix(rule, ".") || strings.HasSuffix(host, "."+strings.TrimPrefix(rule, ".")) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isProxyConnectError reports whether the transport failed to connect through a proxy it handles itself,
+// which reports its dial and SOCKS5 failures as proxyconnect and socks errors
+func isProxyConnectError(err error) bool {
+
+	var opErr *net.OpError
+
+	return errors.As(err, &opErr) && (opErr.Op == "proxyconnect" || strings.HasPrefix(opErr.Op, "socks "))
+}
+
+// newProxyTransport builds an HTTP transport reaching Versa through the proxy. TLS connections through HTTP and
+// HTTPS proxies are tunnelled by the proxy dialer rather than by the transport, which would only report the
+// reason phrase of a proxy refusing the tunnel
+func newProxyTransport(tlsConfig *tls.Config, proxy ProxyFunc) *proxyTransport {
+
+	dialer := &proxyDialer{
+		proxy:  proxy,
+		dialer: net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second},
+	}
+
+	return &proxyTransport{
+		Transport: &http.Transport{
+			TLSClientConfig: tlsConfig,
+			Proxy:           dialer.transportProxy,
+			DialContext:     dialer.DialContext,
+		},
+		proxy: proxy,
+	}
+}
+
+// proxyTransport reports the failures to connect through the proxy as a ProxyError
+type proxyTransport struct {
+	*http.Transport
+	proxy ProxyFunc
+}
+
+func (t *proxyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+
+	res, err := t.Transport.RoundTrip(req)
+
+	if err == nil || t.proxy == nil || !isProxyConnectError(err) {
+		return res, err
+	}
+
+	proxyURL, _ := t.proxy(req)
+
+	if proxyURL == nil {
+		return res, err
+	}
+
+	proxyErr := &ProxyError{Proxy: proxyURL.Scheme + "://" + proxyURL.Host, Err: err}
+
+	var refused *proxyRefusedError
+
+	if errors.As(err, &refused) {
+		proxyErr.StatusCode = refused.statusCode
+	}
+
+	return nil, proxyErr
+}
+
+// proxyDialer opens the connections to Versa, tunnelling them with CONNECT through HTTP and HTTPS proxies
+type proxyDialer struct {
+	proxy  ProxyFunc
+	dialer net.Dialer
+}
+
+func isTunnelProxy(proxyURL *url.URL) bool {
+	return proxyURL != nil && (proxyURL.Scheme == "http" || proxyURL.Scheme == "https")
+}
+
+// proxyAddress returns the host and port of the proxy
+func proxyAddress(proxyURL *url.URL) string {
+
+	if proxyURL.Port() != "" {
+		return proxyURL.Host
+	}
+
+	port := map[string]string{"http": "80", "https": "443", "socks5": "1080"}[proxyURL.Scheme]
+
+	return net.JoinHostPort(proxyURL.Hostname(), port)
+}
+
+// transportProxy leaves to the transport the SOCKS5 proxies and the plain HTTP requests forwarded by the proxy
+func (d *proxyDialer) transportProxy(req *http.Request) (*url.URL, error) {
+
+	if d.proxy == nil {
+		return nil, nil
+	}
+
+	proxyURL, err := d.proxy(req)
+
+	if req.URL.Scheme == "https" && isTunnelProxy(proxyURL) {
+		return nil, nil
+	}
+
+	return proxyURL, err
+}
+
+// DialContext connects to addr, through a CONNECT tunnel when an HTTP or HTTPS proxy is set for it
+func (d *proxyDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+
+	if d.proxy == nil {
+		return d.dialer.DialContext(ctx, network, addr)
+	}
+
+	proxyURL, err := d.proxy(&http.Request{URL: &url.URL{Scheme: "https", Host: addr}})
+
+	if err != nil {
+		return nil, err
+	}
+
+	// The transport dials the proxy itself to forward the plain HTTP requests
+	if !isTunnelProxy(proxyURL) || proxyAddress(proxyURL) == addr {
+		return d.dialer.DialContext(ctx, network, addr)
+	}
+
+	conn, err := d.tunnel(ctx, proxyURL, addr)
+
+	if err != nil {
+		// Reported the way the transport reports the failures of the proxies it dials itself
+		return nil, &net.OpError{Op: "proxyconnect", Net: "tcp", Err: err}
+	}
+
+	return conn, nil
+}
+
+// proxyRefusedError is the response of a proxy refusing a CONNECT request
+type proxyRefusedError struct {
+	statusCode int
+	status     string
+	addr       string
+}
+
+func (e *proxyRefusedError) Error() string {
+	return fmt.Sprintf("proxy refused the tunnel to %v with status %v", e.addr, e.status)
+}
+
+// tunnel opens a CONNECT tunnel to addr through the proxy
+func (d *proxyDialer) tunnel(ctx context.Context, proxyURL *url.URL, addr string) (net.Conn, error) {
+
+	conn, err := d.dialer.DialContext(ctx, "tcp", proxyAddress(proxyURL))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	// Abort the handshake with the proxy when the request is cancelled
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+
+	if proxyURL.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: proxyURL.Hostname()})
+
+		if err := tlsConn.Handshake(); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+
+		conn = tlsConn
+	}
+
+	connectReq := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+
+	if user := proxyURL.User; user != nil {
+		password, _ := user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		connectReq.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+
+	if err := connectReq.Write(conn); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+
+	res, err := http.ReadResponse(reader, connectReq)
+
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	_ = res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		_ = conn.Close()
+		return nil, &proxyRefusedError{statusCode: res.StatusCode, status: res.Status, addr: addr}
+	}
+
+	// The TLS handshake with Versa starts once the tunnel is up, the proxy has nothing more to send
+	if reader.Buffered() > 0 {
+		_ = conn.Close()
+		return nil, fmt.Errorf("proxy sent unexpected data after establishing the tunnel to %v", addr)
+	}
+
+	_ = conn.SetDeadline(time.Time{})
+
+	return conn, nil
+}
+
+// AsProxyError returns the proxy failure wrapped in err, if any
+func AsProxyError(err error) (*ProxyError, bool) {
+
+	var proxyErr *ProxyError
+
+	if errors.As(err, &proxyErr) {
+		return proxyErr, true
+	}
+
+	return nil, false
+}
@@ -0,0 +1,351 @@
+package versa_client_test
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/lucabrasi83/peppamon_versa/versa_client"
+	"github.com/lucabrasi83/peppamon_versa/versatest"
+)
+
+// testProxy records the tunnels opened through an HTTP CONNECT or SOCKS5 proxy
+type testProxy struct {
+	mu      sync.Mutex
+	tunnels []string
+}
+
+func (p *testProxy) record(addr string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.tunnels = append(p.tunnels, addr)
+}
+
+func (p *testProxy) Tunnels() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return append([]string(nil), p.tunnels...)
+}
+
+// pipe relays the tunnel between the client and the target until either side closes it
+func pipe(client, target net.Conn) {
+
+	done := make(chan struct{}, 2)
+
+	relay := func(dst, src net.Conn) {
+		_, _ = io.Copy(dst, src)
+		done <- struct{}{}
+	}
+
+	go relay(target, client)
+	go relay(client, target)
+
+	<-done
+
+	_ = client.Close()
+	_ = target.Close()
+}
+
+// newConnectProxy starts an HTTP proxy tunnelling CONNECT requests, answering with status instead when it is
+// not 200 or when the credentials do not match
+func newConnectProxy(username, password string, status int) (*httptest.Server, *testProxy) {
+
+	proxy := &testProxy{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		if r.Method != http.MethodConnect {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		proxy.record(r.Host)
+
+		credentials := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+
+		if username != "" && r.Header.Get("Proxy-Authorization") != "Basic "+credentials {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+
+		target, err := net.Dial("tcp", r.Host)
+
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+
+		client, _, err := w.(http.Hijacker).Hijack()
+
+		if err != nil {
+			_ = target.Close()
+			return
+		}
+
+		_, _ = client.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+
+		pipe(client, target)
+	}))
+
+	return server, proxy
+}
+
+// newSOCKS5Proxy starts a SOCKS5 proxy without authentication tunnelling CONNECT commands
+func newSOCKS5Proxy(t *testing.T) (net.Listener, *testProxy) {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatalf("unable to start SOCKS5 proxy with error %v", err)
+	}
+
+	proxy := &testProxy{}
+
+	go func() {
+		for {
+			client, err := listener.Accept()
+
+			if err != nil {
+				return
+			}
+
+			go proxy.serveSOCKS5(client)
+		}
+	}()
+
+	return listener, proxy
+}
+
+func (p *testProxy) serveSOCKS5(client net.Conn) {
+
+	// Greeting: version, methods count and methods, answered with no authentication
+	header := make([]byte, 2)
+
+	if _, err := io.ReadFull(client, header); err != nil || header[0] != 5 {
+		_ = client.Close()
+		return
+	}
+
+	if _, err := io.ReadFull(client, make([]byte, header[1])); err != nil {
+		_ = client.Close()
+		return
+	}
+
+	_, _ = client.Write([]byte{5, 0})
+
+	// Request: version, command, reserved and address type followed by the address and port
+	request := make([]byte, 4)
+
+	if _, err := io.ReadFull(client, request); err != nil || request[1] != 1 {
+		_ = client.Close()
+		return
+	}
+
+	var host string
+
+	switch request[3] {
+	case 1:
+		ip := make([]byte, 4)
+		_, _ = io.ReadFull(client, ip)
+		host = net.IP(ip).String()
+	case 3:
+		length := make([]byte, 1)
+		_, _ = io.ReadFull(client, length)
+		name := make([]byte, length[0])
+		_, _ = io.ReadFull(client, name)
+		host = string(name)
+	default:
+		_ = client.Close()
+		return
+	}
+
+	port := make([]byte, 2)
+
+	if _, err := io.ReadFull(client, port); err != nil {
+		_ = client.Close()
+		return
+	}
+
+	addr := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+
+	p.record(addr)
+
+	target, err := net.Dial("tcp", addr)
+
+	if err != nil {
+		_, _ = client.Write([]byte{5, 1, 0, 1, 0, 0, 0, 0, 0, 0})
+		_ = client.Close()
+		return
+	}
+
+	_, _ = client.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+
+	pipe(client, target)
+}
+
+// proxySettings returns the client settings reaching the server through the proxy configured by the variables
+// of the instance, its name being made of upper case letters only
+func proxySettings(server *versatest.Server, instance string, vars map[string]string) versa_client.Settings {
+
+	env := versa_client.Env{Instance: instance}
+
+	for key, value := range vars {
+
+		key = "PEPPAMON_VERSA_" + instance + "_" + key
+
+		_ = os.Setenv(key, value)
+		defer os.Unsetenv(key)
+	}
+
+	settings := server.ClientSettings()
+	settings.Proxy = versa_client.ProxyFromEnv(env)
+
+	return settings
+}
+
+func TestProxyConnectTunnel(t *testing.T) {
+	t.Parallel()
+
+	server := versatest.NewServer(testTenant("acme", 1))
+	defer server.Close()
+
+	proxyServer, proxy := newConnectProxy("proxyuser", "proxypass", http.StatusOK)
+	defer proxyServer.Close()
+
+	client := newTestClient(t, server, proxySettings(server, "CONNECTTUNNEL", map[string]string{
+		"PROXY_URL":      proxyServer.URL,
+		"PROXY_USERNAME": "proxyuser",
+		"PROXY_PASSWORD": "proxypass",
+	}))
+	defer client.Close()
+
+	if tunnels := proxy.Tunnels(); len(tunnels) == 0 || tunnels[0] != server.Hostname() {
+		t.Fatalf("got tunnels %v, want a tunnel to %v", tunnels, server.Hostname())
+	}
+}
+
+func TestProxySOCKS5Tunnel(t *testing.T) {
+	t.Parallel()
+
+	server := versatest.NewServer(testTenant("acme", 1))
+	defer server.Close()
+
+	listener, proxy := newSOCKS5Proxy(t)
+	defer listener.Close()
+
+	client := newTestClient(t, server, proxySettings(server, "SOCKSTUNNEL", map[string]string{
+		"PROXY_URL": "socks5://" + listener.Addr().String(),
+	}))
+	defer client.Close()
+
+	if tunnels := proxy.Tunnels(); len(tunnels) == 0 || tunnels[0] != server.Hostname() {
+		t.Fatalf("got tunnels %v, want a tunnel to %v", tunnels, server.Hostname())
+	}
+}
+
+func TestNoProxyBypass(t *testing.T) {
+	t.Parallel()
+
+	server := versatest.NewServer(testTenant("acme", 1))
+	defer server.Close()
+
+	proxyServer, proxy := newConnectProxy("", "", http.StatusOK)
+	defer proxyServer.Close()
+
+	host, _, _ := net.SplitHostPort(server.Hostname())
+
+	client := newTestClient(t, server, proxySettings(server, "NOPROXY", map[string]string{
+		"PROXY_URL": proxyServer.URL,
+		"NO_PROXY":  "versa.example.com," + host + "/32",
+	}))
+	defer client.Close()
+
+	if tunnels := proxy.Tunnels(); len(tunnels) != 0 {
+		t.Fatalf("got tunnels %v, want Versa to be reached directly", tunnels)
+	}
+}
+
+func TestProxyRefusedTunnel(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		instance string
+		username string
+		status   int
+
+		// wantTunnels is the number of CONNECT requests sent with the 3 attempts allowed
+		wantTunnels int
+	}{
+		{name: "proxy authentication required is not retried", instance: "PROXYAUTH", username: "proxyuser", status: http.StatusOK, wantTunnels: 1},
+		{name: "forbidden is not retried", instance: "PROXYFORBIDDEN", status: http.StatusForbidden, wantTunnels: 1},
+		{name: "bad gateway is retried", instance: "PROXYBADGATEWAY", status: http.StatusBadGateway, wantTunnels: 3},
+	}
+
+	for _, tt := range tests {
+
+		t.Run(tt.name, func(t *testing.T) {
+
+			server := versatest.NewServer(testTenant("acme", 1))
+			defer server.Close()
+
+			proxyServer, proxy := newConnectProxy(tt.username, "proxypass", tt.status)
+			defer proxyServer.Close()
+
+			client, err := versa_client.NewClient(proxySettings(server, tt.instance, map[string]string{
+				"PROXY_URL": proxyServer.URL,
+			}))
+
+			if err != nil {
+				t.Fatalf("NewClient() failed with error %v", err)
+			}
+
+			defer client.Close()
+
+			err = client.GetTenantList(context.Background())
+
+			proxyErr, ok := versa_client.AsProxyError(err)
+
+			if !ok {
+				t.Fatalf("GetTenantList() got error %v, want a proxy error", err)
+			}
+
+			wantStatus := tt.status
+
+			if tt.username != "" {
+				wantStatus = http.StatusProxyAuthRequired
+			}
+
+			if proxyErr.StatusCode != wantStatus {
+				t.Errorf("got proxy status %v, want %v", proxyErr.StatusCode, wantStatus)
+			}
+
+			if kind := versa_client.ErrorKindOf(err); kind != versa_client.ErrorKindProxy {
+				t.Errorf("got error kind %v, want %v", kind, versa_client.ErrorKindProxy)
+			}
+
+			if tunnels := proxy.Tunnels(); len(tunnels) != tt.wantTunnels {
+				t.Errorf("got %v CONNECT requests, want %v", len(tunnels), tt.wantTunnels)
+			}
+
+			if requests := server.Requests("login"); requests != 0 {
+				t.Errorf("got %v logins reaching Versa, want none", requests)
+			}
+		})
+	}
+}
@@ -0,0 +1,179 @@
+package versa_client
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// QueryType is the Versa Analytics "qt" parameter selecting the shape of the report
+type QueryType string
+
+const (
+	QueryTypeStats      QueryType = "stats"
+	QueryTypeTimeseries QueryType = "timeseries"
+	QueryTypeTable      QueryType = "table"
+	QueryTypeSummary    QueryType = "summary"
+)
+
+// CountAll asks Versa Analytics to return every row matching the query.
+// A zero Count leaves the parameter out and lets Versa apply its own default
+const CountAll = -1
+
+var (
+	queryIdentifierRegexp = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_-]*$`)
+	queryGapRegexp        = regexp.MustCompile(`^[0-9]+(MINUTE|HOUR|DAY|WEEK|MONTH)S?$`)
+)
+
+// QueryExpression is the Versa Analytics "q" parameter such as appUser(site,appId,user,accCkt)
+type QueryExpression struct {
+	Name    string
+	GroupBy []string
+}
+
+// String renders the expression the way Versa Analytics expects it in the "q" parameter
+func (e QueryExpression) String() string {
+	if len(e.GroupBy) == 0 {
+		return e.Name
+	}
+	return e.Name + "(" + strings.Join(e.GroupBy, ",") + ")"
+}
+
+// Query describes a Versa Analytics report to run against a tenant
+type Query struct {
+	// Report is a short identifier of the query used as self-metrics label
+	Report string
+
+	// Title is used to identify the query in logs
+	Title      string
+	Feature    string
+	Expression QueryExpression
+	Type       QueryType
+	Metrics    []string
+	Gap        string
+	DataSource string
+	Count      int
+
+	// Offset is the number of rows to skip, used to page through results truncated at Count rows
+	Offset int
+
+	// Window is the time span covered by a query aligned by TimeWindows, a single gap bucket when not set
+	Window time.Duration
+
+	// StartDate and EndDate are computed by TimeWindows when StartDate is empty
+	StartDate string
+	EndDate   string
+
+	// windowStart and windowEnd bound the points kept from the response of an aligned query
+	windowStart time.Time
+	windowEnd   time.Time
+}
+
+// Validate checks the query parameters before they get sent to Versa Analytics
+func (q Query) Validate() error {
+
+	if !queryIdentifierRegexp.MatchString(q.Feature) {
+		return fmt.Errorf("invalid feature %q for query %v", q.Feature, q.Title)
+	}
+
+	if !queryIdentifierRegexp.MatchString(q.Expression.Name) {
+		return fmt.Errorf("invalid query expression %q for query %v", q.Expression.Name, q.Title)
+	}
+
+	for _, field := range q.Expression.GroupBy {
+		if !queryIdentifierRegexp.MatchString(field) {
+			return fmt.Errorf("invalid group-by field %q for query %v", field, q.Title)
+		}
+	}
+
+	switch q.Type {
+	case QueryTypeStats, QueryTypeTimeseries, QueryTypeTable, QueryTypeSummary:
+	default:
+		return fmt.Errorf("invalid query type %q for query %v", q.Type, q.Title)
+	}
+
+	if len(q.Metrics) == 0 {
+		return fmt.Errorf("no metrics requested for query %v", q.Title)
+	}
+
+	for _, metric := range q.Metrics {
+		if !queryIdentifierRegexp.MatchString(metric) {
+			return fmt.Errorf("invalid metric %q for query %v", metric, q.Title)
+		}
+	}
+
+	if q.Gap != "" && !queryGapRegexp.MatchString(q.Gap) {
+		return fmt.Errorf("invalid gap %q for query %v", q.Gap, q.Title)
+	}
+
+	if q.Type == QueryTypeTimeseries && q.Gap == "" {
+		return fmt.Errorf("timeseries query %v requires a gap", q.Title)
+	}
+
+	if q.DataSource != "" && !queryIdentifierRegexp.MatchString(q.DataSource) {
+		return fmt.Errorf("invalid data source %q for query %v", q.DataSource, q.Title)
+	}
+
+	if q.Count < CountAll {
+		return fmt.Errorf("invalid count %v for query %v", q.Count, q.Title)
+	}
+
+	if q.Offset < 0 {
+		return fmt.Errorf("invalid offset %v for query %v", q.Offset, q.Title)
+	}
+
+	if q.StartDate == "" {
+		return fmt.Errorf("no start date set for query %v", q.Title)
+	}
+
+	return nil
+}
+
+// Values returns the URL encoded parameters of the query
+func (q Query) Values() (url.Values, error) {
+
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+
+	params := url.Values{}
+
+	params.Set("q", q.Expression.String())
+	params.Set("qt", string(q.Type))
+	params.Set("start-date", q.StartDate)
+
+	if q.EndDate != "" {
+		params.Set("end-date", q.EndDate)
+	}
+
+	if q.Gap != "" {
+		params.Set("gap", q.Gap)
+	}
+
+	if q.DataSource != "" {
+		params.Set("ds", q.DataSource)
+	}
+
+	if q.Count != 0 {
+		params.Set("count", strconv.Itoa(q.Count))
+	}
+
+	if q.Offset > 0 {
+		params.Set("from-count", strconv.Itoa(q.Offset))
+	}
+
+	for _, metric := range q.Metrics {
+		params.Add("metrics", metric)
+	}
+
+	return params, nil
+}
+
+// path returns the escaped URL path of the query for a given tenant
+func (q Query) path(tenant string) string {
+	return fmt.Sprintf("/versa/analytics/v1.0.0/data/provider/tenants/%s/features/%s/",
+		url.PathEscape(tenant), url.PathEscape(q.Feature))
+}
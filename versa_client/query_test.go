@@ -0,0 +1,166 @@
+package versa_client
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// testQuery returns a valid timeseries query, changed by modify
+func testQuery(modify func(q *Query)) Query {
+
+	q := Query{
+		Report:     "linkUsage",
+		Title:      "Circuit Bandwidth Usage",
+		Feature:    "SDWAN",
+		Expression: QueryExpression{Name: "linkusage", GroupBy: []string{"site", "accCkt"}},
+		Type:       QueryTypeTimeseries,
+		Metrics:    []string{"bw-rx", "bw-tx"},
+		Gap:        "1MINUTE",
+		StartDate:  "2020-03-02 10:00:00",
+		EndDate:    "2020-03-02 10:05:00",
+	}
+
+	if modify != nil {
+		modify(&q)
+	}
+
+	return q
+}
+
+func TestQueryValidate(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		modify  func(q *Query)
+		wantErr string
+	}{
+		{name: "valid"},
+		{name: "stats without gap", modify: func(q *Query) { q.Type, q.Gap = QueryTypeStats, "" }},
+		{name: "plural gap", modify: func(q *Query) { q.Gap = "15MINUTES" }},
+		{name: "expression without group-by", modify: func(q *Query) { q.Expression.GroupBy = nil }},
+		{name: "count all", modify: func(q *Query) { q.Count = CountAll }},
+		{name: "data source", modify: func(q *Query) { q.DataSource = "aggregate" }},
+		{name: "missing feature", modify: func(q *Query) { q.Feature = "" }, wantErr: "invalid feature"},
+		{name: "feature with a slash", modify: func(q *Query) { q.Feature = "SDWAN/../x" }, wantErr: "invalid feature"},
+		{name: "missing expression", modify: func(q *Query) { q.Expression.Name = "" }, wantErr: "invalid query expression"},
+		{name: "expression injecting parameters", modify: func(q *Query) { q.Expression.Name = "appUser&qt=table" }, wantErr: "invalid query expression"},
+		{name: "empty group-by field", modify: func(q *Query) { q.Expression.GroupBy = []string{"site", ""} }, wantErr: "invalid group-by field"},
+		{name: "group-by field with a comma", modify: func(q *Query) { q.Expression.GroupBy = []string{"site,appId"} }, wantErr: "invalid group-by field"},
+		{name: "missing type", modify: func(q *Query) { q.Type = "" }, wantErr: "invalid query type"},
+		{name: "unknown type", modify: func(q *Query) { q.Type = "graph" }, wantErr: "invalid query type"},
+		{name: "missing metrics", modify: func(q *Query) { q.Metrics = nil }, wantErr: "no metrics"},
+		{name: "invalid metric", modify: func(q *Query) { q.Metrics = []string{"bw rx"} }, wantErr: "invalid metric"},
+		{name: "invalid gap", modify: func(q *Query) { q.Gap = "5SECONDS" }, wantErr: "invalid gap"},
+		{name: "timeseries without gap", modify: func(q *Query) { q.Gap = "" }, wantErr: "requires a gap"},
+		{name: "invalid data source", modify: func(q *Query) { q.DataSource = "raw;drop" }, wantErr: "invalid data source"},
+		{name: "invalid count", modify: func(q *Query) { q.Count = -2 }, wantErr: "invalid count"},
+		{name: "negative offset", modify: func(q *Query) { q.Offset = -1 }, wantErr: "invalid offset"},
+		{name: "missing start date", modify: func(q *Query) { q.StartDate = "" }, wantErr: "no start date"},
+	}
+
+	for _, tt := range tests {
+
+		t.Run(tt.name, func(t *testing.T) {
+
+			err := testQuery(tt.modify).Validate()
+
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("Validate() failed with error %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Fatalf("Validate() got error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestQueryValues(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		modify func(q *Query)
+		want   string
+	}{
+		{
+			name: "timeseries",
+			want: "end-date=2020-03-02+10%3A05%3A00&gap=1MINUTE&metrics=bw-rx&metrics=bw-tx&q=linkusage%28site%2CaccCkt%29" +
+				"&qt=timeseries&start-date=2020-03-02+10%3A00%3A00",
+		},
+		{
+			name: "count, offset and data source",
+			modify: func(q *Query) {
+				q.Count, q.Offset, q.DataSource = 100, 200, "aggregate"
+			},
+			want: "count=100&ds=aggregate&end-date=2020-03-02+10%3A05%3A00&from-count=200&gap=1MINUTE&metrics=bw-rx" +
+				"&metrics=bw-tx&q=linkusage%28site%2CaccCkt%29&qt=timeseries&start-date=2020-03-02+10%3A00%3A00",
+		},
+		{
+			name: "count all with relative start date",
+			modify: func(q *Query) {
+				q.Type, q.Gap, q.Count, q.StartDate, q.EndDate = QueryTypeStats, "", CountAll, "15minutesAgo", ""
+				q.Expression.GroupBy = nil
+				q.Metrics = []string{"availability"}
+			},
+			want: "count=-1&metrics=availability&q=linkusage&qt=stats&start-date=15minutesAgo",
+		},
+	}
+
+	for _, tt := range tests {
+
+		t.Run(tt.name, func(t *testing.T) {
+
+			params, err := testQuery(tt.modify).Values()
+
+			if err != nil {
+				t.Fatalf("Values() failed with error %v", err)
+			}
+
+			if got := params.Encode(); got != tt.want {
+				t.Fatalf("Values() got\n%v\nwant\n%v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := testQuery(func(q *Query) { q.Metrics = nil }).Values(); err == nil {
+		t.Fatal("Values() accepted an invalid query")
+	}
+}
+
+func TestQueryPath(t *testing.T) {
+
+	tests := []struct {
+		tenant string
+		want   string
+	}{
+		{tenant: "acme", want: "/versa/analytics/v1.0.0/data/provider/tenants/acme/features/SDWAN/"},
+		{tenant: "acme/emea", want: "/versa/analytics/v1.0.0/data/provider/tenants/acme%2Femea/features/SDWAN/"},
+		{tenant: "Acme Corp", want: "/versa/analytics/v1.0.0/data/provider/tenants/Acme%20Corp/features/SDWAN/"},
+		{tenant: "100%", want: "/versa/analytics/v1.0.0/data/provider/tenants/100%25/features/SDWAN/"},
+		{tenant: "a?b#c", want: "/versa/analytics/v1.0.0/data/provider/tenants/a%3Fb%23c/features/SDWAN/"},
+	}
+
+	for _, tt := range tests {
+
+		got := testQuery(nil).path(tt.tenant)
+
+		if got != tt.want {
+			t.Errorf("path(%q) got %v, want %v", tt.tenant, got, tt.want)
+			continue
+		}
+
+		// The tenant is read back whole as a single path segment
+		parsed, err := url.Parse(got)
+
+		if err != nil {
+			t.Errorf("path(%q) is not a valid URL path: %v", tt.tenant, err)
+			continue
+		}
+
+		segments := strings.Split(parsed.EscapedPath(), "/")
+
+		if tenant, err := url.PathUnescape(segments[7]); err != nil || tenant != tt.tenant {
+			t.Errorf("path(%q) got tenant segment %q", tt.tenant, segments[7])
+		}
+	}
+}
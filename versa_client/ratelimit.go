@@ -0,0 +1,179 @@
+package versa_client
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lucabrasi83/peppamon_versa/logging"
+)
+
+// RateLimit is a token bucket refilled at QPS tokens per second and holding up to Burst tokens.
+// A zero QPS disables the limit
+type RateLimit struct {
+	QPS   float64
+	Burst int
+}
+
+// tokenBucket spaces out the requests sent to a Versa Analytics node
+type tokenBucket struct {
+	mu     sync.Mutex
+	limit  RateLimit
+	tokens float64
+	last   time.Time
+
+	// clock returns the current time, time.Now when nil
+	clock func() time.Time
+}
+
+func newTokenBucket(limit RateLimit) *tokenBucket {
+	return &tokenBucket{limit: limit, tokens: float64(limit.Burst), last: time.Now()}
+}
+
+func (b *tokenBucket) now() time.Time {
+	if b.clock == nil {
+		return time.Now()
+	}
+	return b.clock()
+}
+
+// reserve takes a token and returns how long to wait until it is actually available
+func (b *tokenBucket) reserve() time.Duration {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+
+	b.tokens = math.Min(float64(b.limit.Burst), b.tokens+now.Sub(b.last).Seconds()*b.limit.QPS)
+	b.last = now
+
+	b.tokens--
+
+	if b.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-b.tokens / b.limit.QPS * float64(time.Second))
+}
+
+// cancel gives back a reserved token that was not used
+func (b *tokenBucket) cancel() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.tokens++
+}
+
+// Wait blocks until a token is available or ctx is done and returns the time spent waiting
+func (b *tokenBucket) Wait(ctx context.Context) (time.Duration, error) {
+
+	if b == nil || b.limit.QPS <= 0 {
+		return 0, nil
+	}
+
+	delay := b.reserve()
+
+	if delay == 0 {
+		return 0, nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	start := b.now()
+
+	select {
+	case <-ctx.Done():
+		b.cancel()
+		return b.now().Sub(start), ctx.Err()
+	case <-timer.C:
+		return delay, nil
+	}
+}
+
+// rateLimitsFromEnv loads the per node rate limit from PEPPAMON_VERSA_RATE_LIMIT_QPS and PEPPAMON_VERSA_RATE_LIMIT_BURST
+// along with the per report overrides of PEPPAMON_VERSA_RATE_LIMIT_REPORTS given as report=qps or report=qps:burst
+func rateLimitsFromEnv(env Env) (RateLimit, map[string]RateLimit) {
+
+	qps := env.Float("PEPPAMON_VERSA_RATE_LIMIT_QPS", 0)
+
+	defaultLimit := RateLimit{
+		QPS:   qps,
+		Burst: env.Int("PEPPAMON_VERSA_RATE_LIMIT_BURST", defaultBurst(qps)),
+	}
+
+	if defaultLimit.QPS < 0 || (defaultLimit.QPS > 0 && defaultLimit.Burst < 1) {
+		logging.PeppaMonLog("fatal", "Invalid Versa Analytics rate limit %+v", defaultLimit)
+	}
+
+	reportLimits := make(map[string]RateLimit)
+
+	for _, item := range env.List("PEPPAMON_VERSA_RATE_LIMIT_REPORTS") {
+
+		tokens := strings.SplitN(item, "=", 2)
+
+		if len(tokens) != 2 {
+			logging.PeppaMonLog("fatal", "Invalid report rate limit %q, expected report=qps[:burst]", item)
+		}
+
+		values := strings.SplitN(tokens[1], ":", 2)
+
+		reportQPS, err := strconv.ParseFloat(strings.TrimSpace(values[0]), 64)
+
+		if err != nil || reportQPS <= 0 {
+			logging.PeppaMonLog("fatal", "Invalid rate %q for report %v", values[0], tokens[0])
+		}
+
+		limit := RateLimit{QPS: reportQPS, Burst: defaultBurst(reportQPS)}
+
+		if len(values) == 2 {
+			if limit.Burst, err = strconv.Atoi(strings.TrimSpace(values[1])); err != nil || limit.Burst < 1 {
+				logging.PeppaMonLog("fatal", "Invalid burst %q for report %v", values[1], tokens[0])
+			}
+		}
+
+		reportLimits[strings.TrimSpace(tokens[0])] = limit
+	}
+
+	return defaultLimit, reportLimits
+}
+
+// defaultBurst allows a second worth of requests at once
+func defaultBurst(qps float64) int {
+	return int(math.Max(1, math.Ceil(qps)))
+}
+
+// nodeLimiters holds the token buckets of a Versa Analytics node. Reports with their own limit
+// use a dedicated bucket instead of the one shared by the other reports
+type nodeLimiters struct {
+	shared  *tokenBucket
+	reports map[string]*tokenBucket
+}
+
+func newNodeLimiters(defaultLimit RateLimit, reportLimits map[string]RateLimit) *nodeLimiters {
+
+	limiters := &nodeLimiters{
+		shared:  newTokenBucket(defaultLimit),
+		reports: make(map[string]*tokenBucket, len(reportLimits)),
+	}
+
+	for report, limit := range reportLimits {
+		limiters.reports[report] = newTokenBucket(limit)
+	}
+
+	return limiters
+}
+
+// Wait blocks until the report may send a request to the node
+func (l *nodeLimiters) Wait(ctx context.Context, report string) (time.Duration, error) {
+
+	if bucket, ok := l.reports[report]; ok {
+		return bucket.Wait(ctx)
+	}
+
+	return l.shared.Wait(ctx)
+}
@@ -0,0 +1,126 @@
+package versa_client
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// testBucket returns a full token bucket along with its clock
+func testBucket(limit RateLimit) (*tokenBucket, *time.Time) {
+
+	now := time.Date(2020, 3, 2, 10, 0, 0, 0, time.UTC)
+
+	bucket := &tokenBucket{limit: limit, tokens: float64(limit.Burst), last: now}
+	bucket.clock = func() time.Time { return now }
+
+	return bucket, &now
+}
+
+func TestTokenBucketBurst(t *testing.T) {
+
+	bucket, _ := testBucket(RateLimit{QPS: 2, Burst: 3})
+
+	for i := 0; i < 3; i++ {
+		if delay := bucket.reserve(); delay != 0 {
+			t.Fatalf("request %v of the burst got delay %v, want none", i+1, delay)
+		}
+	}
+
+	// Every request past the burst waits for its own token, refilled every 500ms
+	for i, want := range []time.Duration{500 * time.Millisecond, time.Second, 1500 * time.Millisecond} {
+		if delay := bucket.reserve(); delay != want {
+			t.Fatalf("request %v past the burst got delay %v, want %v", i+1, delay, want)
+		}
+	}
+}
+
+func TestTokenBucketRefill(t *testing.T) {
+
+	bucket, now := testBucket(RateLimit{QPS: 4, Burst: 2})
+
+	bucket.reserve()
+	bucket.reserve()
+
+	// Half a token is refilled after 125ms
+	*now = now.Add(125 * time.Millisecond)
+
+	if delay := bucket.reserve(); delay != 125*time.Millisecond {
+		t.Fatalf("got delay %v with half a token, want 125ms", delay)
+	}
+
+	// The bucket is refilled up to its burst only, however long it stayed idle
+	*now = now.Add(time.Hour)
+
+	for i := 0; i < 2; i++ {
+		if delay := bucket.reserve(); delay != 0 {
+			t.Fatalf("request %v after an idle hour got delay %v, want none", i+1, delay)
+		}
+	}
+
+	if delay := bucket.reserve(); delay != 250*time.Millisecond {
+		t.Fatalf("got delay %v past the refilled burst, want 250ms", delay)
+	}
+}
+
+func TestTokenBucketWaitCancelled(t *testing.T) {
+
+	bucket, _ := testBucket(RateLimit{QPS: 1.0 / 3600, Burst: 1})
+
+	if waited, err := bucket.Wait(context.Background()); waited != 0 || err != nil {
+		t.Fatalf("Wait() got %v, %v for the burst, want no wait", waited, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	if _, err := bucket.Wait(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Wait() got error %v while waiting an hour, want %v", err, context.DeadlineExceeded)
+	}
+
+	// The token of the cancelled request is given back to the next one
+	if delay := bucket.reserve(); delay != time.Hour {
+		t.Fatalf("got delay %v after the cancelled wait, want 1h", delay)
+	}
+}
+
+func TestTokenBucketDisabled(t *testing.T) {
+
+	var unset *tokenBucket
+
+	for _, bucket := range []*tokenBucket{unset, newTokenBucket(RateLimit{})} {
+
+		for i := 0; i < 10; i++ {
+			if waited, err := bucket.Wait(context.Background()); waited != 0 || err != nil {
+				t.Fatalf("Wait() got %v, %v without limit, want no wait", waited, err)
+			}
+		}
+	}
+}
+
+func TestNodeLimitersReportBuckets(t *testing.T) {
+
+	limiters := newNodeLimiters(RateLimit{QPS: 1.0 / 3600, Burst: 1}, map[string]RateLimit{
+		"appUser": {QPS: 1.0 / 3600, Burst: 1},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// Each bucket allows a request at once, a second one has to wait
+	for _, report := range []string{"appUser", "sdwan"} {
+
+		if _, err := limiters.Wait(ctx, report); err != nil {
+			t.Fatalf("Wait(%v) got error %v for the first request, want none", report, err)
+		}
+
+		if _, err := limiters.Wait(ctx, report); err == nil {
+			t.Fatalf("Wait(%v) did not wait for the second request", report)
+		}
+	}
+
+	// Reports without their own limit share the default bucket
+	if _, err := limiters.Wait(ctx, "usage"); err == nil {
+		t.Fatalf("Wait(usage) did not share the exhausted default bucket")
+	}
+}
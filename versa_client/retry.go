@@ -0,0 +1,249 @@
+package versa_client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/lucabrasi83/peppamon_versa/logging"
+)
+
+// RetryPolicy controls how requests failing with a transient error are retried
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts including the first one
+	MaxAttempts int
+
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+
+	// Jitter is the fraction of each backoff that is randomized, between 0 and 1
+	Jitter float64
+
+	RetryableStatusCodes map[int]bool
+
+	// Deadline bounds the total time spent on a request including every retry
+	Deadline time.Duration
+}
+
+// retryPolicyFromEnv loads the retry policy from the PEPPAMON_VERSA_RETRY_* environment variables
+func retryPolicyFromEnv(env Env) RetryPolicy {
+
+	statusCodes := map[int]bool{
+		http.StatusTooManyRequests:    true,
+		http.StatusBadGateway:         true,
+		http.StatusServiceUnavailable: true,
+		http.StatusGatewayTimeout:     true,
+	}
+
+	if codes := env.List("PEPPAMON_VERSA_RETRY_STATUS_CODES"); len(codes) > 0 {
+		statusCodes = make(map[int]bool, len(codes))
+
+		for _, code := range codes {
+			statusCode, err := strconv.Atoi(code)
+
+			if err != nil {
+				logging.PeppaMonLog("fatal", "Invalid HTTP status code %q in PEPPAMON_VERSA_RETRY_STATUS_CODES", code)
+			}
+
+			statusCodes[statusCode] = true
+		}
+	}
+
+	policy := RetryPolicy{
+		MaxAttempts:          env.Int("PEPPAMON_VERSA_RETRY_MAX_ATTEMPTS", 3),
+		BaseBackoff:          env.Duration("PEPPAMON_VERSA_RETRY_BASE_BACKOFF", 500*time.Millisecond),
+		MaxBackoff:           env.Duration("PEPPAMON_VERSA_RETRY_MAX_BACKOFF", 10*time.Second),
+		Jitter:               env.Float("PEPPAMON_VERSA_RETRY_JITTER", 0.2),
+		RetryableStatusCodes: statusCodes,
+		Deadline:             env.Duration("PEPPAMON_VERSA_RETRY_DEADLINE", 2*time.Minute),
+	}
+
+	if policy.MaxAttempts < 1 || policy.Jitter < 0 || policy.Jitter > 1 {
+		logging.PeppaMonLog("fatal", "Invalid Versa Analytics retry policy %+v", policy)
+	}
+
+	return policy
+}
+
+// backoff returns the exponential delay before the given retry, starting at 1, with jitter applied
+func (p RetryPolicy) backoff(retry int) time.Duration {
+
+	delay := float64(p.BaseBackoff) * math.Pow(2, float64(retry-1))
+
+	if delay > float64(p.MaxBackoff) {
+		delay = float64(p.MaxBackoff)
+	}
+
+	delay *= 1 + p.Jitter*(2*rand.Float64()-1)
+
+	return time.Duration(delay)
+}
+
+// retryAfter parses the Retry-After header given either in seconds or as an HTTP date
+func retryAfter(res *http.Response) (time.Duration, bool) {
+
+	header := res.Header.Get("Retry-After")
+
+	if header == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(header); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	if date, err := http.ParseTime(header); err == nil {
+		return time.Until(date), true
+	}
+
+	return 0, false
+}
+
+// retryableError reports whether a transport error is worth retrying such as a reset or refused connection
+func retryableError(err error) bool {
+
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) {
+		return true
+	}
+
+	// Failing to reach a node is retried as the next attempt may go to another node of the cluster
+	var opErr *net.OpError
+
+	if errors.As(err, &opErr) {
+		return true
+	}
+
+	var netErr net.Error
+
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// cancelOnClose releases the request context once the response body has been consumed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c cancelOnClose) Close() error {
+	defer c.cancel()
+	return c.ReadCloser.Close()
+}
+
+// getWithRetry sends a GET request and retries it according to the retry policy.
+// The last response is returned as is, whatever its status code
+func (v *VersaAnalyticsClient) getWithRetry(ctx context.Context, report, queryTitle,
+	reqPath string) (*http.Response, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, v.Retry.Deadline)
+
+	for attempt := 1; ; attempt++ {
+
+		node := v.Nodes.Pick()
+
+		waited, err := node.limiters.Wait(ctx, report)
+
+		v.metrics.rateLimitWait.WithLabelValues(report).Observe(waited.Seconds())
+
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+
+		httpNewReq, err := http.NewRequestWithContext(ctx, "GET", v.Protocol+"://"+node.Hostname+reqPath, nil)
+
+		if err != nil {
+			cancel()
+			logging.PeppaMonLog("error", "unable to build HTTP request for %v with error %v", queryTitle, err)
+			return nil, err
+		}
+
+		httpNewReq.Header.Add("Content-Type", "application/json")
+
+		res, err := v.do(node, httpNewReq)
+
+		// A proxy failure says nothing about the health of the node
+		proxyErr, viaProxy := AsProxyError(err)
+
+		// Mark the node down so that the next attempt fails over to another node, or back up once it answers
+		switch {
+		case err != nil && !viaProxy && ctx.Err() == nil && retryableError(err):
+			v.Nodes.setHealth(node, false, err)
+		case err == nil && res.StatusCode < http.StatusInternalServerError:
+			v.Nodes.setHealth(node, true, nil)
+		}
+
+		var reason string
+
+		switch {
+		case viaProxy:
+			if ctx.Err() == nil && proxyErr.retryable() {
+				reason = "proxy"
+			}
+		case err != nil && retryableError(err):
+			reason = "transport"
+		case err == nil && v.Retry.RetryableStatusCodes[res.StatusCode]:
+			reason = strconv.Itoa(res.StatusCode)
+		}
+
+		if reason == "" || attempt >= v.Retry.MaxAttempts {
+			if err != nil {
+				cancel()
+				return nil, err
+			}
+			res.Body = cancelOnClose{ReadCloser: res.Body, cancel: cancel}
+			return res, nil
+		}
+
+		wait := v.Retry.backoff(attempt)
+
+		if err == nil {
+			if delay, ok := retryAfter(res); ok && delay > wait {
+				wait = delay
+			}
+			_ = res.Body.Close()
+		}
+
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(wait).After(deadline) {
+			cancel()
+			logging.PeppaMonLog("error", "Giving up on %v as retrying in %v would exceed the deadline", queryTitle, wait)
+
+			if err != nil {
+				return nil, err
+			}
+			return nil, &Error{
+				Kind:       ErrorKindHTTPStatus,
+				Report:     report,
+				StatusCode: res.StatusCode,
+				Err:        fmt.Errorf("versa analytics responded with HTTP error code %v for %v", res.StatusCode, queryTitle),
+			}
+		}
+
+		v.metrics.requestRetries.WithLabelValues(report, reason).Inc()
+
+		logging.PeppaMonLog("warning", "Retrying %v in %v after attempt %v failed (reason %v)",
+			queryTitle, wait.Round(time.Millisecond), attempt, reason)
+
+		timer := time.NewTimer(wait)
+
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			cancel()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
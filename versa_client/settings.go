@@ -0,0 +1,100 @@
+package versa_client
+
+import (
+	"fmt"
+	"time"
+)
+
+// Settings holds everything needed to build a Versa Analytics client
+type Settings struct {
+	// Hostnames lists the nodes of the Versa Analytics cluster
+	Hostnames []string
+
+	TLS      TLSSettings
+	Proxy    ProxyFunc
+	Auth     AuthSettings
+	Fixtures FixtureSettings
+
+	// Workers bounds the number of concurrent requests across every tenant and report
+	Workers int
+
+	// NodeStrategy is sticky or round-robin
+	NodeStrategy string
+
+	// HealthCheckInterval is how often every node is probed, nodes are not probed when zero
+	HealthCheckInterval time.Duration
+
+	// NodeRetryInterval is how long a node marked down is skipped before a query tries it again, a minute
+	// when zero
+	NodeRetryInterval time.Duration
+
+	RateLimit        RateLimit
+	ReportRateLimits map[string]RateLimit
+
+	Retry            RetryPolicy
+	ReportPriorities map[string]int
+	MaxRows          int
+	Windows          TimeWindows
+
+	// Clock returns the time the queries are aligned on and the tenant cache ages by, time.Now when nil.
+	// It is stopped at the recording time when replaying fixtures
+	Clock func() time.Time
+
+	Breaker      BreakerSettings
+	TenantFilter TenantFilter
+
+	// TenantCacheTTL is how long discovered tenants are reused across scrapes, tenants are discovered on
+	// every scrape when zero
+	TenantCacheTTL time.Duration
+}
+
+// SettingsFromEnv loads the settings of a Versa instance from the PEPPAMON_VERSA_* environment variables.
+// An empty instance name reads the global variables only
+func SettingsFromEnv(instance string) Settings {
+
+	env := Env{Instance: instance}
+
+	defaultRateLimit, reportRateLimits := rateLimitsFromEnv(env)
+
+	return Settings{
+		Hostnames:           env.List("PEPPAMON_VERSA_ANALYTICS_HOSTNAME"),
+		TLS:                 TLSSettingsFromEnv(env, "Versa Analytics", "PEPPAMON_VERSA_ANALYTICS_TLS_"),
+		Proxy:               ProxyFromEnv(env),
+		Auth:                authSettingsFromEnv(env),
+		Fixtures:            FixtureSettingsFromEnv(env),
+		Workers:             env.Int("PEPPAMON_VERSA_WORKERS", 20),
+		NodeStrategy:        env.String("PEPPAMON_VERSA_ANALYTICS_NODE_STRATEGY", NodeStrategySticky),
+		HealthCheckInterval: env.Duration("PEPPAMON_VERSA_ANALYTICS_HEALTH_CHECK_INTERVAL", 30*time.Second),
+		NodeRetryInterval:   env.Duration("PEPPAMON_VERSA_ANALYTICS_NODE_RETRY_INTERVAL", defaultNodeRetryInterval),
+		RateLimit:           defaultRateLimit,
+		ReportRateLimits:    reportRateLimits,
+		Retry:               retryPolicyFromEnv(env),
+		ReportPriorities:    reportPrioritiesFromEnv(env),
+		MaxRows:             env.Int("PEPPAMON_VERSA_PAGINATION_MAX_ROWS", 150000),
+		Windows:             timeWindowsFromEnv(env),
+		Breaker:             breakerSettingsFromEnv(env),
+		TenantFilter:        tenantFilterFromEnv(env),
+		TenantCacheTTL:      env.Duration("PEPPAMON_VERSA_TENANT_CACHE_TTL", 10*time.Minute),
+	}
+}
+
+// validate returns the first setting the client cannot be built with
+func (s Settings) validate() error {
+
+	switch {
+	case len(s.Hostnames) == 0:
+		return fmt.Errorf("at least one Versa Analytics node is required")
+	case s.Workers < 1:
+		return fmt.Errorf("at least one worker is required, got %v", s.Workers)
+	case s.NodeStrategy != NodeStrategySticky && s.NodeStrategy != NodeStrategyRoundRobin:
+		return fmt.Errorf("unsupported Versa Analytics node strategy %v", s.NodeStrategy)
+	case s.MaxRows < 1:
+		return fmt.Errorf("the Versa Analytics pagination ceiling must be at least one row, got %v", s.MaxRows)
+	case s.Retry.MaxAttempts < 1 || s.Retry.Deadline <= 0:
+		return fmt.Errorf("invalid Versa Analytics retry policy %+v", s.Retry)
+	case s.Windows.Location == nil:
+		return fmt.Errorf("the Versa Analytics timezone is required")
+	}
+
+	return nil
+}
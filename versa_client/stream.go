@@ -0,0 +1,344 @@
+package versa_client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/lucabrasi83/peppamon_versa/logging"
+)
+
+// SeriesFunc receives the series of a tenant one at a time as they are decoded.
+// It may be called concurrently for different tenants
+type SeriesFunc func(tenant string, series TimeseriesSeries)
+
+// expectDelim reads the next JSON token and checks it is the given delimiter
+func expectDelim(decoder *json.Decoder, delim json.Delim) error {
+
+	token, err := decoder.Token()
+
+	if err != nil {
+		return err
+	}
+
+	if token != delim {
+		return fmt.Errorf("expected %v in timeseries response, got %v", delim, token)
+	}
+
+	return nil
+}
+
+// skipValue reads and discards the next JSON value, however deeply nested
+func skipValue(decoder *json.Decoder) error {
+
+	depth := 0
+
+	for {
+		token, err := decoder.Token()
+
+		if err != nil {
+			return err
+		}
+
+		switch token {
+		case json.Delim('['), json.Delim('{'):
+			depth++
+		case json.Delim(']'), json.Delim('}'):
+			depth--
+		}
+
+		if depth == 0 {
+			return nil
+		}
+	}
+}
+
+// decodeTimeseries reads a timeseries response token by token and hands every series to fn as soon as it is
+// decoded, so that only a single series is held in memory. It returns the number of rows read, counted as
+// the series name changes since the series of a row follow each other, along with the query time reported
+// by Versa Analytics
+func decodeTimeseries(r io.Reader, groupBy []string, fn func(series TimeseriesSeries)) (int, int, error) {
+
+	decoder := json.NewDecoder(r)
+	decoder.UseNumber()
+
+	if err := expectDelim(decoder, '{'); err != nil {
+		return 0, 0, err
+	}
+
+	rows := 0
+	qTime := 0
+	previous := ""
+
+	for decoder.More() {
+
+		key, err := decoder.Token()
+
+		if err != nil {
+			return 0, 0, err
+		}
+
+		switch key {
+		case "data":
+			token, err := decoder.Token()
+
+			if err != nil {
+				return 0, 0, err
+			}
+
+			// Versa Analytics returns a null series list when no row matches the query
+			if token == nil {
+				continue
+			}
+
+			if token != json.Delim('[') {
+				return 0, 0, fmt.Errorf("expected the series array in timeseries response, got %v", token)
+			}
+
+			for decoder.More() {
+
+				var series TimeseriesSeries
+
+				if err := decodeSeries(decoder, &series); err != nil {
+					return 0, 0, err
+				}
+
+				series.splitGroupBy(groupBy)
+
+				if rows == 0 || series.Name != previous {
+					rows++
+					previous = series.Name
+				}
+
+				fn(series)
+			}
+
+			if err := expectDelim(decoder, ']'); err != nil {
+				return 0, 0, err
+			}
+
+		case "qTime":
+			if err := decoder.Decode(&qTime); err != nil {
+				return 0, 0, err
+			}
+
+		default:
+			if err := skipValue(decoder); err != nil {
+				return 0, 0, err
+			}
+		}
+	}
+
+	if err := expectDelim(decoder, '}'); err != nil {
+		return 0, 0, err
+	}
+
+	return rows, qTime, nil
+}
+
+// decodeSeries reads a single series without going through reflection
+func decodeSeries(decoder *json.Decoder, series *TimeseriesSeries) error {
+
+	if err := expectDelim(decoder, '{'); err != nil {
+		return err
+	}
+
+	for decoder.More() {
+
+		key, err := decoder.Token()
+
+		if err != nil {
+			return err
+		}
+
+		var field *string
+
+		switch key {
+		case "name":
+			field = &series.Name
+		case "type":
+			field = &series.Type
+		case "metric":
+			field = &series.Metric
+		case "metricName":
+			field = &series.MetricName
+		case "label":
+			field = &series.Label
+		case "data":
+			if series.Points, err = decodePoints(decoder); err != nil {
+				return err
+			}
+			continue
+		default:
+			if err := skipValue(decoder); err != nil {
+				return err
+			}
+			continue
+		}
+
+		token, err := decoder.Token()
+
+		if err != nil {
+			return err
+		}
+
+		switch value := token.(type) {
+		case string:
+			*field = value
+		case nil:
+		default:
+			return fmt.Errorf("expected a string for series field %v, got %v", key, token)
+		}
+	}
+
+	return expectDelim(decoder, '}')
+}
+
+// decodePoints reads the [timestamp, value] pairs of a series
+func decodePoints(decoder *json.Decoder) ([]TimeseriesPoint, error) {
+
+	token, err := decoder.Token()
+
+	if err != nil || token == nil {
+		return nil, err
+	}
+
+	if token != json.Delim('[') {
+		return nil, fmt.Errorf("expected the series points array, got %v", token)
+	}
+
+	var points []TimeseriesPoint
+
+	for decoder.More() {
+
+		point, err := decodePoint(decoder)
+
+		if err != nil {
+			return nil, err
+		}
+
+		points = append(points, point)
+	}
+
+	if err := expectDelim(decoder, ']'); err != nil {
+		return nil, err
+	}
+
+	return points, nil
+}
+
+// decodePoint reads a [timestamp, value] pair where the timestamp is in milliseconds since epoch.
+// Values other than numbers and numeric strings make the point invalid
+func decodePoint(decoder *json.Decoder) (TimeseriesPoint, error) {
+
+	if err := expectDelim(decoder, '['); err != nil {
+		return TimeseriesPoint{}, err
+	}
+
+	timestamp, err := decoder.Token()
+
+	if err != nil {
+		return TimeseriesPoint{}, err
+	}
+
+	epoch, ok := timestamp.(json.Number)
+
+	if !ok {
+		return TimeseriesPoint{}, fmt.Errorf("invalid timestamp %v in timeseries point", timestamp)
+	}
+
+	epochMs, err := epoch.Float64()
+
+	if err != nil {
+		return TimeseriesPoint{}, fmt.Errorf("invalid timestamp %v in timeseries point: %v", epoch, err)
+	}
+
+	if !decoder.More() {
+		return TimeseriesPoint{}, fmt.Errorf("timeseries point at %v does not hold a value", epoch)
+	}
+
+	value, err := decoder.Token()
+
+	if err != nil {
+		return TimeseriesPoint{}, err
+	}
+
+	point := TimeseriesPoint{Timestamp: time.Unix(0, int64(epochMs)*int64(time.Millisecond))}
+
+	switch value := value.(type) {
+	case json.Number:
+		point.Value, point.Valid = parsePointString(string(value))
+	case string:
+		point.Value, point.Valid = parsePointString(value)
+	case json.Delim:
+		return TimeseriesPoint{}, fmt.Errorf("invalid value in timeseries point at %v", epoch)
+	}
+
+	if err := expectDelim(decoder, ']'); err != nil {
+		return TimeseriesPoint{}, fmt.Errorf("timeseries point at %v does not hold a timestamp and a value", epoch)
+	}
+
+	return point, nil
+}
+
+// StreamTimeseries runs a timeseries query built by BuildQuery for the tenant, paging through truncated
+// results, and hands every series to fn as it is decoded instead of holding the whole result in memory
+func (v *VersaAnalyticsClient) StreamTimeseries(ctx context.Context, tenant string, q Query,
+	fn func(series TimeseriesSeries)) (int, error) {
+
+	page := q
+	qTime := 0
+
+	for {
+		var rows, pageQTime int
+
+		err := v.RunStream(ctx, tenant, page, func(r io.Reader) error {
+
+			var err error
+
+			rows, pageQTime, err = decodeTimeseries(r, q.Expression.GroupBy, func(series TimeseriesSeries) {
+				q.inWindow(&series)
+				fn(series)
+			})
+
+			return err
+		})
+
+		if err != nil {
+			return qTime, err
+		}
+
+		qTime += pageQTime
+
+		// A page holding fewer rows than requested is the last one
+		if page.Count <= 0 || rows < page.Count {
+			return qTime, nil
+		}
+
+		page.Offset += rows
+
+		if page.Offset >= v.MaxRows {
+			v.metrics.paginationCeilingReached.WithLabelValues(q.Report).Inc()
+
+			logging.PeppaMonLog("warning", "%v for tenant %v stopped at the ceiling of %v rows, results are incomplete",
+				q.Title, tenant, v.MaxRows)
+
+			return qTime, nil
+		}
+	}
+}
+
+// streamTimeseries streams the series of the query for every tenant to fn and returns the failures per tenant.
+// Series already handed over for a tenant are not taken back when one of its later pages fails
+func (v *VersaAnalyticsClient) streamTimeseries(ctx context.Context, q Query, fn SeriesFunc) error {
+	return v.forEachTenant(ctx, q.Report, func(tenant string) error {
+
+		_, err := v.StreamTimeseries(ctx, tenant, q, func(series TimeseriesSeries) {
+			fn(tenant, series)
+		})
+
+		return err
+	})
+}
@@ -0,0 +1,143 @@
+package versa_client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+var benchmarkGroupBy = []string{"site", "appId", "user", "accCkt"}
+
+// timeseriesPayload builds an application usage response of the given number of rows, each with a rx and
+// a tx series of five points
+func timeseriesPayload(rows int) []byte {
+
+	var buf bytes.Buffer
+
+	buf.WriteString(`{"qTime": 42, "data": [`)
+
+	for i := 0; i < rows; i++ {
+		for j, metric := range []string{"bw-rx", "bw-tx"} {
+
+			if i > 0 || j > 0 {
+				buf.WriteByte(',')
+			}
+
+			fmt.Fprintf(&buf, `{"name": "branch%v,app%v,10.0.%v.%v,MPLS", "type": "timeseries", "metric": %q, `+
+				`"metricName": %q, "label": "", "data": [`, i%200, i%500, i/256%256, i%256, metric, metric)
+
+			for k := 0; k < 5; k++ {
+				if k > 0 {
+					buf.WriteByte(',')
+				}
+				fmt.Fprintf(&buf, `[%v, %v.5]`, 1573000000000+k*60000, i*k)
+			}
+
+			buf.WriteString(`]}`)
+		}
+	}
+
+	buf.WriteString(`]}`)
+
+	return buf.Bytes()
+}
+
+func TestDecodeTimeseriesMatchesUnmarshal(t *testing.T) {
+
+	payload := []byte(`{"qTime": 7, "data": [{"name": "branch1,app1,10.0.0.1,MPLS", "metric": "bw-rx", ` +
+		`"data": [[1573000000000, 1.5], [1573000060000, "2"], [1573000120000, null], [1573000180000, "NaN"]]}]}`)
+
+	var result TimeseriesResult
+
+	if err := json.Unmarshal(payload, &result); err != nil {
+		t.Fatalf("json.Unmarshal() failed with error %v", err)
+	}
+
+	var streamed []TimeseriesSeries
+
+	rows, qTime, err := decodeTimeseries(bytes.NewReader(payload), nil, func(series TimeseriesSeries) {
+		streamed = append(streamed, series)
+	})
+
+	if err != nil {
+		t.Fatalf("decodeTimeseries() failed with error %v", err)
+	}
+
+	if rows != 1 || qTime != result.QTime || !reflect.DeepEqual(streamed, result.Series) {
+		t.Fatalf("decodeTimeseries() got %+v, json.Unmarshal() got %+v", streamed, result.Series)
+	}
+
+	var point TimeseriesPoint
+
+	if err := json.Unmarshal([]byte(`[1573000000000]`), &point); err == nil {
+		t.Fatal("json.Unmarshal() accepted a point without a value")
+	}
+}
+
+func TestDecodeTimeseriesRows(t *testing.T) {
+
+	// Two rows may share a name once their group-by values are truncated, they are still counted apart
+	payload := []byte(`{"data": [` +
+		`{"name": "branch1,MPLS", "metric": "bw-rx", "data": [[1573000000000, 1]]},` +
+		`{"name": "branch1,MPLS", "metric": "bw-tx", "data": [[1573000000000, 2]]},` +
+		`{"name": "branch2,MPLS", "metric": "bw-rx", "data": [[1573000000000, 3]]},` +
+		`{"name": "branch1,MPLS", "metric": "bw-rx", "data": [[1573000000000, 4]]}]}`)
+
+	series := 0
+
+	rows, _, err := decodeTimeseries(bytes.NewReader(payload), nil, func(TimeseriesSeries) { series++ })
+
+	if err != nil {
+		t.Fatalf("decodeTimeseries() failed with error %v", err)
+	}
+
+	if rows != 3 || series != 4 {
+		t.Fatalf("decodeTimeseries() got %v rows and %v series, want 3 rows and 4 series", rows, series)
+	}
+}
+
+func BenchmarkDecodeTimeseriesResult(b *testing.B) {
+
+	payload := timeseriesPayload(15000)
+
+	b.SetBytes(int64(len(payload)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+
+		var result TimeseriesResult
+
+		if err := json.NewDecoder(bytes.NewReader(payload)).Decode(&result); err != nil {
+			b.Fatal(err)
+		}
+
+		for j := range result.Series {
+			result.Series[j].splitGroupBy(benchmarkGroupBy)
+		}
+	}
+}
+
+func BenchmarkDecodeTimeseriesStream(b *testing.B) {
+
+	payload := timeseriesPayload(15000)
+
+	b.SetBytes(int64(len(payload)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+
+		rows, _, err := decodeTimeseries(bytes.NewReader(payload), benchmarkGroupBy, func(series TimeseriesSeries) {})
+
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		if rows != 15000 {
+			b.Fatalf("got %v rows, want 15000", rows)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package versa_client
+
+import (
+	"context"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lucabrasi83/peppamon_versa/logging"
+)
+
+// tenantMatcher matches a tenant name against an exact name, a glob such as lab-* or a regex written as /regex/
+type tenantMatcher func(tenant string) bool
+
+func newTenantMatcher(rule string) tenantMatcher {
+
+	switch {
+	case len(rule) > 2 && strings.HasPrefix(rule, "/") && strings.HasSuffix(rule, "/"):
+		re, err := regexp.Compile(rule[1 : len(rule)-1])
+
+		if err != nil {
+			logging.PeppaMonLog("fatal", "Invalid tenant filter regex %v with error %v", rule, err)
+		}
+
+		return re.MatchString
+
+	case strings.ContainsAny(rule, "*?["):
+		if _, err := path.Match(rule, ""); err != nil {
+			logging.PeppaMonLog("fatal", "Invalid tenant filter glob %v with error %v", rule, err)
+		}
+
+		return func(tenant string) bool {
+			matched, _ := path.Match(rule, tenant)
+			return matched
+		}
+
+	default:
+		return func(tenant string) bool {
+			return tenant == rule
+		}
+	}
+}
+
+// TenantFilter selects the tenants to monitor. A tenant is monitored when it matches one of the include rules,
+// or when there are none, and matches none of the exclude rules
+type TenantFilter struct {
+	Include []tenantMatcher
+	Exclude []tenantMatcher
+}
+
+// tenantFilterFromEnv loads the comma separated rules of PEPPAMON_VERSA_TENANT_INCLUDE and PEPPAMON_VERSA_TENANT_EXCLUDE
+func tenantFilterFromEnv(env Env) TenantFilter {
+
+	var filter TenantFilter
+
+	for _, rule := range env.List("PEPPAMON_VERSA_TENANT_INCLUDE") {
+		filter.Include = append(filter.Include, newTenantMatcher(rule))
+	}
+
+	for _, rule := range env.List("PEPPAMON_VERSA_TENANT_EXCLUDE") {
+		filter.Exclude = append(filter.Exclude, newTenantMatcher(rule))
+	}
+
+	return filter
+}
+
+// Monitored reports whether the tenant passes the filter
+func (f TenantFilter) Monitored(tenant string) bool {
+
+	for _, exclude := range f.Exclude {
+		if exclude(tenant) {
+			return false
+		}
+	}
+
+	if len(f.Include) == 0 {
+		return true
+	}
+
+	for _, include := range f.Include {
+		if include(tenant) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Apply returns the tenants of the list passing the filter
+func (f TenantFilter) Apply(tenants VersaTenantList) VersaTenantList {
+
+	monitored := tenants[:0:0]
+
+	for _, tenant := range tenants {
+		if f.Monitored(tenant.TenantName) {
+			monitored = append(monitored, tenant)
+		}
+	}
+
+	return monitored
+}
+
+// tenantCache holds the tenants discovered on Versa Analytics until they expire
+type tenantCache struct {
+	mu        sync.Mutex
+	tenants   VersaTenantList
+	fetchedAt time.Time
+}
+
+// cachedTenants returns the cached tenants when they are younger than the cache TTL
+func (v *VersaAnalyticsClient) cachedTenants() (VersaTenantList, bool) {
+
+	v.tenantCache.mu.Lock()
+	defer v.tenantCache.mu.Unlock()
+
+	if v.TenantCacheTTL <= 0 || v.tenantCache.fetchedAt.IsZero() || v.now().Sub(v.tenantCache.fetchedAt) > v.TenantCacheTTL {
+		return nil, false
+	}
+
+	return v.tenantCache.tenants, true
+}
+
+// discoverTenants requests the tenant list from Versa Analytics, filters it and caches the result
+func (v *VersaAnalyticsClient) discoverTenants(ctx context.Context) (VersaTenantList, error) {
+
+	logging.PeppaMonLog("info", "Started Batch Job to fetch Versa Tenants")
+
+	reqPath := "/versa/analytics/v1.0.0/data/provider/features/SDWAN/tenants?count=-1"
+
+	var tenantList VersaTenantList
+
+	err := v.getJSON(ctx, ReportTenants, "Get Tenants List", reqPath, &tenantList)
+
+	if err != nil {
+		return nil, err
+	}
+
+	monitored := v.TenantFilter.Apply(tenantList)
+
+	v.metrics.tenants.WithLabelValues("discovered").Set(float64(len(tenantList)))
+	v.metrics.tenants.WithLabelValues("monitored").Set(float64(len(monitored)))
+
+	v.tenantCache.mu.Lock()
+	v.tenantCache.tenants = monitored
+	v.tenantCache.fetchedAt = v.now()
+	v.tenantCache.mu.Unlock()
+
+	logging.PeppaMonLog("info", "Completed Batch Job to fetch Versa Tenants. %v tenants monitored out of %v",
+		len(monitored), len(tenantList))
+
+	return monitored, nil
+}
+
+// refreshTenants rediscovers the tenants in the background halfway through the cache TTL so that scrapes
+// keep using a fresh tenant list without waiting for the discovery. It stops when ctx is done
+func (v *VersaAnalyticsClient) refreshTenants(ctx context.Context) {
+
+	ticker := time.NewTicker(v.TenantCacheTTL / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		refreshCtx, cancel := context.WithTimeout(ctx, v.TenantCacheTTL/2)
+
+		if _, err := v.discoverTenants(refreshCtx); err != nil && ctx.Err() == nil {
+			logging.PeppaMonLog("warning", "Background refresh of Versa Tenants failed with error %v", err)
+		}
+
+		cancel()
+	}
+}
@@ -0,0 +1,61 @@
+package versa_client
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTenantFilter(t *testing.T) {
+
+	tenants := []string{"acme", "acme-lab", "lab-paris", "lab-london", "globex", "Globex2", "initech"}
+
+	tests := []struct {
+		name    string
+		include string
+		exclude string
+		want    []string
+	}{
+		{name: "no rules", want: tenants},
+		{name: "exact include", include: "acme, globex", want: []string{"acme", "globex"}},
+		{name: "glob include", include: "lab-*", want: []string{"lab-paris", "lab-london"}},
+		{name: "glob with single character", include: "lab-?ondon,Globex?", want: []string{"lab-london", "Globex2"}},
+		{name: "glob with character class", include: "[ag]*", want: []string{"acme", "acme-lab", "globex"}},
+		{name: "regex include", include: "/^(?i)globex/", want: []string{"globex", "Globex2"}},
+		{name: "regex matches anywhere", include: "/lab/", want: []string{"acme-lab", "lab-paris", "lab-london"}},
+		{name: "exact exclude", exclude: "initech", want: []string{"acme", "acme-lab", "lab-paris", "lab-london", "globex", "Globex2"}},
+		{name: "glob exclude", exclude: "*lab*", want: []string{"acme", "globex", "Globex2", "initech"}},
+		{name: "regex exclude", exclude: "/[0-9]$/", want: []string{"acme", "acme-lab", "lab-paris", "lab-london", "globex", "initech"}},
+		{name: "exclude wins over include", include: "acme*", exclude: "/-lab$/", want: []string{"acme"}},
+		{name: "exact names are case sensitive", include: "ACME", want: nil},
+		{name: "include without match", include: "umbrella", want: nil},
+	}
+
+	for _, tt := range tests {
+
+		t.Run(tt.name, func(t *testing.T) {
+
+			defer setEnv(map[string]string{
+				"PEPPAMON_VERSA_TENANT_INCLUDE": tt.include,
+				"PEPPAMON_VERSA_TENANT_EXCLUDE": tt.exclude,
+			})()
+
+			filter := tenantFilterFromEnv(Env{})
+
+			list := make(VersaTenantList, len(tenants))
+
+			for i, tenant := range tenants {
+				list[i].TenantName = tenant
+			}
+
+			var got []string
+
+			for _, tenant := range filter.Apply(list) {
+				got = append(got, tenant.TenantName)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got tenants %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
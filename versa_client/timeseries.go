@@ -0,0 +1,189 @@
+package versa_client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TimeseriesResult is the response of a Versa Analytics timeseries query for a single tenant
+type TimeseriesResult struct {
+	TenantName string
+	QTime      int                `json:"qTime"`
+	Series     []TimeseriesSeries `json:"data"`
+}
+
+// TimeseriesSeries is a single series of a timeseries response, one per group-by row and metric
+type TimeseriesSeries struct {
+	Name       string            `json:"name"`
+	Type       string            `json:"type"`
+	Metric     string            `json:"metric"`
+	MetricName string            `json:"metricName"`
+	Label      string            `json:"label"`
+	Points     []TimeseriesPoint `json:"data"`
+
+	// GroupBy maps each group-by field of the query to its value for this series
+	GroupBy map[string]string `json:"-"`
+}
+
+// TimeseriesPoint is a single (timestamp, value) sample of a series
+type TimeseriesPoint struct {
+	Timestamp time.Time
+	Value     float64
+
+	// Valid is false when Versa Analytics returned a null or non numeric value
+	Valid bool
+}
+
+// Key returns the value of a group-by field for the series
+func (s TimeseriesSeries) Key(field string) string {
+	return s.GroupBy[field]
+}
+
+// LatestValue returns the value of the most recent usable point of the series and whether there is one
+func (s TimeseriesSeries) LatestValue() (float64, bool) {
+
+	latest := -1
+
+	for i, point := range s.Points {
+		if point.Valid && (latest < 0 || point.Timestamp.After(s.Points[latest].Timestamp)) {
+			latest = i
+		}
+	}
+
+	if latest < 0 {
+		return 0, false
+	}
+
+	return s.Points[latest].Value, true
+}
+
+// Aggregation reduces the points of a series returned over a query window to a single value
+type Aggregation string
+
+const (
+	AggregationLatest Aggregation = "latest"
+	AggregationMax    Aggregation = "max"
+	AggregationMin    Aggregation = "min"
+	AggregationAvg    Aggregation = "avg"
+	AggregationP95    Aggregation = "p95"
+)
+
+// ParseAggregation validates an aggregation name such as max or p95
+func ParseAggregation(name string) (Aggregation, error) {
+
+	switch aggregation := Aggregation(strings.ToLower(strings.TrimSpace(name))); aggregation {
+	case AggregationLatest, AggregationMax, AggregationMin, AggregationAvg, AggregationP95:
+		return aggregation, nil
+	default:
+		return "", fmt.Errorf("unsupported aggregation %q, expected latest, max, min, avg or p95", name)
+	}
+}
+
+// Description names the aggregation in metric help texts
+func (a Aggregation) Description() string {
+	switch a {
+	case AggregationMax:
+		return "maximum"
+	case AggregationMin:
+		return "minimum"
+	case AggregationAvg:
+		return "average"
+	case AggregationP95:
+		return "95th percentile"
+	default:
+		return "latest value"
+	}
+}
+
+// Aggregate reduces the usable points of the series with the aggregation and reports whether there was any
+func (s TimeseriesSeries) Aggregate(aggregation Aggregation) (float64, bool) {
+
+	if aggregation == AggregationLatest || aggregation == "" {
+		return s.LatestValue()
+	}
+
+	values := make([]float64, 0, len(s.Points))
+
+	for _, point := range s.Points {
+		if point.Valid {
+			values = append(values, point.Value)
+		}
+	}
+
+	if len(values) == 0 {
+		return 0, false
+	}
+
+	sort.Float64s(values)
+
+	switch aggregation {
+	case AggregationMax:
+		return values[len(values)-1], true
+
+	case AggregationMin:
+		return values[0], true
+
+	case AggregationAvg:
+		sum := 0.0
+		for _, value := range values {
+			sum += value
+		}
+		return sum / float64(len(values)), true
+
+	case AggregationP95:
+		// Nearest-rank percentile, the maximum for windows of less than 20 points
+		rank := int(math.Ceil(0.95 * float64(len(values))))
+		return values[rank-1], true
+	}
+
+	return 0, false
+}
+
+// splitGroupBy fills GroupBy from the comma separated series name returned by Versa Analytics
+func (s *TimeseriesSeries) splitGroupBy(fields []string) {
+	if len(fields) == 0 {
+		return
+	}
+
+	s.GroupBy = make(map[string]string, len(fields))
+
+	// The last field keeps any extra comma so that a value containing one does not shift the others
+	for i, token := range strings.SplitN(s.Name, ",", len(fields)) {
+		s.GroupBy[fields[i]] = token
+	}
+}
+
+// UnmarshalJSON decodes a [timestamp, value] pair with the same rules as the streaming decoder
+func (p *TimeseriesPoint) UnmarshalJSON(b []byte) error {
+
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+
+	point, err := decodePoint(decoder)
+
+	if err != nil {
+		return fmt.Errorf("invalid timeseries point %s: %v", b, err)
+	}
+
+	*p = point
+
+	return nil
+}
+
+// parsePointString parses a point value, rejecting NaN and infinities
+func parsePointString(raw string) (float64, bool) {
+
+	value, err := strconv.ParseFloat(raw, 64)
+
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return 0, false
+	}
+
+	return value, true
+}
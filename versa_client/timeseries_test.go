@@ -0,0 +1,97 @@
+package versa_client
+
+import (
+	"testing"
+	"time"
+)
+
+// testSeries builds a series of a point per minute holding the values, the invalid points being marked by
+// negative values
+func testSeries(values ...float64) TimeseriesSeries {
+
+	start := time.Date(2020, 3, 2, 10, 0, 0, 0, time.UTC)
+
+	var series TimeseriesSeries
+
+	for i, value := range values {
+		series.Points = append(series.Points, TimeseriesPoint{
+			Timestamp: start.Add(time.Duration(i) * time.Minute),
+			Value:     value,
+			Valid:     value >= 0,
+		})
+	}
+
+	return series
+}
+
+func TestAggregate(t *testing.T) {
+
+	// 1 to 40 in shuffled order, the last point being 18
+	var shuffled []float64
+
+	for i := 0; i < 40; i++ {
+		shuffled = append(shuffled, float64((i*23)%40+1))
+	}
+
+	tests := []struct {
+		name        string
+		series      TimeseriesSeries
+		aggregation Aggregation
+		want        float64
+		wantOk      bool
+	}{
+		{name: "latest", series: testSeries(1, 4, 2, 6, 3), aggregation: AggregationLatest, want: 3, wantOk: true},
+		{name: "default", series: testSeries(1, 4, 2, 6, 3), aggregation: "", want: 3, wantOk: true},
+		{name: "max", series: testSeries(1, 4, 2, 6, 3), aggregation: AggregationMax, want: 6, wantOk: true},
+		{name: "min", series: testSeries(1, 4, 2, 6, 3), aggregation: AggregationMin, want: 1, wantOk: true},
+		{name: "avg", series: testSeries(1, 4, 2, 6, 3), aggregation: AggregationAvg, want: 3.2, wantOk: true},
+		{name: "p95 of less than 20 points", series: testSeries(1, 4, 2, 6, 3), aggregation: AggregationP95, want: 6, wantOk: true},
+		{name: "p95 nearest rank", series: testSeries(shuffled...), aggregation: AggregationP95, want: 38, wantOk: true},
+		{name: "latest of shuffled points", series: testSeries(shuffled...), aggregation: AggregationLatest, want: 18, wantOk: true},
+		{name: "latest skips invalid points", series: testSeries(1, 4, -1), aggregation: AggregationLatest, want: 4, wantOk: true},
+		{name: "avg skips invalid points", series: testSeries(1, -1, 5), aggregation: AggregationAvg, want: 3, wantOk: true},
+		{name: "min skips invalid points", series: testSeries(-1, 2, 5), aggregation: AggregationMin, want: 2, wantOk: true},
+		{name: "no valid point", series: testSeries(-1, -1), aggregation: AggregationMax},
+		{name: "no point", series: testSeries(), aggregation: AggregationLatest},
+		{name: "unknown aggregation", series: testSeries(1, 2), aggregation: "median"},
+	}
+
+	for _, tt := range tests {
+
+		t.Run(tt.name, func(t *testing.T) {
+
+			got, ok := tt.series.Aggregate(tt.aggregation)
+
+			if ok != tt.wantOk || got != tt.want {
+				t.Fatalf("Aggregate(%v) got %v, %v, want %v, %v", tt.aggregation, got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
+
+func TestParseAggregation(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		want    Aggregation
+		wantErr bool
+	}{
+		{name: "latest", want: AggregationLatest},
+		{name: " MAX ", want: AggregationMax},
+		{name: "Min", want: AggregationMin},
+		{name: "avg", want: AggregationAvg},
+		{name: "p95", want: AggregationP95},
+		{name: "", wantErr: true},
+		{name: "mean", wantErr: true},
+		{name: "p99", wantErr: true},
+	}
+
+	for _, tt := range tests {
+
+		got, err := ParseAggregation(tt.name)
+
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseAggregation(%q) got %q, error %v, want %q, error %v", tt.name, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package versa_client
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lucabrasi83/peppamon_versa/logging"
+)
+
+// TLSSettings configures the TLS connection to a Versa component
+type TLSSettings struct {
+	// Target names the Versa component in logs, such as Versa Analytics
+	Target string
+
+	// CAFile is a PEM bundle of the CAs trusted to sign the server certificate, system CAs are used when empty
+	CAFile string
+
+	// CertFile and KeyFile hold the client certificate presented for mutual TLS
+	CertFile string
+	KeyFile  string
+
+	// ServerName overrides the host name the server certificate is verified against
+	ServerName string
+
+	// PinnedSHA256 lists hex encoded SHA-256 fingerprints of which one must match a certificate of the server chain
+	PinnedSHA256 []string
+
+	MinVersion uint16
+
+	// InsecureSkipVerify disables the server certificate verification. It must only be used in labs
+	InsecureSkipVerify bool
+
+	// ReloadInterval is how often certificate files are checked for changes on disk
+	ReloadInterval time.Duration
+
+	// envPrefix is the prefix of the environment variables the settings were loaded from
+	envPrefix string
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// TLSSettingsFromEnv loads the TLS settings of target from the environment variables starting with prefix,
+// such as PEPPAMON_VERSA_ANALYTICS_TLS_
+func TLSSettingsFromEnv(env Env, target, prefix string) TLSSettings {
+
+	minVersion := env.String(prefix+"MIN_VERSION", "1.2")
+
+	version, ok := tlsVersions[minVersion]
+
+	if !ok {
+		logging.PeppaMonLog("fatal", "Unsupported minimum TLS version %v for %v", minVersion, target)
+	}
+
+	return TLSSettings{
+		Target:             target,
+		CAFile:             env.String(prefix+"CA_FILE", ""),
+		CertFile:           env.String(prefix+"CERT_FILE", ""),
+		KeyFile:            env.String(prefix+"KEY_FILE", ""),
+		ServerName:         env.String(prefix+"SERVER_NAME", ""),
+		PinnedSHA256:       env.List(prefix + "PINNED_SHA256"),
+		MinVersion:         version,
+		InsecureSkipVerify: env.Bool(prefix+"INSECURE_SKIP_VERIFY", false),
+		ReloadInterval:     env.Duration(prefix+"RELOAD_INTERVAL", 1*time.Minute),
+		envPrefix:          prefix,
+	}
+}
+
+// files returns the certificate files to watch for changes
+func (s TLSSettings) files() []string {
+	var files []string
+
+	for _, file := range []string{s.CAFile, s.CertFile, s.KeyFile} {
+		if file != "" {
+			files = append(files, file)
+		}
+	}
+
+	return files
+}
+
+// Config loads the certificate files and builds the matching TLS client configuration
+func (s TLSSettings) Config() (*tls.Config, error) {
+
+	if (s.CertFile == "") != (s.KeyFile == "") {
+		return nil, fmt.Errorf("both a client certificate and a key file are required for mutual TLS")
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         s.ServerName,
+		MinVersion:         s.MinVersion,
+		InsecureSkipVerify: s.InsecureSkipVerify,
+	}
+
+	if s.CAFile != "" {
+		caBundle, err := ioutil.ReadFile(s.CAFile)
+
+		if err != nil {
+			return nil, fmt.Errorf("unable to read CA bundle %v: %v", s.CAFile, err)
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caBundle) {
+			return nil, fmt.Errorf("no PEM certificate found in CA bundle %v", s.CAFile)
+		}
+	}
+
+	if s.CertFile != "" {
+		clientCert, err := tls.LoadX509KeyPair(s.CertFile, s.KeyFile)
+
+		if err != nil {
+			return nil, fmt.Errorf("unable to load client certificate %v: %v", s.CertFile, err)
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{clientCert}
+	}
+
+	if len(s.PinnedSHA256) > 0 {
+		pins := make([][]byte, 0, len(s.PinnedSHA256))
+
+		for _, pin := range s.PinnedSHA256 {
+			fingerprint, err := hex.DecodeString(strings.Replace(pin, ":", "", -1))
+
+			if err != nil || len(fingerprint) != sha256.Size {
+				return nil, fmt.Errorf("invalid SHA-256 certificate pin %q", pin)
+			}
+
+			pins = append(pins, fingerprint)
+		}
+
+		// The pin check runs after the standard chain verification, or on its own in insecure mode
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			for _, rawCert := range rawCerts {
+				fingerprint := sha256.Sum256(rawCert)
+
+				for _, pin := range pins {
+					if bytes.Equal(fingerprint[:], pin) {
+						return nil
+					}
+				}
+			}
+			return fmt.Errorf("no certificate presented by %v matches the pinned SHA-256 fingerprints", s.Target)
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// reloadingTransport swaps its underlying HTTP transport when the certificate files change on disk.
+// Connections opened with the previous certificates are closed once idle
+type reloadingTransport struct {
+	mu       sync.RWMutex
+	current  *proxyTransport
+	settings TLSSettings
+	proxy    ProxyFunc
+	modTimes map[string]time.Time
+
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewTLSTransport builds the HTTP transport used to reach the Versa component through the optional proxy
+// and starts watching the certificate files
+func NewTLSTransport(settings TLSSettings, proxy ProxyFunc) (http.RoundTripper, error) {
+	return newReloadingTransport(settings, proxy)
+}
+
+func newReloadingTransport(settings TLSSettings, proxy ProxyFunc) (*reloadingTransport, error) {
+
+	if settings.InsecureSkipVerify {
+		setting := "InsecureSkipVerify"
+
+		if settings.envPrefix != "" {
+			setting = settings.envPrefix + "INSECURE_SKIP_VERIFY"
+		}
+
+		logging.PeppaMonLog("warning",
+			"!!! TLS CERTIFICATE VERIFICATION IS DISABLED FOR %v !!! "+
+				"Connections are exposed to man-in-the-middle attacks. "+
+				"Unset %v outside of labs", strings.ToUpper(settings.Target), setting)
+	}
+
+	r := &reloadingTransport{settings: settings, proxy: proxy, stop: make(chan struct{})}
+
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+
+	if len(settings.files()) > 0 && settings.ReloadInterval > 0 {
+		go r.watch()
+	}
+
+	return r, nil
+}
+
+func (r *reloadingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	r.mu.RLock()
+	transport := r.current
+	r.mu.RUnlock()
+
+	return transport.RoundTrip(req)
+}
+
+// reload builds a new transport from the certificate files and records their modification time
+func (r *reloadingTransport) reload() error {
+
+	modTimes := r.fileModTimes()
+
+	tlsConfig, err := r.settings.Config()
+
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	previous := r.current
+	r.current = newProxyTransport(tlsConfig, r.proxy)
+	r.modTimes = modTimes
+	r.mu.Unlock()
+
+	if previous != nil {
+		previous.CloseIdleConnections()
+	}
+
+	return nil
+}
+
+func (r *reloadingTransport) fileModTimes() map[string]time.Time {
+	modTimes := make(map[string]time.Time)
+
+	for _, file := range r.settings.files() {
+		if info, err := os.Stat(file); err == nil {
+			modTimes[file] = info.ModTime()
+		}
+	}
+
+	return modTimes
+}
+
+// Close stops watching the certificate files and closes the idle connections
+func (r *reloadingTransport) Close() {
+
+	r.closeOnce.Do(func() { close(r.stop) })
+
+	r.mu.RLock()
+	r.current.CloseIdleConnections()
+	r.mu.RUnlock()
+}
+
+// watch polls the certificate files and reloads them when one of them changed.
+// A failed reload keeps the previous certificates in use
+func (r *reloadingTransport) watch() {
+
+	ticker := time.NewTicker(r.settings.ReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+		}
+
+		r.mu.RLock()
+		previous := r.modTimes
+		r.mu.RUnlock()
+
+		changed := false
+
+		for file, modTime := range r.fileModTimes() {
+			if !modTime.Equal(previous[file]) {
+				changed = true
+			}
+		}
+
+		if !changed {
+			continue
+		}
+
+		if err := r.reload(); err != nil {
+			logging.PeppaMonLog("error", "Unable to reload %v TLS certificates with error %v", r.settings.Target, err)
+			continue
+		}
+
+		logging.PeppaMonLog("info", "Reloaded %v TLS certificates", r.settings.Target)
+	}
+}
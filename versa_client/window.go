@@ -0,0 +1,158 @@
+package versa_client
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lucabrasi83/peppamon_versa/logging"
+)
+
+// versaDateLayout is the layout of absolute start and end dates, which Versa Analytics reads in its own timezone
+const versaDateLayout = "2006-01-02 15:04:05"
+
+var gapDurationRegexp = regexp.MustCompile(`^([0-9]+)(MINUTE|HOUR|DAY)S?$`)
+
+// TimeWindows computes the absolute time windows of the queries so that each one covers the most recent
+// buckets Versa Analytics has completed
+type TimeWindows struct {
+	// Location is the timezone of the Versa Analytics server the dates are sent in, bucket boundaries being
+	// aligned in UTC
+	Location *time.Location
+
+	// IngestionLag is how long Versa Analytics takes to aggregate the logs of a bucket once it is over
+	IngestionLag time.Duration
+
+	// Reports overrides the window of the queries of a report, to aggregate several buckets per scrape
+	Reports map[string]time.Duration
+}
+
+// timeWindowsFromEnv loads PEPPAMON_VERSA_ANALYTICS_TIMEZONE given as an IANA name such as Europe/Paris,
+// PEPPAMON_VERSA_ANALYTICS_INGESTION_LAG and PEPPAMON_VERSA_ANALYTICS_WINDOWS given as a comma separated
+// list of report=duration
+func timeWindowsFromEnv(env Env) TimeWindows {
+
+	timezone := env.String("PEPPAMON_VERSA_ANALYTICS_TIMEZONE", "UTC")
+
+	location, err := time.LoadLocation(timezone)
+
+	if err != nil {
+		logging.PeppaMonLog("fatal", "Invalid Versa Analytics timezone %q with error %v", timezone, err)
+	}
+
+	lag := env.Duration("PEPPAMON_VERSA_ANALYTICS_INGESTION_LAG", 2*time.Minute)
+
+	if lag < 0 {
+		logging.PeppaMonLog("fatal", "Invalid negative Versa Analytics ingestion lag %v", lag)
+	}
+
+	reports := make(map[string]time.Duration)
+
+	for _, item := range env.List("PEPPAMON_VERSA_ANALYTICS_WINDOWS") {
+
+		tokens := strings.SplitN(item, "=", 2)
+
+		if len(tokens) != 2 {
+			logging.PeppaMonLog("fatal", "Invalid report window %q, expected report=duration", item)
+		}
+
+		window, err := time.ParseDuration(strings.TrimSpace(tokens[1]))
+
+		if err != nil || window <= 0 {
+			logging.PeppaMonLog("fatal", "Invalid window %q for report %v", tokens[1], tokens[0])
+		}
+
+		reports[strings.TrimSpace(tokens[0])] = window
+	}
+
+	return TimeWindows{Location: location, IngestionLag: lag, Reports: reports}
+}
+
+// gapDuration returns the length of a query gap bucket, or 0 for gaps of a week or more which have no fixed length
+func gapDuration(gap string) time.Duration {
+
+	tokens := gapDurationRegexp.FindStringSubmatch(gap)
+
+	if tokens == nil {
+		return 0
+	}
+
+	count, _ := strconv.Atoi(tokens[1])
+
+	switch tokens[2] {
+	case "MINUTE":
+		return time.Duration(count) * time.Minute
+	case "HOUR":
+		return time.Duration(count) * time.Hour
+	default:
+		return time.Duration(count) * 24 * time.Hour
+	}
+}
+
+// alignTime rounds t down to a multiple of bucket counted from midnight UTC, so that daylight saving time
+// changes do not shift the bucket boundaries. The result keeps the timezone of t
+func alignTime(t time.Time, bucket time.Duration) time.Time {
+	return t.Truncate(bucket)
+}
+
+// Align returns the query with absolute start and end dates ending on the last bucket boundary that is at
+// least the ingestion lag old. The window spans the window configured for the report, the query Window, or a
+// single gap bucket when neither is set. Queries with a start date set are returned unchanged
+func (w TimeWindows) Align(q Query, now time.Time) Query {
+
+	if q.StartDate != "" {
+		return q
+	}
+
+	location := w.Location
+
+	if location == nil {
+		location = time.UTC
+	}
+
+	bucket := gapDuration(q.Gap)
+
+	if bucket <= 0 {
+		bucket = time.Minute
+	}
+
+	window := q.Window
+
+	if reportWindow, ok := w.Reports[q.Report]; ok {
+		window = reportWindow
+	}
+
+	if window <= 0 {
+		window = bucket
+	}
+
+	end := alignTime(now.Add(-w.IngestionLag).In(location), bucket)
+	start := end.Add(-window)
+
+	q.StartDate = start.Format(versaDateLayout)
+	q.EndDate = end.Format(versaDateLayout)
+	q.windowStart = start
+	q.windowEnd = end
+
+	return q
+}
+
+// inWindow keeps the points of the series within the aligned window of the query, dropping the bucket still
+// being aggregated that Versa Analytics returns when the end date is inclusive
+func (q Query) inWindow(series *TimeseriesSeries) {
+
+	if q.windowEnd.IsZero() {
+		return
+	}
+
+	points := series.Points[:0]
+
+	for _, point := range series.Points {
+		if !point.Timestamp.Before(q.windowStart) && point.Timestamp.Before(q.windowEnd) {
+			points = append(points, point)
+		}
+	}
+
+	series.Points = points
+}
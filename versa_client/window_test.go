@@ -0,0 +1,172 @@
+package versa_client
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAlign(t *testing.T) {
+
+	paris, err := time.LoadLocation("Europe/Paris")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newYork, err := time.LoadLocation("America/New_York")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kolkata, err := time.LoadLocation("Asia/Kolkata")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		windows TimeWindows
+		query   Query
+		now     time.Time
+
+		wantStart string
+		wantEnd   string
+	}{
+		{
+			name:      "single bucket",
+			windows:   TimeWindows{IngestionLag: 2 * time.Minute},
+			query:     Query{Gap: "1MINUTE"},
+			now:       time.Date(2020, 3, 2, 10, 3, 30, 0, time.UTC),
+			wantStart: "2020-03-02 10:00:00",
+			wantEnd:   "2020-03-02 10:01:00",
+		},
+		{
+			name:      "query window",
+			windows:   TimeWindows{IngestionLag: 2 * time.Minute},
+			query:     Query{Gap: "1MINUTE", Window: 5 * time.Minute},
+			now:       time.Date(2020, 3, 2, 10, 3, 30, 0, time.UTC),
+			wantStart: "2020-03-02 09:56:00",
+			wantEnd:   "2020-03-02 10:01:00",
+		},
+		{
+			name:      "report window overriding the query window",
+			windows:   TimeWindows{Reports: map[string]time.Duration{ReportSiteCircuitUsage: 15 * time.Minute}},
+			query:     Query{Report: ReportSiteCircuitUsage, Gap: "1MINUTE", Window: 5 * time.Minute},
+			now:       time.Date(2020, 3, 2, 10, 3, 30, 0, time.UTC),
+			wantStart: "2020-03-02 09:48:00",
+			wantEnd:   "2020-03-02 10:03:00",
+		},
+		{
+			name:      "multiple minute gap",
+			windows:   TimeWindows{},
+			query:     Query{Gap: "5MINUTES"},
+			now:       time.Date(2020, 3, 2, 10, 4, 59, 0, time.UTC),
+			wantStart: "2020-03-02 09:55:00",
+			wantEnd:   "2020-03-02 10:00:00",
+		},
+		{
+			name:      "server timezone",
+			windows:   TimeWindows{Location: paris},
+			query:     Query{Gap: "1MINUTE"},
+			now:       time.Date(2020, 3, 2, 10, 3, 30, 0, time.UTC),
+			wantStart: "2020-03-02 11:02:00",
+			wantEnd:   "2020-03-02 11:03:00",
+		},
+		{
+			name:      "half hour offset timezone",
+			windows:   TimeWindows{Location: kolkata},
+			query:     Query{Gap: "1HOUR"},
+			now:       time.Date(2020, 3, 2, 10, 45, 0, 0, time.UTC),
+			wantStart: "2020-03-02 14:30:00",
+			wantEnd:   "2020-03-02 15:30:00",
+		},
+		{
+			// Clocks jump from 02:00 EST to 03:00 EDT at 07:00 UTC
+			name:      "window across the daylight saving time change",
+			windows:   TimeWindows{Location: newYork},
+			query:     Query{Gap: "15MINUTES", Window: time.Hour},
+			now:       time.Date(2020, 3, 8, 7, 20, 0, 0, time.UTC),
+			wantStart: "2020-03-08 01:15:00",
+			wantEnd:   "2020-03-08 03:15:00",
+		},
+		{
+			name:      "start date set",
+			windows:   TimeWindows{IngestionLag: 2 * time.Minute},
+			query:     Query{Gap: "1MINUTE", StartDate: "1hoursAgo"},
+			now:       time.Date(2020, 3, 2, 10, 3, 30, 0, time.UTC),
+			wantStart: "1hoursAgo",
+		},
+	}
+
+	for _, tt := range tests {
+
+		t.Run(tt.name, func(t *testing.T) {
+
+			q := tt.windows.Align(tt.query, tt.now)
+
+			if q.StartDate != tt.wantStart || q.EndDate != tt.wantEnd {
+				t.Fatalf("Align() got %q to %q, want %q to %q", q.StartDate, q.EndDate, tt.wantStart, tt.wantEnd)
+			}
+
+			if tt.wantEnd == "" {
+				return
+			}
+
+			window := tt.query.Window
+
+			if reportWindow, ok := tt.windows.Reports[tt.query.Report]; ok {
+				window = reportWindow
+			}
+
+			if window == 0 {
+				window = gapDuration(tt.query.Gap)
+			}
+
+			if span := q.windowEnd.Sub(q.windowStart); span != window {
+				t.Fatalf("Align() got a window of %v, want %v", span, window)
+			}
+
+			if q.windowEnd.UTC().Truncate(gapDuration(tt.query.Gap)) != q.windowEnd.UTC() {
+				t.Fatalf("Align() got window end %v, not aligned on a %v bucket in UTC", q.windowEnd.UTC(), tt.query.Gap)
+			}
+		})
+	}
+}
+
+func TestInWindow(t *testing.T) {
+
+	start := time.Date(2020, 3, 2, 10, 0, 0, 0, time.UTC)
+
+	q := TimeWindows{}.Align(Query{Gap: "1MINUTE", Window: 2 * time.Minute}, start.Add(2*time.Minute+30*time.Second))
+
+	var series TimeseriesSeries
+
+	for i := -1; i <= 2; i++ {
+		series.Points = append(series.Points, TimeseriesPoint{
+			Timestamp: start.Add(time.Duration(i) * time.Minute),
+			Value:     float64(i),
+			Valid:     true,
+		})
+	}
+
+	unaligned := series
+	unaligned.Points = append([]TimeseriesPoint(nil), series.Points...)
+
+	q.inWindow(&series)
+
+	// The bucket before the window and the one still being aggregated at its end are dropped
+	want := []TimeseriesPoint{unaligned.Points[1], unaligned.Points[2]}
+
+	if !reflect.DeepEqual(series.Points, want) {
+		t.Fatalf("inWindow() kept %+v, want %+v", series.Points, want)
+	}
+
+	Query{StartDate: "1hoursAgo"}.inWindow(&unaligned)
+
+	if len(unaligned.Points) != 4 {
+		t.Fatalf("inWindow() kept %v points of a query with a start date set, want all 4", len(unaligned.Points))
+	}
+}
@@ -1,12 +1,14 @@
 package versa_collector
 
 import (
+	"context"
 	"regexp"
-	"strings"
 	"sync"
+	"time"
 
 	"github.com/lucabrasi83/peppamon_versa/logging"
 	"github.com/lucabrasi83/peppamon_versa/versa_client"
+	"github.com/lucabrasi83/peppamon_versa/versa_director"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
@@ -16,104 +18,269 @@ const (
 	appUsageRateBpsLimit = 100
 )
 
+// defaultInstance names the Versa instance configured with the global environment variables only
+const defaultInstance = "default"
+
 type VersaAnalyticsExporter struct {
+	// Instance is the name of the Versa platform scraped, exposed as the versa_instance label
+	Instance string
+
 	mu                   sync.Mutex
 	VersaAnalyticsClient *versa_client.VersaAnalyticsClient
 	Metrics              []prometheus.Metric
+
+	// VersaDirectorClient provides the inventory of the sites expected to report to Analytics. It is nil
+	// when no Versa Director is configured for the instance
+	VersaDirectorClient *versa_director.VersaDirectorClient
+
+	// reportingSites holds per tenant the sites Analytics returned data for during the scrape
+	reportingSites map[string]map[string]bool
+
+	// siteReportsFailed holds the tenants for which a report marking the reporting sites failed during the scrape
+	siteReportsFailed map[string]bool
+
+	// ScrapeTimeout bounds a scrape when Prometheus does not send its own timeout
+	ScrapeTimeout time.Duration
+
+	// ScrapeInterval is the default query window of the reports whose points are aggregated
+	ScrapeInterval time.Duration
+
+	// aggregations holds the aggregation of the timeseries metric families during the scrape
+	aggregations familyAggregations
+
+	// scrapeMu serializes scrapes as they share the Metrics slice
+	scrapeMu sync.Mutex
 }
 
-func NewVersaAnalyticsExporter() *VersaAnalyticsExporter {
+// NewVersaAnalyticsExporter builds the exporter of a Versa instance listed in PEPPAMON_VERSA_INSTANCES
+func NewVersaAnalyticsExporter(instance string) *VersaAnalyticsExporter {
+
+	name := instance
+
+	if name == "" {
+		name = defaultInstance
+	}
+
 	return &VersaAnalyticsExporter{
-		VersaAnalyticsClient: versa_client.NewVersaAnalyticsClient(),
+		Instance:             name,
+		VersaAnalyticsClient: versa_client.NewVersaAnalyticsClient(instance),
+		VersaDirectorClient:  versa_director.NewVersaDirectorClient(instance),
 		Metrics:              nil,
+		ScrapeTimeout:        scrapeTimeoutFromEnv(),
+		ScrapeInterval:       scrapeIntervalFromEnv(),
 	}
 }
 
+// Describe sends the descriptions of the metrics, the timeseries metric families using their latest point
 func (v *VersaAnalyticsExporter) Describe(ch chan<- *prometheus.Desc) {
+	v.describe(latestAggregations, ch)
+}
+
+func (v *VersaAnalyticsExporter) describe(aggregations familyAggregations, ch chan<- *prometheus.Desc) {
 
 	for _, desc := range metricsDesc {
 		ch <- desc
 	}
+
+	for _, family := range timeseriesFamilies {
+		ch <- aggregations.desc(family)
+	}
+
+	v.VersaAnalyticsClient.Describe(ch)
 }
 
+// Collect scrapes Versa Analytics within the configured scrape timeout, the timeseries metric families
+// using their latest point
 func (v *VersaAnalyticsExporter) Collect(ch chan<- prometheus.Metric) {
 
-	logging.PeppaMonLog("info", "Started Versa Analytics metrics scraping")
+	ctx, cancel := context.WithTimeout(context.Background(), v.ScrapeTimeout)
+	defer cancel()
+
+	v.collect(ctx, latestAggregations, ch)
+}
 
-	// Bootstrap Versa Login and Tenant List building
-	err := v.VersaAnalyticsClient.Login()
+// collect scrapes Versa Analytics with the aggregations and aborts every in-flight request once ctx is done
+func (v *VersaAnalyticsExporter) collect(ctx context.Context, aggregations familyAggregations, ch chan<- prometheus.Metric) {
+
+	v.scrapeMu.Lock()
+	defer v.scrapeMu.Unlock()
+
+	v.aggregations = aggregations
+
+	logging.PeppaMonLog("info", "Started Versa Analytics metrics scraping for instance %v", v.Instance)
+
+	// Publish the Versa Analytics client self-metrics once scraping is done, even if it failed
+	defer v.VersaAnalyticsClient.Collect(ch)
+
+	// The Director inventory is fetched alongside Analytics, it is still published when Analytics fails
+	directorInventory := v.fetchDirectorInventory(ctx)
+
+	// Empty out Metrics slice once scraping is done
+	defer v.flushMetrics(ch)
+
+	// The Versa Analytics session is opened on the first request and renewed by the client when it expires
+	err := v.VersaAnalyticsClient.GetTenantList(ctx)
+
+	v.versaAnalyticsUpMetric(err)
 
 	if err != nil {
+		v.versaDirectorMetrics(<-directorInventory, false)
 		return
 	}
 
-	err = v.VersaAnalyticsClient.GetTenantList()
+	for _, circuit := range v.VersaAnalyticsClient.Breakers.OpenCircuits() {
+		if circuit.Tenant == "" {
+			logging.PeppaMonLog("warning", "Skipping report %v for instance %v until %v as its circuit breaker is open",
+				circuit.Report, v.Instance, circuit.Until.Format(time.RFC3339))
+		} else {
+			logging.PeppaMonLog("warning",
+				"Skipping report %v of tenant %v for instance %v until %v as its circuit breaker is open",
+				circuit.Report, circuit.Tenant, v.Instance, circuit.Until.Format(time.RFC3339))
+		}
+	}
 
-	if err != nil {
+	v.launchMetricsCollection(ctx)
+
+	v.versaDirectorMetrics(<-directorInventory, true)
+
+	if ctx.Err() != nil {
+		logging.PeppaMonLog("warning", "Versa Analytics metrics scraping for instance %v was interrupted with error %v",
+			v.Instance, ctx.Err())
 		return
 	}
 
-	v.launchMetricsCollection()
+	logging.PeppaMonLog("info", "Completed Versa Analytics metrics scraping for instance %v", v.Instance)
+}
+
+// flushMetrics sends the metrics gathered during the scrape and resets them for the next one
+func (v *VersaAnalyticsExporter) flushMetrics(ch chan<- prometheus.Metric) {
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
 
 	for _, metric := range v.Metrics {
 		ch <- metric
 	}
 
-	// Empty out Metrics slice once scraping is done
-	v.mu.Lock()
 	v.Metrics = nil
+	v.reportingSites = nil
+	v.siteReportsFailed = nil
+}
+
+// versaAnalyticsUpMetric publishes whether the tenants could be listed, which every report depends on
+func (v *VersaAnalyticsExporter) versaAnalyticsUpMetric(err error) {
+
+	metric := prometheus.MustNewConstMetric(versaAnalyticsUp, prometheus.GaugeValue, boolToFloat(err == nil))
+
+	v.mu.Lock()
+	v.Metrics = append(v.Metrics, metric)
+
+	if err != nil {
+		v.Metrics = append(v.Metrics, prometheus.NewInvalidMetric(versaAnalyticsUp, err))
+	}
 	v.mu.Unlock()
+}
+
+// reportStatus publishes whether the report succeeded for every monitored tenant. A report that failed for
+// all of them is also published as an invalid metric so that the scrape error reaches the metrics handler
+func (v *VersaAnalyticsExporter) reportStatus(report string, err error) {
+
+	failures := versa_client.AsTenantErrors(err)
+	tenants := v.VersaAnalyticsClient.Tenants
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	_, global := failures[""]
+
+	failed := 0
+
+	for _, tenant := range tenants {
+
+		_, tenantFailed := failures[tenant.TenantName]
+
+		if tenantFailed || global {
+			v.siteReportFailed(report, tenant.TenantName)
+		}
+
+		if tenantFailed {
+			failed++
+		}
+
+		v.Metrics = append(v.Metrics, prometheus.MustNewConstMetric(
+			versaReportUp,
+			prometheus.GaugeValue,
+			boolToFloat(!tenantFailed),
+			report, tenant.TenantName,
+		))
+	}
 
-	logging.PeppaMonLog("info", "Completed Versa Analytics metrics scraping")
+	// A failure that is not bound to a tenant affects all of them
+	if global || (failed > 0 && failed == len(tenants)) {
+		v.Metrics = append(v.Metrics, prometheus.NewInvalidMetric(versaReportUp, err))
+	}
 }
 
-func (v *VersaAnalyticsExporter) launchMetricsCollection() {
+// aggregationWindow returns the query window of the report for the aggregations of the scrape
+func (v *VersaAnalyticsExporter) aggregationWindow(report string) time.Duration {
+
+	interval := v.ScrapeInterval
+
+	if interval <= 0 {
+		interval = defaultScrapeInterval
+	}
+
+	return v.aggregations.window(report, interval)
+}
+
+func (v *VersaAnalyticsExporter) launchMetricsCollection(ctx context.Context) {
 	var wg sync.WaitGroup
 	wg.Add(6)
 
 	go func() {
 		defer wg.Done()
-		v.versaSitesAvailabilityMetric()
+		v.versaSitesAvailabilityMetric(ctx)
 	}()
 
 	go func() {
 		defer wg.Done()
-		v.versaApplicationUsageRateMetric()
+		v.versaApplicationUsageRateMetric(ctx)
 	}()
 
 	go func() {
 		defer wg.Done()
-		v.versaApplicationUsageVolumeMetric()
+		v.versaApplicationUsageVolumeMetric(ctx)
 	}()
 
 	go func() {
 		defer wg.Done()
-		v.versaSiteCircuitsUsageMetric()
+		v.versaSiteCircuitsUsageMetric(ctx)
 	}()
 
 	go func() {
 		defer wg.Done()
-		v.versaApplianceComputeUsageMetric()
+		v.versaApplianceComputeUsageMetric(ctx)
 	}()
 
 	go func() {
 		defer wg.Done()
-		v.versaSiteSLAMetrics()
+		v.versaSiteSLAMetrics(ctx)
 	}()
 
 	wg.Wait()
 }
 
-func (v *VersaAnalyticsExporter) versaSitesAvailabilityMetric() {
-	sitesAvail, err := v.VersaAnalyticsClient.GetSitesAvailability()
+func (v *VersaAnalyticsExporter) versaSitesAvailabilityMetric(ctx context.Context) {
+	sitesAvail, err := v.VersaAnalyticsClient.GetSitesAvailability(ctx)
 
-	if err != nil {
-		return
-	}
+	// Tenants that failed are reported down while the results of the others are still published
+	v.reportStatus(versa_client.ReportSitesAvailability, err)
 
 	for _, tenant := range sitesAvail {
 		if len(tenant.SitesList) > 0 {
 			for _, site := range tenant.SitesList {
+				v.markSiteReporting(tenant.TenantName, site.SiteName)
+
 				metric := prometheus.MustNewConstMetric(
 					versaSitesAvailabilityPercent,
 					prometheus.GaugeValue,
@@ -129,150 +296,128 @@ func (v *VersaAnalyticsExporter) versaSitesAvailabilityMetric() {
 
 }
 
-func (v *VersaAnalyticsExporter) versaApplicationUsageRateMetric() {
-	appUsage, err := v.VersaAnalyticsClient.GetSitesApplicationUsageRate()
-
-	if err != nil {
-		return
-	}
-
-	for _, tenant := range appUsage {
-		for _, siteUsage := range tenant.Data {
-
-			if len(siteUsage.Data) == 0 {
-				continue
-			}
+func (v *VersaAnalyticsExporter) versaApplicationUsageRateMetric(ctx context.Context) {
 
-			metricTokens := strings.Split(siteUsage.Name, ",")
+	// Series are filtered as they are decoded so that the large responses are never held in memory
+	err := v.VersaAnalyticsClient.GetSitesApplicationUsageRate(ctx, v.aggregationWindow(versa_client.ReportApplicationUsageRate), func(tenant string, siteUsage versa_client.TimeseriesSeries) {
 
-			siteName := metricTokens[0]
-			appName := metricTokens[1]
-			ipAddress := metricTokens[2]
-			circuitName := metricTokens[3]
+		appUsageRate, ok := v.aggregations.aggregate(siteUsage, appUsageRateFamilies)
 
-			appUsageRate := siteUsage.Data[0][1].(float64)
+		if !ok {
+			return
+		}
 
-			// Filter app usage rate to avoid metric high cardinality
-			if appUsageRate < appUsageRateBpsLimit {
-				continue
-			}
+		siteName := siteUsage.Key("site")
+		appName := siteUsage.Key("appId")
+		ipAddress := siteUsage.Key("user")
+		circuitName := siteUsage.Key("accCkt")
 
-			switch siteUsage.Metric {
-			case "bw-rx":
-				metric :=
-					prometheus.MustNewConstMetric(
-						versaApplicationUsageBandwidthRxBps,
-						prometheus.GaugeValue,
-						appUsageRate,
-						tenant.TenantName, siteName, appName, ipAddress, circuitName,
-					)
-				v.mu.Lock()
-				v.Metrics = append(v.Metrics, metric)
-				v.mu.Unlock()
+		// Filter app usage rate to avoid metric high cardinality
+		if appUsageRate < appUsageRateBpsLimit {
+			return
+		}
 
-			case "bw-tx":
-				metric := prometheus.MustNewConstMetric(
-					versaApplicationUsageBandwidthTxBps,
+		switch siteUsage.Metric {
+		case "bw-rx":
+			metric :=
+				prometheus.MustNewConstMetric(
+					v.aggregations.desc(versaApplicationUsageBandwidthRxBps),
 					prometheus.GaugeValue,
 					appUsageRate,
-					tenant.TenantName, siteName, appName, ipAddress, circuitName,
+					tenant, siteName, appName, ipAddress, circuitName,
 				)
-				v.mu.Lock()
-				v.Metrics = append(v.Metrics, metric)
-				v.mu.Unlock()
-			}
-
+			v.mu.Lock()
+			v.Metrics = append(v.Metrics, metric)
+			v.mu.Unlock()
+
+		case "bw-tx":
+			metric := prometheus.MustNewConstMetric(
+				v.aggregations.desc(versaApplicationUsageBandwidthTxBps),
+				prometheus.GaugeValue,
+				appUsageRate,
+				tenant, siteName, appName, ipAddress, circuitName,
+			)
+			v.mu.Lock()
+			v.Metrics = append(v.Metrics, metric)
+			v.mu.Unlock()
 		}
-	}
-}
-
-func (v *VersaAnalyticsExporter) versaApplicationUsageVolumeMetric() {
-	appUsage, err := v.VersaAnalyticsClient.GetSitesApplicationUsageVolume()
+	})
 
-	if err != nil {
-		return
-	}
-
-	for _, tenant := range appUsage {
-		for _, siteUsage := range tenant.Data {
+	v.reportStatus(versa_client.ReportApplicationUsageRate, err)
+}
 
-			if len(siteUsage.Data) == 0 {
-				continue
-			}
+func (v *VersaAnalyticsExporter) versaApplicationUsageVolumeMetric(ctx context.Context) {
 
-			metricTokens := strings.Split(siteUsage.Name, ",")
+	// Series are filtered as they are decoded so that the large responses are never held in memory
+	err := v.VersaAnalyticsClient.GetSitesApplicationUsageVolume(ctx, v.aggregationWindow(versa_client.ReportApplicationUsageVolume), func(tenant string, siteUsage versa_client.TimeseriesSeries) {
 
-			siteName := metricTokens[0]
-			appName := metricTokens[1]
-			ipAddress := metricTokens[2]
-			circuitName := metricTokens[3]
+		appUsageRate, ok := v.aggregations.aggregate(siteUsage, appUsageVolumeFamilies)
 
-			appUsageRate := siteUsage.Data[0][1].(float64)
+		if !ok {
+			return
+		}
 
-			// Filter app usage volume to avoid metric high cardinality
-			if appUsageRate < appUsageVolumeBytesLimit {
-				continue
-			}
+		siteName := siteUsage.Key("site")
+		appName := siteUsage.Key("appId")
+		ipAddress := siteUsage.Key("user")
+		circuitName := siteUsage.Key("accCkt")
 
-			switch siteUsage.Metric {
-			case "volume-rx":
-				metric :=
-					prometheus.MustNewConstMetric(
-						versaApplicationUsageVolumeRxByte,
-						prometheus.CounterValue,
-						appUsageRate,
-						tenant.TenantName, siteName, appName, ipAddress, circuitName,
-					)
-				v.mu.Lock()
-				v.Metrics = append(v.Metrics, metric)
-				v.mu.Unlock()
+		// Filter app usage volume to avoid metric high cardinality
+		if appUsageRate < appUsageVolumeBytesLimit {
+			return
+		}
 
-			case "volume-tx":
-				metric := prometheus.MustNewConstMetric(
-					versaApplicationUsageVolumeTxByte,
+		switch siteUsage.Metric {
+		case "volume-rx":
+			metric :=
+				prometheus.MustNewConstMetric(
+					v.aggregations.desc(versaApplicationUsageVolumeRxByte),
 					prometheus.CounterValue,
 					appUsageRate,
-					tenant.TenantName, siteName, appName, ipAddress, circuitName,
+					tenant, siteName, appName, ipAddress, circuitName,
 				)
-				v.mu.Lock()
-				v.Metrics = append(v.Metrics, metric)
-				v.mu.Unlock()
-			}
-
+			v.mu.Lock()
+			v.Metrics = append(v.Metrics, metric)
+			v.mu.Unlock()
+
+		case "volume-tx":
+			metric := prometheus.MustNewConstMetric(
+				v.aggregations.desc(versaApplicationUsageVolumeTxByte),
+				prometheus.CounterValue,
+				appUsageRate,
+				tenant, siteName, appName, ipAddress, circuitName,
+			)
+			v.mu.Lock()
+			v.Metrics = append(v.Metrics, metric)
+			v.mu.Unlock()
 		}
-	}
+	})
+
+	v.reportStatus(versa_client.ReportApplicationUsageVolume, err)
 }
 
-func (v *VersaAnalyticsExporter) versaSiteCircuitsUsageMetric() {
-	tenantCircuitUsage, err := v.VersaAnalyticsClient.GetSitesCircuitBandwidthUsage()
+func (v *VersaAnalyticsExporter) versaSiteCircuitsUsageMetric(ctx context.Context) {
+	tenantCircuitUsage, err := v.VersaAnalyticsClient.GetSitesCircuitBandwidthUsage(ctx, v.aggregationWindow(versa_client.ReportSiteCircuitUsage))
 
-	if err != nil {
-		return
-	}
+	v.reportStatus(versa_client.ReportSiteCircuitUsage, err)
 
 	for _, tenant := range tenantCircuitUsage {
-		for _, siteUsage := range tenant.Data {
-
-			if len(siteUsage.Data) == 0 {
-				continue
-			}
-
-			metricTokens := strings.Split(siteUsage.Name, ",")
+		for _, siteUsage := range tenant.Series {
 
-			siteName := metricTokens[0]
-			circuitName := metricTokens[1]
+			circuitUsageRate, ok := v.aggregations.aggregate(siteUsage, circuitUsageFamilies)
 
-			circuitUsageRate := siteUsage.Data[0][1].(float64)
-
-			if circuitUsageRate == 0 {
+			if !ok || circuitUsageRate == 0 {
 				continue
 			}
 
+			siteName := siteUsage.Key("site")
+			circuitName := siteUsage.Key("accCkt")
+
 			switch siteUsage.Metric {
 			case "bw-rx":
 				metric :=
 					prometheus.MustNewConstMetric(
-						versaSiteCircuitBandwidthUsageRxBps,
+						v.aggregations.desc(versaSiteCircuitBandwidthUsageRxBps),
 						prometheus.GaugeValue,
 						circuitUsageRate,
 						tenant.TenantName, siteName, circuitName,
@@ -283,7 +428,7 @@ func (v *VersaAnalyticsExporter) versaSiteCircuitsUsageMetric() {
 
 			case "bw-tx":
 				metric := prometheus.MustNewConstMetric(
-					versaSiteCircuitBandwidthUsageTxBps,
+					v.aggregations.desc(versaSiteCircuitBandwidthUsageTxBps),
 					prometheus.GaugeValue,
 					circuitUsageRate,
 					tenant.TenantName, siteName, circuitName,
@@ -297,33 +442,29 @@ func (v *VersaAnalyticsExporter) versaSiteCircuitsUsageMetric() {
 	}
 }
 
-func (v *VersaAnalyticsExporter) versaApplianceComputeUsageMetric() {
-	applianceComputePerfUsage, err := v.VersaAnalyticsClient.GetApplianceComputePerf()
+func (v *VersaAnalyticsExporter) versaApplianceComputeUsageMetric(ctx context.Context) {
+	applianceComputePerfUsage, err := v.VersaAnalyticsClient.GetApplianceComputePerf(ctx, v.aggregationWindow(versa_client.ReportApplianceCompute))
 
-	if err != nil {
-		return
-	}
+	v.reportStatus(versa_client.ReportApplianceCompute, err)
 
 	for _, tenant := range applianceComputePerfUsage {
-		for _, applianceUsage := range tenant.Data {
+		for _, applianceUsage := range tenant.Series {
 
-			if len(applianceUsage.Data) == 0 {
+			performanceUsageMetric, ok := v.aggregations.aggregate(applianceUsage, applianceComputeFamilies)
+
+			if !ok || performanceUsageMetric == 0 {
 				continue
 			}
 
 			siteName := applianceUsage.Name
 
-			performanceUsageMetric := applianceUsage.Data[0][1].(float64)
-
-			if performanceUsageMetric == 0 {
-				continue
-			}
+			v.markSiteReporting(tenant.TenantName, siteName)
 
 			switch applianceUsage.Metric {
 			case "cpuload":
 				metric :=
 					prometheus.MustNewConstMetric(
-						versaApplianceCPULoadPercent,
+						v.aggregations.desc(versaApplianceCPULoadPercent),
 						prometheus.GaugeValue,
 						performanceUsageMetric,
 						tenant.TenantName, siteName,
@@ -334,7 +475,7 @@ func (v *VersaAnalyticsExporter) versaApplianceComputeUsageMetric() {
 
 			case "memload":
 				metric := prometheus.MustNewConstMetric(
-					versaApplianceMemoryLoadPercent,
+					v.aggregations.desc(versaApplianceMemoryLoadPercent),
 					prometheus.GaugeValue,
 					performanceUsageMetric,
 					tenant.TenantName, siteName,
@@ -345,7 +486,7 @@ func (v *VersaAnalyticsExporter) versaApplianceComputeUsageMetric() {
 
 			case "diskload":
 				metric := prometheus.MustNewConstMetric(
-					versaApplianceDiskLoadPercent,
+					v.aggregations.desc(versaApplianceDiskLoadPercent),
 					prometheus.GaugeValue,
 					performanceUsageMetric,
 					tenant.TenantName, siteName,
@@ -356,7 +497,7 @@ func (v *VersaAnalyticsExporter) versaApplianceComputeUsageMetric() {
 
 			case "sessload":
 				metric := prometheus.MustNewConstMetric(
-					versaApplianceSessionsLoad,
+					v.aggregations.desc(versaApplianceSessionsLoad),
 					prometheus.GaugeValue,
 					performanceUsageMetric,
 					tenant.TenantName, siteName,
@@ -370,20 +511,22 @@ func (v *VersaAnalyticsExporter) versaApplianceComputeUsageMetric() {
 	}
 }
 
-func (v *VersaAnalyticsExporter) versaSiteSLAMetrics() {
-	slaMetrics, err := v.VersaAnalyticsClient.GetSitesSLAMetrics()
+func (v *VersaAnalyticsExporter) versaSiteSLAMetrics(ctx context.Context) {
+	slaMetrics, err := v.VersaAnalyticsClient.GetSitesSLAMetrics(ctx, v.aggregationWindow(versa_client.ReportSiteSLAMetrics))
 
-	if err != nil {
-		return
-	}
+	v.reportStatus(versa_client.ReportSiteSLAMetrics, err)
 
 	for _, tenant := range slaMetrics {
-		for _, siteUsage := range tenant.Data {
+		for _, siteUsage := range tenant.Series {
 
-			metricTokens := strings.Split(siteUsage.Name, ",")
+			metricValue, ok := v.aggregations.aggregate(siteUsage, slaFamilies)
 
-			sourceSite := metricTokens[0]
-			destinationSite := metricTokens[1]
+			if !ok {
+				continue
+			}
+
+			sourceSite := siteUsage.Key("localSite")
+			destinationSite := siteUsage.Key("remoteSite")
 
 			// Only insert IP SLA to Controllers and Service Gateway
 			ctrlRegexp := regexp.MustCompile(`^CTLR-.+`).MatchString(destinationSite)
@@ -393,16 +536,14 @@ func (v *VersaAnalyticsExporter) versaSiteSLAMetrics() {
 				continue
 			}
 
-			sourceCircuit := metricTokens[2]
-			destinationCircuit := metricTokens[3]
-
-			metricValue := siteUsage.Data[0][1].(float64)
+			sourceCircuit := siteUsage.Key("localAccCkt")
+			destinationCircuit := siteUsage.Key("remoteAccCkt")
 
 			switch siteUsage.Metric {
 			case "fwdLossRatio":
 				metric :=
 					prometheus.MustNewConstMetric(
-						versaSLALossFwd,
+						v.aggregations.desc(versaSLALossFwd),
 						prometheus.GaugeValue,
 						metricValue,
 						tenant.TenantName, sourceSite, destinationSite, sourceCircuit, destinationCircuit,
@@ -413,7 +554,7 @@ func (v *VersaAnalyticsExporter) versaSiteSLAMetrics() {
 
 			case "revLossRatio":
 				metric := prometheus.MustNewConstMetric(
-					versaSLALossRev,
+					v.aggregations.desc(versaSLALossRev),
 					prometheus.GaugeValue,
 					metricValue,
 					tenant.TenantName, sourceSite, destinationSite, sourceCircuit, destinationCircuit,
@@ -424,7 +565,7 @@ func (v *VersaAnalyticsExporter) versaSiteSLAMetrics() {
 
 			case "fwdDelayVar":
 				metric := prometheus.MustNewConstMetric(
-					versaSLAJitterFwd,
+					v.aggregations.desc(versaSLAJitterFwd),
 					prometheus.GaugeValue,
 					metricValue,
 					tenant.TenantName, sourceSite, destinationSite, sourceCircuit, destinationCircuit,
@@ -435,7 +576,7 @@ func (v *VersaAnalyticsExporter) versaSiteSLAMetrics() {
 
 			case "revDelayVar":
 				metric := prometheus.MustNewConstMetric(
-					versaSLAJitterRev,
+					v.aggregations.desc(versaSLAJitterRev),
 					prometheus.GaugeValue,
 					metricValue,
 					tenant.TenantName, sourceSite, destinationSite, sourceCircuit, destinationCircuit,
@@ -446,7 +587,7 @@ func (v *VersaAnalyticsExporter) versaSiteSLAMetrics() {
 
 			case "delay":
 				metric := prometheus.MustNewConstMetric(
-					versaSLADelay,
+					v.aggregations.desc(versaSLADelay),
 					prometheus.GaugeValue,
 					metricValue,
 					tenant.TenantName, sourceSite, destinationSite, sourceCircuit, destinationCircuit,
@@ -0,0 +1,185 @@
+package versa_collector_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lucabrasi83/peppamon_versa/versa_client"
+	"github.com/lucabrasi83/peppamon_versa/versa_collector"
+	"github.com/lucabrasi83/peppamon_versa/versatest"
+)
+
+func testTenant(name string) versatest.Tenant {
+	return versatest.Tenant{
+		Name: name,
+		Sites: []versatest.Site{{
+			Name:         name + "-branch1",
+			Availability: 99.5,
+			CPULoad:      12,
+			Circuits:     []versatest.Circuit{{Name: "MPLS", RxBps: 1000, TxBps: 500}},
+			Apps: []versatest.App{{
+				Name:     "office365",
+				ClientIP: "10.0.0.1",
+				Circuit:  "MPLS",
+				RxBps:    200,
+				TxBps:    100,
+				RxBytes:  2000,
+				TxBytes:  1000,
+			}},
+			SLAPaths: []versatest.SLAPath{{RemoteSite: "CTLR-1", LocalCircuit: "MPLS", RemoteCircuit: "MPLS", DelayMs: 20}},
+		}},
+	}
+}
+
+// scrape serves a single scrape of the server through a metrics handler with the aggregations and returns
+// the exposition
+func scrape(t *testing.T, server *versatest.Server, aggregations versa_collector.Aggregations) string {
+
+	client, err := versa_client.NewClient(server.ClientSettings())
+
+	if err != nil {
+		t.Fatalf("NewClient() failed with error %v", err)
+	}
+	defer client.Close()
+
+	exporter := &versa_collector.VersaAnalyticsExporter{
+		Instance:             "lab",
+		VersaAnalyticsClient: client,
+		ScrapeTimeout:        30 * time.Second,
+		ScrapeInterval:       5 * time.Minute,
+	}
+
+	handler := &versa_collector.ScrapeHandler{
+		Exporters:    []*versa_collector.VersaAnalyticsExporter{exporter},
+		Aggregations: aggregations,
+	}
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	return recorder.Body.String()
+}
+
+func expectLines(t *testing.T, exposition string, lines ...string) {
+	for _, line := range lines {
+		if !strings.Contains(exposition, line+"\n") {
+			t.Errorf("missing %v in scrape", line)
+		}
+	}
+}
+
+func TestScrape(t *testing.T) {
+	server := versatest.NewServer(testTenant("acme"))
+	defer server.Close()
+
+	exposition := scrape(t, server, versa_collector.Aggregations{})
+
+	expectLines(t, exposition,
+		`versa_analytics_up{versa_instance="lab"} 1`,
+		`versa_analytics_sites_availability_percent{site="acme-branch1",tenant="acme",versa_instance="lab"} 99.5`,
+		`versa_analytics_appliance_cpu_load_pct{site="acme-branch1",tenant="acme",versa_instance="lab"} 12`,
+		`versa_analytics_site_circuit_usage_bandwidth_rx_bps{circuit="MPLS",site="acme-branch1",tenant="acme",versa_instance="lab"} 1000`,
+		`versa_analytics_application_usage_volume_tx_bytes{app_name="office365",circuit="MPLS",client_ip="10.0.0.1",site="acme-branch1",tenant="acme",versa_instance="lab"} 1000`,
+		`versa_analytics_site_slam_delay_ms{destination_circuit="MPLS",destination_site="CTLR-1",source_circuit="MPLS",source_site="acme-branch1",tenant="acme",versa_instance="lab"} 20`,
+		`versa_analytics_exporter_report_up{report="site_sla_metrics",tenant="acme",versa_instance="lab"} 1`,
+	)
+}
+
+func TestScrapeTenantFault(t *testing.T) {
+	server := versatest.NewServer(testTenant("acme"), testTenant("globex"))
+	defer server.Close()
+
+	server.Inject(versatest.Fault{Tenant: "acme", Query: "linkUsage", StatusCode: http.StatusInternalServerError})
+
+	exposition := scrape(t, server, versa_collector.Aggregations{})
+
+	expectLines(t, exposition,
+		`versa_analytics_up{versa_instance="lab"} 1`,
+		`versa_analytics_exporter_report_up{report="site_circuit_usage",tenant="acme",versa_instance="lab"} 0`,
+		`versa_analytics_exporter_report_up{report="site_circuit_usage",tenant="globex",versa_instance="lab"} 1`,
+		`versa_analytics_site_circuit_usage_bandwidth_rx_bps{circuit="MPLS",site="globex-branch1",tenant="globex",versa_instance="lab"} 1000`,
+		`versa_analytics_sites_availability_percent{site="acme-branch1",tenant="acme",versa_instance="lab"} 99.5`,
+	)
+
+	if strings.Contains(exposition, `versa_analytics_site_circuit_usage_bandwidth_rx_bps{circuit="MPLS",site="acme-branch1"`) {
+		t.Error("got circuit usage for acme whose report failed")
+	}
+}
+
+func TestScrapeAnalyticsDown(t *testing.T) {
+	server := versatest.NewServer(testTenant("acme"))
+	defer server.Close()
+
+	server.Inject(versatest.Fault{Query: "tenants", Malformed: true})
+
+	exposition := scrape(t, server, versa_collector.Aggregations{})
+
+	expectLines(t, exposition, `versa_analytics_up{versa_instance="lab"} 0`)
+
+	if strings.Contains(exposition, "versa_analytics_sites_availability_percent{") {
+		t.Error("got site availability while the tenants could not be listed")
+	}
+}
+
+func TestScrapeAggregation(t *testing.T) {
+
+	const rxFamily = "versa_analytics_site_circuit_usage_bandwidth_rx_bps"
+
+	tests := []struct {
+		aggregation versa_client.Aggregation
+		description string
+
+		// The circuit RX of 1000 bps is scaled by 1, 4, 2, 6 and 3 over the 5 buckets of the scrape interval,
+		// a single bucket being queried for the latest value
+		want       string
+		wantWindow time.Duration
+	}{
+		{aggregation: versa_client.AggregationLatest, description: "latest value", want: "1000", wantWindow: time.Minute},
+		{aggregation: versa_client.AggregationMax, description: "maximum", want: "6000", wantWindow: 5 * time.Minute},
+		{aggregation: versa_client.AggregationMin, description: "minimum", want: "1000", wantWindow: 5 * time.Minute},
+		{aggregation: versa_client.AggregationAvg, description: "average", want: "3200", wantWindow: 5 * time.Minute},
+		{aggregation: versa_client.AggregationP95, description: "95th percentile", want: "6000", wantWindow: 5 * time.Minute},
+	}
+
+	for _, tt := range tests {
+
+		t.Run(string(tt.aggregation), func(t *testing.T) {
+
+			server := versatest.NewServer(testTenant("acme"))
+			defer server.Close()
+
+			server.Variation = []float64{1, 4, 2, 6, 3}
+
+			exposition := scrape(t, server, versa_collector.Aggregations{
+				Families: map[string]versa_client.Aggregation{rxFamily: tt.aggregation},
+			})
+
+			// The TX family of the report keeps the latest value, of the last bucket when the window is widened
+			wantTx := "1500"
+
+			if tt.wantWindow == time.Minute {
+				wantTx = "500"
+			}
+
+			expectLines(t, exposition,
+				"# HELP "+rxFamily+" The site circuit RX bandwidth usage rate in bits per second, "+
+					tt.description+" over the query window",
+				rxFamily+`{circuit="MPLS",site="acme-branch1",tenant="acme",versa_instance="lab"} `+tt.want,
+				"# HELP versa_analytics_site_circuit_usage_bandwidth_tx_bps The site circuit TX bandwidth usage "+
+					"rate in bits per second, latest value over the query window",
+				`versa_analytics_site_circuit_usage_bandwidth_tx_bps{circuit="MPLS",site="acme-branch1",tenant="acme",versa_instance="lab"} `+wantTx,
+			)
+
+			if window := server.Window("linkUsage"); window != tt.wantWindow {
+				t.Errorf("got a %v window for the circuit usage report, want %v", window, tt.wantWindow)
+			}
+
+			if window := server.Window("slam"); window != time.Minute {
+				t.Errorf("got a %v window for the SLA metrics report, want a single bucket", window)
+			}
+		})
+	}
+}
@@ -0,0 +1,259 @@
+package versa_collector
+
+import (
+	"context"
+
+	"github.com/lucabrasi83/peppamon_versa/logging"
+	"github.com/lucabrasi83/peppamon_versa/versa_client"
+	"github.com/lucabrasi83/peppamon_versa/versa_director"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// directorInventory is the result of the Versa Director appliances and alarms requests
+type directorInventory struct {
+	appliances []versa_director.VersaAppliance
+	err        error
+
+	// alarms holds the active alarms per tenant, it is nil when the organizations could not be listed
+	alarms map[string][]versa_director.VersaAlarm
+
+	// alarmTenants are the tenants polled for alarms and alarmsErr the failures of the poll as
+	// versa_client.TenantErrors, or the failure to list the organizations
+	alarmTenants []string
+	alarmsErr    error
+}
+
+// fetchDirectorInventory requests the appliances and the active alarms from Versa Director in the background.
+// The channel yields nothing when no Versa Director is configured
+func (v *VersaAnalyticsExporter) fetchDirectorInventory(ctx context.Context) <-chan *directorInventory {
+
+	inventory := make(chan *directorInventory, 1)
+
+	if v.VersaDirectorClient == nil {
+		inventory <- nil
+		return inventory
+	}
+
+	go func() {
+		appliances, err := v.VersaDirectorClient.GetAppliances(ctx)
+
+		result := &directorInventory{appliances: appliances, err: err}
+
+		orgs, err := v.VersaDirectorClient.GetOrganizations(ctx)
+
+		if err != nil {
+			result.alarmsErr = err
+			inventory <- result
+			return
+		}
+
+		// Tenants filtered out of Analytics are not polled for alarms either
+		monitored := orgs[:0:0]
+
+		for _, org := range orgs {
+			if v.VersaAnalyticsClient.TenantFilter.Monitored(org.Name) {
+				monitored = append(monitored, org)
+				result.alarmTenants = append(result.alarmTenants, org.Name)
+			}
+		}
+
+		result.alarms, result.alarmsErr = v.VersaDirectorClient.GetTenantsActiveAlarms(ctx, monitored)
+
+		inventory <- result
+	}()
+
+	return inventory
+}
+
+// markSiteReporting records that Analytics returned data for the site of the tenant
+func (v *VersaAnalyticsExporter) markSiteReporting(tenant, site string) {
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.reportingSites == nil {
+		v.reportingSites = make(map[string]map[string]bool)
+	}
+
+	if v.reportingSites[tenant] == nil {
+		v.reportingSites[tenant] = make(map[string]bool)
+	}
+
+	v.reportingSites[tenant][site] = true
+}
+
+// siteReportFailed records that a report marking the reporting sites failed for the tenant, whose sites
+// without data can then not be told apart from the sites not reporting. It must be called with the lock held
+func (v *VersaAnalyticsExporter) siteReportFailed(report, tenant string) {
+
+	if report != versa_client.ReportSitesAvailability && report != versa_client.ReportApplianceCompute {
+		return
+	}
+
+	if v.siteReportsFailed == nil {
+		v.siteReportsFailed = make(map[string]bool)
+	}
+
+	v.siteReportsFailed[tenant] = true
+}
+
+// versaDirectorMetrics publishes the appliances inventory and reachability. When Analytics was scraped,
+// every appliance is also flagged with whether Analytics returned data for its site. The sites without data of
+// the tenants whose site reports failed are left out rather than reported as not reporting
+func (v *VersaAnalyticsExporter) versaDirectorMetrics(inventory *directorInventory, analyticsScraped bool) {
+
+	if inventory == nil {
+		return
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.versaDirectorAlarmsUpMetrics(inventory)
+	v.versaDirectorAlarmsMetrics(inventory.alarms)
+
+	if inventory.err != nil {
+		v.Metrics = append(v.Metrics, prometheus.MustNewConstMetric(versaDirectorUp, prometheus.GaugeValue, 0))
+		return
+	}
+
+	v.Metrics = append(v.Metrics, prometheus.MustNewConstMetric(versaDirectorUp, prometheus.GaugeValue, 1))
+
+	for _, appliance := range inventory.appliances {
+
+		if !v.VersaAnalyticsClient.TenantFilter.Monitored(appliance.OwnerOrg) {
+			continue
+		}
+
+		v.Metrics = append(v.Metrics,
+			prometheus.MustNewConstMetric(
+				versaDirectorApplianceInfo,
+				prometheus.GaugeValue,
+				1,
+				appliance.OwnerOrg, appliance.Name, appliance.SiteID, appliance.Location.LocationID,
+				appliance.Hardware.Model, appliance.SoftwareVersion, appliance.Type,
+			),
+			prometheus.MustNewConstMetric(
+				versaDirectorApplianceReachable,
+				prometheus.GaugeValue,
+				boolToFloat(appliance.Reachable()),
+				appliance.OwnerOrg, appliance.Name,
+			),
+			prometheus.MustNewConstMetric(
+				versaDirectorApplianceInSync,
+				prometheus.GaugeValue,
+				boolToFloat(appliance.InSync()),
+				appliance.OwnerOrg, appliance.Name,
+			),
+		)
+
+		if !analyticsScraped {
+			continue
+		}
+
+		reporting := v.reportingSites[appliance.OwnerOrg][appliance.Name]
+
+		if !reporting && v.siteReportsFailed[appliance.OwnerOrg] {
+			continue
+		}
+
+		v.Metrics = append(v.Metrics,
+			prometheus.MustNewConstMetric(
+				versaSiteReporting,
+				prometheus.GaugeValue,
+				boolToFloat(reporting),
+				appliance.OwnerOrg, appliance.Name,
+			),
+		)
+	}
+}
+
+// versaDirectorAlarmsUpMetrics publishes per tenant whether its alarms were polled, so that a failed poll is
+// not mistaken for all of its alarms being cleared. When the organizations could not be listed, the tenants
+// known to Analytics are reported down. It must be called with the lock held
+func (v *VersaAnalyticsExporter) versaDirectorAlarmsUpMetrics(inventory *directorInventory) {
+
+	failures := versa_client.AsTenantErrors(inventory.alarmsErr)
+
+	tenants := inventory.alarmTenants
+
+	_, global := failures[""]
+
+	if global {
+
+		logging.PeppaMonLog("warning", "Unable to list Versa Director organizations to poll alarms for instance %v: %v",
+			v.Instance, inventory.alarmsErr)
+
+		tenants = nil
+
+		for _, tenant := range v.VersaAnalyticsClient.Tenants {
+			tenants = append(tenants, tenant.TenantName)
+		}
+
+		v.Metrics = append(v.Metrics, prometheus.NewInvalidMetric(versaDirectorAlarmsUp, inventory.alarmsErr))
+	}
+
+	for _, tenant := range tenants {
+
+		_, failed := failures[tenant]
+
+		v.Metrics = append(v.Metrics, prometheus.MustNewConstMetric(
+			versaDirectorAlarmsUp,
+			prometheus.GaugeValue,
+			boolToFloat(!failed && !global),
+			tenant,
+		))
+	}
+}
+
+// alarmGroup identifies the alarms counted together
+type alarmGroup struct {
+	tenant, appliance, severity, alarmType string
+}
+
+// versaDirectorAlarmsMetrics publishes the active alarms. Cleared alarms are not returned by the client
+// and vanish from the next scrape. It must be called with the lock held
+func (v *VersaAnalyticsExporter) versaDirectorAlarmsMetrics(tenantsAlarms map[string][]versa_director.VersaAlarm) {
+
+	counts := make(map[alarmGroup]float64)
+
+	for tenant, alarms := range tenantsAlarms {
+
+		raised := make(map[string]bool, len(alarms))
+
+		for _, alarm := range alarms {
+
+			counts[alarmGroup{tenant, alarm.Appliance, alarm.Severity, alarm.Type}]++
+
+			// Alarms without an ID would yield duplicate series
+			if alarm.RaisedAt.IsZero() || alarm.ID == "" || raised[alarm.ID] {
+				continue
+			}
+
+			raised[alarm.ID] = true
+
+			v.Metrics = append(v.Metrics, prometheus.MustNewConstMetric(
+				versaDirectorAlarmRaisedTimestamp,
+				prometheus.GaugeValue,
+				float64(alarm.RaisedAt.Unix()),
+				tenant, alarm.Appliance, alarm.ID, alarm.Severity, alarm.Type, alarm.Description,
+			))
+		}
+	}
+
+	for group, count := range counts {
+		v.Metrics = append(v.Metrics, prometheus.MustNewConstMetric(
+			versaDirectorActiveAlarms,
+			prometheus.GaugeValue,
+			count,
+			group.tenant, group.appliance, group.severity, group.alarmType,
+		))
+	}
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
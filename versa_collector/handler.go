@@ -0,0 +1,136 @@
+package versa_collector
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/lucabrasi83/peppamon_versa/logging"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	defaultScrapeTimeout = 4 * time.Minute
+
+	// defaultScrapeInterval matches a scrape timeout of 4 minutes
+	defaultScrapeInterval = 5 * time.Minute
+
+	// scrapeTimeoutOffset leaves Peppamon enough time to send the metrics before Prometheus gives up
+	scrapeTimeoutOffset = 5 * time.Second
+)
+
+// scrapeCollector binds a single scrape of the exporter to the context of the Prometheus request
+type scrapeCollector struct {
+	ctx          context.Context
+	timeout      time.Duration
+	exporter     *VersaAnalyticsExporter
+	aggregations familyAggregations
+}
+
+func (s scrapeCollector) Describe(ch chan<- *prometheus.Desc) {
+	s.exporter.describe(s.aggregations, ch)
+}
+
+func (s scrapeCollector) Collect(ch chan<- prometheus.Metric) {
+
+	ctx, cancel := context.WithTimeout(s.ctx, s.timeout)
+	defer cancel()
+
+	s.exporter.collect(ctx, s.aggregations, ch)
+}
+
+// ScrapeHandler serves the metrics of every Versa instance. Instances are scraped concurrently and
+// each series is labelled with the versa_instance it comes from
+type ScrapeHandler struct {
+	Exporters []*VersaAnalyticsExporter
+
+	// Aggregations sets how the timeseries metric families of every instance are aggregated
+	Aggregations Aggregations
+}
+
+// NewScrapeHandler loads the aggregation of the timeseries metric families from the environment
+func NewScrapeHandler(exporters []*VersaAnalyticsExporter) *ScrapeHandler {
+	return &ScrapeHandler{Exporters: exporters, Aggregations: aggregationsFromEnv()}
+}
+
+// scrapeTimeoutFromEnv loads the default scrape timeout from PEPPAMON_VERSA_SCRAPE_TIMEOUT
+func scrapeTimeoutFromEnv() time.Duration {
+	return durationFromEnv("PEPPAMON_VERSA_SCRAPE_TIMEOUT", defaultScrapeTimeout)
+}
+
+// scrapeIntervalFromEnv loads the Prometheus scrape interval from PEPPAMON_VERSA_SCRAPE_INTERVAL
+func scrapeIntervalFromEnv() time.Duration {
+	return durationFromEnv("PEPPAMON_VERSA_SCRAPE_INTERVAL", defaultScrapeInterval)
+}
+
+func durationFromEnv(name string, defaultDuration time.Duration) time.Duration {
+
+	value := os.Getenv(name)
+
+	if value == "" {
+		return defaultDuration
+	}
+
+	duration, err := time.ParseDuration(value)
+
+	if err != nil || duration <= 0 {
+		logging.PeppaMonLog("fatal", "Invalid duration %q for environment variable %v", value, name)
+	}
+
+	return duration
+}
+
+// scrapeTimeout returns the timeout sent by Prometheus minus an offset, or the configured scrape timeout
+func (v *VersaAnalyticsExporter) scrapeTimeout(r *http.Request) time.Duration {
+
+	header := r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds")
+
+	if header == "" {
+		return v.ScrapeTimeout
+	}
+
+	seconds, err := strconv.ParseFloat(header, 64)
+
+	if err != nil || seconds <= 0 {
+		logging.PeppaMonLog("warning", "Ignoring invalid Prometheus scrape timeout header %q", header)
+		return v.ScrapeTimeout
+	}
+
+	timeout := time.Duration(seconds * float64(time.Second))
+
+	if timeout > 2*scrapeTimeoutOffset {
+		timeout -= scrapeTimeoutOffset
+	}
+
+	return timeout
+}
+
+// ServeHTTP serves the metrics of a scrape bound to the Prometheus request. Every in-flight Versa request
+// is cancelled when the scrape deadline is reached or when Prometheus closes the connection.
+// A failing instance only loses its own metrics, the other instances are still served
+func (h *ScrapeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	registry := prometheus.NewRegistry()
+	aggregations := h.Aggregations.families()
+
+	for _, exporter := range h.Exporters {
+
+		collector := scrapeCollector{
+			ctx:          r.Context(),
+			timeout:      exporter.scrapeTimeout(r),
+			exporter:     exporter,
+			aggregations: aggregations,
+		}
+
+		prometheus.WrapRegistererWith(prometheus.Labels{"versa_instance": exporter.Instance}, registry).
+			MustRegister(collector)
+	}
+
+	promhttp.HandlerFor(
+		prometheus.Gatherers{prometheus.DefaultGatherer, registry},
+		promhttp.HandlerOpts{ErrorHandling: promhttp.ContinueOnError},
+	).ServeHTTP(w, r)
+}
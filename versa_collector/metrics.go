@@ -1,10 +1,19 @@
 package versa_collector
 
-import "github.com/prometheus/client_golang/prometheus"
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/lucabrasi83/peppamon_versa/logging"
+	"github.com/lucabrasi83/peppamon_versa/versa_client"
+	"github.com/prometheus/client_golang/prometheus"
+)
 
 var (
-	metricsDesc = []*prometheus.Desc{
-		versaSitesAvailabilityPercent,
+	// timeseriesFamilies lists the metric families computed from timeseries points
+	timeseriesFamilies = []*timeseriesFamily{
 		versaApplicationUsageBandwidthRxBps,
 		versaApplicationUsageBandwidthTxBps,
 		versaApplicationUsageVolumeRxByte,
@@ -22,6 +31,60 @@ var (
 		versaSLALossRev,
 	}
 
+	// Metric families of the timeseries reports by Versa Analytics metric name
+	appUsageRateFamilies = map[string]*timeseriesFamily{
+		"bw-rx": versaApplicationUsageBandwidthRxBps,
+		"bw-tx": versaApplicationUsageBandwidthTxBps,
+	}
+
+	appUsageVolumeFamilies = map[string]*timeseriesFamily{
+		"volume-rx": versaApplicationUsageVolumeRxByte,
+		"volume-tx": versaApplicationUsageVolumeTxByte,
+	}
+
+	circuitUsageFamilies = map[string]*timeseriesFamily{
+		"bw-rx": versaSiteCircuitBandwidthUsageRxBps,
+		"bw-tx": versaSiteCircuitBandwidthUsageTxBps,
+	}
+
+	applianceComputeFamilies = map[string]*timeseriesFamily{
+		"cpuload":  versaApplianceCPULoadPercent,
+		"memload":  versaApplianceMemoryLoadPercent,
+		"diskload": versaApplianceDiskLoadPercent,
+		"sessload": versaApplianceSessionsLoad,
+	}
+
+	slaFamilies = map[string]*timeseriesFamily{
+		"delay":        versaSLADelay,
+		"fwdDelayVar":  versaSLAJitterFwd,
+		"revDelayVar":  versaSLAJitterRev,
+		"fwdLossRatio": versaSLALossFwd,
+		"revLossRatio": versaSLALossRev,
+	}
+
+	// reportFamilies maps the timeseries reports to the metric families computed from them
+	reportFamilies = map[string]map[string]*timeseriesFamily{
+		versa_client.ReportApplicationUsageRate:   appUsageRateFamilies,
+		versa_client.ReportApplicationUsageVolume: appUsageVolumeFamilies,
+		versa_client.ReportSiteCircuitUsage:       circuitUsageFamilies,
+		versa_client.ReportApplianceCompute:       applianceComputeFamilies,
+		versa_client.ReportSiteSLAMetrics:         slaFamilies,
+	}
+
+	metricsDesc = []*prometheus.Desc{
+		versaSitesAvailabilityPercent,
+		versaDirectorUp,
+		versaDirectorApplianceInfo,
+		versaDirectorApplianceReachable,
+		versaDirectorApplianceInSync,
+		versaSiteReporting,
+		versaDirectorActiveAlarms,
+		versaDirectorAlarmRaisedTimestamp,
+		versaDirectorAlarmsUp,
+		versaAnalyticsUp,
+		versaReportUp,
+	}
+
 	versaSitesAvailabilityPercent = prometheus.NewDesc(
 		"versa_analytics_sites_availability_percent",
 		"The availability percentage for the particular site",
@@ -29,105 +92,315 @@ var (
 		nil,
 	)
 
-	versaApplicationUsageBandwidthRxBps = prometheus.NewDesc(
+	versaApplicationUsageBandwidthRxBps = newTimeseriesFamily(
 		"versa_analytics_application_usage_bandwidth_rx_bps",
 		"The application RX bandwidth usage rate in bits per second",
 		[]string{"tenant", "site", "app_name", "client_ip", "circuit"},
-		nil,
 	)
 
-	versaApplicationUsageBandwidthTxBps = prometheus.NewDesc(
+	versaApplicationUsageBandwidthTxBps = newTimeseriesFamily(
 		"versa_analytics_application_usage_bandwidth_tx_bps",
 		"The application TX bandwidth usage rate in bits per second",
 		[]string{"tenant", "site", "app_name", "client_ip", "circuit"},
-		nil,
 	)
 
-	versaApplicationUsageVolumeRxByte = prometheus.NewDesc(
+	versaApplicationUsageVolumeRxByte = newTimeseriesFamily(
 		"versa_analytics_application_usage_volume_rx_bytes",
 		"The application RX volume usage in bytes",
 		[]string{"tenant", "site", "app_name", "client_ip", "circuit"},
-		nil,
 	)
 
-	versaApplicationUsageVolumeTxByte = prometheus.NewDesc(
+	versaApplicationUsageVolumeTxByte = newTimeseriesFamily(
 		"versa_analytics_application_usage_volume_tx_bytes",
 		"The application TX volume usage in bytes",
 		[]string{"tenant", "site", "app_name", "client_ip", "circuit"},
-		nil,
 	)
 
-	versaSiteCircuitBandwidthUsageTxBps = prometheus.NewDesc(
+	versaSiteCircuitBandwidthUsageTxBps = newTimeseriesFamily(
 		"versa_analytics_site_circuit_usage_bandwidth_tx_bps",
 		"The site circuit TX bandwidth usage rate in bits per second",
 		[]string{"tenant", "site", "circuit"},
-		nil,
 	)
 
-	versaSiteCircuitBandwidthUsageRxBps = prometheus.NewDesc(
+	versaSiteCircuitBandwidthUsageRxBps = newTimeseriesFamily(
 		"versa_analytics_site_circuit_usage_bandwidth_rx_bps",
 		"The site circuit RX bandwidth usage rate in bits per second",
 		[]string{"tenant", "site", "circuit"},
-		nil,
 	)
 
-	versaApplianceCPULoadPercent = prometheus.NewDesc(
+	versaApplianceCPULoadPercent = newTimeseriesFamily(
 		"versa_analytics_appliance_cpu_load_pct",
 		"The appliance CPU Load in percentage",
 		[]string{"tenant", "site"},
-		nil,
 	)
 
-	versaApplianceMemoryLoadPercent = prometheus.NewDesc(
+	versaApplianceMemoryLoadPercent = newTimeseriesFamily(
 		"versa_analytics_appliance_memory_load_pct",
 		"The appliance Memory Load in percentage",
 		[]string{"tenant", "site"},
-		nil,
 	)
 
-	versaApplianceDiskLoadPercent = prometheus.NewDesc(
+	versaApplianceDiskLoadPercent = newTimeseriesFamily(
 		"versa_analytics_appliance_disk_load_pct",
 		"The appliance Disk Load in percentage",
 		[]string{"tenant", "site"},
-		nil,
 	)
 
-	versaApplianceSessionsLoad = prometheus.NewDesc(
+	versaApplianceSessionsLoad = newTimeseriesFamily(
 		"versa_analytics_appliance_sessions_load",
 		"The appliance current sessions",
 		[]string{"tenant", "site"},
-		nil,
 	)
 
-	versaSLADelay = prometheus.NewDesc(
+	versaSLADelay = newTimeseriesFamily(
 		"versa_analytics_site_slam_delay_ms",
 		"The SLA probe delay reported in milliseconds",
 		[]string{"tenant", "source_site", "destination_site", "source_circuit", "destination_circuit"},
-		nil,
 	)
 
-	versaSLAJitterFwd = prometheus.NewDesc(
+	versaSLAJitterFwd = newTimeseriesFamily(
 		"versa_analytics_site_slam_jitter_fwd_ms",
 		"The SLA probe forward jitter reported in milliseconds",
 		[]string{"tenant", "source_site", "destination_site", "source_circuit", "destination_circuit"},
-		nil,
 	)
-	versaSLAJitterRev = prometheus.NewDesc(
+	versaSLAJitterRev = newTimeseriesFamily(
 		"versa_analytics_site_slam_jitter_rcv_ms",
 		"The SLA probe reverse jitter reported in milliseconds",
 		[]string{"tenant", "source_site", "destination_site", "source_circuit", "destination_circuit"},
-		nil,
 	)
-	versaSLALossFwd = prometheus.NewDesc(
+	versaSLALossFwd = newTimeseriesFamily(
 		"versa_analytics_site_slam_loss_fwd_pct",
 		"The SLA probe forward loss reported in percent",
 		[]string{"tenant", "source_site", "destination_site", "source_circuit", "destination_circuit"},
-		nil,
 	)
-	versaSLALossRev = prometheus.NewDesc(
+	versaSLALossRev = newTimeseriesFamily(
 		"versa_analytics_site_slam_loss_rcv_pct",
 		"The SLA probe reverse loss reported in percent",
 		[]string{"tenant", "source_site", "destination_site", "source_circuit", "destination_circuit"},
+	)
+
+	versaDirectorUp = prometheus.NewDesc(
+		"versa_director_up",
+		"Whether Versa Director answered the appliances inventory request",
+		nil,
+		nil,
+	)
+
+	versaDirectorApplianceInfo = prometheus.NewDesc(
+		"versa_director_appliance_info",
+		"The appliances provisioned on Versa Director",
+		[]string{"tenant", "appliance", "site_id", "location", "model", "software_version", "type"},
+		nil,
+	)
+
+	versaDirectorApplianceReachable = prometheus.NewDesc(
+		"versa_director_appliance_reachable",
+		"Whether Versa Director reached the appliance on its last ping",
+		[]string{"tenant", "appliance"},
+		nil,
+	)
+
+	versaDirectorApplianceInSync = prometheus.NewDesc(
+		"versa_director_appliance_config_in_sync",
+		"Whether the appliance configuration is in sync with Versa Director",
+		[]string{"tenant", "appliance"},
+		nil,
+	)
+
+	versaSiteReporting = prometheus.NewDesc(
+		"versa_analytics_site_reporting",
+		"Whether Versa Analytics returned data for a site provisioned on Versa Director",
+		[]string{"tenant", "site"},
+		nil,
+	)
+
+	versaDirectorActiveAlarms = prometheus.NewDesc(
+		"versa_director_active_alarms",
+		"The number of active Versa Director alarms",
+		[]string{"tenant", "appliance", "severity", "type"},
+		nil,
+	)
+
+	versaDirectorAlarmRaisedTimestamp = prometheus.NewDesc(
+		"versa_director_active_alarm_raised_timestamp_seconds",
+		"The time an active Versa Director alarm was raised, labelled with its description",
+		[]string{"tenant", "appliance", "alarm_id", "severity", "type", "description"},
+		nil,
+	)
+
+	versaDirectorAlarmsUp = prometheus.NewDesc(
+		"versa_director_alarms_up",
+		"Whether the active alarms of the tenant could be fetched from Versa Director",
+		[]string{"tenant"},
+		nil,
+	)
+
+	versaAnalyticsUp = prometheus.NewDesc(
+		"versa_analytics_up",
+		"Whether Versa Analytics answered the tenant discovery request",
+		nil,
+		nil,
+	)
+
+	versaReportUp = prometheus.NewDesc(
+		"versa_analytics_exporter_report_up",
+		"Whether the Versa Analytics report succeeded for the tenant during the last scrape",
+		[]string{"report", "tenant"},
 		nil,
 	)
 )
+
+// Aggregations sets how the points of the timeseries metric families are reduced over the query window
+type Aggregations struct {
+	// Default applies to the metric families missing from Families, latest when empty
+	Default versa_client.Aggregation
+
+	// Families sets the aggregation of metric families by name
+	Families map[string]versa_client.Aggregation
+}
+
+// aggregationsFromEnv loads the aggregation of every timeseries metric family from PEPPAMON_VERSA_AGGREGATION,
+// latest by default, overridden per family by PEPPAMON_VERSA_AGGREGATIONS given as a comma separated list of
+// metric=aggregation. Aggregations set for metric families that do not exist are ignored with a warning
+func aggregationsFromEnv() Aggregations {
+
+	aggregations := Aggregations{
+		Default:  versa_client.AggregationLatest,
+		Families: make(map[string]versa_client.Aggregation),
+	}
+
+	if value := os.Getenv("PEPPAMON_VERSA_AGGREGATION"); value != "" {
+
+		aggregation, err := versa_client.ParseAggregation(value)
+
+		if err != nil {
+			logging.PeppaMonLog("fatal", "Invalid PEPPAMON_VERSA_AGGREGATION: %v", err)
+		}
+
+		aggregations.Default = aggregation
+	}
+
+	for _, item := range strings.Split(os.Getenv("PEPPAMON_VERSA_AGGREGATIONS"), ",") {
+
+		if strings.TrimSpace(item) == "" {
+			continue
+		}
+
+		tokens := strings.SplitN(item, "=", 2)
+
+		if len(tokens) != 2 {
+			logging.PeppaMonLog("fatal", "Invalid metric aggregation %q, expected metric=aggregation", item)
+		}
+
+		aggregation, err := versa_client.ParseAggregation(tokens[1])
+
+		if err != nil {
+			logging.PeppaMonLog("fatal", "Invalid aggregation for metric %v: %v", tokens[0], err)
+		}
+
+		aggregations.Families[strings.TrimSpace(tokens[0])] = aggregation
+	}
+
+	for name := range aggregations.Families {
+		if !knownTimeseriesFamily(name) {
+			logging.PeppaMonLog("warning", "Ignoring aggregation of unknown metric family %v", name)
+		}
+	}
+
+	return aggregations
+}
+
+func knownTimeseriesFamily(name string) bool {
+
+	for _, family := range timeseriesFamilies {
+		if family.name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// timeseriesFamily is a metric family computed from timeseries points
+type timeseriesFamily struct {
+	name   string
+	help   string
+	labels []string
+}
+
+func newTimeseriesFamily(name, help string, labels []string) *timeseriesFamily {
+	return &timeseriesFamily{name: name, help: help, labels: labels}
+}
+
+// familyAggregation is the aggregation of a timeseries metric family along with the description stating it
+type familyAggregation struct {
+	aggregation versa_client.Aggregation
+	desc        *prometheus.Desc
+}
+
+// familyAggregations holds the aggregation of every timeseries metric family for the scrapes of a handler
+type familyAggregations map[*timeseriesFamily]familyAggregation
+
+// latestAggregations reduces every timeseries metric family to its latest point
+var latestAggregations = Aggregations{}.families()
+
+// families returns the aggregation of every timeseries metric family
+func (a Aggregations) families() familyAggregations {
+
+	aggregations := make(familyAggregations, len(timeseriesFamilies))
+
+	for _, family := range timeseriesFamilies {
+
+		aggregation, ok := a.Families[family.name]
+
+		if !ok {
+			aggregation = a.Default
+		}
+
+		if aggregation == "" {
+			aggregation = versa_client.AggregationLatest
+		}
+
+		aggregations[family] = familyAggregation{
+			aggregation: aggregation,
+			desc: prometheus.NewDesc(
+				family.name,
+				fmt.Sprintf("%v, %v over the query window", family.help, aggregation.Description()),
+				family.labels,
+				nil,
+			),
+		}
+	}
+
+	return aggregations
+}
+
+func (f familyAggregations) desc(family *timeseriesFamily) *prometheus.Desc {
+	return f[family].desc
+}
+
+// window returns the query window of the report: the scrape interval when one of its metric families aggregates
+// several points, so that a single bucket is not aggregated on its own, or zero for a single bucket.
+// PEPPAMON_VERSA_ANALYTICS_WINDOWS still takes precedence in the client
+func (f familyAggregations) window(report string, interval time.Duration) time.Duration {
+
+	for _, family := range reportFamilies[report] {
+		if f[family].aggregation != versa_client.AggregationLatest {
+			return interval
+		}
+	}
+
+	return 0
+}
+
+// aggregate reduces the points of the series with the aggregation of its metric family
+func (f familyAggregations) aggregate(series versa_client.TimeseriesSeries, families map[string]*timeseriesFamily) (float64, bool) {
+
+	family, ok := families[series.Metric]
+
+	if !ok {
+		return 0, false
+	}
+
+	return series.Aggregate(f[family].aggregation)
+}
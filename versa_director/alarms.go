@@ -0,0 +1,168 @@
+package versa_director
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lucabrasi83/peppamon_versa/logging"
+	"github.com/lucabrasi83/peppamon_versa/versa_client"
+)
+
+// directorAlarmsConcurrency is the number of organizations whose alarms are requested at the same time
+const directorAlarmsConcurrency = 4
+
+// alarmTimeLayouts are the layouts Versa Director uses for alarm times sent as strings
+var alarmTimeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.000-0700",
+	"2006-01-02 15:04:05",
+}
+
+// AlarmTime is an alarm time sent either as epoch milliseconds or as a date string
+type AlarmTime struct {
+	time.Time
+}
+
+func (t *AlarmTime) UnmarshalJSON(data []byte) error {
+
+	if bytes.Equal(data, []byte("null")) {
+		return nil
+	}
+
+	var millis json.Number
+
+	if err := json.Unmarshal(data, &millis); err == nil {
+
+		ms, err := millis.Int64()
+
+		if err != nil {
+			return fmt.Errorf("invalid alarm time %s", data)
+		}
+
+		t.Time = time.Unix(0, ms*int64(time.Millisecond))
+		return nil
+	}
+
+	var value string
+
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("invalid alarm time %s", data)
+	}
+
+	if ms, err := strconv.ParseInt(value, 10, 64); err == nil {
+		t.Time = time.Unix(0, ms*int64(time.Millisecond))
+		return nil
+	}
+
+	for _, layout := range alarmTimeLayouts {
+		if parsed, err := time.Parse(layout, value); err == nil {
+			t.Time = parsed
+			return nil
+		}
+	}
+
+	return fmt.Errorf("invalid alarm time %q", value)
+}
+
+// VersaAlarm is an alarm raised by an appliance and reported by Versa Director
+type VersaAlarm struct {
+	ID          string    `json:"id"`
+	Type        string    `json:"alarmType"`
+	Severity    string    `json:"severity"`
+	Org         string    `json:"org"`
+	Appliance   string    `json:"deviceName"`
+	Description string    `json:"lastAlarmText"`
+	Cleared     bool      `json:"isCleared"`
+	RaisedAt    AlarmTime `json:"createTime"`
+}
+
+type versaAlarmList struct {
+	TotalCount int          `json:"totalCount"`
+	Alarms     []VersaAlarm `json:"alarms"`
+}
+
+// GetActiveAlarms returns the alarms of the organization that are not cleared yet. Versa Director filters out
+// the cleared alarms so that they are neither paged through nor counted in totalCount
+func (d *VersaDirectorClient) GetActiveAlarms(ctx context.Context, org string) ([]VersaAlarm, error) {
+
+	var alarms []VersaAlarm
+
+	for offset := 0; ; offset += d.PageSize {
+
+		var page versaAlarmList
+
+		reqPath := fmt.Sprintf("/vnms/fault/alarms?org=%s&cleared=false&offset=%d&limit=%d",
+			url.QueryEscape(org), offset, d.PageSize)
+
+		if err := d.getJSON(ctx, "Get Director Alarms for tenant "+org, reqPath, &page); err != nil {
+			return nil, err
+		}
+
+		alarms = append(alarms, page.Alarms...)
+
+		if len(page.Alarms) == 0 || len(alarms) >= page.TotalCount {
+			break
+		}
+	}
+
+	return alarms, nil
+}
+
+// GetTenantsActiveAlarms returns the active alarms of every organization. An organization whose alarms
+// cannot be fetched is left out of the map and its failure returned in versa_client.TenantErrors, so that
+// the alarms of the others are still reported
+func (d *VersaDirectorClient) GetTenantsActiveAlarms(ctx context.Context,
+	orgs []VersaOrganization) (map[string][]VersaAlarm, error) {
+
+	logging.PeppaMonLog("info", "Started Batch Job to fetch Versa Director Alarms")
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	tenantsAlarms := make(map[string][]VersaAlarm, len(orgs))
+	failures := make(versa_client.TenantErrors)
+
+	// Alarms are requested a few organizations at a time to spare Versa Director
+	sem := make(chan struct{}, directorAlarmsConcurrency)
+
+	for _, org := range orgs {
+
+		wg.Add(1)
+		sem <- struct{}{}
+
+		go func(org string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			alarms, err := d.GetActiveAlarms(ctx, org)
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if err != nil {
+				failures[org] = err
+				return
+			}
+
+			tenantsAlarms[org] = alarms
+		}(org.Name)
+	}
+
+	wg.Wait()
+
+	logging.PeppaMonLog("info", "Completed Batch Job to fetch Versa Director Alarms")
+
+	if len(failures) > 0 {
+		return tenantsAlarms, failures
+	}
+
+	return tenantsAlarms, nil
+}
@@ -0,0 +1,66 @@
+package versa_director
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/lucabrasi83/peppamon_versa/logging"
+	"github.com/lucabrasi83/peppamon_versa/versa_client"
+)
+
+// BasicAuthenticator sends the Versa Director credentials with every request using HTTP basic authentication,
+// which is what the Director REST API on TCP 9182 expects
+type BasicAuthenticator struct {
+	Username string
+	Password string
+}
+
+func NewBasicAuthenticator(username, password string) *BasicAuthenticator {
+	return &BasicAuthenticator{Username: username, Password: password}
+}
+
+// Login does nothing as there is no session to open with basic authentication
+func (b *BasicAuthenticator) Login(ctx context.Context) error {
+	return nil
+}
+
+func (b *BasicAuthenticator) Authorize(req *http.Request) (uint64, error) {
+	req.SetBasicAuth(b.Username, b.Password)
+	return 0, nil
+}
+
+// Renew fails as the static credentials cannot be renewed once Versa Director rejected them
+func (b *BasicAuthenticator) Renew(ctx context.Context, expired uint64) error {
+	return fmt.Errorf("versa director rejected the credentials of user %v", b.Username)
+}
+
+func (b *BasicAuthenticator) Expired(res *http.Response) bool {
+	return res.StatusCode == http.StatusUnauthorized
+}
+
+// newAuthenticatorFromEnv selects the authenticator set by PEPPAMON_VERSA_DIRECTOR_AUTH_MODE
+func newAuthenticatorFromEnv(env versa_client.Env, httpClient *http.Client, baseURL string) versa_client.Authenticator {
+
+	username := env.String("PEPPAMON_VERSA_DIRECTOR_USERNAME", "")
+	password := env.String("PEPPAMON_VERSA_DIRECTOR_PASSWORD", "")
+
+	switch authMode := env.String("PEPPAMON_VERSA_DIRECTOR_AUTH_MODE", ""); authMode {
+	case "", AuthModeBasic:
+		return NewBasicAuthenticator(username, password)
+
+	case AuthModeOAuth2:
+		return versa_client.NewOAuth2Authenticator(
+			httpClient,
+			env.String("PEPPAMON_VERSA_DIRECTOR_OAUTH_TOKEN_URL", baseURL+"/auth/token"),
+			env.String("PEPPAMON_VERSA_DIRECTOR_OAUTH_CLIENT_ID", ""),
+			env.String("PEPPAMON_VERSA_DIRECTOR_OAUTH_CLIENT_SECRET", ""),
+			username,
+			password,
+		)
+
+	default:
+		logging.PeppaMonLog("fatal", "Unsupported Versa Director authentication mode %v", authMode)
+		return nil
+	}
+}
@@ -0,0 +1,163 @@
+// Package versa_director contains the REST client of Versa Director, the source of truth of the
+// organizations and appliances deployed on a Versa platform
+package versa_director
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"time"
+
+	"github.com/lucabrasi83/peppamon_versa/logging"
+	"github.com/lucabrasi83/peppamon_versa/versa_client"
+)
+
+const (
+	AuthModeBasic  = "basic"
+	AuthModeOAuth2 = versa_client.AuthModeOAuth2
+)
+
+type VersaDirectorClient struct {
+	Hostname      string
+	BaseURL       string
+	HttpClient    *http.Client
+	Authenticator versa_client.Authenticator
+
+	// PageSize is the number of records requested per page of the Director lists
+	PageSize int
+}
+
+// NewVersaDirectorClient builds the Versa Director client of a Versa instance from the PEPPAMON_VERSA_DIRECTOR_*
+// environment variables. It returns nil when PEPPAMON_VERSA_DIRECTOR_HOSTNAME is not set
+func NewVersaDirectorClient(instance string) *VersaDirectorClient {
+
+	env := versa_client.Env{Instance: instance}
+
+	hostname := env.String("PEPPAMON_VERSA_DIRECTOR_HOSTNAME", "")
+
+	if hostname == "" {
+		return nil
+	}
+
+	cookieJar, _ := cookiejar.New(nil)
+
+	httpTransport, err := versa_client.NewTLSTransport(
+		versa_client.TLSSettingsFromEnv(env, "Versa Director", "PEPPAMON_VERSA_DIRECTOR_TLS_"),
+		versa_client.ProxyFromEnv(env),
+	)
+
+	if err != nil {
+		logging.PeppaMonLog("fatal", "Unable to set up TLS for Versa Director with error %v", err)
+	}
+
+	httpClient := &http.Client{
+		Timeout:   2 * time.Minute,
+		Jar:       cookieJar,
+		Transport: versa_client.FixtureTransportFromEnv(env, httpTransport),
+	}
+
+	pageSize := env.Int("PEPPAMON_VERSA_DIRECTOR_PAGE_SIZE", 100)
+
+	if pageSize < 1 {
+		logging.PeppaMonLog("fatal", "PEPPAMON_VERSA_DIRECTOR_PAGE_SIZE must be at least 1")
+	}
+
+	baseURL := "https://" + hostname
+
+	return &VersaDirectorClient{
+		Hostname:      hostname,
+		BaseURL:       baseURL,
+		HttpClient:    httpClient,
+		Authenticator: newAuthenticatorFromEnv(env, httpClient, baseURL),
+		PageSize:      pageSize,
+	}
+}
+
+// Login obtains new credentials from Versa Director
+func (d *VersaDirectorClient) Login(ctx context.Context) error {
+	return d.Authenticator.Login(ctx)
+}
+
+// do sends the request with its credentials and retries it once after renewing them if Versa Director rejected them
+func (d *VersaDirectorClient) do(req *http.Request) (*http.Response, error) {
+
+	retryReq := req.Clone(req.Context())
+
+	generation, err := d.Authenticator.Authorize(req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := d.HttpClient.Do(req)
+
+	if err != nil || !d.Authenticator.Expired(res) {
+		return res, err
+	}
+
+	_ = res.Body.Close()
+
+	if err := d.Authenticator.Renew(req.Context(), generation); err != nil {
+		return nil, err
+	}
+
+	if _, err := d.Authenticator.Authorize(retryReq); err != nil {
+		return nil, err
+	}
+
+	res, err = d.HttpClient.Do(retryReq)
+
+	if err != nil || !d.Authenticator.Expired(res) {
+		return res, err
+	}
+
+	_ = res.Body.Close()
+
+	return nil, fmt.Errorf("versa director rejected the credentials for %v right after renewing them", d.Hostname)
+}
+
+// getJSON sends a GET request for the path to Versa Director and decodes the JSON response into result
+func (d *VersaDirectorClient) getJSON(ctx context.Context, queryTitle, reqPath string, result interface{}) error {
+
+	httpNewReq, err := http.NewRequestWithContext(ctx, "GET", d.BaseURL+reqPath, nil)
+
+	if err != nil {
+		logging.PeppaMonLog("error", "unable to build HTTP request for %v with error %v", queryTitle, err)
+		return err
+	}
+
+	httpNewReq.Header.Set("Accept", "application/json")
+
+	res, err := d.do(httpNewReq)
+
+	if err != nil {
+		logging.PeppaMonLog("error", "HTTP request for %v failed with error %v", queryTitle, err)
+		return err
+	}
+
+	defer func() {
+
+		errBodyClose := res.Body.Close()
+
+		if errBodyClose != nil {
+			logging.PeppaMonLog("error", "HTTP request for %v failed with error %v", queryTitle, errBodyClose)
+		}
+	}()
+
+	if res.StatusCode != http.StatusOK {
+		logging.PeppaMonLog("error", "Versa Director responded with HTTP error code %v for %v",
+			res.StatusCode, queryTitle)
+		return fmt.Errorf("versa director responded with HTTP error code %v for %v", res.StatusCode, queryTitle)
+	}
+
+	err = json.NewDecoder(res.Body).Decode(result)
+
+	if err != nil {
+		logging.PeppaMonLog("error", "Unable to decode JSON response from %v with error %v", queryTitle, err)
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,258 @@
+package versa_director_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lucabrasi83/peppamon_versa/versa_client"
+	"github.com/lucabrasi83/peppamon_versa/versa_director"
+	"github.com/lucabrasi83/peppamon_versa/versatest"
+)
+
+// newTestDirectorClient builds the client of the instance from the variables pointing it to the server.
+// The instance name is made of upper case letters only
+func newTestDirectorClient(t *testing.T, instance string, vars map[string]string) *versa_director.VersaDirectorClient {
+
+	for key, value := range vars {
+
+		key = "PEPPAMON_VERSA_" + instance + "_" + strings.TrimPrefix(key, "PEPPAMON_VERSA_")
+
+		_ = os.Setenv(key, value)
+		defer os.Unsetenv(key)
+	}
+
+	client := versa_director.NewVersaDirectorClient(instance)
+
+	if client == nil {
+		t.Fatalf("NewVersaDirectorClient() returned no client for instance %v", instance)
+	}
+
+	return client
+}
+
+// testOrganizations returns organizations with an appliance each and alarms, the even ones being cleared
+func testOrganizations(names []string, alarms int) []versatest.Organization {
+
+	var organizations []versatest.Organization
+
+	for _, name := range names {
+
+		org := versatest.Organization{
+			Name:       name,
+			Parent:     "provider",
+			Appliances: []versatest.Appliance{{Name: name + "-branch1", Reachable: true, InSync: true}},
+		}
+
+		for i := 0; i < alarms; i++ {
+			org.Alarms = append(org.Alarms, versatest.Alarm{
+				ID:          fmt.Sprintf("%v-%v", name, i),
+				Type:        "interface-down",
+				Severity:    "major",
+				Appliance:   name + "-branch1",
+				Description: "WAN interface down",
+				Cleared:     i%2 == 0,
+				RaisedAt:    time.Date(2020, 3, 2, 10, i, 0, 0, time.UTC),
+			})
+		}
+
+		organizations = append(organizations, org)
+	}
+
+	return organizations
+}
+
+func TestPagination(t *testing.T) {
+
+	server := versatest.NewDirectorServer(testOrganizations([]string{"a", "b", "c", "d", "e"}, 7)...)
+	defer server.Close()
+
+	vars := server.ClientEnv(versa_director.AuthModeBasic)
+	vars["PEPPAMON_VERSA_DIRECTOR_PAGE_SIZE"] = "2"
+
+	client := newTestDirectorClient(t, "PAGINATION", vars)
+
+	organizations, err := client.GetOrganizations(context.Background())
+
+	if err != nil {
+		t.Fatalf("GetOrganizations() failed with error %v", err)
+	}
+
+	if len(organizations) != 5 || organizations[4].Name != "e" || server.Requests("orgs") != 3 {
+		t.Errorf("got %v organizations in %v pages, want 5 in 3 pages", len(organizations), server.Requests("orgs"))
+	}
+
+	appliances, err := client.GetAppliances(context.Background())
+
+	if err != nil {
+		t.Fatalf("GetAppliances() failed with error %v", err)
+	}
+
+	if len(appliances) != 5 || !appliances[0].Reachable() || !appliances[0].InSync() || server.Requests("appliances") != 3 {
+		t.Errorf("got %v appliances in %v pages, want 5 reachable and in sync in 3 pages", len(appliances),
+			server.Requests("appliances"))
+	}
+
+	// The 3 active alarms out of 7 are paged through, the cleared ones being filtered out by the Director
+	alarms, err := client.GetActiveAlarms(context.Background(), "a")
+
+	if err != nil {
+		t.Fatalf("GetActiveAlarms() failed with error %v", err)
+	}
+
+	var ids []string
+
+	for _, alarm := range alarms {
+		if alarm.Cleared {
+			t.Errorf("got cleared alarm %v", alarm.ID)
+		}
+		ids = append(ids, alarm.ID)
+	}
+
+	if strings.Join(ids, ",") != "a-1,a-3,a-5" || server.Requests("alarms") != 2 {
+		t.Errorf("got alarms %v in %v pages, want a-1, a-3 and a-5 in 2 pages", ids, server.Requests("alarms"))
+	}
+
+	if raisedAt := alarms[0].RaisedAt.UTC(); !raisedAt.Equal(time.Date(2020, 3, 2, 10, 1, 0, 0, time.UTC)) {
+		t.Errorf("got alarm raised at %v, want 2020-03-02 10:01 UTC", raisedAt)
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		instance string
+		authMode string
+
+		// wantTokens is the number of token requests, 1 to log in and 1 to refresh the expired token
+		wantTokens int
+	}{
+		{name: "basic", instance: "BASICAUTH", authMode: versa_director.AuthModeBasic},
+		{name: "oauth2", instance: "OAUTHAUTH", authMode: versa_director.AuthModeOAuth2, wantTokens: 2},
+	}
+
+	for _, tt := range tests {
+
+		t.Run(tt.name, func(t *testing.T) {
+
+			server := versatest.NewDirectorServer(testOrganizations([]string{"acme"}, 0)...)
+			server.Username, server.Password = "admin", "secret"
+			server.ClientID, server.ClientSecret = "peppamon", "clientsecret"
+			defer server.Close()
+
+			client := newTestDirectorClient(t, tt.instance, server.ClientEnv(tt.authMode))
+
+			if _, err := client.GetOrganizations(context.Background()); err != nil {
+				t.Fatalf("GetOrganizations() failed with error %v", err)
+			}
+
+			// Bearer tokens rejected by the Director are refreshed transparently
+			server.ExpireTokens()
+
+			if _, err := client.GetOrganizations(context.Background()); err != nil {
+				t.Fatalf("GetOrganizations() failed with error %v once the tokens expired", err)
+			}
+
+			if tokens := server.Requests("token"); tokens != tt.wantTokens {
+				t.Errorf("got %v token requests, want %v", tokens, tt.wantTokens)
+			}
+		})
+	}
+}
+
+func TestRejectedCredentials(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		instance string
+		authMode string
+	}{
+		{name: "basic", instance: "BASICREJECTED", authMode: versa_director.AuthModeBasic},
+		{name: "oauth2", instance: "OAUTHREJECTED", authMode: versa_director.AuthModeOAuth2},
+	}
+
+	for _, tt := range tests {
+
+		t.Run(tt.name, func(t *testing.T) {
+
+			server := versatest.NewDirectorServer(testOrganizations([]string{"acme"}, 0)...)
+			server.Username, server.Password = "admin", "secret"
+			defer server.Close()
+
+			vars := server.ClientEnv(tt.authMode)
+			vars["PEPPAMON_VERSA_DIRECTOR_PASSWORD"] = "wrong"
+
+			client := newTestDirectorClient(t, tt.instance, vars)
+
+			if _, err := client.GetOrganizations(context.Background()); err == nil {
+				t.Fatalf("GetOrganizations() succeeded with wrong credentials")
+			}
+
+			// Basic credentials are sent once as they cannot be renewed, a bearer token is never obtained
+			if orgs := server.Requests("orgs"); orgs > 1 {
+				t.Errorf("got %v organization requests, want at most 1", orgs)
+			}
+		})
+	}
+}
+
+func TestTenantsActiveAlarmsErrors(t *testing.T) {
+
+	tests := []struct {
+		name  string
+		fault versatest.Fault
+	}{
+		{name: "server error", fault: versatest.Fault{Tenant: "beta", Query: "alarms", StatusCode: http.StatusInternalServerError}},
+		{name: "malformed response", fault: versatest.Fault{Tenant: "beta", Query: "alarms", Malformed: true}},
+		{name: "disconnect", fault: versatest.Fault{Tenant: "beta", Query: "alarms", Disconnect: true}},
+	}
+
+	for i, tt := range tests {
+
+		t.Run(tt.name, func(t *testing.T) {
+
+			server := versatest.NewDirectorServer(testOrganizations([]string{"alpha", "beta", "gamma"}, 4)...)
+			defer server.Close()
+
+			server.Inject(tt.fault)
+
+			client := newTestDirectorClient(t, fmt.Sprintf("ALARMERRORS%c", 'A'+i),
+				server.ClientEnv(versa_director.AuthModeBasic))
+
+			orgs, err := client.GetOrganizations(context.Background())
+
+			if err != nil {
+				t.Fatalf("GetOrganizations() failed with error %v", err)
+			}
+
+			tenantsAlarms, err := client.GetTenantsActiveAlarms(context.Background(), orgs)
+
+			failures := versa_client.AsTenantErrors(err)
+
+			if len(failures) != 1 || failures["beta"] == nil {
+				t.Fatalf("GetTenantsActiveAlarms() got error %v, want a failure of beta only", err)
+			}
+
+			var tenants []string
+
+			for tenant, alarms := range tenantsAlarms {
+				if len(alarms) != 2 {
+					t.Errorf("got %v alarms for %v, want 2", len(alarms), tenant)
+				}
+				tenants = append(tenants, tenant)
+			}
+
+			sort.Strings(tenants)
+
+			if strings.Join(tenants, ",") != "alpha,gamma" {
+				t.Errorf("got alarms for %v, want alpha and gamma", tenants)
+			}
+		})
+	}
+}
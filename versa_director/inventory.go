@@ -0,0 +1,123 @@
+package versa_director
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/lucabrasi83/peppamon_versa/logging"
+)
+
+const (
+	PingStatusReachable = "REACHABLE"
+	SyncStatusInSync    = "IN_SYNC"
+)
+
+type VersaOrganization struct {
+	UUID   string `json:"uuid"`
+	Name   string `json:"name"`
+	Parent string `json:"parent"`
+}
+
+type versaOrganizationList struct {
+	TotalCount    int                 `json:"totalCount"`
+	Organizations []VersaOrganization `json:"organizations"`
+}
+
+// VersaAppliance is an appliance provisioned on Versa Director with its last known status
+type VersaAppliance struct {
+	Name            string `json:"name"`
+	UUID            string `json:"uuid"`
+	Type            string `json:"type"`
+	OwnerOrg        string `json:"ownerOrg"`
+	SiteID          string `json:"branchId"`
+	IPAddress       string `json:"ipAddress"`
+	SoftwareVersion string `json:"softwareVersion"`
+	PingStatus      string `json:"ping-status"`
+	SyncStatus      string `json:"sync-status"`
+
+	Location struct {
+		LocationID string `json:"locationId"`
+		Latitude   string `json:"latitude"`
+		Longitude  string `json:"longitude"`
+	} `json:"applianceLocation"`
+
+	Hardware struct {
+		Model    string `json:"model"`
+		SerialNo string `json:"serialNo"`
+	} `json:"Hardware"`
+}
+
+// Reachable reports whether Versa Director reached the appliance on its last ping
+func (a VersaAppliance) Reachable() bool {
+	return a.PingStatus == PingStatusReachable
+}
+
+// InSync reports whether the appliance configuration matches the one held by Versa Director
+func (a VersaAppliance) InSync() bool {
+	return a.SyncStatus == SyncStatusInSync
+}
+
+type versaApplianceList struct {
+	Result struct {
+		TotalCount int              `json:"totalCount"`
+		Appliances []VersaAppliance `json:"appliances"`
+	} `json:"versanms.ApplianceStatusResult"`
+}
+
+// GetOrganizations returns every organization, also known as tenant, provisioned on Versa Director
+func (d *VersaDirectorClient) GetOrganizations(ctx context.Context) ([]VersaOrganization, error) {
+
+	logging.PeppaMonLog("info", "Started Batch Job to fetch Versa Director Organizations")
+
+	var organizations []VersaOrganization
+
+	for offset := 0; ; offset += d.PageSize {
+
+		var page versaOrganizationList
+
+		reqPath := fmt.Sprintf("/vnms/organization/orgs?offset=%d&limit=%d", offset, d.PageSize)
+
+		if err := d.getJSON(ctx, "Get Director Organizations", reqPath, &page); err != nil {
+			return nil, err
+		}
+
+		organizations = append(organizations, page.Organizations...)
+
+		if len(page.Organizations) == 0 || len(organizations) >= page.TotalCount {
+			break
+		}
+	}
+
+	logging.PeppaMonLog("info", "Completed Batch Job to fetch Versa Director Organizations")
+
+	return organizations, nil
+}
+
+// GetAppliances returns every appliance provisioned on Versa Director along with its status
+func (d *VersaDirectorClient) GetAppliances(ctx context.Context) ([]VersaAppliance, error) {
+
+	logging.PeppaMonLog("info", "Started Batch Job to fetch Versa Director Appliances")
+
+	var appliances []VersaAppliance
+
+	for offset := 0; ; offset += d.PageSize {
+
+		var page versaApplianceList
+
+		reqPath := fmt.Sprintf("/vnms/appliance/appliance?offset=%d&limit=%d", offset, d.PageSize)
+
+		if err := d.getJSON(ctx, "Get Director Appliances", reqPath, &page); err != nil {
+			return nil, err
+		}
+
+		appliances = append(appliances, page.Result.Appliances...)
+
+		if len(page.Result.Appliances) == 0 || len(appliances) >= page.Result.TotalCount {
+			break
+		}
+	}
+
+	logging.PeppaMonLog("info", "Completed Batch Job to fetch Versa Director Appliances")
+
+	return appliances, nil
+}
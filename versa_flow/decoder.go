@@ -0,0 +1,351 @@
+// Package versa_flow receives the IPFIX and NetFlow v9 flow records Versa branches export and aggregates them
+// into per site, application and circuit Prometheus counters
+package versa_flow
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	VersionNetFlowV9 = 9
+	VersionIPFIX     = 10
+
+	// VersaEnterpriseNumber is the IANA Private Enterprise Number of Versa Networks
+	VersaEnterpriseNumber = 42359
+
+	// variableLength is the length of IPFIX fields whose length is carried by each record
+	variableLength = 65535
+)
+
+// errMalformed is returned for the messages whose sets or records overrun their length
+var errMalformed = errors.New("malformed flow export message")
+
+// ElementID identifies an information element. Enterprise is 0 for IANA elements and NetFlow v9 field types
+type ElementID struct {
+	Enterprise uint32
+	ID         uint16
+}
+
+func (e ElementID) String() string {
+	if e.Enterprise == 0 {
+		return fmt.Sprint(e.ID)
+	}
+	return fmt.Sprintf("%v/%v", e.Enterprise, e.ID)
+}
+
+type templateField struct {
+	element ElementID
+	length  uint16
+}
+
+type template struct {
+	fields []templateField
+
+	// options templates describe exporter metadata rather than flows, their records are skipped
+	options bool
+
+	// minLength is the length of a record whose variable length fields are empty
+	minLength int
+
+	updated time.Time
+}
+
+// templateKey scopes templates to the exporter and observation domain, or source ID in NetFlow v9
+type templateKey struct {
+	exporter string
+	version  uint16
+	domain   uint32
+	id       uint16
+}
+
+// Flow holds the fields of a data record by information element
+type Flow map[ElementID][]byte
+
+// Message summarizes a decoded export message
+type Message struct {
+	Version uint16
+
+	// Records is the number of flow records decoded
+	Records int
+
+	// MissingTemplates is the number of data sets skipped as their template was not received yet
+	MissingTemplates int
+
+	// DroppedTemplates is the number of new templates not stored as the decoder reached its template limit
+	DroppedTemplates int
+}
+
+// Decoder decodes IPFIX and NetFlow v9 messages, keeping the templates exporters send. It is not safe
+// for concurrent use
+type Decoder struct {
+	// TemplateTimeout expires the templates an exporter has not refreshed for that long
+	TemplateTimeout time.Duration
+
+	// MaxTemplates bounds the number of templates kept across every exporter, 0 meaning unbounded.
+	// Templates refreshed by their exporter are still updated once the limit is reached
+	MaxTemplates int
+
+	templates map[templateKey]*template
+	flow      Flow
+	swept     time.Time
+}
+
+func NewDecoder(templateTimeout time.Duration, maxTemplates int) *Decoder {
+	return &Decoder{
+		TemplateTimeout: templateTimeout,
+		MaxTemplates:    maxTemplates,
+		templates:       make(map[templateKey]*template),
+		flow:            make(Flow),
+	}
+}
+
+// Templates returns the number of templates known
+func (d *Decoder) Templates() int {
+	return len(d.templates)
+}
+
+// Decode decodes a message received from the exporter, calling fn for each flow record. The flow is reused
+// between records and is only valid during the call
+func (d *Decoder) Decode(exporter string, packet []byte, now time.Time, fn func(Flow)) (Message, error) {
+
+	d.expire(now)
+
+	if len(packet) < 4 {
+		return Message{}, errMalformed
+	}
+
+	msg := Message{Version: binary.BigEndian.Uint16(packet)}
+
+	var headerLength int
+	var domain uint32
+
+	switch msg.Version {
+	case VersionNetFlowV9:
+		headerLength = 20
+
+		if len(packet) < headerLength {
+			return msg, errMalformed
+		}
+
+		domain = binary.BigEndian.Uint32(packet[16:])
+
+	case VersionIPFIX:
+		headerLength = 16
+
+		length := int(binary.BigEndian.Uint16(packet[2:]))
+
+		if len(packet) < headerLength || length < headerLength || length > len(packet) {
+			return msg, errMalformed
+		}
+
+		packet = packet[:length]
+		domain = binary.BigEndian.Uint32(packet[12:])
+
+	default:
+		return msg, fmt.Errorf("unsupported flow export version %v", msg.Version)
+	}
+
+	sets := packet[headerLength:]
+
+	// NetFlow v9 exporters may pad the message after the last set
+	for len(sets) >= 4 {
+
+		setID := binary.BigEndian.Uint16(sets)
+		setLength := int(binary.BigEndian.Uint16(sets[2:]))
+
+		if setLength < 4 || setLength > len(sets) {
+			return msg, errMalformed
+		}
+
+		body := sets[4:setLength]
+		sets = sets[setLength:]
+
+		key := templateKey{exporter: exporter, version: msg.Version, domain: domain}
+
+		var err error
+
+		switch {
+		case msg.Version == VersionNetFlowV9 && setID == 0, msg.Version == VersionIPFIX && setID == 2:
+			err = d.parseTemplates(key, body, false, &msg, now)
+		case msg.Version == VersionNetFlowV9 && setID == 1, msg.Version == VersionIPFIX && setID == 3:
+			err = d.parseTemplates(key, body, true, &msg, now)
+		case setID >= 256:
+			key.id = setID
+			err = d.parseData(key, body, &msg, fn)
+		}
+
+		if err != nil {
+			return msg, err
+		}
+	}
+
+	return msg, nil
+}
+
+// parseTemplates stores the templates or options templates of a template set
+func (d *Decoder) parseTemplates(key templateKey, body []byte, options bool, msg *Message, now time.Time) error {
+
+	// Template records are followed by padding shorter than a record header
+	for len(body) >= 4 {
+
+		key.id = binary.BigEndian.Uint16(body)
+
+		if key.id < 256 {
+			break
+		}
+
+		var fieldCount int
+
+		switch {
+		case key.version == VersionNetFlowV9 && options:
+			// NetFlow v9 options templates give the length in bytes of their scope and option fields
+			if len(body) < 6 {
+				return errMalformed
+			}
+
+			fieldCount = int(binary.BigEndian.Uint16(body[2:])+binary.BigEndian.Uint16(body[4:])) / 4
+			body = body[6:]
+
+		case options:
+			if len(body) < 6 {
+				return errMalformed
+			}
+
+			fieldCount = int(binary.BigEndian.Uint16(body[2:]))
+			body = body[6:]
+
+		default:
+			fieldCount = int(binary.BigEndian.Uint16(body[2:]))
+			body = body[4:]
+		}
+
+		// An IPFIX template without fields withdraws the template
+		if fieldCount == 0 {
+			delete(d.templates, key)
+			continue
+		}
+
+		t := &template{fields: make([]templateField, 0, fieldCount), options: options, updated: now}
+
+		for i := 0; i < fieldCount; i++ {
+
+			if len(body) < 4 {
+				return errMalformed
+			}
+
+			field := templateField{
+				element: ElementID{ID: binary.BigEndian.Uint16(body)},
+				length:  binary.BigEndian.Uint16(body[2:]),
+			}
+
+			body = body[4:]
+
+			// The enterprise bit of IPFIX field specifiers is followed by the enterprise number
+			if key.version == VersionIPFIX && field.element.ID&0x8000 != 0 {
+
+				if len(body) < 4 {
+					return errMalformed
+				}
+
+				field.element.ID &^= 0x8000
+				field.element.Enterprise = binary.BigEndian.Uint32(body)
+				body = body[4:]
+			}
+
+			if field.length == variableLength {
+				t.minLength++
+			} else {
+				t.minLength += int(field.length)
+			}
+
+			t.fields = append(t.fields, field)
+		}
+
+		if _, ok := d.templates[key]; !ok && d.MaxTemplates > 0 && len(d.templates) >= d.MaxTemplates {
+			msg.DroppedTemplates++
+			continue
+		}
+
+		d.templates[key] = t
+	}
+
+	return nil
+}
+
+// parseData decodes the records of a data set with the template it references
+func (d *Decoder) parseData(key templateKey, body []byte, msg *Message, fn func(Flow)) error {
+
+	t, ok := d.templates[key]
+
+	if !ok {
+		msg.MissingTemplates++
+		return nil
+	}
+
+	if t.options || t.minLength == 0 {
+		return nil
+	}
+
+	// Records are followed by padding shorter than the shortest record
+	for len(body) >= t.minLength {
+
+		for element := range d.flow {
+			delete(d.flow, element)
+		}
+
+		for _, field := range t.fields {
+
+			length := int(field.length)
+
+			if field.length == variableLength {
+
+				if len(body) < 1 {
+					return errMalformed
+				}
+
+				length = int(body[0])
+				body = body[1:]
+
+				if length == 255 {
+					if len(body) < 2 {
+						return errMalformed
+					}
+
+					length = int(binary.BigEndian.Uint16(body))
+					body = body[2:]
+				}
+			}
+
+			if len(body) < length {
+				return errMalformed
+			}
+
+			d.flow[field.element] = body[:length]
+			body = body[length:]
+		}
+
+		msg.Records++
+		fn(d.flow)
+	}
+
+	return nil
+}
+
+// expire drops the templates not refreshed within the template timeout, at most once per timeout
+func (d *Decoder) expire(now time.Time) {
+
+	if d.TemplateTimeout <= 0 || now.Sub(d.swept) < d.TemplateTimeout {
+		return
+	}
+
+	d.swept = now
+
+	for key, t := range d.templates {
+		if now.Sub(t.updated) > d.TemplateTimeout {
+			delete(d.templates, key)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+//go:build go1.18
+// +build go1.18
+
+package versa_flow
+
+import (
+	"testing"
+	"time"
+)
+
+func FuzzDecode(f *testing.F) {
+
+	for _, tt := range decodeTests {
+		for _, packet := range tt.packets {
+			f.Add(packet)
+		}
+	}
+
+	f.Fuzz(func(t *testing.T, packet []byte) {
+
+		d := NewDecoder(time.Hour, 16)
+		m := NewMetrics(defaultRoleElements, Limits{Exporters: 4, Sites: 4, Applications: 4, Circuits: 4})
+
+		// The packet is decoded twice so that the data sets use the templates it carries
+		for i := 0; i < 2; i++ {
+
+			records := 0
+
+			msg, err := d.Decode("192.0.2.1", packet, time.Now(), func(flow Flow) {
+				records++
+				m.Observe("192.0.2.1", flow)
+			})
+
+			if err == nil && msg.Records != records {
+				t.Fatalf("Decode() reported %v records, decoded %v", msg.Records, records)
+			}
+
+			if d.Templates() > 16 {
+				t.Fatalf("Decode() kept %v templates, beyond the limit of 16", d.Templates())
+			}
+		}
+	})
+}
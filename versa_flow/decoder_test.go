@@ -0,0 +1,364 @@
+package versa_flow
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// field describes a template field, enterprise setting the IPFIX enterprise bit
+type field struct {
+	id         uint16
+	length     uint16
+	enterprise uint32
+}
+
+func be16(v uint16) []byte {
+	return []byte{byte(v >> 8), byte(v)}
+}
+
+func be32(v uint32) []byte {
+	return []byte{byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)}
+}
+
+func concat(parts ...[]byte) []byte {
+	var b []byte
+	for _, part := range parts {
+		b = append(b, part...)
+	}
+	return b
+}
+
+// ipfixMessage builds an IPFIX message of the observation domain carrying the sets
+func ipfixMessage(domain uint32, sets ...[]byte) []byte {
+	body := concat(sets...)
+	return concat(be16(VersionIPFIX), be16(uint16(16+len(body))), be32(1573000000), be32(1), be32(domain), body)
+}
+
+// netflowMessage builds a NetFlow v9 message of the source ID carrying the sets
+func netflowMessage(sourceID uint32, sets ...[]byte) []byte {
+	return concat(be16(VersionNetFlowV9), be16(uint16(len(sets))), be32(1000), be32(1573000000), be32(1),
+		be32(sourceID), concat(sets...))
+}
+
+// set builds a set of the given ID holding the records
+func set(id uint16, records ...[]byte) []byte {
+	body := concat(records...)
+	return concat(be16(id), be16(uint16(4+len(body))), body)
+}
+
+func fieldSpecifiers(fields []field) []byte {
+	var b []byte
+	for _, f := range fields {
+		if f.enterprise != 0 {
+			b = concat(b, be16(f.id|0x8000), be16(f.length), be32(f.enterprise))
+			continue
+		}
+		b = concat(b, be16(f.id), be16(f.length))
+	}
+	return b
+}
+
+// templateRecord builds a template record of an IPFIX or NetFlow v9 template set
+func templateRecord(id uint16, fields ...field) []byte {
+	return concat(be16(id), be16(uint16(len(fields))), fieldSpecifiers(fields))
+}
+
+// ipfixOptionsRecord builds an IPFIX options template record, the first scopes fields being scope fields
+func ipfixOptionsRecord(id uint16, scopes int, fields ...field) []byte {
+	return concat(be16(id), be16(uint16(len(fields))), be16(uint16(scopes)), fieldSpecifiers(fields))
+}
+
+// netflowOptionsRecord builds a NetFlow v9 options template record
+func netflowOptionsRecord(id uint16, scopes []field, options []field) []byte {
+	return concat(be16(id), be16(uint16(4*len(scopes))), be16(uint16(4*len(options))),
+		fieldSpecifiers(scopes), fieldSpecifiers(options))
+}
+
+var (
+	octets  = field{id: 1, length: 4}
+	packets = field{id: 2, length: 4}
+	appName = field{id: 96, length: variableLength}
+	tenant  = field{id: 1, length: variableLength, enterprise: VersaEnterpriseNumber}
+)
+
+// flowRecord is a record of the octets and packets template
+var flowRecord = concat(be32(1500), be32(3))
+
+type decodeTest struct {
+	name         string
+	maxTemplates int
+	packets      [][]byte
+
+	// the expectations apply to the last packet
+	wantErr       bool
+	want          Message
+	wantFlows     []map[ElementID]string
+	wantTemplates int
+}
+
+var decodeTests = []decodeTest{
+	{
+		name:          "IPFIX template and data in one message",
+		packets:       [][]byte{ipfixMessage(1, set(2, templateRecord(256, octets, packets)), set(256, flowRecord))},
+		want:          Message{Version: VersionIPFIX, Records: 1},
+		wantFlows:     []map[ElementID]string{{{ID: 1}: "\x00\x00\x05\xdc", {ID: 2}: "\x00\x00\x00\x03"}},
+		wantTemplates: 1,
+	},
+	{
+		name: "IPFIX data after its template",
+		packets: [][]byte{
+			ipfixMessage(1, set(2, templateRecord(256, octets, packets))),
+			ipfixMessage(1, set(256, flowRecord, flowRecord)),
+		},
+		want:          Message{Version: VersionIPFIX, Records: 2},
+		wantFlows:     []map[ElementID]string{{{ID: 1}: "\x00\x00\x05\xdc", {ID: 2}: "\x00\x00\x00\x03"}, {{ID: 1}: "\x00\x00\x05\xdc", {ID: 2}: "\x00\x00\x00\x03"}},
+		wantTemplates: 1,
+	},
+	{
+		name:          "NetFlow v9 template set 0",
+		packets:       [][]byte{netflowMessage(7, set(0, templateRecord(300, octets)), set(300, be32(42)))},
+		want:          Message{Version: VersionNetFlowV9, Records: 1},
+		wantFlows:     []map[ElementID]string{{{ID: 1}: "\x00\x00\x00\x2a"}},
+		wantTemplates: 1,
+	},
+	{
+		name:    "NetFlow v9 ignores the IPFIX template set ID",
+		packets: [][]byte{netflowMessage(7, set(2, templateRecord(300, octets)), set(300, be32(42)))},
+		want:    Message{Version: VersionNetFlowV9, MissingTemplates: 1},
+	},
+	{
+		name:    "IPFIX ignores the NetFlow v9 template set ID",
+		packets: [][]byte{ipfixMessage(1, set(0, templateRecord(256, octets)), set(256, be32(42)))},
+		want:    Message{Version: VersionIPFIX, MissingTemplates: 1},
+	},
+	{
+		name: "IPFIX options template records are skipped",
+		packets: [][]byte{ipfixMessage(1,
+			set(3, ipfixOptionsRecord(257, 1, field{id: 149, length: 4}, field{id: 41, length: 8})),
+			set(257, concat(be32(1), be32(0), be32(5))),
+		)},
+		want:          Message{Version: VersionIPFIX},
+		wantTemplates: 1,
+	},
+	{
+		name: "NetFlow v9 options template records are skipped",
+		packets: [][]byte{netflowMessage(7,
+			set(1, netflowOptionsRecord(257, []field{{id: 1, length: 4}}, []field{{id: 41, length: 4}})),
+			set(257, concat(be32(1), be32(5))),
+		)},
+		want:          Message{Version: VersionNetFlowV9},
+		wantTemplates: 1,
+	},
+	{
+		name: "IPFIX variable length fields in short and long form",
+		packets: [][]byte{ipfixMessage(1,
+			set(2, templateRecord(256, appName, octets)),
+			set(256,
+				concat([]byte{4}, []byte("http"), be32(10)),
+				concat([]byte{255}, be16(3), []byte("ssh"), be32(20)),
+			),
+		)},
+		want: Message{Version: VersionIPFIX, Records: 2},
+		wantFlows: []map[ElementID]string{
+			{{ID: 96}: "http", {ID: 1}: "\x00\x00\x00\x0a"},
+			{{ID: 96}: "ssh", {ID: 1}: "\x00\x00\x00\x14"},
+		},
+		wantTemplates: 1,
+	},
+	{
+		name: "IPFIX enterprise elements",
+		packets: [][]byte{ipfixMessage(1,
+			set(2, templateRecord(256, tenant, octets)),
+			set(256, concat([]byte{4}, []byte("acme"), be32(10))),
+		)},
+		want:          Message{Version: VersionIPFIX, Records: 1},
+		wantFlows:     []map[ElementID]string{{{Enterprise: VersaEnterpriseNumber, ID: 1}: "acme", {ID: 1}: "\x00\x00\x00\x0a"}},
+		wantTemplates: 1,
+	},
+	{
+		name:          "padding after the records",
+		packets:       [][]byte{ipfixMessage(1, set(2, templateRecord(256, octets, packets)), set(256, flowRecord, []byte{0, 0, 0}))},
+		want:          Message{Version: VersionIPFIX, Records: 1},
+		wantFlows:     []map[ElementID]string{{{ID: 1}: "\x00\x00\x05\xdc", {ID: 2}: "\x00\x00\x00\x03"}},
+		wantTemplates: 1,
+	},
+	{
+		name:    "data set without template",
+		packets: [][]byte{ipfixMessage(1, set(256, flowRecord))},
+		want:    Message{Version: VersionIPFIX, MissingTemplates: 1},
+	},
+	{
+		name: "templates are scoped to the observation domain",
+		packets: [][]byte{
+			ipfixMessage(1, set(2, templateRecord(256, octets, packets))),
+			ipfixMessage(2, set(256, flowRecord)),
+		},
+		want:          Message{Version: VersionIPFIX, MissingTemplates: 1},
+		wantTemplates: 1,
+	},
+	{
+		name: "template withdrawal",
+		packets: [][]byte{
+			ipfixMessage(1, set(2, templateRecord(256, octets, packets))),
+			ipfixMessage(1, set(2, templateRecord(256)), set(256, flowRecord)),
+		},
+		want: Message{Version: VersionIPFIX, MissingTemplates: 1},
+	},
+	{
+		name:         "new templates beyond the limit are dropped",
+		maxTemplates: 1,
+		packets: [][]byte{
+			ipfixMessage(1, set(2, templateRecord(256, octets, packets))),
+			ipfixMessage(1, set(2, templateRecord(257, octets), templateRecord(256, octets)), set(256, be32(7)), set(257, be32(7))),
+		},
+		want:          Message{Version: VersionIPFIX, Records: 1, MissingTemplates: 1, DroppedTemplates: 1},
+		wantFlows:     []map[ElementID]string{{{ID: 1}: "\x00\x00\x00\x07"}},
+		wantTemplates: 1,
+	},
+	{
+		name:    "short message",
+		packets: [][]byte{{0, 10}},
+		wantErr: true,
+	},
+	{
+		name:    "unsupported version",
+		packets: [][]byte{concat(be16(5), make([]byte, 22))},
+		want:    Message{Version: 5},
+		wantErr: true,
+	},
+	{
+		name:    "truncated NetFlow v9 header",
+		packets: [][]byte{netflowMessage(1)[:12]},
+		want:    Message{Version: VersionNetFlowV9},
+		wantErr: true,
+	},
+	{
+		name:    "IPFIX length beyond the message",
+		packets: [][]byte{ipfixMessage(1, set(2, templateRecord(256, octets)))[:20]},
+		want:    Message{Version: VersionIPFIX},
+		wantErr: true,
+	},
+	{
+		name:    "IPFIX length shorter than its header",
+		packets: [][]byte{concat(be16(VersionIPFIX), be16(8), make([]byte, 12))},
+		want:    Message{Version: VersionIPFIX},
+		wantErr: true,
+	},
+	{
+		name:    "set length beyond the message",
+		packets: [][]byte{netflowMessage(1, concat(be16(0), be16(64), templateRecord(256, octets)))},
+		want:    Message{Version: VersionNetFlowV9},
+		wantErr: true,
+	},
+	{
+		name:    "set length shorter than its header",
+		packets: [][]byte{netflowMessage(1, concat(be16(0), be16(2), templateRecord(256, octets)))},
+		want:    Message{Version: VersionNetFlowV9},
+		wantErr: true,
+	},
+	{
+		name:    "truncated template",
+		packets: [][]byte{ipfixMessage(1, set(2, concat(be16(256), be16(3), fieldSpecifiers([]field{octets}))))},
+		want:    Message{Version: VersionIPFIX},
+		wantErr: true,
+	},
+	{
+		name:    "truncated enterprise number",
+		packets: [][]byte{ipfixMessage(1, set(2, concat(be16(256), be16(1), be16(0x8001), be16(4), be16(0))))},
+		want:    Message{Version: VersionIPFIX},
+		wantErr: true,
+	},
+	{
+		name:    "truncated IPFIX options template header",
+		packets: [][]byte{ipfixMessage(1, set(3, concat(be16(256), be16(1))))},
+		want:    Message{Version: VersionIPFIX},
+		wantErr: true,
+	},
+	{
+		name:    "variable length field beyond the set",
+		packets: [][]byte{ipfixMessage(1, set(2, templateRecord(256, appName, octets)), set(256, concat([]byte{200}, []byte("http"))))},
+		want:    Message{Version: VersionIPFIX},
+		wantErr: true,
+	},
+	{
+		name:    "truncated long variable length",
+		packets: [][]byte{ipfixMessage(1, set(2, templateRecord(256, appName)), set(256, []byte{255, 0}))},
+		want:    Message{Version: VersionIPFIX},
+		wantErr: true,
+	},
+}
+
+func TestDecode(t *testing.T) {
+
+	for _, tt := range decodeTests {
+
+		t.Run(tt.name, func(t *testing.T) {
+
+			d := NewDecoder(time.Hour, tt.maxTemplates)
+			now := time.Now()
+
+			var msg Message
+			var err error
+			var flows []map[ElementID]string
+
+			for i, packet := range tt.packets {
+
+				flows = nil
+
+				msg, err = d.Decode("192.0.2.1", packet, now, func(f Flow) {
+					flow := make(map[ElementID]string, len(f))
+					for element, value := range f {
+						flow[element] = string(value)
+					}
+					flows = append(flows, flow)
+				})
+
+				if i < len(tt.packets)-1 && err != nil {
+					t.Fatalf("Decode() of packet %v failed with error %v", i, err)
+				}
+			}
+
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Decode() got error %v, want error %v", err, tt.wantErr)
+			}
+
+			if msg != tt.want {
+				t.Errorf("Decode() got %+v, want %+v", msg, tt.want)
+			}
+
+			if !tt.wantErr && !reflect.DeepEqual(flows, tt.wantFlows) {
+				t.Errorf("Decode() got flows %q, want %q", flows, tt.wantFlows)
+			}
+
+			if templates := d.Templates(); templates != tt.wantTemplates && !tt.wantErr {
+				t.Errorf("got %v templates, want %v", templates, tt.wantTemplates)
+			}
+		})
+	}
+}
+
+func TestDecodeTemplateExpiry(t *testing.T) {
+
+	d := NewDecoder(time.Minute, 0)
+	now := time.Now()
+
+	if _, err := d.Decode("192.0.2.1", ipfixMessage(1, set(2, templateRecord(256, octets, packets))), now, func(Flow) {}); err != nil {
+		t.Fatalf("Decode() failed with error %v", err)
+	}
+
+	data := ipfixMessage(1, set(256, flowRecord))
+
+	msg, err := d.Decode("192.0.2.1", data, now.Add(30*time.Second), func(Flow) {})
+
+	if err != nil || msg.Records != 1 {
+		t.Fatalf("Decode() within the timeout got %+v with error %v, want a record", msg, err)
+	}
+
+	msg, err = d.Decode("192.0.2.1", data, now.Add(2*time.Minute), func(Flow) {})
+
+	if err != nil || msg.MissingTemplates != 1 || d.Templates() != 0 {
+		t.Fatalf("Decode() after the timeout got %+v with error %v and %v templates, want the template expired",
+			msg, err, d.Templates())
+	}
+}
@@ -0,0 +1,148 @@
+package versa_flow
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/lucabrasi83/peppamon_versa/logging"
+	"github.com/lucabrasi83/peppamon_versa/versa_client"
+)
+
+// Listener receives IPFIX and NetFlow v9 messages over UDP
+type Listener struct {
+	// Address is the UDP address listened on such as :4739
+	Address string
+
+	// ReadBuffer sets the size of the socket receive buffer so that bursts of messages are not dropped, the
+	// system default being kept when 0
+	ReadBuffer int
+
+	Decoder *Decoder
+	Metrics *Metrics
+
+	mu     sync.Mutex
+	conn   net.PacketConn
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// ListenerFromEnv builds the flow listener from PEPPAMON_VERSA_FLOW_ADDRESS. It returns nil when it is not set
+func ListenerFromEnv() *Listener {
+
+	env := versa_client.Env{}
+
+	address := env.String("PEPPAMON_VERSA_FLOW_ADDRESS", "")
+
+	if address == "" {
+		return nil
+	}
+
+	decoder := NewDecoder(
+		env.Duration("PEPPAMON_VERSA_FLOW_TEMPLATE_TIMEOUT", 30*time.Minute),
+		env.Int("PEPPAMON_VERSA_FLOW_MAX_TEMPLATES", 10000),
+	)
+
+	return &Listener{
+		Address:    address,
+		ReadBuffer: env.Int("PEPPAMON_VERSA_FLOW_READ_BUFFER", 4*1024*1024),
+		Decoder:    decoder,
+		Metrics:    NewMetrics(roleElementsFromEnv(env), limitsFromEnv(env)),
+	}
+}
+
+// Start listens on the address and serves it in the background
+func (l *Listener) Start() error {
+
+	conn, err := net.ListenPacket("udp", l.Address)
+
+	if err != nil {
+		return fmt.Errorf("unable to listen for flow records on UDP %v: %v", l.Address, err)
+	}
+
+	if udpConn, ok := conn.(*net.UDPConn); ok && l.ReadBuffer > 0 {
+		if err := udpConn.SetReadBuffer(l.ReadBuffer); err != nil {
+			logging.PeppaMonLog("warning", "Unable to set flow listener read buffer to %v bytes: %v", l.ReadBuffer, err)
+		}
+	}
+
+	l.mu.Lock()
+	l.conn = conn
+	l.mu.Unlock()
+
+	l.wg.Add(1)
+
+	go func() {
+		defer l.wg.Done()
+		l.serve(conn)
+	}()
+
+	logging.PeppaMonLog("info", "Listening for Versa IPFIX and NetFlow v9 records on UDP %v", conn.LocalAddr())
+
+	return nil
+}
+
+// Close stops listening
+func (l *Listener) Close() {
+
+	l.mu.Lock()
+
+	l.closed = true
+
+	if l.conn != nil {
+		_ = l.conn.Close()
+	}
+
+	l.mu.Unlock()
+
+	l.wg.Wait()
+}
+
+// serve decodes the messages received until the listener is closed. Messages are decoded one at a time as
+// the templates they carry apply to the messages that follow
+func (l *Listener) serve(conn net.PacketConn) {
+
+	buf := make([]byte, 65535)
+
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+
+		if err != nil {
+			if !l.isClosed() {
+				logging.PeppaMonLog("error", "Unable to read flow export message with error %v", err)
+			}
+			return
+		}
+
+		exporter := addr.String()
+
+		if udpAddr, ok := addr.(*net.UDPAddr); ok {
+			exporter = udpAddr.IP.String()
+		}
+
+		l.handle(exporter, buf[:n])
+	}
+}
+
+// handle decodes a message and updates the metrics, counting the messages that cannot be decoded
+func (l *Listener) handle(exporter string, packet []byte) {
+
+	msg, err := l.Decoder.Decode(exporter, packet, time.Now(), func(f Flow) {
+		l.Metrics.Observe(exporter, f)
+	})
+
+	if err != nil {
+		l.Metrics.invalidMessages.Inc()
+		return
+	}
+
+	l.Metrics.message(exporter, msg, l.Decoder.Templates())
+}
+
+func (l *Listener) isClosed() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.closed
+}
@@ -0,0 +1,418 @@
+package versa_flow
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/lucabrasi83/peppamon_versa/internal/cardinality"
+	"github.com/lucabrasi83/peppamon_versa/logging"
+	"github.com/lucabrasi83/peppamon_versa/versa_client"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Role is a label taken from the fields of the flows
+type Role string
+
+const (
+	RoleTenant      Role = "tenant"
+	RoleSite        Role = "site"
+	RoleApplication Role = "application"
+	RoleCircuit     Role = "circuit"
+)
+
+// IANA information elements read from the flows
+var (
+	elementOctetDeltaCount  = ElementID{ID: 1}
+	elementPacketDeltaCount = ElementID{ID: 2}
+	elementInitiatorOctets  = ElementID{ID: 231}
+	elementResponderOctets  = ElementID{ID: 232}
+	elementInitiatorPackets = ElementID{ID: 298}
+	elementResponderPackets = ElementID{ID: 299}
+)
+
+// addressElements are the IANA information elements holding an IP address
+var addressElements = map[ElementID]bool{
+	{ID: 8}: true, {ID: 12}: true, {ID: 15}: true, {ID: 27}: true, {ID: 28}: true, {ID: 62}: true,
+	{ID: 130}: true, {ID: 131}: true,
+}
+
+// Versa enterprise elements carrying the tenant, application and access circuit of the flows
+var (
+	elementVersaTenantName    = ElementID{Enterprise: VersaEnterpriseNumber, ID: 1}
+	elementVersaApplication   = ElementID{Enterprise: VersaEnterpriseNumber, ID: 2}
+	elementVersaAccessCircuit = ElementID{Enterprise: VersaEnterpriseNumber, ID: 3}
+)
+
+// defaultRoleElements are the information elements each label is read from, the first one set in a flow
+// being used. Versa elements are preferred to the IANA ones some exporters send instead. The site defaults
+// to the address of the exporter
+var defaultRoleElements = map[Role][]ElementID{
+	RoleTenant:      {elementVersaTenantName, {ID: 236}},             // VRFname
+	RoleApplication: {elementVersaApplication, {ID: 96}, {ID: 95}},   // applicationName, applicationId
+	RoleCircuit:     {elementVersaAccessCircuit, {ID: 82}, {ID: 14}}, // interfaceName, egressInterface
+	RoleSite:        nil,
+}
+
+// roleElementsFromEnv overrides the default elements of a label with PEPPAMON_VERSA_FLOW_ELEMENTS given as a
+// comma separated list of role=element, element being an IANA or NetFlow v9 field type such as 96, or an
+// enterprise element such as 42359/10 for Versa elements. A role listed several times is read from each
+// element in turn
+func roleElementsFromEnv(env versa_client.Env) map[Role][]ElementID {
+
+	roles := make(map[Role][]ElementID, len(defaultRoleElements))
+	overridden := make(map[Role]bool)
+
+	for role, elements := range defaultRoleElements {
+		roles[role] = elements
+	}
+
+	for _, item := range env.List("PEPPAMON_VERSA_FLOW_ELEMENTS") {
+
+		tokens := strings.SplitN(item, "=", 2)
+
+		if len(tokens) != 2 {
+			logging.PeppaMonLog("fatal", "Invalid flow element %q, expected role=element", item)
+		}
+
+		role := Role(strings.TrimSpace(tokens[0]))
+
+		if _, ok := defaultRoleElements[role]; !ok {
+			logging.PeppaMonLog("fatal", "Unsupported flow label %q, expected tenant, site, application or circuit", role)
+		}
+
+		element, err := parseElementID(strings.TrimSpace(tokens[1]))
+
+		if err != nil {
+			logging.PeppaMonLog("fatal", "Invalid information element %q for flow label %v", tokens[1], role)
+		}
+
+		if !overridden[role] {
+			overridden[role] = true
+			roles[role] = nil
+		}
+
+		roles[role] = append(roles[role], element)
+	}
+
+	return roles
+}
+
+// parseElementID parses an element given as id or enterprise/id
+func parseElementID(s string) (ElementID, error) {
+
+	var element ElementID
+
+	if tokens := strings.SplitN(s, "/", 2); len(tokens) == 2 {
+
+		enterprise, err := strconv.ParseUint(tokens[0], 10, 32)
+
+		if err != nil {
+			return element, err
+		}
+
+		element.Enterprise = uint32(enterprise)
+		s = tokens[1]
+	}
+
+	id, err := strconv.ParseUint(s, 10, 15)
+
+	if err != nil {
+		return element, err
+	}
+
+	element.ID = uint16(id)
+
+	return element, nil
+}
+
+// Uint returns the value of an unsigned field, which exporters may send with a reduced size
+func (f Flow) Uint(element ElementID) (uint64, bool) {
+
+	value, ok := f[element]
+
+	if !ok || len(value) == 0 || len(value) > 8 {
+		return 0, false
+	}
+
+	var buf [8]byte
+	copy(buf[8-len(value):], value)
+
+	return binary.BigEndian.Uint64(buf[:]), true
+}
+
+// String returns the value of a field as a label, the text of string fields or else the address or number
+// it holds
+func (f Flow) String(element ElementID) string {
+
+	value := f[element]
+
+	if len(value) == 0 {
+		return ""
+	}
+
+	if addressElements[element] && (len(value) == net.IPv4len || len(value) == net.IPv6len) {
+		return net.IP(value).String()
+	}
+
+	if text := strings.TrimRight(string(value), "\x00"); text != "" && utf8.ValidString(text) && isPrintable(text) {
+		return text
+	}
+
+	if number, ok := f.Uint(element); ok {
+		return strconv.FormatUint(number, 10)
+	}
+
+	return hex.EncodeToString(value)
+}
+
+func isPrintable(s string) bool {
+	for _, r := range s {
+		if !unicode.IsPrint(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// flowCount returns the delta counter of a flow, or the sum of its initiator and responder counters for
+// bidirectional flows
+func flowCount(f Flow, delta, initiator, responder ElementID) uint64 {
+
+	if count, ok := f.Uint(delta); ok {
+		return count
+	}
+
+	initiatorCount, _ := f.Uint(initiator)
+	responderCount, _ := f.Uint(responder)
+
+	return initiatorCount + responderCount
+}
+
+// limitedCounters counts the bytes and packets of the flows by label values with their series bounded
+type limitedCounters struct {
+	bytes   *prometheus.CounterVec
+	packets *prometheus.CounterVec
+	series  *cardinality.Limit
+}
+
+func newLimitedCounters(name, help string, labels []string, limit int, overflow *prometheus.CounterVec) *limitedCounters {
+	return &limitedCounters{
+		bytes: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "versa_flow_" + name + "_bytes_total",
+				Help: "The number of bytes of the flows exported " + help,
+			},
+			labels,
+		),
+		packets: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "versa_flow_" + name + "_packets_total",
+				Help: "The number of packets of the flows exported " + help,
+			},
+			labels,
+		),
+		series: cardinality.NewLimit(name, limit, overflow),
+	}
+}
+
+// add counts a flow and returns the label values it was counted with
+func (c *limitedCounters) add(labels []string, bytes, packets uint64) []string {
+
+	labels = c.series.Labels(labels...)
+
+	c.bytes.WithLabelValues(labels...).Add(float64(bytes))
+	c.packets.WithLabelValues(labels...).Add(float64(packets))
+
+	return labels
+}
+
+// Limits bounds the number of series of each flow metric, 0 meaning unbounded
+type Limits struct {
+	Exporters    int
+	Sites        int
+	Applications int
+	Circuits     int
+}
+
+// limitsFromEnv loads PEPPAMON_VERSA_FLOW_MAX_EXPORTERS, PEPPAMON_VERSA_FLOW_MAX_SITES,
+// PEPPAMON_VERSA_FLOW_MAX_APPLICATIONS and PEPPAMON_VERSA_FLOW_MAX_CIRCUITS
+func limitsFromEnv(env versa_client.Env) Limits {
+	return Limits{
+		Exporters:    env.Int("PEPPAMON_VERSA_FLOW_MAX_EXPORTERS", 1000),
+		Sites:        env.Int("PEPPAMON_VERSA_FLOW_MAX_SITES", 1000),
+		Applications: env.Int("PEPPAMON_VERSA_FLOW_MAX_APPLICATIONS", 10000),
+		Circuits:     env.Int("PEPPAMON_VERSA_FLOW_MAX_CIRCUITS", 5000),
+	}
+}
+
+// Metrics aggregates the flows into Prometheus metrics
+type Metrics struct {
+	roles map[Role][]ElementID
+
+	messages         *prometheus.CounterVec
+	invalidMessages  prometheus.Counter
+	records          *prometheus.CounterVec
+	missingTemplates *prometheus.CounterVec
+	droppedTemplates prometheus.Counter
+	templates        prometheus.Gauge
+	overflow         *prometheus.CounterVec
+
+	exporters    *cardinality.Limit
+	sites        *limitedCounters
+	applications *limitedCounters
+	circuits     *limitedCounters
+}
+
+// NewMetrics builds the flow metrics reading the labels from the given elements
+func NewMetrics(roles map[Role][]ElementID, limits Limits) *Metrics {
+
+	overflow := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "versa_flow_cardinality_overflow_total",
+			Help: "The number of flows counted as other as the flow metric reached its series limit",
+		},
+		[]string{"metric"},
+	)
+
+	return &Metrics{
+		roles: roles,
+		messages: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "versa_flow_messages_total",
+				Help: "The number of flow export messages received by version",
+			},
+			[]string{"version"},
+		),
+		invalidMessages: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "versa_flow_invalid_messages_total",
+				Help: "The number of flow export messages dropped as they could not be decoded",
+			},
+		),
+		records: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "versa_flow_records_total",
+				Help: "The number of flow records received by exporter",
+			},
+			[]string{"exporter"},
+		),
+		missingTemplates: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "versa_flow_missing_template_sets_total",
+				Help: "The number of data sets dropped as their template was not received yet",
+			},
+			[]string{"exporter"},
+		),
+		droppedTemplates: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "versa_flow_dropped_templates_total",
+				Help: "The number of flow templates dropped as the decoder reached its template limit",
+			},
+		),
+		templates: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "versa_flow_templates",
+				Help: "The number of flow templates known",
+			},
+		),
+		overflow:  overflow,
+		exporters: cardinality.NewLimit("exporter", limits.Exporters, overflow),
+		sites: newLimitedCounters(
+			"site", "by the site", []string{"tenant", "site"}, limits.Sites, overflow,
+		),
+		applications: newLimitedCounters(
+			"application", "by the site for the application", []string{"tenant", "site", "application"},
+			limits.Applications, overflow,
+		),
+		circuits: newLimitedCounters(
+			"circuit", "by the site on the circuit", []string{"tenant", "site", "circuit"},
+			limits.Circuits, overflow,
+		),
+	}
+}
+
+func (m *Metrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.messages,
+		m.invalidMessages,
+		m.records,
+		m.missingTemplates,
+		m.droppedTemplates,
+		m.templates,
+		m.overflow,
+		m.sites.bytes,
+		m.sites.packets,
+		m.applications.bytes,
+		m.applications.packets,
+		m.circuits.bytes,
+		m.circuits.packets,
+	}
+}
+
+// Describe implements prometheus.Collector for the flow metrics
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	for _, c := range m.collectors() {
+		c.Describe(ch)
+	}
+}
+
+// Collect implements prometheus.Collector for the flow metrics
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	for _, c := range m.collectors() {
+		c.Collect(ch)
+	}
+}
+
+// label returns the value of the first element of the role set in the flow
+func (m *Metrics) label(f Flow, role Role) string {
+	for _, element := range m.roles[role] {
+		if value := f.String(element); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// Observe counts a flow record received from the exporter
+func (m *Metrics) Observe(exporter string, f Flow) {
+
+	bytes := flowCount(f, elementOctetDeltaCount, elementInitiatorOctets, elementResponderOctets)
+	packets := flowCount(f, elementPacketDeltaCount, elementInitiatorPackets, elementResponderPackets)
+
+	tenant := m.label(f, RoleTenant)
+	site := m.label(f, RoleSite)
+
+	if site == "" {
+		site = exporter
+	}
+
+	// The application and circuit series use the tenant and site as counted by the site metric so that
+	// sites beyond its limit do not add series to the other metrics
+	labels := m.sites.add([]string{tenant, site}, bytes, packets)
+	tenant, site = labels[0], labels[1]
+
+	m.applications.add([]string{tenant, site, m.label(f, RoleApplication)}, bytes, packets)
+	m.circuits.add([]string{tenant, site, m.label(f, RoleCircuit)}, bytes, packets)
+}
+
+// message counts a decoded export message
+func (m *Metrics) message(exporter string, msg Message, templates int) {
+
+	m.messages.WithLabelValues(strconv.Itoa(int(msg.Version))).Inc()
+	exporterLabels := m.exporters.Labels(exporter)
+
+	m.records.WithLabelValues(exporterLabels...).Add(float64(msg.Records))
+
+	if msg.MissingTemplates > 0 {
+		m.missingTemplates.WithLabelValues(exporterLabels...).Add(float64(msg.MissingTemplates))
+	}
+
+	m.droppedTemplates.Add(float64(msg.DroppedTemplates))
+
+	m.templates.Set(float64(templates))
+}
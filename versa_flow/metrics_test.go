@@ -0,0 +1,74 @@
+package versa_flow
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func versaFlow(tenant, application, circuit string, octets byte) Flow {
+	return Flow{
+		elementVersaTenantName:    []byte(tenant),
+		elementVersaApplication:   []byte(application),
+		elementVersaAccessCircuit: []byte(circuit),
+		elementOctetDeltaCount:    {octets},
+		elementPacketDeltaCount:   {1},
+	}
+}
+
+func TestObserve(t *testing.T) {
+
+	m := NewMetrics(defaultRoleElements, Limits{Exporters: 1, Sites: 2, Applications: 10, Circuits: 10})
+
+	m.Observe("192.0.2.1", versaFlow("acme", "http", "MPLS", 10))
+	m.Observe("192.0.2.1", versaFlow("acme", "ssh", "MPLS", 20))
+
+	// IANA elements are read when the Versa ones are not exported
+	m.Observe("192.0.2.2", Flow{{ID: 236}: []byte("globex"), {ID: 96}: []byte("dns"), {ID: 82}: []byte("ge-0/0/1"),
+		elementOctetDeltaCount: {30}, elementPacketDeltaCount: {1}})
+
+	// Tenants beyond the site limit are counted as other whatever the label they come from
+	m.Observe("192.0.2.3", versaFlow("initech", "http", "INET", 40))
+	m.Observe("192.0.2.3", versaFlow("umbrella\xff", "http", "INET", 50))
+
+	m.message("192.0.2.1", Message{Version: VersionIPFIX, Records: 3}, 1)
+	m.message("192.0.2.2", Message{Version: VersionIPFIX, Records: 1, MissingTemplates: 2}, 1)
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(m)
+
+	expected := `
+# HELP versa_flow_application_bytes_total The number of bytes of the flows exported by the site for the application
+# TYPE versa_flow_application_bytes_total counter
+versa_flow_application_bytes_total{application="dns",site="192.0.2.2",tenant="globex"} 30
+versa_flow_application_bytes_total{application="http",site="192.0.2.1",tenant="acme"} 10
+versa_flow_application_bytes_total{application="http",site="other",tenant="other"} 90
+versa_flow_application_bytes_total{application="ssh",site="192.0.2.1",tenant="acme"} 20
+# HELP versa_flow_cardinality_overflow_total The number of flows counted as other as the flow metric reached its series limit
+# TYPE versa_flow_cardinality_overflow_total counter
+versa_flow_cardinality_overflow_total{metric="exporter"} 1
+versa_flow_cardinality_overflow_total{metric="site"} 2
+# HELP versa_flow_records_total The number of flow records received by exporter
+# TYPE versa_flow_records_total counter
+versa_flow_records_total{exporter="192.0.2.1"} 3
+versa_flow_records_total{exporter="other"} 1
+# HELP versa_flow_missing_template_sets_total The number of data sets dropped as their template was not received yet
+# TYPE versa_flow_missing_template_sets_total counter
+versa_flow_missing_template_sets_total{exporter="other"} 2
+# HELP versa_flow_site_bytes_total The number of bytes of the flows exported by the site
+# TYPE versa_flow_site_bytes_total counter
+versa_flow_site_bytes_total{site="192.0.2.1",tenant="acme"} 30
+versa_flow_site_bytes_total{site="192.0.2.2",tenant="globex"} 30
+versa_flow_site_bytes_total{site="other",tenant="other"} 90
+`
+
+	err := testutil.GatherAndCompare(registry, strings.NewReader(expected),
+		"versa_flow_application_bytes_total", "versa_flow_cardinality_overflow_total", "versa_flow_records_total",
+		"versa_flow_missing_template_sets_total", "versa_flow_site_bytes_total")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,444 @@
+package versa_lef
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lucabrasi83/peppamon_versa/logging"
+	"github.com/lucabrasi83/peppamon_versa/versa_client"
+)
+
+const (
+	TransportTCP = "tcp"
+	TransportUDP = "udp"
+	TransportTLS = "tls"
+)
+
+// minRecordSize is the smallest maximum record size accepted, the 480 octets every syslog receiver must
+// accept according to RFC 5424
+const minRecordSize = 480
+
+// errRecordTooLarge is returned for the records exceeding the maximum record size
+var errRecordTooLarge = errors.New("LEF record exceeds the maximum record size")
+
+// Listener receives LEF records over syslog on TCP, UDP and TLS. Stream transports accept both
+// newline delimited and octet counted framing as described in RFC 6587
+type Listener struct {
+	// TCPAddress, UDPAddress and TLSAddress are the addresses listened on, a transport is disabled when empty
+	TCPAddress string
+	UDPAddress string
+	TLSAddress string
+
+	TLSConfig *tls.Config
+
+	// MaxRecordSize bounds the size of a record, larger ones are dropped. It must be at least 480 bytes
+	MaxRecordSize int
+
+	// IdleTimeout closes the stream connections that sent nothing for that long
+	IdleTimeout time.Duration
+
+	Metrics *Metrics
+
+	mu        sync.Mutex
+	listeners []io.Closer
+	conns     map[net.Conn]bool
+	closed    bool
+	wg        sync.WaitGroup
+}
+
+// ListenerFromEnv builds the LEF listener from PEPPAMON_VERSA_LEF_TCP_ADDRESS, PEPPAMON_VERSA_LEF_UDP_ADDRESS
+// and PEPPAMON_VERSA_LEF_TLS_ADDRESS such as :1514. It returns nil when none is set
+func ListenerFromEnv() *Listener {
+
+	env := versa_client.Env{}
+
+	l := &Listener{
+		TCPAddress:    env.String("PEPPAMON_VERSA_LEF_TCP_ADDRESS", ""),
+		UDPAddress:    env.String("PEPPAMON_VERSA_LEF_UDP_ADDRESS", ""),
+		TLSAddress:    env.String("PEPPAMON_VERSA_LEF_TLS_ADDRESS", ""),
+		MaxRecordSize: env.Int("PEPPAMON_VERSA_LEF_MAX_RECORD_SIZE", 64*1024),
+		IdleTimeout:   env.Duration("PEPPAMON_VERSA_LEF_IDLE_TIMEOUT", 5*time.Minute),
+		Metrics:       NewMetrics(logTypesFromEnv(env), limitsFromEnv(env)),
+	}
+
+	if l.TCPAddress == "" && l.UDPAddress == "" && l.TLSAddress == "" {
+		return nil
+	}
+
+	if l.MaxRecordSize < minRecordSize {
+		logging.PeppaMonLog("fatal", "Invalid PEPPAMON_VERSA_LEF_MAX_RECORD_SIZE %v, expected at least %v bytes",
+			l.MaxRecordSize, minRecordSize)
+	}
+
+	if l.TLSAddress != "" {
+		tlsConfig, err := serverTLSConfig(
+			env.String("PEPPAMON_VERSA_LEF_TLS_CERT_FILE", ""),
+			env.String("PEPPAMON_VERSA_LEF_TLS_KEY_FILE", ""),
+			env.String("PEPPAMON_VERSA_LEF_TLS_CLIENT_CA_FILE", ""),
+		)
+
+		if err != nil {
+			logging.PeppaMonLog("fatal", "Invalid LEF TLS listener settings: %v", err)
+		}
+
+		l.TLSConfig = tlsConfig
+	}
+
+	return l
+}
+
+// serverTLSConfig loads the certificate of the TLS listener. Appliances must present a certificate signed by
+// the client CA when one is set
+func serverTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("both a certificate and a key file are required")
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+
+	if err != nil {
+		return nil, fmt.Errorf("unable to load certificate %v: %v", certFile, err)
+	}
+
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+
+	if clientCAFile != "" {
+		caBundle, err := ioutil.ReadFile(clientCAFile)
+
+		if err != nil {
+			return nil, fmt.Errorf("unable to read client CA bundle %v: %v", clientCAFile, err)
+		}
+
+		tlsConfig.ClientCAs = x509.NewCertPool()
+
+		if !tlsConfig.ClientCAs.AppendCertsFromPEM(caBundle) {
+			return nil, fmt.Errorf("no PEM certificate found in client CA bundle %v", clientCAFile)
+		}
+
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsConfig, nil
+}
+
+// Start listens on every configured address and serves them in the background
+func (l *Listener) Start() error {
+
+	if l.MaxRecordSize < minRecordSize {
+		return fmt.Errorf("the maximum LEF record size must be at least %v bytes, got %v", minRecordSize, l.MaxRecordSize)
+	}
+
+	l.mu.Lock()
+	l.conns = make(map[net.Conn]bool)
+	l.mu.Unlock()
+
+	if l.UDPAddress != "" {
+		conn, err := net.ListenPacket("udp", l.UDPAddress)
+
+		if err != nil {
+			l.Close()
+			return fmt.Errorf("unable to listen for LEF records on UDP %v: %v", l.UDPAddress, err)
+		}
+
+		l.track(conn)
+		l.serve(func() { l.servePackets(conn) })
+
+		logging.PeppaMonLog("info", "Listening for Versa LEF records on UDP %v", conn.LocalAddr())
+	}
+
+	streams := []struct {
+		transport string
+		address   string
+	}{
+		{TransportTCP, l.TCPAddress},
+		{TransportTLS, l.TLSAddress},
+	}
+
+	for _, stream := range streams {
+
+		if stream.address == "" {
+			continue
+		}
+
+		listener, err := net.Listen("tcp", stream.address)
+
+		if err != nil {
+			l.Close()
+			return fmt.Errorf("unable to listen for LEF records on %v %v: %v", stream.transport, stream.address, err)
+		}
+
+		if stream.transport == TransportTLS {
+			listener = tls.NewListener(listener, l.TLSConfig)
+		}
+
+		transport := stream.transport
+
+		l.track(listener)
+		l.serve(func() { l.accept(listener, transport) })
+
+		logging.PeppaMonLog("info", "Listening for Versa LEF records on %v %v", transport, listener.Addr())
+	}
+
+	return nil
+}
+
+// Close stops listening and closes the open connections
+func (l *Listener) Close() {
+
+	l.mu.Lock()
+
+	l.closed = true
+
+	for _, listener := range l.listeners {
+		_ = listener.Close()
+	}
+
+	for conn := range l.conns {
+		_ = conn.Close()
+	}
+
+	l.mu.Unlock()
+
+	l.wg.Wait()
+}
+
+func (l *Listener) track(listener io.Closer) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.listeners = append(l.listeners, listener)
+}
+
+func (l *Listener) serve(fn func()) {
+	l.wg.Add(1)
+
+	go func() {
+		defer l.wg.Done()
+		fn()
+	}()
+}
+
+// servePackets handles every UDP datagram as one or more newline delimited records
+func (l *Listener) servePackets(conn net.PacketConn) {
+
+	buf := make([]byte, 65535)
+
+	for {
+		n, _, err := conn.ReadFrom(buf)
+
+		if err != nil {
+			if !l.isClosed() {
+				logging.PeppaMonLog("error", "Unable to read LEF datagram with error %v", err)
+			}
+			return
+		}
+
+		for _, message := range bytes.Split(buf[:n], []byte("\n")) {
+			if len(bytes.TrimSpace(message)) > 0 {
+				l.handle(TransportUDP, string(message))
+			}
+		}
+	}
+}
+
+func (l *Listener) accept(listener net.Listener, transport string) {
+
+	for {
+		conn, err := listener.Accept()
+
+		if err != nil {
+			if l.isClosed() {
+				return
+			}
+
+			// Keep accepting after temporary failures such as running out of file descriptors
+			var netErr net.Error
+
+			if errors.As(err, &netErr) && netErr.Temporary() {
+				logging.PeppaMonLog("warning", "Failed to accept LEF connection with error %v", err)
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+
+			logging.PeppaMonLog("error", "Stopped accepting LEF connections on %v with error %v", transport, err)
+			return
+		}
+
+		l.mu.Lock()
+
+		if l.closed {
+			l.mu.Unlock()
+			_ = conn.Close()
+			return
+		}
+
+		l.conns[conn] = true
+		l.mu.Unlock()
+
+		l.serve(func() { l.serveStream(conn, transport) })
+	}
+}
+
+// serveStream reads the records of a TCP or TLS connection until it is closed or idle
+func (l *Listener) serveStream(conn net.Conn, transport string) {
+
+	l.Metrics.connections.WithLabelValues(transport).Inc()
+
+	defer func() {
+		l.Metrics.connections.WithLabelValues(transport).Dec()
+
+		l.mu.Lock()
+		delete(l.conns, conn)
+		l.mu.Unlock()
+
+		_ = conn.Close()
+	}()
+
+	reader := bufio.NewReaderSize(conn, l.MaxRecordSize)
+
+	for {
+		if l.IdleTimeout > 0 {
+			_ = conn.SetReadDeadline(time.Now().Add(l.IdleTimeout))
+		}
+
+		message, err := readFrame(reader, l.MaxRecordSize)
+
+		if err == errRecordTooLarge {
+			l.Metrics.invalid(transport)
+			continue
+		}
+
+		if err != nil {
+			if err != io.EOF && !l.isClosed() {
+				logging.PeppaMonLog("warning", "Closing LEF connection from %v with error %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+
+		if len(bytes.TrimSpace(message)) > 0 {
+			l.handle(transport, string(message))
+		}
+	}
+}
+
+// maxOctetCountDigits bounds the length prefix of octet counted messages
+const maxOctetCountDigits = 9
+
+// octetCounted reports whether the next message starts with its length followed by a space. LEF records sent
+// without a syslog header start with the digits of their timestamp which are followed by a dash instead
+func octetCounted(reader *bufio.Reader) (bool, error) {
+
+	for i := 1; i <= maxOctetCountDigits+1; i++ {
+
+		prefix, err := reader.Peek(i)
+
+		if err != nil {
+			return false, err
+		}
+
+		switch c := prefix[i-1]; {
+		case c == ' ':
+			return i > 1, nil
+		case c < '0' || c > '9':
+			return false, nil
+		}
+	}
+
+	return false, nil
+}
+
+// readFrame reads the next syslog message, octet counted when it starts with its length or else newline
+// delimited. A record exceeding maxSize is skipped and reported with errRecordTooLarge
+func readFrame(reader *bufio.Reader, maxSize int) ([]byte, error) {
+
+	counted, err := octetCounted(reader)
+
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	if counted {
+		length, err := reader.ReadString(' ')
+
+		if err != nil {
+			return nil, err
+		}
+
+		size, err := strconv.Atoi(length[:len(length)-1])
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid octet count %q", length)
+		}
+
+		if size > maxSize {
+			if _, err := reader.Discard(size); err != nil {
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return nil, err
+			}
+			return nil, errRecordTooLarge
+		}
+
+		message := make([]byte, size)
+
+		if _, err := io.ReadFull(reader, message); err != nil {
+			return nil, err
+		}
+
+		return message, nil
+	}
+
+	message, err := reader.ReadSlice('\n')
+
+	if err == bufio.ErrBufferFull {
+		// Drop the rest of the oversized record up to its delimiter
+		for err == bufio.ErrBufferFull {
+			_, err = reader.ReadSlice('\n')
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		return nil, errRecordTooLarge
+	}
+
+	// The last record of a connection may miss its delimiter
+	if err != nil && (err != io.EOF || len(message) == 0) {
+		return nil, err
+	}
+
+	return append([]byte(nil), message...), nil
+}
+
+// handle parses a record and updates the metrics, counting the records that cannot be parsed
+func (l *Listener) handle(transport, message string) {
+
+	record, err := ParseRecord(message, time.Now())
+
+	if err != nil {
+		l.Metrics.invalid(transport)
+		return
+	}
+
+	l.Metrics.Observe(record)
+}
+
+func (l *Listener) isClosed() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.closed
+}
@@ -0,0 +1,128 @@
+package versa_lef
+
+import (
+	"bufio"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadFrame(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		stream  string
+		maxSize int
+
+		// want holds the frames read until the end of the stream, <too large> standing for the skipped records
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:   "newline delimited",
+			stream: "<134>1 - - - - - - alarmLog, a=1\n<134>1 - - - - - - alarmLog, a=2",
+			want:   []string{"<134>1 - - - - - - alarmLog, a=1\n", "<134>1 - - - - - - alarmLog, a=2"},
+		},
+		{
+			name:   "octet counted",
+			stream: "16 alarmLog, a=1\nb=22 alarmLog, a=\"2\n3\", b=4",
+			want:   []string{"alarmLog, a=1\nb=", "alarmLog, a=\"2\n3\", b=4"},
+		},
+		{
+			name:   "octet counted then newline delimited",
+			stream: "13 alarmLog, a=1alarmLog, a=2\n",
+			want:   []string{"alarmLog, a=1", "alarmLog, a=2\n"},
+		},
+		{
+			name:   "LEF timestamp without syslog header",
+			stream: "2020-03-02T10:20:30+0000 alarmLog, a=1\n",
+			want:   []string{"2020-03-02T10:20:30+0000 alarmLog, a=1\n"},
+		},
+		{
+			name:   "octet count longer than the maximum digits",
+			stream: "1234567890 alarmLog, a=1\n",
+			want:   []string{"1234567890 alarmLog, a=1\n"},
+		},
+		{
+			name:    "oversized newline delimited record",
+			stream:  strings.Repeat("x", 100) + "\nalarmLog, a=1\n",
+			maxSize: 32,
+			want:    []string{"<too large>", "alarmLog, a=1\n"},
+		},
+		{
+			name:    "oversized octet counted record",
+			stream:  "100 " + strings.Repeat("x", 100) + "13 alarmLog, a=1",
+			maxSize: 32,
+			want:    []string{"<too large>", "alarmLog, a=1"},
+		},
+		{
+			name:    "truncated octet counted record",
+			stream:  "40 alarmLog, a=1",
+			wantErr: true,
+		},
+		{
+			name:    "truncated oversized octet counted record",
+			stream:  "100 alarmLog, a=1",
+			maxSize: 32,
+			wantErr: true,
+		},
+		{
+			name:   "binary garbage",
+			stream: "\x00\xff 12\x01\n",
+			want:   []string{"\x00\xff 12\x01\n"},
+		},
+	}
+
+	for _, tt := range tests {
+
+		t.Run(tt.name, func(t *testing.T) {
+
+			maxSize := tt.maxSize
+
+			if maxSize == 0 {
+				maxSize = 1024
+			}
+
+			reader := bufio.NewReaderSize(strings.NewReader(tt.stream), maxSize)
+
+			var frames []string
+			var err error
+
+			for {
+				var frame []byte
+
+				frame, err = readFrame(reader, maxSize)
+
+				if err == errRecordTooLarge {
+					frames = append(frames, "<too large>")
+					continue
+				}
+
+				if err != nil {
+					break
+				}
+
+				frames = append(frames, string(frame))
+			}
+
+			if (err != io.EOF) != tt.wantErr {
+				t.Fatalf("readFrame() got error %v, want error %v", err, tt.wantErr)
+			}
+
+			if !tt.wantErr && !reflect.DeepEqual(frames, tt.want) {
+				t.Fatalf("readFrame() got %q, want %q", frames, tt.want)
+			}
+		})
+	}
+}
+
+func TestStartRejectsSmallRecordSize(t *testing.T) {
+
+	l := &Listener{UDPAddress: "127.0.0.1:0", MaxRecordSize: 16, Metrics: NewMetrics(defaultLogTypes, Limits{})}
+
+	if err := l.Start(); err == nil {
+		l.Close()
+		t.Fatal("Start() accepted a maximum record size below the syslog minimum")
+	}
+}
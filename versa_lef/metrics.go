@@ -0,0 +1,294 @@
+package versa_lef
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/lucabrasi83/peppamon_versa/internal/cardinality"
+	"github.com/lucabrasi83/peppamon_versa/logging"
+	"github.com/lucabrasi83/peppamon_versa/versa_client"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// LogKind groups the LEF log types turned into the same metrics
+type LogKind string
+
+const (
+	LogKindFlow         LogKind = "flow"
+	LogKindSLAViolation LogKind = "sla_violation"
+	LogKindAlarm        LogKind = "alarm"
+	LogKindThreat       LogKind = "threat"
+)
+
+// defaultLogTypes maps the LEF log types to their kind, others are only counted
+var defaultLogTypes = map[string]LogKind{
+	"accessLog":           LogKindFlow,
+	"flowMonLog":          LogKindFlow,
+	"sdwanB2BSlamViolLog": LogKindSLAViolation,
+	"alarmLog":            LogKindAlarm,
+	"idpLog":              LogKindThreat,
+	"avLog":               LogKindThreat,
+}
+
+// logTypesFromEnv extends the default log types with PEPPAMON_VERSA_LEF_LOG_TYPES given as a comma separated
+// list of logType=kind, kind being flow, sla_violation, alarm or threat
+func logTypesFromEnv(env versa_client.Env) map[string]LogKind {
+
+	logTypes := make(map[string]LogKind, len(defaultLogTypes))
+
+	for logType, kind := range defaultLogTypes {
+		logTypes[logType] = kind
+	}
+
+	for _, item := range env.List("PEPPAMON_VERSA_LEF_LOG_TYPES") {
+
+		tokens := strings.SplitN(item, "=", 2)
+
+		if len(tokens) != 2 {
+			logging.PeppaMonLog("fatal", "Invalid LEF log type %q, expected logType=kind", item)
+		}
+
+		switch kind := LogKind(strings.TrimSpace(tokens[1])); kind {
+		case LogKindFlow, LogKindSLAViolation, LogKindAlarm, LogKindThreat:
+			logTypes[strings.TrimSpace(tokens[0])] = kind
+		default:
+			logging.PeppaMonLog("fatal", "Unsupported kind %q for LEF log type %v", tokens[1], tokens[0])
+		}
+	}
+
+	return logTypes
+}
+
+// Limits bounds the number of series of the LEF metrics, 0 meaning unbounded
+type Limits struct {
+	Appliances int
+	SLAPaths   int
+	Alarms     int
+	Threats    int
+}
+
+// limitsFromEnv loads PEPPAMON_VERSA_LEF_MAX_APPLIANCES, PEPPAMON_VERSA_LEF_MAX_SLA_PATHS,
+// PEPPAMON_VERSA_LEF_MAX_ALARMS and PEPPAMON_VERSA_LEF_MAX_THREATS
+func limitsFromEnv(env versa_client.Env) Limits {
+	return Limits{
+		Appliances: env.Int("PEPPAMON_VERSA_LEF_MAX_APPLIANCES", 5000),
+		SLAPaths:   env.Int("PEPPAMON_VERSA_LEF_MAX_SLA_PATHS", 10000),
+		Alarms:     env.Int("PEPPAMON_VERSA_LEF_MAX_ALARMS", 5000),
+		Threats:    env.Int("PEPPAMON_VERSA_LEF_MAX_THREATS", 5000),
+	}
+}
+
+// Metrics turns LEF records into Prometheus metrics
+type Metrics struct {
+	logTypes map[string]LogKind
+
+	records         *prometheus.CounterVec
+	invalidRecords  *prometheus.CounterVec
+	connections     *prometheus.GaugeVec
+	lastRecord      *prometheus.GaugeVec
+	flows           *prometheus.CounterVec
+	flowBytes       *prometheus.CounterVec
+	slaViolations   *prometheus.CounterVec
+	lastSLAViolated *prometheus.GaugeVec
+	alarms          *prometheus.CounterVec
+	threats         *prometheus.CounterVec
+	overflow        *prometheus.CounterVec
+
+	appliances   *cardinality.Limit
+	slaPaths     *cardinality.Limit
+	alarmTypes   *cardinality.Limit
+	threatSeries *cardinality.Limit
+}
+
+// slaPathLabels identify the SD-WAN path of an SLA violation
+var slaPathLabels = []string{"tenant", "local_site", "remote_site", "local_circuit", "remote_circuit", "forwarding_class"}
+
+// NewMetrics builds the LEF metrics for the given log types with their series bounded by limits
+func NewMetrics(logTypes map[string]LogKind, limits Limits) *Metrics {
+
+	overflow := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "versa_lef_cardinality_overflow_total",
+			Help: "The number of LEF records counted as other as the metric reached its series limit",
+		},
+		[]string{"metric"},
+	)
+
+	return &Metrics{
+		logTypes: logTypes,
+		records: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "versa_lef_records_total",
+				Help: "The number of LEF records received by log type, other for the log types not configured",
+			},
+			[]string{"log_type"},
+		),
+		invalidRecords: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "versa_lef_invalid_records_total",
+				Help: "The number of LEF records dropped as they could not be parsed or exceeded the size limit",
+			},
+			[]string{"transport"},
+		),
+		connections: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "versa_lef_connections",
+				Help: "The number of open LEF syslog connections",
+			},
+			[]string{"transport"},
+		),
+		lastRecord: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "versa_lef_last_record_timestamp_seconds",
+				Help: "The time of the last LEF record received from the appliance",
+			},
+			[]string{"tenant", "appliance"},
+		),
+		flows: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "versa_lef_flows_total",
+				Help: "The number of flow records exported by the appliance",
+			},
+			[]string{"tenant", "appliance"},
+		),
+		flowBytes: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "versa_lef_flow_bytes_total",
+				Help: "The number of bytes of the flows exported by the appliance",
+			},
+			[]string{"tenant", "appliance", "direction"},
+		),
+		slaViolations: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "versa_lef_sla_violations_total",
+				Help: "The number of SLA violations reported for the SD-WAN path",
+			},
+			slaPathLabels,
+		),
+		lastSLAViolated: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "versa_lef_sla_violation_last_timestamp_seconds",
+				Help: "The time of the last SLA violation reported for the SD-WAN path",
+			},
+			slaPathLabels,
+		),
+		alarms: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "versa_lef_alarms_total",
+				Help: "The number of alarms raised by the appliance",
+			},
+			[]string{"tenant", "appliance", "severity", "type"},
+		),
+		threats: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "versa_lef_threat_events_total",
+				Help: "The number of threat events detected at the site by log type",
+			},
+			[]string{"tenant", "site", "log_type", "severity"},
+		),
+		overflow: overflow,
+
+		appliances:   cardinality.NewLimit("appliances", limits.Appliances, overflow),
+		slaPaths:     cardinality.NewLimit("sla_paths", limits.SLAPaths, overflow),
+		alarmTypes:   cardinality.NewLimit("alarms", limits.Alarms, overflow),
+		threatSeries: cardinality.NewLimit("threats", limits.Threats, overflow),
+	}
+}
+
+func (m *Metrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.records,
+		m.invalidRecords,
+		m.connections,
+		m.lastRecord,
+		m.flows,
+		m.flowBytes,
+		m.slaViolations,
+		m.lastSLAViolated,
+		m.alarms,
+		m.threats,
+		m.overflow,
+	}
+}
+
+// Describe implements prometheus.Collector for the LEF metrics
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	for _, c := range m.collectors() {
+		c.Describe(ch)
+	}
+}
+
+// Collect implements prometheus.Collector for the LEF metrics
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	for _, c := range m.collectors() {
+		c.Collect(ch)
+	}
+}
+
+// Observe updates the metrics with a record
+func (m *Metrics) Observe(record Record) {
+
+	kind, known := m.logTypes[record.Type]
+
+	if known {
+		m.records.WithLabelValues(record.Type).Inc()
+	} else {
+		// Unknown log types are counted as other so that records cannot add series
+		m.records.WithLabelValues(cardinality.Other).Inc()
+	}
+
+	source := m.appliances.Labels(record.Field("tenantName"), record.Field("applianceName"))
+	tenant, appliance := source[0], source[1]
+
+	if appliance != "" {
+		m.lastRecord.WithLabelValues(tenant, appliance).Set(float64(record.Time.Unix()))
+	}
+
+	switch kind {
+	case LogKindFlow:
+		m.flows.WithLabelValues(tenant, appliance).Inc()
+
+		if sent, err := strconv.ParseFloat(record.Field("sentOctets"), 64); err == nil && sent >= 0 {
+			m.flowBytes.WithLabelValues(tenant, appliance, "tx").Add(sent)
+		}
+
+		if received, err := strconv.ParseFloat(record.Field("recvdOctets"), 64); err == nil && received >= 0 {
+			m.flowBytes.WithLabelValues(tenant, appliance, "rx").Add(received)
+		}
+
+	case LogKindSLAViolation:
+		path := m.slaPaths.Labels(
+			record.Field("tenantName"),
+			record.FirstField("localSiteName", "applianceName"),
+			record.Field("remoteSiteName"),
+			record.Field("localAccCktName"),
+			record.Field("remoteAccCktName"),
+			record.Field("fwdClass"),
+		)
+
+		m.slaViolations.WithLabelValues(path...).Inc()
+		m.lastSLAViolated.WithLabelValues(path...).Set(float64(record.Time.Unix()))
+
+	case LogKindAlarm:
+		m.alarms.WithLabelValues(m.alarmTypes.Labels(
+			record.Field("tenantName"),
+			record.Field("applianceName"),
+			record.FirstField("alarmSeverity", "severity"),
+			record.FirstField("alarmType", "type"),
+		)...).Inc()
+
+	case LogKindThreat:
+		threat := m.threatSeries.Labels(
+			record.Field("tenantName"),
+			record.FirstField("siteName", "applianceName"),
+			record.FirstField("threatSeverity", "idpSeverity", "severity"),
+		)
+
+		m.threats.WithLabelValues(threat[0], threat[1], record.Type, threat[2]).Inc()
+	}
+}
+
+// invalid counts a record dropped on the transport
+func (m *Metrics) invalid(transport string) {
+	m.invalidRecords.WithLabelValues(transport).Inc()
+}
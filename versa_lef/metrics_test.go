@@ -0,0 +1,78 @@
+package versa_lef
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestObserve(t *testing.T) {
+
+	l := &Listener{Metrics: NewMetrics(defaultLogTypes, Limits{Appliances: 2, SLAPaths: 10, Alarms: 10, Threats: 10})}
+
+	messages := []string{
+		"2020-03-02T10:20:30+0000 accessLog, tenantName=acme, applianceName=Branch1, sentOctets=100, recvdOctets=300",
+		"2020-03-02T10:20:31+0000 accessLog, tenantName=acme, applianceName=Branch1, sentOctets=50, recvdOctets=-1",
+		"2020-03-02T10:20:32+0000 sdwanB2BSlamViolLog, tenantName=acme, applianceName=Branch1, remoteSiteName=Hub, " +
+			"localAccCktName=MPLS, remoteAccCktName=INET, fwdClass=fc_ef",
+		"2020-03-02T10:20:33+0000 alarmLog, tenantName=acme, applianceName=Branch2, alarmSeverity=critical, alarmType=bgp-down",
+		"2020-03-02T10:20:34+0000 idpLog, tenantName=acme, applianceName=Branch2, threatSeverity=high",
+
+		// Appliances beyond the limit are counted as other, invalid UTF-8 being replaced beforehand
+		"2020-03-02T10:20:35+0000 accessLog, tenantName=globex, applianceName=Branch\xff, sentOctets=1",
+		"2020-03-02T10:20:36+0000 unknownLog, tenantName=acme, applianceName=Branch1",
+		"garbage",
+	}
+
+	for _, message := range messages {
+		l.handle(TransportTCP, message)
+	}
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(l.Metrics)
+
+	expected := `
+# HELP versa_lef_alarms_total The number of alarms raised by the appliance
+# TYPE versa_lef_alarms_total counter
+versa_lef_alarms_total{appliance="Branch2",severity="critical",tenant="acme",type="bgp-down"} 1
+# HELP versa_lef_cardinality_overflow_total The number of LEF records counted as other as the metric reached its series limit
+# TYPE versa_lef_cardinality_overflow_total counter
+versa_lef_cardinality_overflow_total{metric="appliances"} 1
+# HELP versa_lef_flow_bytes_total The number of bytes of the flows exported by the appliance
+# TYPE versa_lef_flow_bytes_total counter
+versa_lef_flow_bytes_total{appliance="Branch1",direction="rx",tenant="acme"} 300
+versa_lef_flow_bytes_total{appliance="Branch1",direction="tx",tenant="acme"} 150
+versa_lef_flow_bytes_total{appliance="other",direction="tx",tenant="other"} 1
+# HELP versa_lef_flows_total The number of flow records exported by the appliance
+# TYPE versa_lef_flows_total counter
+versa_lef_flows_total{appliance="Branch1",tenant="acme"} 2
+versa_lef_flows_total{appliance="other",tenant="other"} 1
+# HELP versa_lef_invalid_records_total The number of LEF records dropped as they could not be parsed or exceeded the size limit
+# TYPE versa_lef_invalid_records_total counter
+versa_lef_invalid_records_total{transport="tcp"} 1
+# HELP versa_lef_records_total The number of LEF records received by log type, other for the log types not configured
+# TYPE versa_lef_records_total counter
+versa_lef_records_total{log_type="accessLog"} 3
+versa_lef_records_total{log_type="alarmLog"} 1
+versa_lef_records_total{log_type="idpLog"} 1
+versa_lef_records_total{log_type="other"} 1
+versa_lef_records_total{log_type="sdwanB2BSlamViolLog"} 1
+# HELP versa_lef_sla_violations_total The number of SLA violations reported for the SD-WAN path
+# TYPE versa_lef_sla_violations_total counter
+versa_lef_sla_violations_total{forwarding_class="fc_ef",local_circuit="MPLS",local_site="Branch1",remote_circuit="INET",remote_site="Hub",tenant="acme"} 1
+# HELP versa_lef_threat_events_total The number of threat events detected at the site by log type
+# TYPE versa_lef_threat_events_total counter
+versa_lef_threat_events_total{log_type="idpLog",severity="high",site="Branch2",tenant="acme"} 1
+`
+
+	err := testutil.GatherAndCompare(registry, strings.NewReader(expected),
+		"versa_lef_alarms_total", "versa_lef_cardinality_overflow_total", "versa_lef_flow_bytes_total",
+		"versa_lef_flows_total", "versa_lef_invalid_records_total", "versa_lef_records_total",
+		"versa_lef_sla_violations_total", "versa_lef_threat_events_total")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
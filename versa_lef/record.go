@@ -0,0 +1,165 @@
+// Package versa_lef receives the logs Versa appliances and Analytics stream over syslog with the Log Export
+// Functionality (LEF) and turns them into Prometheus metrics
+package versa_lef
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// lefTimeLayouts are the layouts of the timestamp preceding the log type of a LEF record
+var lefTimeLayouts = []string{
+	"2006-01-02T15:04:05-0700",
+	time.RFC3339Nano,
+}
+
+// Record is a LEF log record made of its log type and key=value fields
+type Record struct {
+	// Type is the LEF log type such as alarmLog or idpLog
+	Type string
+
+	// Time is when the record was generated, or received when it carries no timestamp
+	Time time.Time
+
+	Fields map[string]string
+}
+
+// Field returns the value of a field of the record, empty when it is not set
+func (r Record) Field(key string) string {
+	return r.Fields[key]
+}
+
+// FirstField returns the value of the first field set among keys, as field names vary between log types
+func (r Record) FirstField(keys ...string) string {
+	for _, key := range keys {
+		if value := r.Fields[key]; value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// ParseRecord parses a LEF record such as
+//
+//	2020-03-02T10:20:30+0000 alarmLog, applianceName=Branch1, tenantName=Customer1, alarmType=...
+//
+// along with the syslog header it is wrapped in, if any. The header is skipped whatever its format
+func ParseRecord(message string, received time.Time) (Record, error) {
+
+	message = strings.TrimRight(message, "\r\n\x00")
+
+	comma := strings.IndexByte(message, ',')
+
+	if comma < 0 {
+		return Record{}, fmt.Errorf("no key=value field found in LEF record %q", truncate(message))
+	}
+
+	// The log type is the last word before the first field, optionally preceded by the LEF timestamp
+	head := strings.Fields(message[:comma])
+
+	if len(head) == 0 || strings.Contains(head[len(head)-1], "=") {
+		return Record{}, fmt.Errorf("no log type found in LEF record %q", truncate(message))
+	}
+
+	record := Record{Type: head[len(head)-1], Time: received}
+
+	if len(head) > 1 {
+		for _, layout := range lefTimeLayouts {
+			if timestamp, err := time.Parse(layout, head[len(head)-2]); err == nil {
+				record.Time = timestamp
+				break
+			}
+		}
+	}
+
+	fields, err := parseFields(message[comma+1:])
+
+	if err != nil {
+		return Record{}, fmt.Errorf("invalid LEF record %q: %v", truncate(message), err)
+	}
+
+	record.Fields = fields
+
+	return record, nil
+}
+
+// parseFields parses the comma separated key=value fields of a record. Values may be double quoted to hold
+// commas, a backslash escaping a quote or a backslash within quotes
+func parseFields(s string) (map[string]string, error) {
+
+	fields := make(map[string]string)
+
+	for i := 0; i < len(s); {
+
+		// Skip the separator and the spaces before the key
+		for i < len(s) && (s[i] == ' ' || s[i] == ',') {
+			i++
+		}
+
+		if i == len(s) {
+			break
+		}
+
+		equal := strings.IndexByte(s[i:], '=')
+
+		if equal < 0 {
+			return nil, fmt.Errorf("field %q has no value", s[i:])
+		}
+
+		key := strings.TrimSpace(s[i : i+equal])
+
+		if key == "" || strings.ContainsAny(key, ", ") {
+			return nil, fmt.Errorf("invalid field name %q", key)
+		}
+
+		i += equal + 1
+
+		var value strings.Builder
+
+		if i < len(s) && s[i] == '"' {
+			i++
+
+			closed := false
+
+			for i < len(s) && !closed {
+				switch {
+				case s[i] == '\\' && i+1 < len(s):
+					value.WriteByte(s[i+1])
+					i += 2
+				case s[i] == '"':
+					closed = true
+					i++
+				default:
+					value.WriteByte(s[i])
+					i++
+				}
+			}
+
+			if !closed {
+				return nil, fmt.Errorf("unterminated quoted value for field %v", key)
+			}
+		} else {
+			end := strings.IndexByte(s[i:], ',')
+
+			if end < 0 {
+				end = len(s) - i
+			}
+
+			value.WriteString(strings.TrimSpace(s[i : i+end]))
+			i += end
+		}
+
+		fields[key] = value.String()
+	}
+
+	return fields, nil
+}
+
+// truncate shortens a record quoted in an error message
+func truncate(message string) string {
+	if len(message) > 120 {
+		return message[:120] + "..."
+	}
+	return message
+}
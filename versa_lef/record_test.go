@@ -0,0 +1,118 @@
+package versa_lef
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseRecord(t *testing.T) {
+
+	received := time.Date(2020, 3, 2, 11, 0, 0, 0, time.UTC)
+	generated := time.Date(2020, 3, 2, 10, 20, 30, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		message string
+		want    Record
+		wantErr bool
+	}{
+		{
+			name:    "LEF record",
+			message: "2020-03-02T10:20:30+0000 alarmLog, applianceName=Branch1, tenantName=Customer1, alarmType=interface-down\n",
+			want: Record{Type: "alarmLog", Time: generated, Fields: map[string]string{
+				"applianceName": "Branch1", "tenantName": "Customer1", "alarmType": "interface-down",
+			}},
+		},
+		{
+			name:    "syslog header",
+			message: "<134>1 2020-03-02T10:20:31Z analytics lef - - - 2020-03-02T10:20:30+0000 idpLog, tenantName=acme\r\n",
+			want:    Record{Type: "idpLog", Time: generated, Fields: map[string]string{"tenantName": "acme"}},
+		},
+		{
+			name:    "RFC 3339 timestamp",
+			message: "2020-03-02T10:20:30Z accessLog, sentOctets=10",
+			want:    Record{Type: "accessLog", Time: generated, Fields: map[string]string{"sentOctets": "10"}},
+		},
+		{
+			name:    "no timestamp",
+			message: "accessLog, sentOctets=10",
+			want:    Record{Type: "accessLog", Time: received, Fields: map[string]string{"sentOctets": "10"}},
+		},
+		{
+			name:    "quoted values holding separators",
+			message: `alarmLog, alarmText="link down, reason=carrier lost", note="say \"hi\" \\ bye", tenantName=acme`,
+			want: Record{Type: "alarmLog", Time: received, Fields: map[string]string{
+				"alarmText": "link down, reason=carrier lost", "note": `say "hi" \ bye`, "tenantName": "acme",
+			}},
+		},
+		{
+			name:    "unquoted values holding spaces and equal signs",
+			message: "alarmLog, alarmText = link down reason=carrier , empty=,tenantName=acme",
+			want: Record{Type: "alarmLog", Time: received, Fields: map[string]string{
+				"alarmText": "link down reason=carrier", "empty": "", "tenantName": "acme",
+			}},
+		},
+		{
+			name:    "no field",
+			message: "garbage without fields",
+			wantErr: true,
+		},
+		{
+			name:    "no log type",
+			message: " , tenantName=acme",
+			wantErr: true,
+		},
+		{
+			name:    "field instead of log type",
+			message: "tenantName=acme, applianceName=Branch1",
+			wantErr: true,
+		},
+		{
+			name:    "field without value",
+			message: "alarmLog, applianceName",
+			wantErr: true,
+		},
+		{
+			name:    "field name with a space",
+			message: "alarmLog, appliance name=Branch1",
+			wantErr: true,
+		},
+		{
+			name:    "unterminated quoted value",
+			message: `alarmLog, alarmText="link down`,
+			wantErr: true,
+		},
+		{
+			name:    "binary garbage",
+			message: "\x00\xff\xfe,\x01\x02",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+
+		t.Run(tt.name, func(t *testing.T) {
+
+			record, err := ParseRecord(tt.message, received)
+
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseRecord() got error %v, want error %v", err, tt.wantErr)
+			}
+
+			if tt.wantErr {
+				return
+			}
+
+			if !record.Time.Equal(tt.want.Time) {
+				t.Fatalf("ParseRecord() got time %v, want %v", record.Time, tt.want.Time)
+			}
+
+			record.Time = tt.want.Time
+
+			if !reflect.DeepEqual(record, tt.want) {
+				t.Fatalf("ParseRecord() got %+v, want %+v", record, tt.want)
+			}
+		})
+	}
+}
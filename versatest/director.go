@@ -0,0 +1,333 @@
+package versatest
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// directorTokenLifetime is the expires_in of the OAuth2 tokens issued by the fake Director, in seconds
+const directorTokenLifetime = 3600
+
+// DirectorServer is a fake Versa Director REST API programmed with organizations and faults. It accepts
+// the credentials with basic authentication or as OAuth2 bearer tokens obtained from /auth/token
+type DirectorServer struct {
+	*httptest.Server
+	faultInjector
+
+	// Username and Password are the credentials accepted, any are accepted when Username is empty
+	Username string
+	Password string
+
+	// ClientID and ClientSecret identify the OAuth2 client, any is accepted when ClientID is empty
+	ClientID     string
+	ClientSecret string
+
+	mu            sync.Mutex
+	organizations []Organization
+	tokens        map[string]bool
+	refreshTokens map[string]bool
+}
+
+// NewDirectorServer starts a fake Versa Director over TLS. It must be closed once done
+func NewDirectorServer(organizations ...Organization) *DirectorServer {
+
+	s := &DirectorServer{
+		faultInjector: newFaultInjector(),
+		organizations: organizations,
+		tokens:        make(map[string]bool),
+		refreshTokens: make(map[string]bool),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/auth/token", s.handleToken)
+	mux.HandleFunc("/vnms/organization/orgs", s.authenticated(s.handleOrganizations))
+	mux.HandleFunc("/vnms/appliance/appliance", s.authenticated(s.handleAppliances))
+	mux.HandleFunc("/vnms/fault/alarms", s.authenticated(s.handleAlarms))
+
+	s.Server = httptest.NewTLSServer(mux)
+
+	return s
+}
+
+// Hostname returns the host and port of the server as expected in PEPPAMON_VERSA_DIRECTOR_HOSTNAME
+func (s *DirectorServer) Hostname() string {
+	return strings.TrimPrefix(s.URL, "https://")
+}
+
+// ClientEnv returns the environment variables pointing versa_director to the server with the authentication
+// mode, basic or oauth2. The self-signed certificate of the server is pinned instead of being verified
+func (s *DirectorServer) ClientEnv(authMode string) map[string]string {
+
+	fingerprint := sha256.Sum256(s.Certificate().Raw)
+
+	return map[string]string{
+		"PEPPAMON_VERSA_DIRECTOR_HOSTNAME":                 s.Hostname(),
+		"PEPPAMON_VERSA_DIRECTOR_USERNAME":                 s.Username,
+		"PEPPAMON_VERSA_DIRECTOR_PASSWORD":                 s.Password,
+		"PEPPAMON_VERSA_DIRECTOR_AUTH_MODE":                authMode,
+		"PEPPAMON_VERSA_DIRECTOR_OAUTH_CLIENT_ID":          s.ClientID,
+		"PEPPAMON_VERSA_DIRECTOR_OAUTH_CLIENT_SECRET":      s.ClientSecret,
+		"PEPPAMON_VERSA_DIRECTOR_TLS_INSECURE_SKIP_VERIFY": "true",
+		"PEPPAMON_VERSA_DIRECTOR_TLS_PINNED_SHA256":        hex.EncodeToString(fingerprint[:]),
+	}
+}
+
+// SetOrganizations replaces the organizations served
+func (s *DirectorServer) SetOrganizations(organizations ...Organization) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.organizations = organizations
+}
+
+// ExpireTokens invalidates the access tokens so that the next requests are rejected until the client
+// refreshes them. Refresh tokens remain valid
+func (s *DirectorServer) ExpireTokens() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tokens = make(map[string]bool)
+}
+
+func randomToken() string {
+	token := make([]byte, 16)
+	_, _ = rand.Read(token)
+
+	return hex.EncodeToString(token)
+}
+
+func (s *DirectorServer) validCredentials(username, password string) bool {
+	return s.Username == "" || (username == s.Username && password == s.Password)
+}
+
+// handleToken grants tokens with the password and refresh_token grants
+func (s *DirectorServer) handleToken(w http.ResponseWriter, r *http.Request) {
+
+	if !applyFault(w, r, s.fault("", "token")) {
+		return
+	}
+
+	var tokenReq struct {
+		GrantType    string `json:"grant_type"`
+		ClientID     string `json:"client_id"`
+		ClientSecret string `json:"client_secret"`
+		Username     string `json:"username"`
+		Password     string `json:"password"`
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	if r.Method != http.MethodPost || json.NewDecoder(r.Body).Decode(&tokenReq) != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if s.ClientID != "" && (tokenReq.ClientID != s.ClientID || tokenReq.ClientSecret != s.ClientSecret) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch tokenReq.GrantType {
+	case "password":
+		if !s.validCredentials(tokenReq.Username, tokenReq.Password) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+	case "refresh_token":
+		if !s.refreshTokens[tokenReq.RefreshToken] {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		delete(s.refreshTokens, tokenReq.RefreshToken)
+
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	accessToken, refreshToken := randomToken(), randomToken()
+
+	s.tokens[accessToken] = true
+	s.refreshTokens[refreshToken] = true
+
+	writeJSON(w, map[string]interface{}{
+		"access_token":  accessToken,
+		"refresh_token": refreshToken,
+		"token_type":    "bearer",
+		"expires_in":    directorTokenLifetime,
+	})
+}
+
+// authenticated rejects the requests without valid basic credentials or bearer token
+func (s *DirectorServer) authenticated(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		s.mu.Lock()
+
+		valid := false
+
+		if username, password, ok := r.BasicAuth(); ok {
+			valid = s.validCredentials(username, password)
+		} else if token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "); token != "" {
+			valid = s.tokens[token]
+		}
+
+		s.mu.Unlock()
+
+		if !valid {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+// pageBounds returns the bounds of the page of n records selected by the offset and limit parameters
+func pageBounds(r *http.Request, n int) (int, int) {
+
+	offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+
+	if offset > n || offset < 0 {
+		offset = n
+	}
+
+	if err != nil || limit < 0 || offset+limit > n {
+		return offset, n
+	}
+
+	return offset, offset + limit
+}
+
+func (s *DirectorServer) handleOrganizations(w http.ResponseWriter, r *http.Request) {
+
+	if !applyFault(w, r, s.fault("", "orgs")) {
+		return
+	}
+
+	s.mu.Lock()
+
+	organizations := make([]map[string]string, 0, len(s.organizations))
+
+	for i, org := range s.organizations {
+		organizations = append(organizations, map[string]string{
+			"uuid":   strconv.Itoa(i + 1),
+			"name":   org.Name,
+			"parent": org.Parent,
+		})
+	}
+
+	s.mu.Unlock()
+
+	start, end := pageBounds(r, len(organizations))
+
+	writeJSON(w, map[string]interface{}{
+		"totalCount":    len(organizations),
+		"organizations": organizations[start:end],
+	})
+}
+
+func (s *DirectorServer) handleAppliances(w http.ResponseWriter, r *http.Request) {
+
+	if !applyFault(w, r, s.fault("", "appliances")) {
+		return
+	}
+
+	status := func(ok bool, up, down string) string {
+		if ok {
+			return up
+		}
+		return down
+	}
+
+	s.mu.Lock()
+
+	appliances := []map[string]interface{}{}
+
+	for _, org := range s.organizations {
+		for _, appliance := range org.Appliances {
+			appliances = append(appliances, map[string]interface{}{
+				"name":            appliance.Name,
+				"uuid":            org.Name + "-" + appliance.Name,
+				"type":            "branch",
+				"ownerOrg":        org.Name,
+				"softwareVersion": appliance.SoftwareVersion,
+				"ping-status":     status(appliance.Reachable, "REACHABLE", "UNREACHABLE"),
+				"sync-status":     status(appliance.InSync, "IN_SYNC", "OUT_OF_SYNC"),
+			})
+		}
+	}
+
+	s.mu.Unlock()
+
+	start, end := pageBounds(r, len(appliances))
+
+	writeJSON(w, map[string]interface{}{
+		"versanms.ApplianceStatusResult": map[string]interface{}{
+			"totalCount": len(appliances),
+			"appliances": appliances[start:end],
+		},
+	})
+}
+
+// handleAlarms serves the alarms of the org parameter, only the active ones when cleared is false
+func (s *DirectorServer) handleAlarms(w http.ResponseWriter, r *http.Request) {
+
+	orgName := r.URL.Query().Get("org")
+
+	if !applyFault(w, r, s.fault(orgName, "alarms")) {
+		return
+	}
+
+	activeOnly := r.URL.Query().Get("cleared") == "false"
+
+	s.mu.Lock()
+
+	alarms := []map[string]interface{}{}
+
+	for _, org := range s.organizations {
+
+		if org.Name != orgName {
+			continue
+		}
+
+		for _, alarm := range org.Alarms {
+
+			if activeOnly && alarm.Cleared {
+				continue
+			}
+
+			alarms = append(alarms, map[string]interface{}{
+				"id":            alarm.ID,
+				"alarmType":     alarm.Type,
+				"severity":      alarm.Severity,
+				"org":           org.Name,
+				"deviceName":    alarm.Appliance,
+				"lastAlarmText": alarm.Description,
+				"isCleared":     alarm.Cleared,
+				"createTime":    alarm.RaisedAt.UnixNano() / 1e6,
+			})
+		}
+	}
+
+	s.mu.Unlock()
+
+	start, end := pageBounds(r, len(alarms))
+
+	writeJSON(w, map[string]interface{}{
+		"totalCount": len(alarms),
+		"alarms":     alarms[start:end],
+	})
+}
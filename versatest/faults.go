@@ -0,0 +1,125 @@
+package versatest
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// faultInjector holds the faults injected into a fake server and counts the requests it received per query
+type faultInjector struct {
+	mu       sync.Mutex
+	faults   []*Fault
+	requests map[string]int
+}
+
+func newFaultInjector() faultInjector {
+	return faultInjector{requests: make(map[string]int)}
+}
+
+// Inject adds a fault applied to the matching requests
+func (f *faultInjector) Inject(fault Fault) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.faults = append(f.faults, &fault)
+}
+
+// ClearFaults removes every injected fault
+func (f *faultInjector) ClearFaults() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.faults = nil
+}
+
+// Requests returns the number of requests received for a query expression such as appUser,
+// tenants for the tenant list and login for the logins
+func (f *faultInjector) Requests(query string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.requests[query]
+}
+
+// count records a request that faults do not apply to
+func (f *faultInjector) count(query string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.requests[query]++
+}
+
+// fault returns the first fault matching the request and consumes one of its occurrences
+func (f *faultInjector) fault(tenant, query string) *Fault {
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.requests[query]++
+
+	for i, fault := range f.faults {
+
+		if (fault.Tenant != "" && fault.Tenant != tenant) || (fault.Query != "" && fault.Query != query) {
+			continue
+		}
+
+		matched := *fault
+
+		if fault.Times > 0 {
+			fault.Times--
+
+			if fault.Times == 0 {
+				f.faults = append(f.faults[:i:i], f.faults[i+1:]...)
+			}
+		}
+
+		return &matched
+	}
+
+	return nil
+}
+
+// applyFault delays the response and writes the faulty one, returning whether the report must still be sent
+func applyFault(w http.ResponseWriter, r *http.Request, fault *Fault) bool {
+
+	if fault == nil {
+		return true
+	}
+
+	if fault.Latency > 0 {
+		timer := time.NewTimer(fault.Latency)
+
+		select {
+		case <-r.Context().Done():
+			timer.Stop()
+			return false
+		case <-timer.C:
+		}
+	}
+
+	if fault.Disconnect {
+		if hijacker, ok := w.(http.Hijacker); ok {
+			if conn, _, err := hijacker.Hijack(); err == nil {
+				_ = conn.Close()
+			}
+		}
+		return false
+	}
+
+	if fault.StatusCode != 0 {
+		if fault.RetryAfter != "" {
+			w.Header().Set("Retry-After", fault.RetryAfter)
+		}
+		w.WriteHeader(fault.StatusCode)
+		return false
+	}
+
+	if fault.Malformed {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"data": [{"name": "trunc`))
+		return false
+	}
+
+	return true
+}
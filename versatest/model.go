@@ -0,0 +1,110 @@
+package versatest
+
+import "time"
+
+// Tenant is a Versa tenant served by the fake Analytics server
+type Tenant struct {
+	Name  string
+	Sites []Site
+}
+
+// Site is a branch of a tenant with its availability, appliance load, circuits, applications and SLA paths
+type Site struct {
+	Name         string
+	Availability float64
+
+	// CPULoad, MemoryLoad and DiskLoad are percentages, SessionsLoad the number of sessions of the appliance
+	CPULoad      float64
+	MemoryLoad   float64
+	DiskLoad     float64
+	SessionsLoad float64
+
+	Circuits []Circuit
+	Apps     []App
+	SLAPaths []SLAPath
+}
+
+// Circuit is a WAN circuit of a site with its bandwidth usage in bits per second
+type Circuit struct {
+	Name  string
+	RxBps float64
+	TxBps float64
+}
+
+// App is the usage of an application by a client of a site over a circuit
+type App struct {
+	Name     string
+	ClientIP string
+	Circuit  string
+
+	RxBps   float64
+	TxBps   float64
+	RxBytes float64
+	TxBytes float64
+}
+
+// SLAPath is the SLA measured from a circuit of the site to a circuit of a remote site
+type SLAPath struct {
+	RemoteSite    string
+	LocalCircuit  string
+	RemoteCircuit string
+
+	DelayMs     float64
+	FwdJitterMs float64
+	RevJitterMs float64
+	FwdLossPct  float64
+	RevLossPct  float64
+}
+
+// Organization is a Versa organization provisioned on the fake Director with its appliances and alarms
+type Organization struct {
+	Name   string
+	Parent string
+
+	Appliances []Appliance
+	Alarms     []Alarm
+}
+
+// Appliance is an appliance of an organization with the status last reported by the Director
+type Appliance struct {
+	Name            string
+	SoftwareVersion string
+	Reachable       bool
+	InSync          bool
+}
+
+// Alarm is an alarm raised by an appliance of an organization
+type Alarm struct {
+	ID          string
+	Type        string
+	Severity    string
+	Appliance   string
+	Description string
+	Cleared     bool
+	RaisedAt    time.Time
+}
+
+// Fault alters the responses of the report requests it matches
+type Fault struct {
+	// Tenant and Query restrict the fault to a tenant and a query expression such as appUser, all
+	// requests match when empty. The tenant list request has the tenants query. On the fake Director,
+	// Tenant is the organization and Query one of orgs, appliances, alarms and token
+	Tenant string
+	Query  string
+
+	// StatusCode is returned instead of the report when set, along with RetryAfter as Retry-After header
+	StatusCode int
+	RetryAfter string
+
+	// Latency delays the response, or until the client gives up
+	Latency time.Duration
+
+	// Malformed returns a truncated JSON body
+	Malformed bool
+
+	// Disconnect closes the connection without answering, like a node going down
+	Disconnect bool
+
+	// Times is the number of requests the fault applies to, it applies to every request when zero
+	Times int
+}
@@ -0,0 +1,140 @@
+package versatest
+
+import (
+	"strings"
+	"time"
+)
+
+// row is a group-by row of a report with its value per metric
+type row struct {
+	name   string
+	values map[string]float64
+}
+
+// tenantRows builds the rows of the query expression for the tenant
+func tenantRows(tenant Tenant, query string) []row {
+
+	var rows []row
+
+	for _, site := range tenant.Sites {
+		switch query {
+		case "site":
+			rows = append(rows, row{
+				name:   site.Name,
+				values: map[string]float64{"availability": site.Availability},
+			})
+
+		case "applMonitor":
+			rows = append(rows, row{
+				name: site.Name,
+				values: map[string]float64{
+					"cpuload":  site.CPULoad,
+					"memload":  site.MemoryLoad,
+					"diskload": site.DiskLoad,
+					"sessload": site.SessionsLoad,
+				},
+			})
+
+		case "linkUsage":
+			for _, circuit := range site.Circuits {
+				rows = append(rows, row{
+					name:   strings.Join([]string{site.Name, circuit.Name}, ","),
+					values: map[string]float64{"bw-rx": circuit.RxBps, "bw-tx": circuit.TxBps},
+				})
+			}
+
+		case "appUser":
+			for _, app := range site.Apps {
+				rows = append(rows, row{
+					name: strings.Join([]string{site.Name, app.Name, app.ClientIP, app.Circuit}, ","),
+					values: map[string]float64{
+						"bw-rx":     app.RxBps,
+						"bw-tx":     app.TxBps,
+						"volume-rx": app.RxBytes,
+						"volume-tx": app.TxBytes,
+					},
+				})
+			}
+
+		case "slam":
+			for _, path := range site.SLAPaths {
+				rows = append(rows, row{
+					name: strings.Join([]string{site.Name, path.RemoteSite, path.LocalCircuit, path.RemoteCircuit}, ","),
+					values: map[string]float64{
+						"delay":        path.DelayMs,
+						"fwdDelayVar":  path.FwdJitterMs,
+						"revDelayVar":  path.RevJitterMs,
+						"fwdLossRatio": path.FwdLossPct,
+						"revLossRatio": path.RevLossPct,
+					},
+				})
+			}
+		}
+	}
+
+	return rows
+}
+
+// lookup returns the value of the requested metric along with its name as Versa returns it in series,
+// metrics being requested case insensitively
+func (r row) lookup(metric string) (string, float64, bool) {
+	for name, value := range r.values {
+		if strings.EqualFold(name, metric) {
+			return name, value, true
+		}
+	}
+	return "", 0, false
+}
+
+func statsResponse(rows []row, metrics []string) map[string]interface{} {
+
+	stats := make(map[string]interface{}, len(rows))
+
+	for _, r := range rows {
+		for _, metric := range metrics {
+			if _, value, ok := r.lookup(metric); ok {
+				stats[r.name] = map[string]float64{"mean": value}
+			}
+		}
+	}
+
+	return map[string]interface{}{"stats": stats}
+}
+
+// timeseriesResponse serves every row with its value in each bucket, scaled by the variation factor of the bucket
+func timeseriesResponse(rows []row, metrics []string, buckets []time.Time, variation []float64) map[string]interface{} {
+
+	series := make([]map[string]interface{}, 0, len(rows)*len(metrics))
+
+	for _, r := range rows {
+		for _, metric := range metrics {
+
+			name, value, ok := r.lookup(metric)
+
+			if !ok {
+				continue
+			}
+
+			points := make([][]interface{}, 0, len(buckets))
+
+			for i, bucket := range buckets {
+
+				scaled := value
+
+				if len(variation) > 0 {
+					scaled *= variation[i%len(variation)]
+				}
+
+				points = append(points, []interface{}{bucket.UnixNano() / int64(time.Millisecond), scaled})
+			}
+
+			series = append(series, map[string]interface{}{
+				"name":   r.name,
+				"metric": name,
+				"data":   points,
+			})
+		}
+	}
+
+	return map[string]interface{}{"qTime": 1, "data": series}
+}
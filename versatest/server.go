@@ -0,0 +1,342 @@
+// Package versatest provides an in-process fake Versa Analytics server to exercise versa_client and
+// versa_collector end to end without a live Analytics cluster
+package versatest
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lucabrasi83/peppamon_versa/versa_client"
+)
+
+const (
+	sessionCookie = "JSESSIONID"
+
+	tenantsPath = "/versa/analytics/v1.0.0/data/provider/features/SDWAN/tenants"
+	reportsPath = "/versa/analytics/v1.0.0/data/provider/tenants/"
+
+	// tenantsQuery is the query name faults use to match the tenant list request
+	tenantsQuery = "tenants"
+
+	// dateLayout is the layout of the absolute start and end dates sent by versa_client
+	dateLayout = "2006-01-02 15:04:05"
+)
+
+// Server is a fake Versa Analytics server programmed with tenants and faults
+type Server struct {
+	*httptest.Server
+
+	// Username and Password are the credentials accepted on login, any are accepted when Username is empty
+	Username string
+	Password string
+
+	// Variation scales the successive buckets of every timeseries, cycling through the factors. Every bucket
+	// holds the value programmed for the tenant when it is empty
+	Variation []float64
+
+	faultInjector
+
+	mu       sync.Mutex
+	tenants  []Tenant
+	sessions map[string]bool
+	windows  map[string]time.Duration
+}
+
+// NewServer starts a fake Versa Analytics server over TLS. It must be closed once done
+func NewServer(tenants ...Tenant) *Server {
+
+	s := &Server{
+		faultInjector: newFaultInjector(),
+		tenants:       tenants,
+		sessions:      make(map[string]bool),
+		windows:       make(map[string]time.Duration),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/versa/login", s.handleLogin)
+	mux.HandleFunc(tenantsPath, s.authenticated(s.handleTenants))
+	mux.HandleFunc(reportsPath, s.authenticated(s.handleReport))
+
+	s.Server = httptest.NewTLSServer(mux)
+
+	return s
+}
+
+// Hostname returns the host and port of the server as expected in PEPPAMON_VERSA_ANALYTICS_HOSTNAME
+func (s *Server) Hostname() string {
+	return strings.TrimPrefix(s.URL, "https://")
+}
+
+// ClientEnv returns the environment variables pointing versa_client to the server. The self-signed
+// certificate of the server is pinned instead of being verified against a CA
+func (s *Server) ClientEnv() map[string]string {
+
+	fingerprint := sha256.Sum256(s.Certificate().Raw)
+
+	return map[string]string{
+		"PEPPAMON_VERSA_ANALYTICS_HOSTNAME":                 s.Hostname(),
+		"PEPPAMON_VERSA_ANALYTICS_USERNAME":                 s.Username,
+		"PEPPAMON_VERSA_ANALYTICS_PASSWORD":                 s.Password,
+		"PEPPAMON_VERSA_ANALYTICS_TLS_INSECURE_SKIP_VERIFY": "true",
+		"PEPPAMON_VERSA_ANALYTICS_TLS_PINNED_SHA256":        hex.EncodeToString(fingerprint[:]),
+		"PEPPAMON_VERSA_ANALYTICS_TIMEZONE":                 "UTC",
+	}
+}
+
+// ClientSettings returns the settings of a versa_client client of the server. Retries back off for a few
+// milliseconds, breakers, health checks and the tenant cache are disabled so that every query reaches the server
+func (s *Server) ClientSettings() versa_client.Settings {
+
+	fingerprint := sha256.Sum256(s.Certificate().Raw)
+
+	return versa_client.Settings{
+		Hostnames: []string{s.Hostname()},
+		TLS: versa_client.TLSSettings{
+			Target:             "Versa Analytics",
+			PinnedSHA256:       []string{hex.EncodeToString(fingerprint[:])},
+			MinVersion:         tls.VersionTLS12,
+			InsecureSkipVerify: true,
+		},
+		Auth:         versa_client.AuthSettings{Username: s.Username, Password: s.Password},
+		Workers:      4,
+		NodeStrategy: versa_client.NodeStrategySticky,
+		Retry: versa_client.RetryPolicy{
+			MaxAttempts: 3,
+			BaseBackoff: time.Millisecond,
+			MaxBackoff:  10 * time.Millisecond,
+			RetryableStatusCodes: map[int]bool{
+				http.StatusTooManyRequests:    true,
+				http.StatusBadGateway:         true,
+				http.StatusServiceUnavailable: true,
+				http.StatusGatewayTimeout:     true,
+			},
+			Deadline: 30 * time.Second,
+		},
+		MaxRows: 150000,
+		Windows: versa_client.TimeWindows{Location: time.UTC},
+	}
+}
+
+// SetTenants replaces the tenants served
+func (s *Server) SetTenants(tenants ...Tenant) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tenants = tenants
+}
+
+// ExpireSessions invalidates every session so that the next requests are rejected until the client logs in again
+func (s *Server) ExpireSessions() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sessions = make(map[string]bool)
+}
+
+// Window returns the time span between the absolute dates of the last request for a query expression,
+// zero when it was sent relative dates or was never requested
+func (s *Server) Window(query string) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.windows[query]
+}
+
+func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	s.count("login")
+
+	if s.Username != "" && (r.FormValue("username") != s.Username || r.FormValue("password") != s.Password) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	token := make([]byte, 16)
+	_, _ = rand.Read(token)
+
+	session := hex.EncodeToString(token)
+
+	s.mu.Lock()
+	s.sessions[session] = true
+	s.mu.Unlock()
+
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: session, Path: "/"})
+	w.WriteHeader(http.StatusOK)
+}
+
+// authenticated rejects the requests without a valid session cookie
+func (s *Server) authenticated(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		cookie, err := r.Cookie(sessionCookie)
+
+		s.mu.Lock()
+		valid := err == nil && s.sessions[cookie.Value]
+		s.mu.Unlock()
+
+		if !valid {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+func (s *Server) handleTenants(w http.ResponseWriter, r *http.Request) {
+
+	if !applyFault(w, r, s.fault("", tenantsQuery)) {
+		return
+	}
+
+	s.mu.Lock()
+
+	tenants := make([]map[string]string, 0, len(s.tenants))
+
+	for _, tenant := range s.tenants {
+		tenants = append(tenants, map[string]string{"name": tenant.Name})
+	}
+
+	s.mu.Unlock()
+
+	writeJSON(w, tenants)
+}
+
+// handleReport serves /tenants/{tenant}/features/{feature}/ for the stats and timeseries queries
+func (s *Server) handleReport(w http.ResponseWriter, r *http.Request) {
+
+	tokens := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, reportsPath), "/"), "/")
+
+	if len(tokens) != 3 || tokens[1] != "features" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	tenantName := tokens[0]
+	params := r.URL.Query()
+
+	expression := params.Get("q")
+	queryName := expression
+
+	if i := strings.Index(expression, "("); i >= 0 {
+		queryName = expression[:i]
+	}
+
+	if !applyFault(w, r, s.fault(tenantName, queryName)) {
+		return
+	}
+
+	s.mu.Lock()
+
+	s.windows[queryName] = window(params.Get("start-date"), params.Get("end-date"))
+
+	var tenant *Tenant
+
+	for i := range s.tenants {
+		if s.tenants[i].Name == tenantName {
+			tenant = &s.tenants[i]
+		}
+	}
+
+	var rows []row
+
+	if tenant != nil {
+		rows = tenantRows(*tenant, queryName)
+	}
+
+	s.mu.Unlock()
+
+	if tenant == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if params.Get("qt") == "stats" {
+		writeJSON(w, statsResponse(rows, params["metrics"]))
+		return
+	}
+
+	buckets := bucketTimes(params.Get("start-date"), params.Get("end-date"), params.Get("gap"))
+
+	writeJSON(w, timeseriesResponse(page(rows, params), params["metrics"], buckets, s.Variation))
+}
+
+// window returns the time span between the absolute dates, zero for relative dates
+func window(startDate, endDate string) time.Duration {
+
+	start, errStart := time.ParseInLocation(dateLayout, startDate, time.UTC)
+	end, errEnd := time.ParseInLocation(dateLayout, endDate, time.UTC)
+
+	if errStart != nil || errEnd != nil {
+		return 0
+	}
+
+	return end.Sub(start)
+}
+
+// bucketTimes returns the start of every minute gap bucket between the absolute dates, read in UTC like the
+// timezone set by ClientEnv. A single bucket at the current time is served for relative dates such as
+// 15minutesAgo and for other gaps
+func bucketTimes(startDate, endDate, gap string) []time.Time {
+
+	start, errStart := time.ParseInLocation(dateLayout, startDate, time.UTC)
+	end, errEnd := time.ParseInLocation(dateLayout, endDate, time.UTC)
+	minutes, errGap := strconv.Atoi(strings.TrimSuffix(strings.TrimSuffix(gap, "S"), "MINUTE"))
+
+	if errStart != nil || errEnd != nil || errGap != nil || minutes <= 0 || !start.Before(end) {
+		return []time.Time{time.Now()}
+	}
+
+	var buckets []time.Time
+
+	for t := start; t.Before(end); t = t.Add(time.Duration(minutes) * time.Minute) {
+		buckets = append(buckets, t)
+	}
+
+	return buckets
+}
+
+// page returns the rows selected by the count and from-count parameters
+func page(rows []row, params map[string][]string) []row {
+
+	offset, _ := strconv.Atoi(first(params["from-count"]))
+	count, err := strconv.Atoi(first(params["count"]))
+
+	if offset > len(rows) {
+		offset = len(rows)
+	}
+
+	rows = rows[offset:]
+
+	if err == nil && count >= 0 && count < len(rows) {
+		rows = rows[:count]
+	}
+
+	return rows
+}
+
+func first(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+func writeJSON(w http.ResponseWriter, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,313 @@
+package versatest_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lucabrasi83/peppamon_versa/versatest"
+)
+
+const appUserPath = "/versa/analytics/v1.0.0/data/provider/tenants/acme/features/SDWAN/"
+
+func testTenant(apps int) versatest.Tenant {
+
+	site := versatest.Site{Name: "acme-branch1", Circuits: []versatest.Circuit{{Name: "MPLS", RxBps: 1000, TxBps: 500}}}
+
+	for i := 0; i < apps; i++ {
+		site.Apps = append(site.Apps, versatest.App{
+			Name:     fmt.Sprintf("app%v", i),
+			ClientIP: "10.0.0.1",
+			Circuit:  "MPLS",
+			RxBps:    float64(i),
+		})
+	}
+
+	return versatest.Tenant{Name: "acme", Sites: []versatest.Site{site}}
+}
+
+// newHTTPClient returns a client of the server keeping its session cookie
+func newHTTPClient(server *versatest.Server) *http.Client {
+
+	client := server.Client()
+	client.Jar, _ = cookiejar.New(nil)
+
+	return client
+}
+
+func login(t *testing.T, client *http.Client, server *versatest.Server, username, password string) int {
+
+	t.Helper()
+
+	res, err := client.PostForm(server.URL+"/versa/login", url.Values{"username": {username}, "password": {password}})
+
+	if err != nil {
+		t.Fatalf("login failed with error %v", err)
+	}
+
+	_ = res.Body.Close()
+
+	return res.StatusCode
+}
+
+// get sends the request and decodes the JSON response into result when it succeeds
+func get(t *testing.T, client *http.Client, rawURL string, result interface{}) (*http.Response, error) {
+
+	t.Helper()
+
+	res, err := client.Get(rawURL)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusOK && result != nil {
+		err = json.NewDecoder(res.Body).Decode(result)
+	}
+
+	return res, err
+}
+
+type timeseries struct {
+	Data []struct {
+		Name   string          `json:"name"`
+		Metric string          `json:"metric"`
+		Data   [][]json.Number `json:"data"`
+	} `json:"data"`
+}
+
+func TestLogin(t *testing.T) {
+
+	server := versatest.NewServer(testTenant(1))
+	server.Username, server.Password = "admin", "secret"
+	defer server.Close()
+
+	client := newHTTPClient(server)
+	tenantsURL := server.URL + "/versa/analytics/v1.0.0/data/provider/features/SDWAN/tenants"
+
+	if res, err := get(t, client, tenantsURL, nil); err != nil || res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("got %v, %v without session, want 401", res, err)
+	}
+
+	if status := login(t, client, server, "admin", "wrong"); status != http.StatusUnauthorized {
+		t.Fatalf("got status %v with wrong credentials, want 401", status)
+	}
+
+	if status := login(t, client, server, "admin", "secret"); status != http.StatusOK {
+		t.Fatalf("got status %v with valid credentials, want 200", status)
+	}
+
+	var tenants []struct {
+		Name string `json:"name"`
+	}
+
+	if res, err := get(t, client, tenantsURL, &tenants); err != nil || res.StatusCode != http.StatusOK {
+		t.Fatalf("got %v, %v with a session, want 200", res, err)
+	}
+
+	if len(tenants) != 1 || tenants[0].Name != "acme" {
+		t.Fatalf("got tenants %+v, want acme", tenants)
+	}
+
+	// Expired sessions are rejected until the client logs in again
+	server.ExpireSessions()
+
+	if res, err := get(t, client, tenantsURL, nil); err != nil || res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("got %v, %v with an expired session, want 401", res, err)
+	}
+
+	if logins, requests := server.Requests("login"), server.Requests("tenants"); logins != 2 || requests != 1 {
+		t.Fatalf("got %v logins and %v tenant requests, want 2 and 1", logins, requests)
+	}
+}
+
+func TestPagination(t *testing.T) {
+
+	server := versatest.NewServer(testTenant(5))
+	defer server.Close()
+
+	client := newHTTPClient(server)
+	login(t, client, server, "", "")
+
+	params := url.Values{
+		"q":          {"appUser(site,appId,user,accCkt)"},
+		"qt":         {"timeseries"},
+		"start-date": {"2020-03-02 10:00:00"},
+		"end-date":   {"2020-03-02 10:05:00"},
+		"gap":        {"1MINUTE"},
+		"metrics":    {"bw-rx"},
+		"count":      {"2"},
+	}
+
+	var names []string
+
+	for offset := 0; offset < 6; offset += 2 {
+
+		params.Set("from-count", fmt.Sprint(offset))
+
+		var page timeseries
+
+		if res, err := get(t, client, server.URL+appUserPath+"?"+params.Encode(), &page); err != nil || res.StatusCode != http.StatusOK {
+			t.Fatalf("got %v, %v for offset %v, want 200", res, err, offset)
+		}
+
+		for _, series := range page.Data {
+
+			if len(series.Data) != 5 {
+				t.Fatalf("got %v points for %v, want a point per minute of the window", len(series.Data), series.Name)
+			}
+
+			names = append(names, strings.Split(series.Name, ",")[1])
+		}
+	}
+
+	if got := strings.Join(names, ","); got != "app0,app1,app2,app3,app4" {
+		t.Fatalf("got pages of %v, want app0 to app4 in pages of 2", got)
+	}
+
+	if window := server.Window("appUser"); window != 5*time.Minute {
+		t.Fatalf("got window %v, want 5m", window)
+	}
+}
+
+func TestFaults(t *testing.T) {
+
+	server := versatest.NewServer(testTenant(1), versatest.Tenant{Name: "globex"})
+	defer server.Close()
+
+	client := newHTTPClient(server)
+	login(t, client, server, "", "")
+
+	reportURL := server.URL + appUserPath + "?q=appUser&qt=stats&start-date=15minutesAgo&metrics=bw-rx"
+	otherURL := strings.Replace(reportURL, "/acme/", "/globex/", 1)
+
+	server.Inject(versatest.Fault{Tenant: "acme", Query: "appUser", StatusCode: http.StatusServiceUnavailable, RetryAfter: "7", Times: 2})
+
+	// The fault is limited to the matching tenant and query
+	if res, err := get(t, client, otherURL, nil); err != nil || res.StatusCode != http.StatusOK {
+		t.Fatalf("got %v, %v for another tenant, want 200", res, err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if res, err := get(t, client, reportURL, nil); err != nil || res.StatusCode != http.StatusServiceUnavailable ||
+			res.Header.Get("Retry-After") != "7" {
+			t.Fatalf("got %v, %v for faulty request %v, want 503 with Retry-After", res, err, i+1)
+		}
+	}
+
+	// The fault is removed once applied Times times
+	if res, err := get(t, client, reportURL, nil); err != nil || res.StatusCode != http.StatusOK {
+		t.Fatalf("got %v, %v once the fault was consumed, want 200", res, err)
+	}
+
+	server.Inject(versatest.Fault{Malformed: true})
+
+	if _, err := get(t, client, reportURL, &struct{}{}); err == nil {
+		t.Fatal("decoded a malformed response")
+	}
+
+	// Faulty requests are counted like the others
+	if requests := server.Requests("appUser"); requests != 5 {
+		t.Fatalf("got %v appUser requests, want 5", requests)
+	}
+
+	server.ClearFaults()
+	server.Inject(versatest.Fault{Disconnect: true})
+
+	if _, err := get(t, client, reportURL, nil); err == nil {
+		t.Fatal("got a response from a disconnected request")
+	}
+
+	server.ClearFaults()
+	server.Inject(versatest.Fault{Latency: time.Hour})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, reportURL, nil)
+
+	if res, err := client.Do(req); err == nil {
+		_ = res.Body.Close()
+		t.Fatal("got a response before the latency of the fault")
+	}
+}
+
+func TestDirectorServer(t *testing.T) {
+
+	server := versatest.NewDirectorServer(
+		versatest.Organization{Name: "acme", Alarms: []versatest.Alarm{{ID: "1"}, {ID: "2", Cleared: true}, {ID: "3"}}},
+		versatest.Organization{Name: "globex"},
+	)
+	server.Username, server.Password = "admin", "secret"
+	defer server.Close()
+
+	client := server.Client()
+
+	alarms := func(query string) (*http.Response, []string) {
+
+		t.Helper()
+
+		req, _ := http.NewRequest(http.MethodGet, server.URL+"/vnms/fault/alarms?"+query, nil)
+		req.SetBasicAuth("admin", "secret")
+
+		res, err := client.Do(req)
+
+		if err != nil {
+			t.Fatalf("alarms request failed with error %v", err)
+		}
+
+		defer res.Body.Close()
+
+		var page struct {
+			TotalCount int `json:"totalCount"`
+			Alarms     []struct {
+				ID string `json:"id"`
+			} `json:"alarms"`
+		}
+
+		_ = json.NewDecoder(res.Body).Decode(&page)
+
+		ids := []string{fmt.Sprint(page.TotalCount)}
+
+		for _, alarm := range page.Alarms {
+			ids = append(ids, alarm.ID)
+		}
+
+		return res, ids
+	}
+
+	// Pages hold limit alarms from offset, totalCount counting the alarms of every page
+	if _, ids := alarms("org=acme&offset=1&limit=1"); strings.Join(ids, ",") != "3,2" {
+		t.Fatalf("got total and alarms %v, want 3 alarms paged to 2", ids)
+	}
+
+	if _, ids := alarms("org=acme&cleared=false&offset=0&limit=10"); strings.Join(ids, ",") != "2,1,3" {
+		t.Fatalf("got total and active alarms %v, want 1 and 3", ids)
+	}
+
+	server.Inject(versatest.Fault{Tenant: "acme", Query: "alarms", StatusCode: http.StatusInternalServerError, Times: 1})
+
+	if res, _ := alarms("org=acme"); res.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("got status %v for the faulty organization, want 500", res.StatusCode)
+	}
+
+	res, err := client.Get(server.URL + "/vnms/organization/orgs")
+
+	if err != nil {
+		t.Fatalf("organizations request failed with error %v", err)
+	}
+
+	_ = res.Body.Close()
+
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("got status %v without credentials, want 401", res.StatusCode)
+	}
+}